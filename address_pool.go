@@ -0,0 +1,222 @@
+package node
+
+import (
+	"errors"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AutoRoute/node/internal"
+	"github.com/AutoRoute/node/types"
+)
+
+var pool_exhausted_error = errors.New("no free addresses left in the pool")
+
+type lease struct {
+	ip      net.IP
+	node    types.NodeAddress
+	expires time.Time
+}
+
+// An AddressPool hands out the addresses in a prefix to tunnel clients. Each
+// client holds at most one lease, which lasts until it is released or goes
+// unrenewed for the lease time. A client which comes back gets its old address
+// again if nobody has been given it since.
+type AddressPool struct {
+	prefix *net.IPNet
+	// The number of addresses which can be handed out, capped so offsets fit
+	// in a uint64.
+	size       uint64
+	next       uint64
+	lease_time time.Duration
+	leases     map[string]*lease
+	by_node    map[types.NodeAddress]*lease
+	// Who last held each address which is no longer leased, and the other
+	// way around.
+	previous         map[string]types.NodeAddress
+	previous_by_node map[types.NodeAddress]string
+	clock            internal.Clock
+	l                *sync.Mutex
+}
+
+// Creates a pool for a prefix such as "10.64.0.0/16" or "2001:db8::/64". The
+// network address, and for IPv4 the broadcast address, are never handed out.
+func NewAddressPool(prefix string, lease_time time.Duration, clock internal.Clock) (*AddressPool, error) {
+	_, network, err := net.ParseCIDR(prefix)
+	if err != nil {
+		return nil, err
+	}
+	if v4 := network.IP.To4(); v4 != nil {
+		network.IP = v4
+	}
+	ones, bits := network.Mask.Size()
+	host_bits := uint(bits - ones)
+	if host_bits > 62 {
+		host_bits = 62
+	}
+	size := uint64(1)<<host_bits - 1
+	if bits == 32 && size > 0 {
+		size--
+	}
+	if size == 0 {
+		return nil, errors.New("prefix " + prefix + " has no host addresses")
+	}
+	return &AddressPool{
+		network,
+		size,
+		0,
+		lease_time,
+		make(map[string]*lease),
+		make(map[types.NodeAddress]*lease),
+		make(map[string]types.NodeAddress),
+		make(map[types.NodeAddress]string),
+		clock,
+		&sync.Mutex{},
+	}, nil
+}
+
+// Returns the address offset hosts into the prefix.
+func (a *AddressPool) address(offset uint64) net.IP {
+	ip := make(net.IP, len(a.prefix.IP))
+	copy(ip, a.prefix.IP)
+	for i := len(ip) - 1; i >= 0 && offset > 0; i-- {
+		sum := uint64(ip[i]) + offset&0xFF
+		ip[i] = byte(sum)
+		offset = offset>>8 + sum>>8
+	}
+	return ip
+}
+
+// Reports whether ip is in this pool's prefix.
+func (a *AddressPool) Contains(ip net.IP) bool {
+	return a.prefix.Contains(ip)
+}
+
+// Ends a lease, remembering who had the address.
+func (a *AddressPool) remove(l *lease) {
+	delete(a.leases, l.ip.String())
+	delete(a.by_node, l.node)
+	a.forget(l.ip.String())
+	a.previous[l.ip.String()] = l.node
+	a.previous_by_node[l.node] = l.ip.String()
+}
+
+// Forgets who last held an address before it's handed out.
+func (a *AddressPool) forget(ip string) {
+	if node, ok := a.previous[ip]; ok {
+		delete(a.previous, ip)
+		delete(a.previous_by_node, node)
+	}
+}
+
+func (a *AddressPool) expire(now time.Time) []types.NodeAddress {
+	var expired []types.NodeAddress
+	for _, l := range a.leases {
+		if now.After(l.expires) {
+			a.remove(l)
+			expired = append(expired, l.node)
+		}
+	}
+	return expired
+}
+
+func (a *AddressPool) grant(ip net.IP, node types.NodeAddress, now time.Time) net.IP {
+	a.forget(ip.String())
+	delete(a.previous_by_node, node)
+	l := &lease{ip, node, now.Add(a.lease_time)}
+	a.leases[ip.String()] = l
+	a.by_node[node] = l
+	return ip
+}
+
+// Returns the address leased to node, leasing it a new one if it has none. An
+// existing lease is renewed so clients which retry keep their address, and
+// clients which reconnect get their old address back if it is still free.
+// Leases which have run out are only freed by Expire, so whoever owns the pool
+// hears who they belonged to.
+func (a *AddressPool) Acquire(node types.NodeAddress) (net.IP, error) {
+	a.l.Lock()
+	defer a.l.Unlock()
+	now := a.clock.Now()
+	if l, ok := a.by_node[node]; ok {
+		l.expires = now.Add(a.lease_time)
+		return l.ip, nil
+	}
+	if ip, ok := a.previous_by_node[node]; ok {
+		return a.grant(net.ParseIP(ip), node, now), nil
+	}
+	for i := uint64(0); i < a.size; i++ {
+		ip := a.address(a.next + 1)
+		a.next = (a.next + 1) % a.size
+		if _, ok := a.leases[ip.String()]; ok {
+			continue
+		}
+		return a.grant(ip, node, now), nil
+	}
+	return nil, pool_exhausted_error
+}
+
+// Extends the lease on ip, returning who holds it. Returns false if nobody
+// does.
+func (a *AddressPool) Renew(ip net.IP) (types.NodeAddress, bool) {
+	a.l.Lock()
+	defer a.l.Unlock()
+	now := a.clock.Now()
+	l, ok := a.leases[ip.String()]
+	if !ok || now.After(l.expires) {
+		return "", false
+	}
+	l.expires = now.Add(a.lease_time)
+	return l.node, true
+}
+
+// Extends node's lease, returning false if it doesn't have one.
+func (a *AddressPool) RenewNode(node types.NodeAddress) bool {
+	a.l.Lock()
+	defer a.l.Unlock()
+	now := a.clock.Now()
+	l, ok := a.by_node[node]
+	if !ok || now.After(l.expires) {
+		return false
+	}
+	l.expires = now.Add(a.lease_time)
+	return true
+}
+
+// Returns who holds the lease on ip without renewing it.
+func (a *AddressPool) Lookup(ip net.IP) (types.NodeAddress, bool) {
+	a.l.Lock()
+	defer a.l.Unlock()
+	l, ok := a.leases[ip.String()]
+	if !ok || a.clock.Now().After(l.expires) {
+		return "", false
+	}
+	return l.node, true
+}
+
+// Gives up node's lease so the address can be reused, returning the address
+// or nil if it had none.
+func (a *AddressPool) Release(node types.NodeAddress) net.IP {
+	a.l.Lock()
+	defer a.l.Unlock()
+	l, ok := a.by_node[node]
+	if !ok {
+		return nil
+	}
+	a.remove(l)
+	return l.ip
+}
+
+// Drops every lease which has run out, returning who held them.
+func (a *AddressPool) Expire() []types.NodeAddress {
+	a.l.Lock()
+	defer a.l.Unlock()
+	return a.expire(a.clock.Now())
+}
+
+// Returns the number of addresses currently leased.
+func (a *AddressPool) Leases() int {
+	a.l.Lock()
+	defer a.l.Unlock()
+	return len(a.leases)
+}
@@ -0,0 +1,118 @@
+package node
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AutoRoute/node/internal"
+	"github.com/AutoRoute/node/types"
+)
+
+func TestAddressPool(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	// Only 10.0.0.1 and 10.0.0.2 can be handed out.
+	pool, err := NewAddressPool("10.0.0.0/30", time.Minute, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, c := types.NodeAddress("a"), types.NodeAddress("b"), types.NodeAddress("c")
+
+	ip_a, err := pool.Acquire(a)
+	if err != nil || !ip_a.Equal(net.ParseIP("10.0.0.1")) {
+		t.Fatalf("Unexpected lease %v %v", ip_a, err)
+	}
+	ip_b, err := pool.Acquire(b)
+	if err != nil || !ip_b.Equal(net.ParseIP("10.0.0.2")) {
+		t.Fatalf("Unexpected lease %v %v", ip_b, err)
+	}
+	if _, err := pool.Acquire(c); err != pool_exhausted_error {
+		t.Fatalf("Expected the pool to be exhausted got %v", err)
+	}
+	if owner, ok := pool.Lookup(ip_a); !ok || owner != a {
+		t.Fatalf("Expected %v to be leased to a got %q", ip_a, owner)
+	}
+
+	// b releases its address, which c then gets.
+	pool.Release(b)
+	ip_c, err := pool.Acquire(c)
+	if err != nil || !ip_c.Equal(ip_b) {
+		t.Fatalf("Expected c to get %v got %v %v", ip_b, ip_c, err)
+	}
+
+	// a keeps its lease by renewing it while c's expires.
+	clock.Advance(40 * time.Second)
+	if _, ok := pool.Renew(ip_a); !ok {
+		t.Fatal("Expected a's lease to renew")
+	}
+	clock.Advance(40 * time.Second)
+	if _, ok := pool.Lookup(ip_c); ok {
+		t.Fatal("Expected c's lease to expire")
+	}
+	// Only Expire frees it, so the owner hears about it.
+	if _, err := pool.Acquire(b); err != pool_exhausted_error {
+		t.Fatalf("Expected the pool to be exhausted got %v", err)
+	}
+	if expired := pool.Expire(); len(expired) != 1 || expired[0] != c {
+		t.Fatalf("Expected c's lease to expire got %v", expired)
+	}
+	if pool.Leases() != 1 {
+		t.Fatalf("Expected 1 lease got %d", pool.Leases())
+	}
+	if ip, _ := pool.Acquire(a); !ip.Equal(ip_a) {
+		t.Fatalf("Expected a to keep %v got %v", ip_a, ip)
+	}
+}
+
+// Clients which come back get their old address if it's still free.
+func TestAddressPoolReconnect(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	pool, err := NewAddressPool("10.0.0.0/24", time.Minute, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, b, c := types.NodeAddress("a"), types.NodeAddress("b"), types.NodeAddress("c")
+	ip_a, _ := pool.Acquire(a)
+	ip_b, _ := pool.Acquire(b)
+
+	pool.Release(a)
+	clock.Advance(2 * time.Minute)
+	if expired := pool.Expire(); len(expired) != 1 || expired[0] != b {
+		t.Fatalf("Expected b's lease to expire got %v", expired)
+	}
+	if pool.RenewNode(b) {
+		t.Fatal("Renewed an expired lease")
+	}
+	if ip, _ := pool.Acquire(a); !ip.Equal(ip_a) {
+		t.Fatalf("Expected a to get %v back got %v", ip_a, ip)
+	}
+	if !pool.RenewNode(a) {
+		t.Fatal("Expected a's lease to renew")
+	}
+
+	// Once someone else has b's address it gets a new one.
+	pool.grant(ip_b, c, clock.Now())
+	if ip, _ := pool.Acquire(b); ip.Equal(ip_b) || ip.Equal(ip_a) {
+		t.Fatalf("b was given %v which is taken", ip)
+	}
+}
+
+func TestAddressPoolIPv6(t *testing.T) {
+	pool, err := NewAddressPool("2001:db8::ff/120", time.Minute, internal.SystemClock())
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i, expected := range []string{"2001:db8::1", "2001:db8::2"} {
+		ip, err := pool.Acquire(types.NodeAddress([]byte{byte(i)}))
+		if err != nil || !ip.Equal(net.ParseIP(expected)) {
+			t.Fatalf("Expected %s got %v %v", expected, ip, err)
+		}
+	}
+	if !pool.Contains(net.ParseIP("2001:db8::ab")) || pool.Contains(net.ParseIP("2001:db8::1:1")) {
+		t.Fatal("Pool contains the wrong addresses")
+	}
+
+	if _, err := NewAddressPool("2001:db8::1/128", time.Minute, internal.SystemClock()); err == nil {
+		t.Fatal("Expected a prefix with no hosts to be rejected")
+	}
+}
@@ -0,0 +1,55 @@
+// This binary replays the route logs written by autoroute's -route_log_path
+// flag and summarizes how each neighbor performed: how many forwarded packets
+// were receipted, how long receipts took, and what the traffic earned.
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+
+	"github.com/AutoRoute/node"
+)
+
+var as_json = flag.Bool("json", false, "Print the analysis as JSON")
+
+func analyze(r io.Reader, name string) {
+	a, err := node.AnalyzeRouteLog(r)
+	if err != nil {
+		log.Fatalf("Error reading %s: %v", name, err)
+	}
+	if *as_json {
+		b, err := json.MarshalIndent(a, "", "  ")
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("%s\n", b)
+		return
+	}
+	fmt.Printf("%s: %s", name, a)
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintf(os.Stderr, "Usage: %s [flags] [route log ...]\n", os.Args[0])
+		fmt.Fprintf(os.Stderr, "Reads standard input if no logs are given.\n")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	if flag.NArg() == 0 {
+		analyze(os.Stdin, "stdin")
+		return
+	}
+	for _, path := range flag.Args() {
+		f, err := os.Open(path)
+		if err != nil {
+			log.Fatalf("Error opening route log: %v", err)
+		}
+		analyze(f, path)
+		f.Close()
+	}
+}
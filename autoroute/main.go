@@ -5,15 +5,18 @@
 package main
 
 import (
+	"encoding/hex"
 	"flag"
 	"fmt"
+	"io/ioutil"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
 	"os/signal"
 	"strings"
+	"syscall"
+	"time"
 
 	"github.com/AutoRoute/node"
 	"github.com/AutoRoute/node/types"
@@ -36,22 +39,88 @@ var btc_user = flag.String("btc_user", "user",
 	"The bitcoin daemon username")
 var btc_pass = flag.String("btc_pass", "password",
 	"The bitcoin daemon password")
+var btc_network = flag.String("btc_network", "mainnet",
+	"The bitcoin network the daemon is on: mainnet, testnet, regtest or simnet")
+var btc_confirmations = flag.Int64("btc_confirmations", 6,
+	"The number of confirmations before a payment is considered complete")
+var btc_poll_rate = flag.Duration("btc_poll_rate", 30*time.Second,
+	"How often to poll the bitcoin daemon for payment and balance changes")
+var btc_tls = flag.Bool("btc_tls", false, "Connect to the bitcoin daemon over TLS")
+var btc_cert = flag.String("btc_cert", "",
+	"PEM certificate to verify the bitcoin daemon with when using TLS")
 var fake_money = flag.Bool("fake_money", false, "Enables a money system which is purely fake")
 var status = flag.String("status", "[::1]:12345", "The port to expose status information on")
 var unix = flag.String("unix", "", "The path to accept / receive packets as unix packets from")
 var tcp_tun = flag.String("tcp_tun", "", "Address to try and tcp tunnel to")
 var tcp_tun_serve = flag.Bool("tcp_tun_serve", false, "Enables this node to be an exit node")
 var tcp_address = flag.String("tcp_address", "", "IP address to assign to the tcp tunnel")
+var tcp_tun_ipv4_prefix = flag.String("tcp_tun_ipv4_prefix", "10.64.0.0/16",
+	"The IPv4 prefix an exit node leases client addresses from, or empty for none")
+var tcp_tun_ipv6_prefix = flag.String("tcp_tun_ipv6_prefix", "2001::/64",
+	"The IPv6 prefix an exit node leases client addresses from, or empty for none")
+var tcp_tun_lease_time = flag.Duration("tcp_tun_lease_time", 10*time.Minute,
+	"How long an idle tunnel client keeps its addresses")
+var tcp_tun_nat_ipv4 = flag.String("tcp_tun_nat_ipv4", "",
+	"An unused IPv4 address an exit node translates client traffic to, or empty to not translate")
+var tcp_tun_nat_ipv6 = flag.String("tcp_tun_nat_ipv6", "",
+	"An unused IPv6 address an exit node translates client traffic to, or empty to not translate")
+var tcp_tun_allow_unsigned = flag.Bool("tcp_tun_allow_unsigned", false,
+	"Let clients tunnel or use the proxy exit node without proving they own the address they ask from")
+var tcp_tun_allow = flag.String("tcp_tun_allow", "",
+	"Comma separated list of the only node addresses allowed to tunnel or use the proxy exit node, empty for everyone")
+var tcp_tun_deny = flag.String("tcp_tun_deny", "",
+	"Comma separated list of node addresses not allowed to tunnel or use the proxy exit node")
+var tcp_tun_max_bandwidth = flag.Int64("tcp_tun_max_bandwidth", 0,
+	"Bytes per second each tunnel client may use, 0 for no limit")
+var tcp_tun_min_amt = flag.Int64("tcp_tun_min_amt", 0,
+	"The smallest amount each tunnel client must pay per packet")
+var tcp_tun_policies = flag.String("tcp_tun_policies", "",
+	"JSON file of per client tunnel policies, keyed by node address")
+var tcp_tun_version = flag.Int("tcp_tun_version", types.TCPTunnelVersion,
+	"The newest tunnel message version to ask for, 0 for exit nodes which only speak 0")
+var tcp_tun_fallback_retries = flag.Int("tcp_tun_fallback_retries", 3,
+	"How many tunnel requests may go unanswered before asking for version 0 unsigned, 0 to never")
+var tcp_tun_keepalive = flag.Duration("tcp_tun_keepalive", 30*time.Second,
+	"How often a tunnel client tells the exit node it's still there")
+var tcp_tun_handshake_timeout = flag.Duration("tcp_tun_handshake_timeout", 2*time.Minute,
+	"How long a tunnel client keeps asking the exit node for a tunnel before giving up")
+var tcp_tun_mtu = flag.Int("tcp_tun_mtu", 1400,
+	"The largest packet sent through a tcp tunnel, at least 1280. Clients and exit nodes use the smaller of theirs")
+var socks = flag.String("socks", "",
+	"Address to accept SOCKS5 connections on, which are carried to socks_exit")
+var socks_exit = flag.String("socks_exit", "", "Address of the exit node SOCKS5 connections leave the mesh from")
+var proxy_serve = flag.Bool("proxy_serve", false,
+	"Enables this node to be an exit node for other nodes' SOCKS5 proxies")
+var proxy_allow_private = flag.Bool("proxy_allow_private", false,
+	"Let SOCKS5 proxies reach this exit node's loopback, link-local and private addresses")
+var tcp_tun_tap = flag.Bool("tcp_tun_tap", false,
+	"Bridge ethernet frames through a tap device instead of routing IP packets. Exit nodes bridge to their tap device")
+var native = flag.Bool("native", false,
+	"Give this node an IPv6 address derived from its NodeAddress and send packets for other nodes' derived addresses straight to them")
+var native_peers = flag.String("native_peers", "",
+	"Comma separated hex NodeAddresses which can be reached natively before they've opened a session with us")
 var route_log_path = flag.String("route_log_path", "", "Routing decision log path")
+var receipt_interval = flag.Duration("receipt_interval", 30*time.Second,
+	"How often to send receipts for packets delivered to us")
+var payment_interval = flag.Duration("payment_interval", 30*time.Second,
+	"How often to pay neighbors what we owe them")
+var receipt_batch_size = flag.Int("receipt_batch_size", 0,
+	"Send a receipt as soon as this many packets are waiting for one, 0 for no limit")
+var reputation_path = flag.String("reputation_path", "",
+	"File to persist neighbor reputations in, empty to keep them in memory")
 
 func main() {
 	log.SetFlags(log.LstdFlags | log.Lmicroseconds | log.Lshortfile)
 	log.Print(os.Args)
 	flag.Parse()
+	if *receipt_interval <= 0 || *payment_interval <= 0 {
+		log.Fatal("-receipt_interval and -payment_interval must be positive")
+	}
 
-	// Capture all signals to the quit channel
-	quit := make(chan os.Signal)
-	signal.Notify(quit, os.Interrupt, os.Kill)
+	// Capture the signals asking us to stop to the quit channel, so the
+	// deferred cleanup runs. SIGKILL can't be caught.
+	quit := make(chan os.Signal, 1)
+	signal.Notify(quit, os.Interrupt, syscall.SIGTERM)
 
 	// Figure out and load what key we are using for our identity
 	var key node.Key
@@ -72,9 +141,24 @@ func main() {
 
 	// Connect to our money server
 	money := node.FakeMoney()
+	// How long payments to us take to confirm, a block being mined about
+	// every ten minutes.
+	var confirmation_time time.Duration
 	if !*fake_money {
+		confirmation_time = time.Duration(*btc_confirmations) * 10 * time.Minute
 		log.Print("Connecting to bitcoin daemon")
-		rpc, err := node.NewRPCMoney(*btc_host, *btc_user, *btc_pass)
+		o := node.DefaultRPCMoneyOptions(*btc_host, *btc_user, *btc_pass)
+		o.Network = *btc_network
+		o.Confirmations = *btc_confirmations
+		o.PollRate = *btc_poll_rate
+		o.TLS = *btc_tls
+		if len(*btc_cert) > 0 {
+			o.Certificates, err = ioutil.ReadFile(*btc_cert)
+			if err != nil {
+				log.Fatalf("Error reading bitcoin daemon certificate: %v", err)
+			}
+		}
+		rpc, err := node.NewRPCMoneyWithOptions(o)
 		if err != nil {
 			log.Fatalf("Error connection to bitcoin daemon: %v", err)
 		}
@@ -87,7 +171,17 @@ func main() {
 		log.Fatal("Error creating bloom log: %v", err)
 	}
 	route_logger := node.NewLogger(route_log)
-	n := node.NewServer(key, money, log.New(os.Stderr, "", log.LstdFlags), route_logger)
+	o := node.ServerOptions{
+		ReceiptInterval:  *receipt_interval,
+		PaymentInterval:  *payment_interval,
+		ReceiptBatchSize: *receipt_batch_size,
+		ReputationPath:   *reputation_path,
+		ConfirmationTime: confirmation_time,
+	}
+	n, err := node.NewServerWithOptions(key, money, log.New(os.Stderr, "", log.LstdFlags), route_logger, o)
+	if err != nil {
+		log.Fatalf("Error creating server: %v", err)
+	}
 
 	log.Printf("Starting to listen on %s", *listen)
 	err = n.Listen(*listen)
@@ -133,24 +227,215 @@ func main() {
 		}
 	}
 
+	n.PublishExpvar()
+	http.Handle("/flows", n.FlowsHandler())
+	http.Handle("/metrics", n.MetricsHandler())
 	go func() {
 		log.Fatal(http.ListenAndServe(*status, nil))
 	}()
 
-	if *tcp_tun_serve {
+	// The first error any of the services below stops with.
+	failed := make(chan error, 1)
+
+	// Tunnels, proxies and native packets all read from our node, so they
+	// share its packets through splitters when more than one is enabled.
+	var tun_node, proxy_node, native_node node.NodeConnection = n.Node(), n.Node(), n.Node()
+	if *native {
+		tun_node, native_node = node.SplitNativePackets(n.Node())
+		proxy_node = tun_node
+	}
+	if (*tcp_tun_serve || len(*tcp_tun) > 0) && (*proxy_serve || len(*socks) > 0) {
+		tun_node, proxy_node = node.SplitProxyPackets(tun_node)
+	}
+
+	if *native {
+		i, err := tuntap.Open("tun%d", tuntap.DevTun)
+		if err != nil {
+			log.Fatal(err)
+		}
+		o := node.DefaultNativeTunOptions()
+		o.Peers, err = parseAddresses(*native_peers)
+		if err != nil {
+			log.Fatal(err)
+		}
+		o.MTU = *tcp_tun_mtu
+		o.Key = &key
+		nt, err := node.NewNativeTunWithOptions(native_node, i, 10000, o)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Printf("Starting native IPv6 as %v", nt.IP())
+		iface, err := node.NewInterface(i.Name())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer cleanupInterface(iface)
+		err = iface.Up()
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = iface.SetMTU(o.MTU)
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = iface.AddAddr(nt.IP().String())
+		if err != nil {
+			log.Fatal(err)
+		}
+		err = iface.AddRoute(node.NativePrefix().String(), nil)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer nt.Close()
+		nt.Listen()
+		watch("Native IPv6", nt.Error(), failed)
+	}
+
+	if *proxy_serve {
+		log.Printf("Starting proxy exit node")
+		o := node.DefaultProxyServerOptions()
+		o.AllowUnsigned = *tcp_tun_allow_unsigned
+		o.Allow, err = parseAddresses(*tcp_tun_allow)
+		if err != nil {
+			log.Fatal(err)
+		}
+		o.Deny, err = parseAddresses(*tcp_tun_deny)
+		if err != nil {
+			log.Fatal(err)
+		}
+		o.AllowPrivate = *proxy_allow_private
+		p := node.NewProxyServerWithOptions(proxy_node, 10000, o)
+		defer p.Close()
+		p.Listen()
+		watch("Proxy exit node", p.Error(), failed)
+	}
+
+	if len(*socks) > 0 {
+		log.Printf("Starting SOCKS5 proxy on %s through %s", *socks, *socks_exit)
+		exit, err := hex.DecodeString(*socks_exit)
+		if err != nil {
+			log.Fatal(err)
+		}
+		o := node.DefaultSOCKSProxyOptions()
+		o.Key = &key
+		p, err := node.NewSOCKSProxyWithOptions(proxy_node, types.NodeAddress(exit), 10000, *socks, o)
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer p.Close()
+		watch("SOCKS5 proxy", p.Error(), failed)
+	}
+
+	if *tcp_tun_serve && *tcp_tun_tap {
+		log.Printf("Starting tap bridge")
+		i, err := tuntap.Open("tap%d", tuntap.DevTap)
+		if err != nil {
+			log.Fatal(err)
+		}
+		o := node.DefaultTAPBridgeOptions()
+		o.AllowUnsigned = *tcp_tun_allow_unsigned
+		o.Allow, err = parseAddresses(*tcp_tun_allow)
+		if err != nil {
+			log.Fatal(err)
+		}
+		o.Deny, err = parseAddresses(*tcp_tun_deny)
+		if err != nil {
+			log.Fatal(err)
+		}
+		o.MTU = *tcp_tun_mtu
+		o.SessionTimeout = *tcp_tun_lease_time
+		o.DefaultPolicy = node.TunnelPolicy{MaxBandwidth: *tcp_tun_max_bandwidth, MinAmt: *tcp_tun_min_amt}
+		if len(*tcp_tun_policies) > 0 {
+			o.Policies, err = node.LoadTunnelPolicies(*tcp_tun_policies)
+			if err != nil {
+				log.Fatalf("Error loading tunnel policies: %v", err)
+			}
+		}
+		bridge, err := node.NewTAPBridgeWithOptions(tun_node, i, 10000, o)
+		if err != nil {
+			log.Fatal(err)
+		}
+		// The tap device is joined to the LAN by adding it to a bridge
+		// outside of autoroute.
+		iface, err := node.NewInterface(i.Name())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer cleanupInterface(iface)
+		err = iface.Up()
+		if err != nil {
+			log.Fatal(err)
+		}
+		bridge.Listen()
+		watch("Tap bridge", bridge.Error(), failed)
+	} else if *tcp_tun_serve {
 		log.Printf("Starting tcp tunnel server")
 		log.Printf("Establishing tcp tunnel to %v", *tcp_tun)
 		i, err := tuntap.Open("tun%d", tuntap.DevTun)
 		if err != nil {
 			log.Fatal(err)
 		}
-		tunserver := node.NewTCPTunServer(n.Node(), i, 10000)
+		o := node.DefaultTCPTunServerOptions()
+		o.IPv4Prefix = *tcp_tun_ipv4_prefix
+		o.IPv6Prefix = *tcp_tun_ipv6_prefix
+		o.LeaseTime = *tcp_tun_lease_time
+		o.NATIPv4 = *tcp_tun_nat_ipv4
+		o.NATIPv6 = *tcp_tun_nat_ipv6
+		o.AllowUnsigned = *tcp_tun_allow_unsigned
+		o.Allow, err = parseAddresses(*tcp_tun_allow)
+		if err != nil {
+			log.Fatal(err)
+		}
+		o.Deny, err = parseAddresses(*tcp_tun_deny)
+		if err != nil {
+			log.Fatal(err)
+		}
+		o.MTU = *tcp_tun_mtu
+		o.DefaultPolicy = node.TunnelPolicy{MaxBandwidth: *tcp_tun_max_bandwidth, MinAmt: *tcp_tun_min_amt}
+		if len(*tcp_tun_policies) > 0 {
+			o.Policies, err = node.LoadTunnelPolicies(*tcp_tun_policies)
+			if err != nil {
+				log.Fatalf("Error loading tunnel policies: %v", err)
+			}
+		}
+		tunserver, err := node.NewTCPTunServerWithOptions(tun_node, i, 10000, o)
+		if err != nil {
+			log.Fatal(err)
+		}
+		iface, err := node.NewInterface(i.Name())
+		if err != nil {
+			log.Fatal(err)
+		}
+		defer cleanupInterface(iface)
+		err = iface.Up()
+		if err != nil {
+			log.Fatal(err)
+		}
+		for _, prefix := range tunserver.Prefixes() {
+			err = iface.AddRoute(prefix.String(), nil)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+		// Replies to translated traffic come back through the tun device, which
+		// needs forwarding enabled to reach other interfaces.
+		for _, ip := range tunserver.NATAddresses() {
+			err = iface.AddRoute(ip.String(), nil)
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
 		tunserver.Listen()
+		watch("Tunnel server", tunserver.Error(), failed)
 	}
 
 	if len(*tcp_tun) > 0 {
 		log.Printf("Establishing tcp tunnel to %v", *tcp_tun)
-		i, err := tuntap.Open("tun%d", tuntap.DevTun)
+		kind, pattern := tuntap.DevTun, "tun%d"
+		if *tcp_tun_tap {
+			kind, pattern = tuntap.DevTap, "tap%d"
+		}
+		i, err := tuntap.Open(pattern, kind)
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -159,7 +444,16 @@ func main() {
 		if err != nil {
 			log.Fatal(err)
 		}
-		t := node.NewTCPTunClient(n.Node(), i, types.NodeAddress(dest), 10000, i.Name())
+		co := node.DefaultTCPTunClientOptions()
+		co.Key = &key
+		co.Version = byte(*tcp_tun_version)
+		co.FallbackRetries = *tcp_tun_fallback_retries
+		co.MTU = *tcp_tun_mtu
+		co.TAP = *tcp_tun_tap
+		co.KeepaliveInterval = *tcp_tun_keepalive
+		co.KeepaliveTimeout = 3 * *tcp_tun_keepalive
+		co.HandshakeTimeout = *tcp_tun_handshake_timeout
+		t := node.NewTCPTunClientWithOptions(tun_node, i, types.NodeAddress(dest), 10000, i.Name(), co)
 		defer t.Close()
 
 		if len(*tcp_address) > 0 {
@@ -167,26 +461,35 @@ func main() {
 			if err != nil {
 				log.Fatal(err)
 			}
-			err = exec.Command("ip", "link", "set", "dev", i.Name(), "up").Run()
+			iface, err := node.NewInterface(i.Name())
 			if err != nil {
 				log.Fatal(err)
 			}
-			err = exec.Command("ip", "addr", "add", *tcp_address, "dev", i.Name()).Run()
+			defer cleanupInterface(iface)
+			err = iface.Up()
 			if err != nil {
 				log.Fatal(err)
 			}
-			err = exec.Command("ip", "route", "add", "0/1", "via", ip.String(), "dev", i.Name()).Run()
+			err = iface.AddAddr(*tcp_address)
 			if err != nil {
 				log.Fatal(err)
 			}
-			err = exec.Command("ip", "route", "add", "128/1", "via", ip.String(), "dev", i.Name()).Run()
-			if err != nil {
-				log.Fatal(err)
+			// Two halves of the internet are more specific than the default
+			// route, so they win without replacing it. A bridged LAN has
+			// its own routers, which are left to the user.
+			halves := []string{"0.0.0.0/1", "128.0.0.0/1"}
+			if *tcp_tun_tap {
+				halves = nil
+			}
+			for _, half := range halves {
+				err = iface.AddRoute(half, ip)
+				if err != nil {
+					log.Fatal(err)
+				}
 			}
-
 		}
-		m := <-quit
-		log.Print(m)
+		watch("Tunnel", t.Error(), failed)
+		wait(quit, failed)
 		return
 	}
 
@@ -198,9 +501,55 @@ func main() {
 		}
 		defer os.Remove(*unix)
 		defer c.Close()
-		<-quit
+		wait(quit, failed)
 		return
 	}
 
-	<-quit
+	wait(quit, failed)
+}
+
+// Reports the error a service stops with to failed.
+func watch(name string, errs chan error, failed chan error) {
+	go func() {
+		err := <-errs
+		select {
+		case failed <- fmt.Errorf("%s failed: %v", name, err):
+		default:
+		}
+	}()
+}
+
+// Waits for a signal or for a service to fail, so the deferred cleanup runs
+// either way.
+func wait(quit chan os.Signal, failed chan error) {
+	select {
+	case m := <-quit:
+		log.Print(m)
+	case err := <-failed:
+		log.Print(err)
+	}
+}
+
+// Takes the routes and addresses we gave an interface off it again.
+func cleanupInterface(iface *node.Interface) {
+	err := iface.Cleanup()
+	if err != nil {
+		log.Printf("Error cleaning up %s: %v", iface.Name(), err)
+	}
+}
+
+// Parses a comma separated list of hex node addresses.
+func parseAddresses(list string) ([]types.NodeAddress, error) {
+	var addresses []types.NodeAddress
+	for _, id := range strings.Split(list, ",") {
+		if len(id) == 0 {
+			continue
+		}
+		b, err := hex.DecodeString(id)
+		if err != nil {
+			return nil, fmt.Errorf("invalid node address %q: %v", id, err)
+		}
+		addresses = append(addresses, types.NodeAddress(b))
+	}
+	return addresses, nil
 }
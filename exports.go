@@ -1,6 +1,8 @@
 package node
 
 import (
+	"time"
+
 	"github.com/AutoRoute/node/internal"
 	"github.com/AutoRoute/node/types"
 )
@@ -15,6 +17,20 @@ func NewRPCMoney(host, user, pass string) (types.Money, error) {
 	return internal.NewRPCMoney(host, user, pass)
 }
 
+// Settings for a RPCMoney connection, such as which bitcoin network the
+// daemon is on and how many confirmations a payment needs.
+type RPCMoneyOptions internal.RPCMoneyOptions
+
+// Returns the settings used by NewRPCMoney.
+func DefaultRPCMoneyOptions(host, user, pass string) RPCMoneyOptions {
+	return RPCMoneyOptions(internal.DefaultRPCMoneyOptions(host, user, pass))
+}
+
+// Represents a money connection to an active bitcoin server with custom settings
+func NewRPCMoneyWithOptions(o RPCMoneyOptions) (types.Money, error) {
+	return internal.NewRPCMoneyWithOptions(internal.RPCMoneyOptions(o))
+}
+
 // Represents an object capable of sending and receiving packets.
 type DataConnection interface {
 	SendPacket(types.Packet) error
@@ -35,10 +51,36 @@ func (n Node) SendPacket(p types.Packet) error {
 	return n.private.SendPacket(p)
 }
 
+// Tracks whether a packet sent with SendPacketWithReceipt has arrived.
+type Delivery interface {
+	// Receives nil once the destination's receipt for the packet arrives, or
+	// ErrReceiptTimeout if it doesn't arrive in time.
+	Done() <-chan error
+	Wait() error
+	Hash() types.PacketHash
+}
+
+// Returned by a Delivery when no receipt arrives before its timeout.
+var ErrReceiptTimeout = internal.ErrReceiptTimeout
+
+// Sends a packet and returns a Delivery which reports whether it arrived.
+func (n Node) SendPacketWithReceipt(p types.Packet, timeout time.Duration) (Delivery, error) {
+	d, err := n.private.SendPacketWithReceipt(p, timeout)
+	if err != nil {
+		return nil, err
+	}
+	return d, nil
+}
+
+// Returns how well a neighbor has behaved, negative meaning badly.
+func (n Node) Reputation(addr types.NodeAddress) float64 {
+	return n.private.Reputation(addr)
+}
+
 func (n Node) Packets() <-chan types.Packet {
 	return n.private.Packets()
 }
 
 func (n Node) GetNodeAddress() types.NodeAddress {
-	return n.GetNodeAddress()
+	return n.private.GetNodeAddress()
 }
@@ -6,6 +6,7 @@ import (
 	"io/ioutil"
 	"net/http"
 	"strings"
+	"time"
 )
 
 // Represents a binary execution of the autoroute binary.
@@ -28,7 +29,11 @@ type BinaryOptions struct {
 	BTCHost             string
 	BTCUser             string
 	BTCPass             string
+	BTCNetwork          string
 	RouteLogPath        string
+	ReceiptInterval     time.Duration
+	PaymentInterval     time.Duration
+	ReceiptBatchSize    int
 }
 
 // Transforms a BinaryOptions into a valid AutoRoute command line.
@@ -67,12 +72,24 @@ func ProduceCommandLine(b BinaryOptions) []string {
 	if len(b.BTCPass) > 0 {
 		args = append(args, "--btc_pass="+b.BTCPass)
 	}
+	if len(b.BTCNetwork) > 0 {
+		args = append(args, "--btc_network="+b.BTCNetwork)
+	}
 	if len(b.Unix) > 0 {
 		args = append(args, "--unix="+b.Unix)
 	}
 	if len(b.RouteLogPath) > 0 {
 		args = append(args, "--route_log_path="+b.RouteLogPath)
 	}
+	if b.ReceiptInterval > 0 {
+		args = append(args, "--receipt_interval="+b.ReceiptInterval.String())
+	}
+	if b.PaymentInterval > 0 {
+		args = append(args, "--payment_interval="+b.PaymentInterval.String())
+	}
+	if b.ReceiptBatchSize > 0 {
+		args = append(args, "--receipt_batch_size="+fmt.Sprint(b.ReceiptBatchSize))
+	}
 	return args
 }
 
@@ -103,6 +103,7 @@ func TestBitcoin(t *testing.T) {
 		BTCHost:      "127.0.0.1:19001",
 		BTCUser:      "admin1",
 		BTCPass:      "123",
+		BTCNetwork:   "regtest",
 		RouteLogPath: "/tmp/route1.log",
 	})
 	listen.Start()
@@ -118,6 +119,7 @@ func TestBitcoin(t *testing.T) {
 		BTCHost:      "127.0.0.1:19011",
 		BTCUser:      "admin2",
 		BTCPass:      "123",
+		BTCNetwork:   "regtest",
 		RouteLogPath: "/tmp/route2.log",
 	})
 	connect.Start()
@@ -45,7 +45,7 @@ func TestPacket(t *testing.T) {
 	}
 
 	raw_id, err := hex.DecodeString(connect_id)
-	p := types.Packet{types.NodeAddress(string(raw_id)), 10, []byte("data")}
+	p := types.Packet{Dest: types.NodeAddress(string(raw_id)), Amt: 10, Data: []byte("data")}
 
 	c, err := WaitForSocket("/tmp/unix")
 	if err != nil {
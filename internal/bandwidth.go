@@ -29,6 +29,7 @@ type bandwidthEstimator struct {
 	// This is so we can keep track of packets that came from the same source. It
 	// maps each source to the next hop of the last packet sent from that source.
 	last_sent_to map[types.NodeAddress]types.NodeAddress
+	clock        Clock
 
 	// Channel to indicate when it's time to quit.
 	quit chan bool
@@ -36,10 +37,11 @@ type bandwidthEstimator struct {
 
 // Creates a new bandwidthEstimator.
 // Args:
-//  routing: The routingHan.
+//  routing: The routingHandler's decisions.
+//  clock: What send times are measured with.
 // Returns:
 //  A new bandwidthEstimator.
-func newBandwidthEstimator(routing <-chan routingDecision) *bandwidthEstimator {
+func newBandwidthEstimator(routing <-chan routingDecision, clock Clock) *bandwidthEstimator {
 	estimator := bandwidthEstimator{
 		routing,
 		make(map[types.NodeAddress]float64),
@@ -48,6 +50,7 @@ func newBandwidthEstimator(routing <-chan routingDecision) *bandwidthEstimator {
 		make(map[types.NodeAddress]time.Duration),
 		make(map[types.NodeAddress]time.Time),
 		make(map[types.NodeAddress]types.NodeAddress),
+		clock,
 		make(chan bool),
 	}
 
@@ -96,7 +99,7 @@ func (b *bandwidthEstimator) sentPacket(src types.NodeAddress,
 	if !ok {
 		// If we have no previous data, there's not much we can do in the way of
 		// bandwidth.
-		b.send_start_time[node] = time.Now()
+		b.send_start_time[node] = b.clock.Now()
 		return
 	}
 
@@ -104,7 +107,7 @@ func (b *bandwidthEstimator) sentPacket(src types.NodeAddress,
 	b.bytes_sent[use_node] += int64(size)
 
 	start_time := b.send_start_time[use_node]
-	elapsed := time.Since(start_time)
+	elapsed := b.clock.Since(start_time)
 	b.sent_time[use_node] += elapsed
 
 	b.bandwidth_lock.Lock()
@@ -115,7 +118,7 @@ func (b *bandwidthEstimator) sentPacket(src types.NodeAddress,
 	// Mark the time now. Assuming the connection is fairly saturated, this should
 	// be accurate for calculating how long it took to send the next packet. If
 	// it's not saturated, well, then this calculation doesn't really matter. :)
-	b.send_start_time[node] = time.Now()
+	b.send_start_time[node] = b.clock.Now()
 }
 
 // Calculates and returns weights for each node in order to make routing
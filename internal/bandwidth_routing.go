@@ -1,6 +1,7 @@
 package internal
 
 import (
+	"errors"
 	"math/rand"
 
 	"github.com/AutoRoute/node/types"
@@ -14,6 +15,9 @@ type bandwidthRouting struct {
 
 	// Bandwidth estimator for all nodes.
 	bandwidths *bandwidthEstimator
+
+	// Neighbors with a bad reputation aren't routed through.
+	reputation *Reputation
 }
 
 // Helper function that, given a set of weights and a possible next hops,
@@ -42,10 +46,11 @@ func chooseNextHop(weights []float64,
 	return next
 }
 
-func newBandwidthRouting(r *reachabilityHandler) *bandwidthRouting {
+func newBandwidthRouting(r *reachabilityHandler, reputation *Reputation) *bandwidthRouting {
 	return &bandwidthRouting{
 		r,
 		nil,
+		reputation,
 	}
 }
 
@@ -57,6 +62,10 @@ func (b *bandwidthRouting) FindNextHop(id types.NodeAddress,
 	if err != nil {
 		return "", err
 	}
+	possible_next = b.reputation.Filter(possible_next)
+	if len(possible_next) == 0 {
+		return "", errors.New("Host is only reachable through untrusted neighbors")
+	}
 
 	// Decide which one of our possible destinations to send it to.
 	weights := b.bandwidths.GetWeights(possible_next)
@@ -69,7 +78,7 @@ func (b *bandwidthRouting) FindNextHop(id types.NodeAddress,
 // See the routingAlgorithm interface for details.
 func (b *bandwidthRouting) BindToRouting(routing *routingHandler) {
 	// Create bandwidth estimator.
-	b.bandwidths = newBandwidthEstimator(routing.Routes())
+	b.bandwidths = newBandwidthEstimator(routing.Routes(), routing.clock)
 }
 
 // Clean up the bandwidth estimator.
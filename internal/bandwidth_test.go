@@ -12,7 +12,7 @@ import (
 func TestBasic(t *testing.T) {
 	// Channel that we'll send information about outgoing packets down.
 	outgoing := make(chan routingDecision)
-	estimator := newBandwidthEstimator(outgoing)
+	estimator := newBandwidthEstimator(outgoing, SystemClock())
 
 	// Fake node addresses.
 	node1 := types.NodeAddress("A")
@@ -20,8 +20,8 @@ func TestBasic(t *testing.T) {
 	src := types.NodeAddress("src")
 
 	// Fake packet that we'll say we sent.
-	packet1 := types.Packet{node1, 1, nil}
-	packet2 := types.Packet{node2, 1, nil}
+	packet1 := types.Packet{Dest: node1, Amt: 1, Data: nil}
+	packet2 := types.Packet{Dest: node2, Amt: 1, Data: nil}
 
 	decision1 := newRoutingDecision(packet1, src, node1, 10)
 	decision2 := newRoutingDecision(packet2, src, node2, 10)
@@ -53,9 +53,11 @@ func TestBasic(t *testing.T) {
 
 // A slightly more complicated test with varying bandwidths.
 func TestDifferingBandwidths(t *testing.T) {
-	// Channel that we'll send information about outgoing packets down.
-	outgoing := make(chan routingDecision)
-	estimator := newBandwidthEstimator(outgoing)
+	// Packets are reported directly so the fake clock can be advanced between
+	// them without racing the background service.
+	clock := NewFakeClock(time.Now())
+	estimator := newBandwidthEstimator(nil, clock)
+	defer estimator.Close()
 
 	// Fake node addresses.
 	node1 := types.NodeAddress("A")
@@ -63,17 +65,17 @@ func TestDifferingBandwidths(t *testing.T) {
 	src := types.NodeAddress("src")
 
 	// Fake packet that we'll say we sent.
-	packet1 := types.Packet{node1, 1, nil}
-	packet2 := types.Packet{node2, 1, nil}
+	packet1 := types.Packet{Dest: node1, Amt: 1, Data: nil}
+	packet2 := types.Packet{Dest: node2, Amt: 1, Data: nil}
 
 	decision1 := newRoutingDecision(packet1, src, node1, 10)
 	decision2 := newRoutingDecision(packet2, src, node2, 10)
 	for i := 0; i < 10; i++ {
-		outgoing <- decision1
-		time.Sleep(10 * time.Millisecond)
+		estimator.sentPacket(src, node1, decision1.size)
+		clock.Advance(10 * time.Millisecond)
 
-		outgoing <- decision2
-		time.Sleep(20 * time.Millisecond)
+		estimator.sentPacket(src, node2, decision2.size)
+		clock.Advance(20 * time.Millisecond)
 	}
 
 	// The weights should be split about 2/3 and 1/3.
@@ -102,8 +104,9 @@ func TestDifferingBandwidths(t *testing.T) {
 
 // A test to make sure it can handle weights with only partial information.
 func TestPartialData(t *testing.T) {
-	outgoing := make(chan routingDecision)
-	estimator := newBandwidthEstimator(outgoing)
+	clock := NewFakeClock(time.Now())
+	estimator := newBandwidthEstimator(nil, clock)
+	defer estimator.Close()
 
 	// Try to get weights for some nodes that don't exist.
 	node1 := types.NodeAddress("A")
@@ -116,8 +119,8 @@ func TestPartialData(t *testing.T) {
 	nodes[2] = node3
 
 	// Fake packets that we'll say we sent.
-	packet1 := types.Packet{node1, 1, nil}
-	packet2 := types.Packet{node2, 1, nil}
+	packet1 := types.Packet{Dest: node1, Amt: 1, Data: nil}
+	packet2 := types.Packet{Dest: node2, Amt: 1, Data: nil}
 
 	decision1 := newRoutingDecision(packet1, src, node1, 10)
 	decision2 := newRoutingDecision(packet2, src, node2, 10)
@@ -139,11 +142,11 @@ func TestPartialData(t *testing.T) {
 
 	// Add sufficient data for two of the nodes.
 	for i := 0; i < 10; i++ {
-		outgoing <- decision1
-		time.Sleep(10 * time.Millisecond)
+		estimator.sentPacket(src, node1, decision1.size)
+		clock.Advance(10 * time.Millisecond)
 
-		outgoing <- decision2
-		time.Sleep(20 * time.Millisecond)
+		estimator.sentPacket(src, node2, decision2.size)
+		clock.Advance(20 * time.Millisecond)
 	}
 
 	// The way this works is that for any node for which it lacks sufficient data,
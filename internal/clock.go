@@ -0,0 +1,145 @@
+package internal
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// A Clock tells the time and schedules things to happen later. Everything
+// timing sensitive takes one so tests can swap in a FakeClock and step
+// through time explicitly instead of sleeping.
+type Clock interface {
+	Now() time.Time
+	Since(t time.Time) time.Duration
+	// Sends the time on the returned channel once d has passed.
+	After(d time.Duration) <-chan time.Time
+	// Sends the time on the returned channel every d, dropping ticks the
+	// reader is too slow for.
+	Tick(d time.Duration) <-chan time.Time
+	Sleep(d time.Duration)
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time                         { return time.Now() }
+func (systemClock) Since(t time.Time) time.Duration        { return time.Since(t) }
+func (systemClock) After(d time.Duration) <-chan time.Time { return time.After(d) }
+func (systemClock) Tick(d time.Duration) <-chan time.Time  { return time.Tick(d) }
+func (systemClock) Sleep(d time.Duration)                  { time.Sleep(d) }
+
+// Returns the Clock backed by the time package.
+func SystemClock() Clock {
+	return systemClock{}
+}
+
+// Returns c, or the system clock if c is nil.
+func clockOrDefault(c Clock) Clock {
+	if c == nil {
+		return SystemClock()
+	}
+	return c
+}
+
+type fakeTimer struct {
+	at time.Time
+	// Zero for timers which only fire once.
+	period time.Duration
+	c      chan time.Time
+}
+
+// A FakeClock only moves when Advance is called. Timers and tickers fire
+// synchronously inside Advance, in order of when they were due.
+type FakeClock struct {
+	l      *sync.Mutex
+	now    time.Time
+	timers []*fakeTimer
+}
+
+func NewFakeClock(now time.Time) *FakeClock {
+	return &FakeClock{&sync.Mutex{}, now, nil}
+}
+
+func (f *FakeClock) Now() time.Time {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return f.now
+}
+
+func (f *FakeClock) Since(t time.Time) time.Duration {
+	return f.Now().Sub(t)
+}
+
+func (f *FakeClock) schedule(d, period time.Duration) <-chan time.Time {
+	f.l.Lock()
+	defer f.l.Unlock()
+	c := make(chan time.Time, 1)
+	if d <= 0 && period == 0 {
+		c <- f.now
+		return c
+	}
+	f.timers = append(f.timers, &fakeTimer{f.now.Add(d), period, c})
+	return c
+}
+
+func (f *FakeClock) After(d time.Duration) <-chan time.Time {
+	return f.schedule(d, 0)
+}
+
+// Like time.Tick, returns nil if d is not positive.
+func (f *FakeClock) Tick(d time.Duration) <-chan time.Time {
+	if d <= 0 {
+		return nil
+	}
+	return f.schedule(d, d)
+}
+
+func (f *FakeClock) Sleep(d time.Duration) {
+	<-f.After(d)
+}
+
+// Moves the clock forward by d, firing every timer and tick due by then.
+func (f *FakeClock) Advance(d time.Duration) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	end := f.now.Add(d)
+	for {
+		sort.Stable(byDeadline(f.timers))
+		if len(f.timers) == 0 || f.timers[0].at.After(end) {
+			break
+		}
+		t := f.timers[0]
+		f.now = t.at
+		select {
+		case t.c <- t.at:
+		default:
+		}
+		if t.period > 0 {
+			t.at = t.at.Add(t.period)
+		} else {
+			f.timers = f.timers[1:]
+		}
+	}
+	f.now = end
+}
+
+// Returns the number of timers and tickers waiting to fire.
+func (f *FakeClock) Waiters() int {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return len(f.timers)
+}
+
+// Waits until at least n timers and tickers are waiting to fire, so a test
+// knows the goroutine it is driving has got as far as scheduling them.
+func (f *FakeClock) BlockUntil(n int) {
+	for f.Waiters() < n {
+		time.Sleep(time.Millisecond)
+	}
+}
+
+type byDeadline []*fakeTimer
+
+func (b byDeadline) Len() int           { return len(b) }
+func (b byDeadline) Less(i, j int) bool { return b[i].at.Before(b[j].at) }
+func (b byDeadline) Swap(i, j int)      { b[i], b[j] = b[j], b[i] }
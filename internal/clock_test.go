@@ -0,0 +1,101 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AutoRoute/node/types"
+)
+
+func TestFakeClock(t *testing.T) {
+	start := time.Unix(1000, 0)
+	c := NewFakeClock(start)
+	after := c.After(10 * time.Second)
+	tick := c.Tick(3 * time.Second)
+	if c.Waiters() != 2 {
+		t.Fatalf("Expected 2 waiters got %d", c.Waiters())
+	}
+
+	c.Advance(2 * time.Second)
+	select {
+	case <-after:
+		t.Fatal("Timer fired early")
+	case <-tick:
+		t.Fatal("Ticker fired early")
+	default:
+	}
+
+	c.Advance(2 * time.Second)
+	if now := <-tick; !now.Equal(start.Add(3 * time.Second)) {
+		t.Fatalf("Expected tick at +3s got %v", now.Sub(start))
+	}
+
+	// Ticks the reader misses are dropped, like time.Tick.
+	c.Advance(10 * time.Second)
+	if now := <-after; !now.Equal(start.Add(10 * time.Second)) {
+		t.Fatalf("Expected timer at +10s got %v", now.Sub(start))
+	}
+	if now := <-tick; !now.Equal(start.Add(6 * time.Second)) {
+		t.Fatalf("Expected tick at +6s got %v", now.Sub(start))
+	}
+	select {
+	case <-tick:
+		t.Fatal("Expected missed ticks to be dropped")
+	default:
+	}
+	if c.Since(start) != 14*time.Second || c.Waiters() != 1 {
+		t.Fatalf("Unexpected clock state %v %d", c.Since(start), c.Waiters())
+	}
+}
+
+func TestDeliveryFakeClock(t *testing.T) {
+	c := NewFakeClock(time.Now())
+	cancelled := make(chan bool, 1)
+	d := newDelivery(types.PacketHash("hash"), make(chan bool), c.After(time.Minute), func() { cancelled <- true })
+
+	c.Advance(59 * time.Second)
+	select {
+	case err := <-d.Done():
+		t.Fatalf("Delivery finished early with %v", err)
+	case <-time.After(10 * time.Millisecond):
+	}
+	c.Advance(time.Second)
+	if err := d.Wait(); err != ErrReceiptTimeout {
+		t.Fatalf("Expected timeout got %v", err)
+	}
+	<-cancelled
+}
+
+func TestReceiptDroppedFakeClock(t *testing.T) {
+	a1, a2 := types.NodeAddress("1"), types.NodeAddress("2")
+	i1 := make(chan routingDecision)
+	lgr1 := testLogger{0, 0, 0, &sync.Mutex{}}
+	rep := newMemoryReputation()
+	c := NewFakeClock(time.Now())
+	ri1 := newReceipt(a1, i1, rep, NewMetrics(), c, &lgr1)
+	defer ri1.Close()
+
+	i1 <- newRoutingDecision(testPacket(a2), a1, a2, 1)
+	for {
+		ri1.l.Lock()
+		n := len(ri1.unreceipted)
+		ri1.l.Unlock()
+		if n == 1 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	// Ticks the handler hasn't read yet are dropped, so keep the clock moving
+	// until one is seen after the receipt is overdue.
+	timeout := time.After(time.Second)
+	for rep.Score(a2) >= 0 {
+		c.Advance(receipt_timeout / 2)
+		select {
+		case <-timeout:
+			t.Fatalf("Expected %x to be blamed for the dropped packet", a2)
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
@@ -0,0 +1,48 @@
+package internal
+
+import (
+	"errors"
+	"time"
+
+	"github.com/AutoRoute/node/types"
+)
+
+// Returned by a Delivery when no receipt for its packet arrives in time.
+var ErrReceiptTimeout = errors.New("Timed out waiting for packet receipt")
+
+// A Delivery tracks whether a packet we sent has been receipted by its
+// destination.
+type Delivery struct {
+	hash types.PacketHash
+	done chan error
+}
+
+// Gives up once expired fires.
+func newDelivery(hash types.PacketHash, receipted <-chan bool, expired <-chan time.Time, cancel func()) *Delivery {
+	d := &Delivery{hash, make(chan error, 1)}
+	go func() {
+		select {
+		case <-receipted:
+			d.done <- nil
+		case <-expired:
+			cancel()
+			d.done <- ErrReceiptTimeout
+		}
+	}()
+	return d
+}
+
+func (d *Delivery) Hash() types.PacketHash {
+	return d.hash
+}
+
+// Returns a channel which receives nil once a verified receipt covering the
+// packet arrives, or ErrReceiptTimeout if none arrives in time.
+func (d *Delivery) Done() <-chan error {
+	return d.done
+}
+
+// Blocks until the packet is receipted or the timeout passes.
+func (d *Delivery) Wait() error {
+	return <-d.done
+}
@@ -0,0 +1,235 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AutoRoute/node/types"
+)
+
+// The width of each bucket in a flowWindow, and how many are kept. This bounds
+// the longest rolling window which can be asked for.
+const (
+	flow_bucket_width = time.Minute
+	flow_buckets      = 60
+)
+
+// The rolling windows included when exporting flows.
+var flow_windows = []time.Duration{time.Minute, 5 * time.Minute, time.Hour}
+
+// FlowStats is how much traffic has passed through us for a single source or
+// destination.
+type FlowStats struct {
+	Packets int64
+	Bytes   int64
+	// The money carried by the packets, which is owed once they are receipted.
+	Amount int64
+}
+
+func (f *FlowStats) add(o FlowStats) {
+	f.Packets += o.Packets
+	f.Bytes += o.Bytes
+	f.Amount += o.Amount
+}
+
+type flowBucket struct {
+	start time.Time
+	stats FlowStats
+}
+
+// A flowWindow keeps the all time total for a flow and per minute buckets for
+// the last hour.
+type flowWindow struct {
+	total   FlowStats
+	buckets []flowBucket
+}
+
+func (w *flowWindow) add(now time.Time, s FlowStats) {
+	w.total.add(s)
+	start := now.Truncate(flow_bucket_width)
+	if len(w.buckets) == 0 || w.buckets[len(w.buckets)-1].start != start {
+		w.buckets = append(w.buckets, flowBucket{start, FlowStats{}})
+		if len(w.buckets) > flow_buckets {
+			w.buckets = w.buckets[len(w.buckets)-flow_buckets:]
+		}
+	}
+	w.buckets[len(w.buckets)-1].stats.add(s)
+}
+
+// Sums the buckets which overlap the last d.
+func (w *flowWindow) window(now time.Time, d time.Duration) FlowStats {
+	var s FlowStats
+	for _, b := range w.buckets {
+		if now.Sub(b.start) < d {
+			s.add(b.stats)
+		}
+	}
+	return s
+}
+
+// flowAccounting aggregates every routing decision into counters per source
+// (the neighbor a packet came from, or us) and per destination, so exit nodes
+// can bill or cap their users.
+type flowAccounting struct {
+	sources      map[types.NodeAddress]*flowWindow
+	destinations map[types.NodeAddress]*flowWindow
+	l            *sync.Mutex
+	clock        Clock
+	quit         chan bool
+}
+
+func newFlowAccounting(c <-chan routingDecision, clock Clock) *flowAccounting {
+	f := &flowAccounting{
+		make(map[types.NodeAddress]*flowWindow),
+		make(map[types.NodeAddress]*flowWindow),
+		&sync.Mutex{},
+		clock,
+		make(chan bool),
+	}
+	go f.handleDecisions(c)
+	return f
+}
+
+func (f *flowAccounting) handleDecisions(c <-chan routingDecision) {
+	for {
+		select {
+		case d := <-c:
+			f.record(f.clock.Now(), d)
+		case <-f.quit:
+			return
+		}
+	}
+}
+
+func (f *flowAccounting) record(now time.Time, d routingDecision) {
+	s := FlowStats{1, int64(d.size), d.amount}
+	f.l.Lock()
+	defer f.l.Unlock()
+	for _, m := range []struct {
+		flows map[types.NodeAddress]*flowWindow
+		id    types.NodeAddress
+	}{{f.sources, d.source}, {f.destinations, d.destination}} {
+		w, ok := m.flows[m.id]
+		if !ok {
+			w = &flowWindow{}
+			m.flows[m.id] = w
+		}
+		w.add(now, s)
+	}
+}
+
+func flowTotals(flows map[types.NodeAddress]*flowWindow) map[types.NodeAddress]FlowStats {
+	o := make(map[types.NodeAddress]FlowStats)
+	for id, w := range flows {
+		o[id] = w.total
+	}
+	return o
+}
+
+func flowWindows(flows map[types.NodeAddress]*flowWindow, now time.Time, d time.Duration) map[types.NodeAddress]FlowStats {
+	o := make(map[types.NodeAddress]FlowStats)
+	for id, w := range flows {
+		o[id] = w.window(now, d)
+	}
+	return o
+}
+
+// Returns the all time totals for every source.
+func (f *flowAccounting) SourceFlows() map[types.NodeAddress]FlowStats {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return flowTotals(f.sources)
+}
+
+// Returns the all time totals for every destination.
+func (f *flowAccounting) DestinationFlows() map[types.NodeAddress]FlowStats {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return flowTotals(f.destinations)
+}
+
+// Returns the traffic from each source over roughly the last d, which can be
+// at most an hour.
+func (f *flowAccounting) RecentSourceFlows(d time.Duration) map[types.NodeAddress]FlowStats {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return flowWindows(f.sources, f.clock.Now(), d)
+}
+
+// Returns the traffic to each destination over roughly the last d, which can
+// be at most an hour.
+func (f *flowAccounting) RecentDestinationFlows(d time.Duration) map[types.NodeAddress]FlowStats {
+	f.l.Lock()
+	defer f.l.Unlock()
+	return flowWindows(f.destinations, f.clock.Now(), d)
+}
+
+// Writes every flow counter in the Prometheus text exposition format.
+func (f *flowAccounting) WritePrometheus(w io.Writer) error {
+	return f.writePrometheus(w, f.clock.Now())
+}
+
+func (f *flowAccounting) writePrometheus(w io.Writer, now time.Time) error {
+	f.l.Lock()
+	defer f.l.Unlock()
+	metrics := []struct {
+		name  string
+		help  string
+		value func(FlowStats) int64
+	}{
+		{"autoroute_flow_packets", "Packets routed", func(s FlowStats) int64 { return s.Packets }},
+		{"autoroute_flow_bytes", "Bytes of packet data routed", func(s FlowStats) int64 { return s.Bytes }},
+		{"autoroute_flow_amount", "Satoshis carried by routed packets", func(s FlowStats) int64 { return s.Amount }},
+	}
+	flows := []struct {
+		direction string
+		flows     map[types.NodeAddress]*flowWindow
+	}{{"source", f.sources}, {"destination", f.destinations}}
+
+	for _, m := range metrics {
+		fmt.Fprintf(w, "# HELP %s_total %s, by source or destination.\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s_total counter\n", m.name)
+		for _, fl := range flows {
+			for _, id := range sortedFlowAddresses(fl.flows) {
+				fmt.Fprintf(w, "%s_total{direction=%q,address=\"%x\"} %d\n",
+					m.name, fl.direction, id, m.value(fl.flows[id].total))
+			}
+		}
+		fmt.Fprintf(w, "# HELP %s_recent %s over a rolling window, by source or destination.\n", m.name, m.help)
+		fmt.Fprintf(w, "# TYPE %s_recent gauge\n", m.name)
+		for _, fl := range flows {
+			for _, id := range sortedFlowAddresses(fl.flows) {
+				for _, d := range flow_windows {
+					_, err := fmt.Fprintf(w, "%s_recent{direction=%q,address=\"%x\",window=%q} %d\n",
+						m.name, fl.direction, id, d, m.value(fl.flows[id].window(now, d)))
+					if err != nil {
+						return err
+					}
+				}
+			}
+		}
+	}
+	return nil
+}
+
+// Sorts addresses so the export is stable between scrapes.
+func sortedFlowAddresses(flows map[types.NodeAddress]*flowWindow) []types.NodeAddress {
+	ids := make([]string, 0, len(flows))
+	for id := range flows {
+		ids = append(ids, string(id))
+	}
+	sort.Strings(ids)
+	o := make([]types.NodeAddress, 0, len(ids))
+	for _, id := range ids {
+		o = append(o, types.NodeAddress(id))
+	}
+	return o
+}
+
+func (f *flowAccounting) Close() error {
+	close(f.quit)
+	return nil
+}
@@ -0,0 +1,73 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/AutoRoute/node/types"
+)
+
+func TestFlowAccounting(t *testing.T) {
+	c := make(chan routingDecision)
+	clock := NewFakeClock(time.Now())
+	f := newFlowAccounting(c, clock)
+	defer f.Close()
+	a1, a2, a3 := types.NodeAddress("1"), types.NodeAddress("2"), types.NodeAddress("3")
+
+	now := clock.Now()
+	p := types.Packet{Dest: a3, Amt: 5, Data: []byte("data")}
+	// An hour ago a1 sent a packet to a3, and just now a1 and a2 both did.
+	f.record(now.Add(-time.Hour), newRoutingDecision(p, a1, a3, 4))
+	f.record(now, newRoutingDecision(p, a1, a3, 4))
+	f.record(now, newRoutingDecision(p, a2, a3, 4))
+
+	if s := f.SourceFlows()[a1]; s != (FlowStats{2, 8, 10}) {
+		t.Fatalf("Unexpected total for %x: %v", a1, s)
+	}
+	if s := f.DestinationFlows()[a3]; s != (FlowStats{3, 12, 15}) {
+		t.Fatalf("Unexpected total for %x: %v", a3, s)
+	}
+	if s := f.RecentSourceFlows(time.Minute)[a1]; s != (FlowStats{1, 4, 5}) {
+		t.Fatalf("Unexpected recent flow for %x: %v", a1, s)
+	}
+	if s := f.RecentDestinationFlows(time.Minute)[a3]; s != (FlowStats{2, 8, 10}) {
+		t.Fatalf("Unexpected recent flow for %x: %v", a3, s)
+	}
+
+	var b bytes.Buffer
+	err := f.writePrometheus(&b, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"# TYPE autoroute_flow_packets_total counter",
+		fmt.Sprintf("autoroute_flow_packets_total{direction=\"source\",address=\"%x\"} 2", a1),
+		fmt.Sprintf("autoroute_flow_amount_total{direction=\"destination\",address=\"%x\"} 15", a3),
+		fmt.Sprintf("autoroute_flow_bytes_recent{direction=\"source\",address=\"%x\",window=\"1m0s\"} 4", a1),
+		fmt.Sprintf("autoroute_flow_packets_recent{direction=\"source\",address=\"%x\",window=\"1h0m0s\"} 1", a2),
+	} {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Fatalf("Expected %q in\n%s", line, b.String())
+		}
+	}
+}
+
+func TestFlowAccountingDecisions(t *testing.T) {
+	c := make(chan routingDecision)
+	f := newFlowAccounting(c, SystemClock())
+	defer f.Close()
+	a1, a2 := types.NodeAddress("1"), types.NodeAddress("2")
+
+	c <- newRoutingDecision(types.Packet{Dest: a2, Amt: 3, Data: []byte("data")}, a1, a2, 4)
+	timeout := time.After(time.Second)
+	for f.DestinationFlows()[a2].Packets != 1 {
+		select {
+		case <-timeout:
+			t.Fatal("Routing decision never counted")
+		case <-time.After(time.Millisecond):
+		}
+	}
+}
@@ -15,11 +15,16 @@ type ReceiptConnection interface {
 	SendReceipt(PacketReceipt) error
 	PacketReceipts() <-chan PacketReceipt
 }
+type PaymentConnection interface {
+	SendPaymentNotification(PaymentNotification) error
+	PaymentNotifications() <-chan PaymentNotification
+}
 
-// While the two connections use different messages, a working ControlConnection has both interfaces
+// While the connections use different messages, a working ControlConnection has all the interfaces
 type ControlConnection interface {
 	MapConnection
 	ReceiptConnection
+	PaymentConnection
 }
 
 // The actual data connection. Should be done at the layer two level in order to be able to send congestion signals
@@ -63,6 +68,6 @@ type routingAlgorithm interface {
 // Interface for something that can log routing decisions
 type Logger interface {
 	LogBloomFilter(*BloomReachabilityMap) error
-	LogRoutingDecision(types.NodeAddress, types.NodeAddress, int, int64, types.PacketHash) error
+	LogRoutingDecision(types.NodeAddress, types.NodeAddress, types.NodeAddress, int, int64, types.PacketHash) error
 	LogPacketReceipt(types.PacketHash) error
 }
@@ -3,10 +3,16 @@ package internal
 import (
 	"log"
 	"sync"
+	"time"
 
 	"github.com/AutoRoute/node/types"
 )
 
+// The most unacknowledged payments, unconfirmed notifications and
+// discrepancies kept for each neighbor. Past this the oldest unacknowledged
+// payments and discrepancies are forgotten, and new notifications dropped.
+const max_unreconciled = 64
+
 // This keeps track of our outstanding owed payments and provides an interface
 // to send payments. It does not create payments on its own.
 // There are really only a few interesting pieces of data you will want to
@@ -20,17 +26,55 @@ type Ledger struct {
 	outgoing_debt    map[types.NodeAddress]int64
 	packets          map[types.PacketHash]routingDecision
 	payment_channels map[string]chan uint64
-	l                *sync.Mutex
-	id               types.NodeAddress
-	quit             chan bool
+
+	// Payment reconciliation state.
+	// Total we have paid each neighbor.
+	paid map[types.NodeAddress]int64
+	// Total we have seen arrive from each neighbor.
+	received map[types.NodeAddress]int64
+	// The number of payments we have made to each neighbor.
+	periods map[types.NodeAddress]uint64
+	// Notifications we sent, kept until they are acknowledged.
+	sent map[types.NodeAddress]map[uint64]PaymentNotification
+	// Notifications we received for payments we haven't seen arrive yet.
+	unseen map[types.NodeAddress][]PaymentNotification
+	// Acknowledgements which need to be signed and sent back.
+	acks          chan paymentAck
+	discrepancies []Discrepancy
+
+	// What each neighbor owed us last time we checked, and since when it
+	// hasn't paid any of it down.
+	last_incoming map[types.NodeAddress]int64
+	unpaid_since  map[types.NodeAddress]time.Time
+	reputation    *Reputation
+
+	l    *sync.Mutex
+	id   types.NodeAddress
+	quit chan bool
+}
+
+// An unsigned acknowledgement and the neighbor it should be sent to.
+type paymentAck struct {
+	payer types.NodeAddress
+	ack   PaymentNotification
 }
 
-func newLedger(id types.NodeAddress, c <-chan types.PacketHash, d <-chan routingDecision) *Ledger {
+func newLedger(id types.NodeAddress, c <-chan types.PacketHash, d <-chan routingDecision, reputation *Reputation) *Ledger {
 	p := &Ledger{
 		make(map[types.NodeAddress]int64),
 		make(map[types.NodeAddress]int64),
 		make(map[types.PacketHash]routingDecision),
 		make(map[string]chan uint64),
+		make(map[types.NodeAddress]int64),
+		make(map[types.NodeAddress]int64),
+		make(map[types.NodeAddress]uint64),
+		make(map[types.NodeAddress]map[uint64]PaymentNotification),
+		make(map[types.NodeAddress][]PaymentNotification),
+		make(chan paymentAck),
+		nil,
+		make(map[types.NodeAddress]int64),
+		make(map[types.NodeAddress]time.Time),
+		reputation,
 		&sync.Mutex{},
 		id,
 		make(chan bool),
@@ -52,6 +96,28 @@ func (p *Ledger) OutgoingDebt(n types.NodeAddress) int64 {
 	return p.outgoing_debt[n]
 }
 
+func copyDebts(debts map[types.NodeAddress]int64) map[types.NodeAddress]int64 {
+	o := make(map[types.NodeAddress]int64)
+	for n, d := range debts {
+		o[n] = d
+	}
+	return o
+}
+
+// Returns what every neighbor owes us.
+func (p *Ledger) IncomingDebts() map[types.NodeAddress]int64 {
+	p.l.Lock()
+	defer p.l.Unlock()
+	return copyDebts(p.incoming_debt)
+}
+
+// Returns what we owe every neighbor.
+func (p *Ledger) OutgoingDebts() map[types.NodeAddress]int64 {
+	p.l.Lock()
+	defer p.l.Unlock()
+	return copyDebts(p.outgoing_debt)
+}
+
 func (p *Ledger) AddAddress(address string, c chan uint64) {
 	p.l.Lock()
 	defer p.l.Unlock()
@@ -60,6 +126,7 @@ func (p *Ledger) AddAddress(address string, c chan uint64) {
 
 func (p *Ledger) AddConnection(n types.NodeAddress, c Connection) {
 	go p.handlePayments(n, c)
+	go p.handleNotifications(n, c)
 }
 
 func (p *Ledger) handleReceipt(c <-chan types.PacketHash) {
@@ -105,7 +172,10 @@ func (p *Ledger) handlePayments(n types.NodeAddress, c Connection) {
 			log.Printf("Received payment of %d to %q", amount, c.MetaData().Payment_Address)
 			p.l.Lock()
 			p.incoming_debt[n] -= int64(amount)
+			p.received[n] += int64(amount)
+			acks := p.checkUnseen(n)
 			p.l.Unlock()
+			p.sendAcks(n, acks)
 		case <-p.quit:
 			return
 		}
@@ -114,13 +184,218 @@ func (p *Ledger) handlePayments(n types.NodeAddress, c Connection) {
 
 // Waits for the payment to be confirmed and records it in the Ledger.
 func (p *Ledger) RecordPayment(destination types.NodeAddress, amount int64, confirmed chan bool) {
+	p.RecordTransaction(destination, "", "", amount, confirmed)
+}
+
+// Waits for a payment made in the given transaction to be confirmed and
+// records it in the Ledger. Returns whether it was confirmed and, if so, an
+// unsigned notification describing it which should be sent to the payee.
+func (p *Ledger) RecordTransaction(destination types.NodeAddress, transaction, address string, amount int64, confirmed chan bool) (PaymentNotification, bool) {
 	ok := <-confirmed
-	if ok {
-		p.l.Lock()
-		p.incoming_debt[p.id] -= amount
-		p.outgoing_debt[destination] -= amount
+	if !ok {
+		return PaymentNotification{}, false
+	}
+	p.l.Lock()
+	defer p.l.Unlock()
+	debt := p.outgoing_debt[destination]
+	p.outgoing_debt[destination] -= amount
+	p.paid[destination] += amount
+	p.periods[destination]++
+	n := PaymentNotification{
+		Transaction: transaction,
+		Address:     address,
+		Amount:      amount,
+		Period:      p.periods[destination],
+		Debt:        debt,
+		TotalPaid:   p.paid[destination],
+	}
+	if p.sent[destination] == nil {
+		p.sent[destination] = make(map[uint64]PaymentNotification)
+	}
+	p.sent[destination][n.Period] = n
+	if n.Period > max_unreconciled {
+		delete(p.sent[destination], n.Period-max_unreconciled)
+	}
+	return n, true
+}
+
+func (p *Ledger) handleNotifications(n types.NodeAddress, c Connection) {
+	for {
+		select {
+		case notification, ok := <-c.PaymentNotifications():
+			if !ok {
+				return
+			}
+			if err := notification.Verify(); err != nil {
+				log.Printf("Error verifying payment notification from %x: %v", n, err)
+				p.reputation.Report(n, BadSignature)
+				continue
+			}
+			if notification.Source() != n {
+				log.Printf("Payment notification from %x signed by %x", n, notification.Source())
+				p.reputation.Report(n, BadSignature)
+				continue
+			}
+			if notification.Ack {
+				p.handleAck(n, notification)
+			} else {
+				p.handleNotification(n, c.MetaData().Payment_Address, notification)
+			}
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// Handles a neighbor telling us it has paid us.
+func (p *Ledger) handleNotification(n types.NodeAddress, address string, notification PaymentNotification) {
+	p.l.Lock()
+	if notification.Address != address {
+		p.flag(Discrepancy{n, notification.Period, notification.Transaction,
+			"payment made to unknown address " + notification.Address, 0, notification.Amount})
+	}
+	if len(p.unseen[n]) >= max_unreconciled {
+		log.Printf("Dropping payment notification from %x: too many unconfirmed", n)
 		p.l.Unlock()
+		return
+	}
+	p.unseen[n] = append(p.unseen[n], notification)
+	acks := p.checkUnseen(n)
+	p.l.Unlock()
+	p.sendAcks(n, acks)
+}
+
+// Acknowledges every notification from n whose payment has now arrived,
+// comparing the neighbor's view of the debt with ours. Must be called with the
+// lock held.
+func (p *Ledger) checkUnseen(n types.NodeAddress) []PaymentNotification {
+	acks := make([]PaymentNotification, 0)
+	remaining := make([]PaymentNotification, 0)
+	for _, notification := range p.unseen[n] {
+		if p.received[n] < notification.TotalPaid {
+			remaining = append(remaining, notification)
+			continue
+		}
+		// Undo every payment received since the one before this notification
+		// to find what we think was owed when it was made. Receipts reach us
+		// before the payer and more traffic may have been billed since, so our
+		// view can only legitimately be larger.
+		debt := p.incoming_debt[n] + p.received[n] - (notification.TotalPaid - notification.Amount)
+		if debt < notification.Debt {
+			p.flag(Discrepancy{n, notification.Period, notification.Transaction,
+				"disagreement about debt", debt, notification.Debt})
+		}
+		acks = append(acks, PaymentNotification{
+			Transaction: notification.Transaction,
+			Address:     notification.Address,
+			Amount:      notification.Amount,
+			Period:      notification.Period,
+			Debt:        debt,
+			TotalPaid:   p.received[n],
+			Ack:         true,
+		})
+	}
+	p.unseen[n] = remaining
+	return acks
+}
+
+func (p *Ledger) sendAcks(n types.NodeAddress, acks []PaymentNotification) {
+	for _, ack := range acks {
+		select {
+		case p.acks <- paymentAck{n, ack}:
+		case <-p.quit:
+			return
+		}
+	}
+}
+
+// Handles a neighbor acknowledging a payment we made.
+func (p *Ledger) handleAck(n types.NodeAddress, ack PaymentNotification) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	sent, ok := p.sent[n][ack.Period]
+	if !ok {
+		p.flag(Discrepancy{n, ack.Period, ack.Transaction,
+			"acknowledgement of unknown payment", 0, ack.Amount})
+		return
+	}
+	delete(p.sent[n], ack.Period)
+	if ack.Amount != sent.Amount || ack.Transaction != sent.Transaction {
+		p.flag(Discrepancy{n, ack.Period, ack.Transaction,
+			"acknowledgement of a different payment", sent.Amount, ack.Amount})
+	}
+	if ack.TotalPaid < sent.TotalPaid {
+		p.flag(Discrepancy{n, ack.Period, ack.Transaction,
+			"payee has received less than we paid", sent.TotalPaid, ack.TotalPaid})
 	}
+	if ack.Debt < sent.Debt {
+		p.flag(Discrepancy{n, ack.Period, ack.Transaction,
+			"disagreement about debt", sent.Debt, ack.Debt})
+	}
+}
+
+// Records a discrepancy, forgetting the neighbor's oldest one if it has too
+// many. Must be called with the lock held.
+func (p *Ledger) flag(d Discrepancy) {
+	log.Printf("Payment discrepancy with %v", d)
+	oldest := -1
+	count := 0
+	for i, e := range p.discrepancies {
+		if e.Peer == d.Peer {
+			if oldest < 0 {
+				oldest = i
+			}
+			count++
+		}
+	}
+	if count >= max_unreconciled {
+		p.discrepancies = append(p.discrepancies[:oldest], p.discrepancies[oldest+1:]...)
+	}
+	p.discrepancies = append(p.discrepancies, d)
+}
+
+// Reports every neighbor which owes us money and hasn't paid any of it down
+// for grace, which should cover how often neighbors pay and how long their
+// payments take to confirm. Debts no bigger than holdback may be held back
+// until they are worth a transaction fee, so aren't counted. Should be called
+// periodically.
+func (p *Ledger) CheckUnpaid(now time.Time, grace time.Duration, holdback int64) {
+	p.l.Lock()
+	defer p.l.Unlock()
+	for n, owed := range p.incoming_debt {
+		if n == p.id {
+			continue
+		}
+		paid_down := owed < p.last_incoming[n]
+		p.last_incoming[n] = owed
+		if owed <= holdback || paid_down {
+			delete(p.unpaid_since, n)
+			continue
+		}
+		since, ok := p.unpaid_since[n]
+		if !ok {
+			p.unpaid_since[n] = now
+			continue
+		}
+		if now.Sub(since) >= grace {
+			p.reputation.Report(n, UnpaidDebt)
+			p.unpaid_since[n] = now
+		}
+	}
+}
+
+// Returns acknowledgements of payments made to us, which should be signed and
+// sent back to the payer.
+func (p *Ledger) PaymentAcks() <-chan paymentAck {
+	return p.acks
+}
+
+// Returns the disagreements found between our books and our neighbors',
+// oldest first. Only the most recent ones are kept for each neighbor.
+func (p *Ledger) Discrepancies() []Discrepancy {
+	p.l.Lock()
+	defer p.l.Unlock()
+	return append([]Discrepancy(nil), p.discrepancies...)
 }
 
 func (p *Ledger) Close() error {
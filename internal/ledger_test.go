@@ -49,7 +49,7 @@ func TestLedger(t *testing.T) {
 
 	routed := make(chan routingDecision)
 
-	Ledger := newLedger(a1, delivered, routed)
+	Ledger := newLedger(a1, delivered, routed, newMemoryReputation())
 	defer Ledger.Close()
 
 	// two packets from a1 to a2
@@ -76,26 +76,74 @@ func TestLedger(t *testing.T) {
 	WaitForIncomingDebt(t, Ledger, a1, owed)
 	WaitForOutgoingDebt(t, Ledger, a2, owed)
 
-	// We pay for some of it.
+	// We pay for some of it. Paying a neighbor doesn't change what is owed to
+	// us.
+	owing := owed
 	c := make(chan bool, 1)
 	c <- true
 	Ledger.RecordPayment(a2, 4, c)
-	owed -= 4
+	owing -= 4
 
 	WaitForIncomingDebt(t, Ledger, a1, owed)
-	WaitForOutgoingDebt(t, Ledger, a2, owed)
+	WaitForOutgoingDebt(t, Ledger, a2, owing)
 
 	// We send a payment which is never accepted.
 	c <- false
 	Ledger.RecordPayment(a2, 4, c)
 	WaitForIncomingDebt(t, Ledger, a1, owed)
-	WaitForOutgoingDebt(t, Ledger, a2, owed)
+	WaitForOutgoingDebt(t, Ledger, a2, owing)
 
 	// We pay for the rest.
 	c <- true
-	Ledger.RecordPayment(a2, owed, c)
-	owed -= owed
+	Ledger.RecordPayment(a2, owing, c)
+	owing -= owing
 
 	WaitForIncomingDebt(t, Ledger, a1, owed)
-	WaitForOutgoingDebt(t, Ledger, a2, owed)
+	WaitForOutgoingDebt(t, Ledger, a2, owing)
+}
+
+func TestLedgerBounded(t *testing.T) {
+	Ledger := newLedger("1", make(chan types.PacketHash), make(chan routingDecision), newMemoryReputation())
+	defer Ledger.Close()
+
+	// Notifications of payments which never arrive, to the wrong address.
+	for i := 1; i <= 2*max_unreconciled; i++ {
+		Ledger.handleNotification("2", "address", PaymentNotification{
+			Address: "other", Amount: 1, Period: uint64(i), TotalPaid: int64(i)})
+	}
+	if l := len(Ledger.unseen["2"]); l != max_unreconciled {
+		t.Fatalf("Kept %d unconfirmed notifications", l)
+	}
+	d := Ledger.Discrepancies()
+	if len(d) != max_unreconciled || d[len(d)-1].Period != 2*max_unreconciled {
+		t.Fatalf("Kept %d discrepancies, the last %v", len(d), d[len(d)-1])
+	}
+
+	// Payments which are never acknowledged.
+	for i := 0; i < 2*max_unreconciled; i++ {
+		confirmed := make(chan bool, 1)
+		confirmed <- true
+		Ledger.RecordTransaction("3", "", "", 1, confirmed)
+	}
+	if l := len(Ledger.sent["3"]); l != max_unreconciled {
+		t.Fatalf("Kept %d unacknowledged payments", l)
+	}
+	if _, ok := Ledger.sent["3"][2*max_unreconciled]; !ok {
+		t.Fatal("Forgot the latest payment")
+	}
+}
+
+func TestLedgerConnectionPayments(t *testing.T) {
+	Ledger := newLedger("1", make(chan types.PacketHash), make(chan routingDecision), newMemoryReputation())
+	defer Ledger.Close()
+	payments := make(chan uint64)
+	Ledger.AddAddress("addr", payments)
+
+	sk1, _ := NewECDSAKey()
+	sk2, _ := NewECDSAKey()
+	c, _ := MakePairedConnectionsWithMetaData(sk1.PublicKey(), sk2.PublicKey(), SSHMetaData{}, SSHMetaData{Payment_Address: "addr"})
+	Ledger.AddConnection("2", c)
+
+	payments <- 5
+	WaitForIncomingDebt(t, Ledger, "2", -5)
 }
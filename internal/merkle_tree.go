@@ -12,7 +12,7 @@ import (
 func CreateMerkleReceipt(key PrivateKey, packets []types.PacketHash) PacketReceipt {
 	old := make([]merklenode, 0)
 	for _, h := range packets {
-		old = append(old, merklenode{h, nil, nil})
+		old = append(old, merklenode{h, nil, nil, nil})
 	}
 
 	for {
@@ -22,11 +22,11 @@ func CreateMerkleReceipt(key PrivateKey, packets []types.PacketHash) PacketRecei
 		cur := make([]merklenode, 0)
 		for i, _ := range old {
 			if i%2 == 1 {
-				cur = append(cur, merklenode{"", &old[i], &old[i-1]})
+				cur = append(cur, merklenode{"", &old[i], &old[i-1], nil})
 			}
 		}
 		if len(old)%2 == 1 {
-			cur = append(cur, merklenode{"", &old[len(old)-1], nil})
+			cur = append(cur, merklenode{"", &old[len(old)-1], nil, nil})
 		}
 		old = cur
 	}
@@ -53,16 +53,65 @@ func (m PacketReceipt) ListPackets() []types.PacketHash {
 	return m.Tree.ListLeafs()
 }
 
+// Returns a proof that the given packets were received, covering only those
+// packets out of everything in the receipt. Every subtree without any of them
+// is replaced by its hash, so the proof stays signed by the original signature
+// while its size is logarithmic in the size of the original receipt.
+func (m PacketReceipt) Prune(packets []types.PacketHash) PacketReceipt {
+	keep := make(map[types.PacketHash]bool)
+	for _, h := range packets {
+		keep[h] = true
+	}
+	return PacketReceipt{m.Tree.prune(keep), m.Signature}
+}
+
+// A merklenode is either a leaf, an interior node, or a pruned subtree of which
+// only the hash is known.
 type merklenode struct {
 	LeafHash types.PacketHash
 	Left     *merklenode
 	Right    *merklenode
+	Pruned   []byte `json:",omitempty"`
+}
+
+func (m merklenode) contains(keep map[types.PacketHash]bool) bool {
+	if len(m.Pruned) != 0 {
+		return false
+	}
+	if len(m.LeafHash) != 0 {
+		return keep[m.LeafHash]
+	}
+	if m.Right == nil {
+		return m.Left.contains(keep)
+	}
+	return m.Left.contains(keep) || m.Right.contains(keep)
+}
+
+func (m merklenode) prune(keep map[types.PacketHash]bool) merklenode {
+	if !m.contains(keep) {
+		return merklenode{"", nil, nil, m.Hash()}
+	}
+	if len(m.LeafHash) != 0 {
+		return m
+	}
+	left := m.Left.prune(keep)
+	if m.Right == nil {
+		return merklenode{"", &left, nil, nil}
+	}
+	right := m.Right.prune(keep)
+	return merklenode{"", &left, &right, nil}
 }
 
 func (m merklenode) ListLeafs() []types.PacketHash {
+	if len(m.Pruned) != 0 {
+		return nil
+	}
 	if len(m.LeafHash) != 0 {
 		return []types.PacketHash{m.LeafHash}
 	}
+	if m.Left == nil {
+		return nil
+	}
 	if m.Right == nil {
 		return m.Left.ListLeafs()
 	}
@@ -70,10 +119,18 @@ func (m merklenode) ListLeafs() []types.PacketHash {
 }
 
 func (m merklenode) Hash() []byte {
+	if len(m.Pruned) != 0 {
+		return m.Pruned
+	}
 	if len(m.LeafHash) != 0 {
 		s := sha512.Sum512([]byte(m.LeafHash))
 		return s[0:sha512.Size]
 	}
+	if m.Left == nil {
+		// Only a malformed node from a peer is empty, and it won't verify.
+		s := sha512.Sum512(nil)
+		return s[0:sha512.Size]
+	}
 	if m.Right == nil {
 		s := sha512.Sum512(append(m.Left.Hash()))
 		return s[0:sha512.Size]
@@ -83,9 +140,18 @@ func (m merklenode) Hash() []byte {
 }
 
 func (m merklenode) String() string {
+	if len(m.Pruned) > 4 {
+		return fmt.Sprintf("{pruned %x}", m.Pruned[0:4])
+	}
+	if len(m.Pruned) > 0 {
+		return fmt.Sprintf("{pruned %x}", m.Pruned)
+	}
 	if len(m.LeafHash) > 0 {
 		return fmt.Sprintf("{%x}", m.LeafHash)
 	}
+	if m.Left == nil {
+		return "{}"
+	}
 	if m.Right == nil {
 		return fmt.Sprintf("{%v nil}", *m.Left)
 	}
@@ -2,6 +2,7 @@ package internal
 
 import (
 	"encoding/json"
+	"fmt"
 	"testing"
 
 	"github.com/AutoRoute/node/types"
@@ -54,3 +55,65 @@ func TestMerkleMarshalling(t *testing.T) {
 		t.Fatal(err)
 	}
 }
+
+func TestMerklePrune(t *testing.T) {
+	k, _ := NewECDSAKey()
+	p := make([]types.PacketHash, 0)
+	for i := 0; i < 64; i++ {
+		p = append(p, types.PacketHash(fmt.Sprintf("Fo%d", i)))
+	}
+	pr := CreateMerkleReceipt(k, p)
+
+	pruned := pr.Prune([]types.PacketHash{p[5], p[40]})
+	if err := pruned.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if pruned.Source() != pr.Source() {
+		t.Fatalf("Expected %v got %v", pr.Source(), pruned.Source())
+	}
+	l := pruned.ListPackets()
+	if len(l) != 2 || (l[0] != p[5] && l[1] != p[5]) || (l[0] != p[40] && l[1] != p[40]) {
+		t.Fatalf("Expected only %v and %v got %v", p[5], p[40], l)
+	}
+
+	full, _ := json.Marshal(pr)
+	small, _ := json.Marshal(pruned)
+	if len(small) >= len(full)/2 {
+		t.Fatalf("Pruned receipt isn't much smaller %d >= %d / 2", len(small), len(full))
+	}
+
+	// A pruned receipt still verifies after being sent over the wire.
+	var m PacketReceipt
+	if err := json.Unmarshal(small, &m); err != nil {
+		t.Fatal(err)
+	}
+	if err := m.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if len(m.ListPackets()) != 2 {
+		t.Fatalf("Expected 2 packets got %v", m.ListPackets())
+	}
+
+	if empty := pr.Prune(nil); empty.Verify() != nil || len(empty.ListPackets()) != 0 {
+		t.Fatalf("Expected an empty proof got %v", empty.ListPackets())
+	}
+}
+
+// Malformed nodes from peers can be printed and hashed without panicking.
+func TestMerkleMalformed(t *testing.T) {
+	for _, c := range []struct {
+		m merklenode
+		s string
+	}{
+		{merklenode{Pruned: []byte{1, 2}}, "{pruned 0102}"},
+		{merklenode{Pruned: []byte{1, 2, 3, 4, 5}}, "{pruned 01020304}"},
+		{merklenode{}, "{}"},
+	} {
+		if s := c.m.String(); s != c.s {
+			t.Fatalf("Expected %s got %s", c.s, s)
+		}
+		if len(c.m.Hash()) == 0 || len(c.m.ListLeafs()) != 0 {
+			t.Fatalf("Unexpected hash or leafs for %s", c.s)
+		}
+	}
+}
@@ -0,0 +1,172 @@
+package internal
+
+import (
+	"fmt"
+	"io"
+	"math"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Buckets for histograms measured in seconds, from a tenth of a millisecond
+// to a few minutes.
+var latency_buckets = []float64{.0001, .0005, .001, .005, .01, .05, .1, .5, 1, 5, 30, 120}
+
+// Buckets for histograms of small counts such as queue depths.
+var depth_buckets = []float64{0, 1, 2, 4, 8, 16, 32, 64, 128}
+
+// Metrics is a registry of a single node's metrics. Keeping one per node rather
+// than using package level state means several nodes in one process don't mix
+// their numbers. Everything registered can be exported in the Prometheus text
+// exposition format.
+type Metrics struct {
+	l          *sync.Mutex
+	collectors []func(io.Writer) error
+}
+
+func NewMetrics() *Metrics {
+	return &Metrics{&sync.Mutex{}, nil}
+}
+
+// Registers a function which writes some metrics in the Prometheus text
+// format whenever the registry is exported.
+func (m *Metrics) Register(c func(io.Writer) error) {
+	m.l.Lock()
+	defer m.l.Unlock()
+	m.collectors = append(m.collectors, c)
+}
+
+// Writes every registered metric in the Prometheus text format.
+func (m *Metrics) WritePrometheus(w io.Writer) error {
+	m.l.Lock()
+	collectors := append([]func(io.Writer) error(nil), m.collectors...)
+	m.l.Unlock()
+	for _, c := range collectors {
+		err := c(w)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func writeHeader(w io.Writer, name, help, kind string) error {
+	_, err := fmt.Fprintf(w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+	return err
+}
+
+// A Counter is a value which only goes up.
+type Counter struct {
+	l     *sync.Mutex
+	value float64
+}
+
+func (m *Metrics) NewCounter(name, help string) *Counter {
+	c := &Counter{&sync.Mutex{}, 0}
+	m.Register(func(w io.Writer) error {
+		err := writeHeader(w, name, help, "counter")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintf(w, "%s %v\n", name, c.Value())
+		return err
+	})
+	return c
+}
+
+func (c *Counter) Add(v float64) {
+	c.l.Lock()
+	defer c.l.Unlock()
+	c.value += v
+}
+
+func (c *Counter) Inc() {
+	c.Add(1)
+}
+
+func (c *Counter) Value() float64 {
+	c.l.Lock()
+	defer c.l.Unlock()
+	return c.value
+}
+
+// Registers a gauge whose values are computed when exported, one per label
+// value. This suits things like debts which already live elsewhere.
+func (m *Metrics) NewGaugeFunc(name, help, label string, f func() map[string]float64) {
+	m.Register(func(w io.Writer) error {
+		err := writeHeader(w, name, help, "gauge")
+		if err != nil {
+			return err
+		}
+		values := f()
+		keys := make([]string, 0, len(values))
+		for k := range values {
+			keys = append(keys, k)
+		}
+		sort.Strings(keys)
+		for _, k := range keys {
+			_, err = fmt.Fprintf(w, "%s{%s=%q} %v\n", name, label, k, values[k])
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+}
+
+// A Histogram counts observations into buckets.
+type Histogram struct {
+	l       *sync.Mutex
+	buckets []float64
+	// counts[i] is the number of observations no larger than buckets[i].
+	counts []uint64
+	count  uint64
+	sum    float64
+}
+
+func (m *Metrics) NewHistogram(name, help string, buckets []float64) *Histogram {
+	h := &Histogram{&sync.Mutex{}, buckets, make([]uint64, len(buckets)), 0, 0}
+	m.Register(func(w io.Writer) error {
+		err := writeHeader(w, name, help, "histogram")
+		if err != nil {
+			return err
+		}
+		h.l.Lock()
+		defer h.l.Unlock()
+		for i, b := range h.buckets {
+			fmt.Fprintf(w, "%s_bucket{le=\"%v\"} %d\n", name, b, h.counts[i])
+		}
+		fmt.Fprintf(w, "%s_bucket{le=\"+Inf\"} %d\n", name, h.count)
+		fmt.Fprintf(w, "%s_sum %v\n", name, h.sum)
+		_, err = fmt.Fprintf(w, "%s_count %d\n", name, h.count)
+		return err
+	})
+	return h
+}
+
+func (h *Histogram) Observe(v float64) {
+	h.l.Lock()
+	defer h.l.Unlock()
+	for i, b := range h.buckets {
+		if v <= b {
+			h.counts[i]++
+		}
+	}
+	h.count++
+	if !math.IsNaN(v) {
+		h.sum += v
+	}
+}
+
+// Observes how long it has been since start in seconds.
+func (h *Histogram) ObserveSince(start time.Time) {
+	h.Observe(time.Since(start).Seconds())
+}
+
+// Returns the number of observations so far.
+func (h *Histogram) Count() uint64 {
+	h.l.Lock()
+	defer h.l.Unlock()
+	return h.count
+}
@@ -0,0 +1,89 @@
+package internal
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AutoRoute/node/types"
+)
+
+func expectMetrics(t *testing.T, m *Metrics, lines ...string) {
+	var b bytes.Buffer
+	err := m.WritePrometheus(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range lines {
+		if !strings.Contains(b.String(), line+"\n") {
+			t.Fatalf("Expected %q in\n%s", line, b.String())
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	m := NewMetrics()
+	c := m.NewCounter("test_total", "A counter.")
+	h := m.NewHistogram("test_seconds", "A histogram.", []float64{1, 2})
+	m.NewGaugeFunc("test_gauge", "A gauge.", "neighbor", func() map[string]float64 {
+		return map[string]float64{"b": 2, "a": -1}
+	})
+
+	c.Inc()
+	c.Add(2)
+	h.Observe(0.5)
+	h.Observe(1.5)
+	h.Observe(10)
+
+	expectMetrics(t, m,
+		"# TYPE test_total counter",
+		"test_total 3",
+		"# TYPE test_seconds histogram",
+		`test_seconds_bucket{le="1"} 1`,
+		`test_seconds_bucket{le="2"} 2`,
+		`test_seconds_bucket{le="+Inf"} 3`,
+		"test_seconds_sum 12",
+		"test_seconds_count 3",
+		"# TYPE test_gauge gauge",
+		`test_gauge{neighbor="a"} -1`+"\n"+`test_gauge{neighbor="b"} 2`,
+	)
+}
+
+func TestNodeMetrics(t *testing.T) {
+	sk1, _ := NewECDSAKey()
+	sk2, _ := NewECDSAKey()
+	lgr1 := testLogger{0, 0, 0, &sync.Mutex{}}
+	lgr2 := testLogger{0, 0, 0, &sync.Mutex{}}
+	n1 := NewNode(sk1, FakeMoney{}, time.Tick(10*time.Millisecond), time.Tick(time.Hour), &lgr1)
+	n2 := NewNode(sk2, FakeMoney{}, time.Tick(10*time.Millisecond), time.Tick(time.Hour), &lgr2)
+	defer n1.Close()
+	defer n2.Close()
+	Link(n1, n2)
+
+	p := types.Packet{Dest: sk2.PublicKey().Hash(), Amt: 3, Data: []byte("data")}
+	err := n1.SendPacket(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-n2.Packets()
+	waitForDebts(t, n1, n2, 3)
+
+	// Each node only counts its own packets.
+	m1, m2 := n1.router.Metrics(), n2.router.Metrics()
+	expectMetrics(t, m1,
+		"autoroute_packets_forwarded_total 1",
+		"autoroute_packets_delivered_total 0",
+		"autoroute_forwarding_latency_seconds_count 1",
+		"autoroute_queue_depth_count 1",
+		"autoroute_receipt_delay_seconds_count 1",
+		`autoroute_outgoing_debt{neighbor="`+fmt.Sprintf("%x", sk2.PublicKey().Hash())+`"} 3`,
+	)
+	expectMetrics(t, m2,
+		"autoroute_packets_forwarded_total 0",
+		"autoroute_packets_delivered_total 1",
+		`autoroute_incoming_debt{neighbor="`+fmt.Sprintf("%x", sk1.PublicKey().Hash())+`"} 3`,
+	)
+}
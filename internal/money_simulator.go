@@ -0,0 +1,203 @@
+package internal
+
+import (
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+// A MoneySimulator is an in process stand in for a bitcoin network. Every node
+// gets its own SimulatedWallet, payments between wallets take a configurable
+// time to confirm, and failures can be injected to see how the rest of the
+// system copes.
+type MoneySimulator struct {
+	l *sync.Mutex
+	// Which wallet owns each address.
+	owners map[string]*SimulatedWallet
+	// Total amount paid to each address.
+	received map[string]int64
+	// Channels notified whenever an address receives money.
+	watchers map[string]chan uint64
+	// How long a payment takes to confirm.
+	confirmation_delay time.Duration
+	// The fee charged for each output of a transaction.
+	fee_per_output int64
+	// The number of upcoming payments to reject outright.
+	reject int
+	// The number of upcoming payments which will never confirm.
+	drop             int
+	next_address     int
+	next_transaction int
+	clock            Clock
+}
+
+func NewMoneySimulator(confirmation_delay time.Duration) *MoneySimulator {
+	return NewMoneySimulatorWithClock(confirmation_delay, SystemClock())
+}
+
+// Creates a MoneySimulator whose confirmation delays are timed by clock.
+func NewMoneySimulatorWithClock(confirmation_delay time.Duration, clock Clock) *MoneySimulator {
+	return &MoneySimulator{
+		&sync.Mutex{},
+		make(map[string]*SimulatedWallet),
+		make(map[string]int64),
+		make(map[string]chan uint64),
+		confirmation_delay,
+		0,
+		0,
+		0,
+		0,
+		0,
+		clock,
+	}
+}
+
+// Creates a new wallet starting with the given balance in satoshis.
+func (s *MoneySimulator) NewWallet(balance int64) *SimulatedWallet {
+	return &SimulatedWallet{s, balance}
+}
+
+func (s *MoneySimulator) SetConfirmationDelay(d time.Duration) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.confirmation_delay = d
+}
+
+// Sets the fee taken from the payer for every output of a transaction.
+func (s *MoneySimulator) SetFee(fee_per_output int64) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.fee_per_output = fee_per_output
+}
+
+// Makes the next n payments fail immediately.
+func (s *MoneySimulator) RejectPayments(n int) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.reject += n
+}
+
+// Makes the next n payments be accepted but never confirm. The payer is
+// refunded once the confirmation delay has passed.
+func (s *MoneySimulator) DropConfirmations(n int) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.drop += n
+}
+
+// Returns the total amount which has been paid to an address.
+func (s *MoneySimulator) Received(address string) int64 {
+	s.l.Lock()
+	defer s.l.Unlock()
+	return s.received[address]
+}
+
+func (s *MoneySimulator) newAddress(w *SimulatedWallet) (string, chan uint64) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	address := fmt.Sprint("sim", s.next_address)
+	s.next_address++
+	c := make(chan uint64)
+	s.owners[address] = w
+	s.watchers[address] = c
+	return address, c
+}
+
+// Makes a transaction paying every address in payments, returning its id.
+func (s *MoneySimulator) pay(w *SimulatedWallet, payments map[string]int64) (string, chan bool, error) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if s.reject > 0 {
+		s.reject--
+		return "", nil, errors.New("Payment rejected")
+	}
+	total := s.fee_per_output * int64(len(payments))
+	for address, amount := range payments {
+		if _, ok := s.owners[address]; !ok {
+			return "", nil, fmt.Errorf("Unknown address %q", address)
+		}
+		if amount <= 0 {
+			return "", nil, fmt.Errorf("Invalid amount %d", amount)
+		}
+		total += amount
+	}
+	if w.balance < total {
+		return "", nil, fmt.Errorf("Insufficient funds %d < %d", w.balance, total)
+	}
+	w.balance -= total
+
+	dropped := s.drop > 0
+	if dropped {
+		s.drop--
+	}
+	transaction := fmt.Sprint("simtx", s.next_transaction)
+	s.next_transaction++
+	c := make(chan bool, 1)
+	go s.confirm(w, payments, total, dropped, s.confirmation_delay, c)
+	return transaction, c, nil
+}
+
+func (s *MoneySimulator) confirm(w *SimulatedWallet, payments map[string]int64, total int64, dropped bool, delay time.Duration, c chan bool) {
+	s.clock.Sleep(delay)
+	s.l.Lock()
+	if dropped {
+		w.balance += total
+		s.l.Unlock()
+		close(c)
+		return
+	}
+	for address, amount := range payments {
+		s.owners[address].balance += amount
+		s.received[address] += amount
+	}
+	s.l.Unlock()
+	c <- true
+	for address, amount := range payments {
+		go func(c chan uint64, amount int64) {
+			c <- uint64(amount)
+		}(s.watchers[address], amount)
+	}
+}
+
+// A SimulatedWallet is the money system for a single node in a MoneySimulator.
+// It satisfies types.BatchMoney and types.TransactionMoney.
+type SimulatedWallet struct {
+	sim     *MoneySimulator
+	balance int64
+}
+
+func (w *SimulatedWallet) MakePayment(amount int64, destination string) (chan bool, error) {
+	_, c, err := w.sim.pay(w, map[string]int64{destination: amount})
+	return c, err
+}
+
+func (w *SimulatedWallet) MakePayments(payments map[string]int64) (chan bool, error) {
+	_, c, err := w.sim.pay(w, payments)
+	return c, err
+}
+
+func (w *SimulatedWallet) MakeTransaction(payments map[string]int64) (string, chan bool, error) {
+	return w.sim.pay(w, payments)
+}
+
+func (w *SimulatedWallet) EstimateFee(outputs int) (int64, error) {
+	w.sim.l.Lock()
+	defer w.sim.l.Unlock()
+	return w.sim.fee_per_output * int64(outputs), nil
+}
+
+// Returns a new address owned by this wallet. Every confirmed payment to it is
+// sent down the returned channel.
+func (w *SimulatedWallet) GetNewAddress() (string, chan uint64, error) {
+	address, c := w.sim.newAddress(w)
+	return address, c, nil
+}
+
+// Returns the wallet's current balance, not counting unconfirmed incoming
+// payments.
+func (w *SimulatedWallet) Balance() int64 {
+	w.sim.l.Lock()
+	defer w.sim.l.Unlock()
+	return w.balance
+}
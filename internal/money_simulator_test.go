@@ -0,0 +1,134 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AutoRoute/node/types"
+)
+
+func TestMoneySimulatorPayment(t *testing.T) {
+	clock := NewFakeClock(time.Now())
+	sim := NewMoneySimulatorWithClock(10*time.Millisecond, clock)
+	sim.SetFee(1)
+	w1, w2 := sim.NewWallet(100), sim.NewWallet(0)
+	addr, received, _ := w2.GetNewAddress()
+
+	c, err := w1.MakePayment(50, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if w1.Balance() != 49 {
+		t.Fatalf("Expected payer balance 49 got %d", w1.Balance())
+	}
+	if w2.Balance() != 0 {
+		t.Fatalf("Payment arrived before confirmation")
+	}
+	clock.BlockUntil(1)
+	clock.Advance(10 * time.Millisecond)
+	if !<-c {
+		t.Fatal("Payment failed")
+	}
+	if amt := <-received; amt != 50 {
+		t.Fatalf("Expected to receive 50 got %d", amt)
+	}
+	if w2.Balance() != 50 || sim.Received(addr) != 50 {
+		t.Fatalf("Expected payee balance 50 got %d", w2.Balance())
+	}
+
+	_, err = w1.MakePayment(50, addr)
+	if err == nil {
+		t.Fatal("Expected insufficient funds")
+	}
+	_, err = w1.MakePayment(1, "nowhere")
+	if err == nil {
+		t.Fatal("Expected unknown address")
+	}
+}
+
+func TestMoneySimulatorFailures(t *testing.T) {
+	sim := NewMoneySimulator(0)
+	w1, w2 := sim.NewWallet(100), sim.NewWallet(0)
+	addr, _, _ := w2.GetNewAddress()
+
+	sim.RejectPayments(1)
+	_, err := w1.MakePayment(10, addr)
+	if err == nil {
+		t.Fatal("Expected payment to be rejected")
+	}
+
+	sim.DropConfirmations(1)
+	c, err := w1.MakePayment(10, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if <-c {
+		t.Fatal("Expected payment to never confirm")
+	}
+	if w1.Balance() != 100 || w2.Balance() != 0 {
+		t.Fatalf("Dropped payment moved money %d %d", w1.Balance(), w2.Balance())
+	}
+
+	c, err = w1.MakePayment(10, addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !<-c {
+		t.Fatal("Payment failed")
+	}
+}
+
+func waitForDebts(t *testing.T, n1, n2 *Node, o int64) {
+	a1, a2 := n1.GetNodeAddress(), n2.GetNodeAddress()
+	timeout := time.After(5 * time.Second)
+	tick := time.Tick(10 * time.Millisecond)
+	for {
+		select {
+		case <-timeout:
+			t.Fatalf("Ledgers didn't converge to %d: n1 owes %d, n2 is owed %d", o,
+				n1.router.OutgoingDebt(a2), n2.router.IncomingDebt(a1))
+		case <-tick:
+			if n1.router.OutgoingDebt(a2) == o && n2.router.IncomingDebt(a1) == o {
+				return
+			}
+		}
+	}
+}
+
+func TestLedgerConvergence(t *testing.T) {
+	sim := NewMoneySimulator(20 * time.Millisecond)
+	w1, w2 := sim.NewWallet(1000), sim.NewWallet(0)
+	sk1, _ := NewECDSAKey()
+	sk2, _ := NewECDSAKey()
+	lgr1 := testLogger{0, 0, 0, &sync.Mutex{}}
+	lgr2 := testLogger{0, 0, 0, &sync.Mutex{}}
+	payments := make(chan time.Time)
+	n1 := NewNode(sk1, w1, time.Tick(10*time.Millisecond), payments, &lgr1)
+	n2 := NewNode(sk2, w2, time.Tick(10*time.Millisecond), time.Tick(time.Hour), &lgr2)
+	defer n1.Close()
+	defer n2.Close()
+	LinkNodes(n1, n2)
+
+	for i := 0; i < 5; i++ {
+		p := types.Packet{Dest: sk2.PublicKey().Hash(), Amt: 7, Data: []byte{byte(i)}}
+		err := n1.SendPacket(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-n2.Packets()
+	}
+	waitForDebts(t, n1, n2, 35)
+
+	// The first payment never confirms, so the debt is still owed.
+	sim.DropConfirmations(1)
+	payments <- time.Now()
+	time.Sleep(50 * time.Millisecond)
+	waitForDebts(t, n1, n2, 35)
+
+	payments <- time.Now()
+	waitForDebts(t, n1, n2, 0)
+	if w1.Balance() != 1000-35 || w2.Balance() != 35 {
+		t.Fatalf("Unexpected balances %d %d", w1.Balance(), w2.Balance())
+	}
+}
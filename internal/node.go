@@ -1,8 +1,12 @@
 package internal
 
 import (
+	"crypto/rand"
+	"encoding/binary"
+	"io"
 	"log"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/AutoRoute/node/types"
@@ -17,25 +21,79 @@ type Node struct {
 	receipt_buffer []types.PacketHash
 	receipt_ticker <-chan time.Time
 	payment_ticker <-chan time.Time
-	m              types.Money
-	quit           chan bool
+	// Receipts are sent early once this many packets are waiting for one.
+	receipt_batch_size int
+	// How long a neighbor's debt can go unpaid before it's held against it.
+	payment_grace time.Duration
+	m             types.Money
+	payments      *paymentScheduler
+	// Used to give every packet we send a distinct nonce.
+	sequence uint64
+	clock    Clock
+	quit     chan bool
 }
 
+// Settings controlling how often a Node sends receipts and payments.
+type NodeOptions struct {
+	ReceiptTicker <-chan time.Time
+	PaymentTicker <-chan time.Time
+	// Send a receipt as soon as this many packets are waiting for one, or zero
+	// to only send them when ReceiptTicker fires.
+	ReceiptBatchSize int
+	// Where to persist neighbor reputations, or empty to keep them in memory.
+	ReputationPath string
+	// How long a neighbor can leave its debt unpaid before it counts against
+	// it, which should cover how often neighbors pay and how long payments
+	// take to confirm. Zero uses default_payment_grace.
+	PaymentGrace time.Duration
+	// What the node and its router tell the time with, or nil for the system
+	// clock. The tickers above should come from the same clock.
+	Clock Clock
+}
+
+// The payment grace used when none is given, which leaves time for a payment
+// to get six confirmations ten minutes apart.
+const default_payment_grace = 2 * time.Hour
+
+// How often changed reputations are written out.
+const reputation_save_interval = time.Minute
+
 func NewNode(pk PrivateKey, m types.Money, receipt_ticker <-chan time.Time, payment_ticker <-chan time.Time, route_logger Logger) *Node {
+	return NewNodeWithOptions(pk, m, NodeOptions{receipt_ticker, payment_ticker, 0, "", 0, nil}, route_logger)
+}
+
+func NewNodeWithOptions(pk PrivateKey, m types.Money, o NodeOptions, route_logger Logger) *Node {
+	clock := clockOrDefault(o.Clock)
+	reputation, err := NewReputationWithClock(o.ReputationPath, clock)
+	if err != nil {
+		log.Printf("Error loading reputations, starting afresh: %v", err)
+		reputation, _ = NewReputationWithClock("", clock)
+	}
+	grace := o.PaymentGrace
+	if grace <= 0 {
+		grace = default_payment_grace
+	}
 	n := &Node{
-		NewRouter(pk.PublicKey(), route_logger),
+		NewRouterWithOptions(pk.PublicKey(), route_logger, RouterOptions{reputation, clock}),
 		&sync.Mutex{},
 		pk,
 		make(chan types.Packet),
 		nil,
-		receipt_ticker,
-		payment_ticker,
+		o.ReceiptTicker,
+		o.PaymentTicker,
+		o.ReceiptBatchSize,
+		grace,
 		m,
+		newPaymentScheduler(m, default_min_fee_ratio, clock),
+		randomSequence(),
+		clock,
 		make(chan bool),
 	}
 	go n.receivePackets()
 	go n.sendReceipts()
 	go n.sendPayments()
+	go n.sendPaymentAcks()
+	go n.saveReputation()
 	return n
 }
 
@@ -48,6 +106,9 @@ func (n *Node) receivePackets() {
 			}
 			n.l.Lock()
 			n.receipt_buffer = append(n.receipt_buffer, p.Hash())
+			if n.receipt_batch_size > 0 && len(n.receipt_buffer) >= n.receipt_batch_size {
+				n.flushReceipts()
+			}
 			n.l.Unlock()
 			n.outgoing <- p
 		case <-n.quit:
@@ -61,11 +122,7 @@ func (n *Node) sendReceipts() {
 		select {
 		case <-n.receipt_ticker:
 			n.l.Lock()
-			if len(n.receipt_buffer) > 0 {
-				r := CreateMerkleReceipt(n.id, n.receipt_buffer)
-				n.receipt_buffer = nil
-				n.router.SendReceipt(r)
-			}
+			n.flushReceipts()
 			n.l.Unlock()
 		case <-n.quit:
 			return
@@ -73,25 +130,34 @@ func (n *Node) sendReceipts() {
 	}
 }
 
+// Sends a receipt for every buffered packet. Must be called with the lock held.
+func (n *Node) flushReceipts() {
+	if len(n.receipt_buffer) > 0 {
+		r := CreateMerkleReceipt(n.id, n.receipt_buffer)
+		n.receipt_buffer = nil
+		n.router.SendReceipt(r)
+	}
+}
+
 func (n *Node) sendPayments() {
 	for {
 		select {
 		case <-n.payment_ticker:
+			n.router.CheckUnpaid(n.clock.Now(), n.payment_grace, n.payments.holdback())
 			n.l.Lock()
+			debts := make([]debt, 0)
 			for _, c := range n.router.Connections() {
 				owed := n.router.OutgoingDebt(c.Key().Hash())
 				log.Printf("Owe %x %d", c.Key().Hash(), owed)
 				if owed > 0 {
-					log.Printf("Sending payment to %s", c.OtherMetaData().Payment_Address)
-					p, err := n.m.MakePayment(owed, c.OtherMetaData().Payment_Address)
-					if err != nil {
-						log.Printf("Failed to make a payment to %x (%x) : %v",
-							c.Key().Hash(), c.OtherMetaData().Payment_Address, err)
-						break
-					}
-					go n.router.RecordPayment(c.Key().Hash(), owed, p)
+					debts = append(debts, debt{c.Key().Hash(), c.OtherMetaData().Payment_Address, owed, ""})
 				}
 			}
+			paid, confirmations := n.payments.Pay(debts)
+			for _, d := range paid {
+				log.Printf("Sending payment of %d to %s", d.amount, d.address)
+				go n.recordPayment(d, confirmations[d.id])
+			}
 			n.l.Unlock()
 		case <-n.quit:
 			return
@@ -99,8 +165,129 @@ func (n *Node) sendPayments() {
 	}
 }
 
+func (n *Node) recordPayment(d debt, confirmed chan bool) {
+	notification, ok := n.router.RecordTransaction(d.id, d.transaction, d.address, d.amount, confirmed)
+	n.payments.Settled(d)
+	if !ok {
+		return
+	}
+	err := n.router.SendPaymentNotification(d.id, SignPaymentNotification(n.id, notification))
+	if err != nil {
+		log.Printf("Failed to notify %x of payment: %v", d.id, err)
+	}
+}
+
+// Signs and returns acknowledgements of payments made to us.
+func (n *Node) sendPaymentAcks() {
+	for {
+		select {
+		case a := <-n.router.PaymentAcks():
+			err := n.router.SendPaymentNotification(a.payer, SignPaymentNotification(n.id, a.ack))
+			if err != nil {
+				log.Printf("Failed to acknowledge payment: %v", err)
+			}
+		case <-n.quit:
+			return
+		}
+	}
+}
+
+// Periodically writes out changed reputations, and does so one last time when
+// the node is closed.
+func (n *Node) saveReputation() {
+	tick := n.clock.Tick(reputation_save_interval)
+	for {
+		select {
+		case <-tick:
+		case <-n.quit:
+			return
+		}
+		err := n.router.Reputation().Save()
+		if err != nil {
+			log.Printf("Error saving reputation: %v", err)
+		}
+	}
+}
+
+// Returns how well a neighbor has behaved, negative meaning badly.
+func (n *Node) Reputation(id types.NodeAddress) float64 {
+	return n.router.Reputation().Score(id)
+}
+
+// Writes per source and destination traffic counters in the Prometheus text
+// format.
+func (n *Node) WriteFlows(w io.Writer) error {
+	return n.router.Flows().WritePrometheus(w)
+}
+
+// Returns this node's connection and packet counters.
+func (n *Node) Stats() *RouterStats {
+	return n.router.Stats()
+}
+
+// Writes all of this node's metrics in the Prometheus text format.
+func (n *Node) WriteMetrics(w io.Writer) error {
+	return n.router.Metrics().WritePrometheus(w)
+}
+
+// Returns what every neighbor owes us.
+func (n *Node) IncomingDebts() map[types.NodeAddress]int64 {
+	return n.router.IncomingDebts()
+}
+
+// Returns what we owe every neighbor.
+func (n *Node) OutgoingDebts() map[types.NodeAddress]int64 {
+	return n.router.OutgoingDebts()
+}
+
+// Returns every disagreement found between our payment records and our
+// neighbors'.
+func (n *Node) PaymentDiscrepancies() []Discrepancy {
+	return n.router.Discrepancies()
+}
+
+// Returns a record of the most recent payment transactions this node has
+// made.
+func (n *Node) PaymentHistory() []PaymentBatch {
+	return n.payments.Batches()
+}
+
+// Starts the nonce sequence somewhere random so a restarted node doesn't reuse
+// the nonces it used before.
+func randomSequence() uint64 {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Printf("Unable to seed packet nonces: %v", err)
+		return 0
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// Gives the packet a nonce unless the caller already chose one.
+func (n *Node) addNonce(p types.Packet) types.Packet {
+	for p.Nonce == 0 {
+		p.Nonce = atomic.AddUint64(&n.sequence, 1)
+	}
+	return p
+}
+
 func (n *Node) SendPacket(p types.Packet) error {
-	return n.router.SendPacket(p)
+	return n.router.SendPacket(n.addNonce(p))
+}
+
+// Sends a packet and returns a Delivery which fires once the destination's
+// receipt for it comes back, or with ErrReceiptTimeout after timeout.
+func (n *Node) SendPacketWithReceipt(p types.Packet, timeout time.Duration) (*Delivery, error) {
+	p = n.addNonce(p)
+	// Wait before sending so a fast receipt can't be missed.
+	receipted, cancel := n.router.WaitForReceipt(p.Hash())
+	err := n.router.SendPacket(p)
+	if err != nil {
+		cancel()
+		return nil, err
+	}
+	return newDelivery(p.Hash(), receipted, n.clock.After(timeout), cancel), nil
 }
 
 func (n *Node) Packets() <-chan types.Packet {
@@ -109,7 +296,7 @@ func (n *Node) Packets() <-chan types.Packet {
 
 func (n *Node) Close() error {
 	close(n.quit)
-	return nil
+	return n.router.Reputation().Save()
 }
 
 func (n *Node) GetNewAddress() string {
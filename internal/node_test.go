@@ -24,10 +24,84 @@ func TestNode(t *testing.T) {
 		t.Fatalf("n2 is not reachable")
 	}
 
-	p2 := types.Packet{sk2.PublicKey().Hash(), 3, []byte("data")}
+	p2 := types.Packet{Dest: sk2.PublicKey().Hash(), Amt: 3, Data: []byte("data")}
 	err := n1.SendPacket(p2)
 	if err != nil {
 		t.Fatalf("Error sending packet: %v", err)
 	}
 	<-n2.Packets()
 }
+
+func TestNodeNonces(t *testing.T) {
+	sk1, _ := NewECDSAKey()
+	sk2, _ := NewECDSAKey()
+	lgr1 := testLogger{0, 0, 0, &sync.Mutex{}}
+	lgr2 := testLogger{0, 0, 0, &sync.Mutex{}}
+	n1 := NewNode(sk1, FakeMoney{}, time.Tick(10*time.Millisecond), time.Tick(time.Hour), &lgr1)
+	n2 := NewNode(sk2, FakeMoney{}, time.Tick(10*time.Millisecond), time.Tick(time.Hour), &lgr2)
+	defer n1.Close()
+	defer n2.Close()
+	Link(n1, n2)
+
+	// Identical packets are billed separately.
+	p := types.Packet{Dest: sk2.PublicKey().Hash(), Amt: 3, Data: []byte("keepalive")}
+	for i := 0; i < 2; i++ {
+		err := n1.SendPacket(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	p1, p2 := <-n2.Packets(), <-n2.Packets()
+	if p1.Hash() == p2.Hash() {
+		t.Fatal("Identical packets were given the same hash")
+	}
+	waitForDebts(t, n1, n2, 6)
+}
+
+func TestNodeDelivery(t *testing.T) {
+	sk1, _ := NewECDSAKey()
+	sk2, _ := NewECDSAKey()
+	lgr1 := testLogger{0, 0, 0, &sync.Mutex{}}
+	lgr2 := testLogger{0, 0, 0, &sync.Mutex{}}
+	receipts := make(chan time.Time)
+	n1 := NewNode(sk1, FakeMoney{}, time.Tick(10*time.Millisecond), time.Tick(time.Hour), &lgr1)
+	n2 := NewNode(sk2, FakeMoney{}, receipts, time.Tick(time.Hour), &lgr2)
+	defer n1.Close()
+	defer n2.Close()
+	Link(n1, n2)
+
+	p := types.Packet{Dest: sk2.PublicKey().Hash(), Amt: 3, Data: []byte("data")}
+	d, err := n1.SendPacketWithReceipt(p, time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := <-n2.Packets(); got.Hash() != d.Hash() {
+		t.Fatalf("Expected %x got %x", got.Hash(), d.Hash())
+	}
+	// Routing decisions are recorded asynchronously, so make sure n2 knows
+	// about the packet before it sends a receipt for it.
+	for {
+		n2.router.receiptHandler.l.Lock()
+		_, ok := n2.router.receiptHandler.packets[d.Hash()]
+		n2.router.receiptHandler.l.Unlock()
+		if ok {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+	receipts <- time.Now()
+	if err := d.Wait(); err != nil {
+		t.Fatal(err)
+	}
+
+	// No receipt is sent for this one.
+	p = types.Packet{Dest: sk2.PublicKey().Hash(), Amt: 3, Data: []byte("lost")}
+	d, err = n1.SendPacketWithReceipt(p, 50*time.Millisecond)
+	if err != nil {
+		t.Fatal(err)
+	}
+	<-n2.Packets()
+	if err := d.Wait(); err != ErrReceiptTimeout {
+		t.Fatalf("Expected timeout got %v", err)
+	}
+}
@@ -0,0 +1,82 @@
+package internal
+
+import (
+	"bytes"
+	"crypto/sha512"
+	"encoding/json"
+	"errors"
+	"fmt"
+
+	"github.com/AutoRoute/node/types"
+)
+
+// A PaymentNotification is a signed statement about a payment between two
+// neighbors. The payer sends one once the payment confirms, and the payee
+// answers with an acknowledgement containing its own view of the same period
+// so that both sides can check each other's books.
+type PaymentNotification struct {
+	// The transaction the payment was made in, as identified by the payer.
+	Transaction string
+	// The address the payment was made to.
+	Address string
+	Amount  int64
+	// The number of payments between the two neighbors, including this one.
+	Period uint64
+	// The sender's view of how much was owed before this payment.
+	Debt int64
+	// The sender's view of how much has been paid in total, including this
+	// payment.
+	TotalPaid int64
+	// Whether this is the payee's acknowledgement.
+	Ack       bool
+	Signature Signature
+}
+
+// Returns the canonical hash of everything in the notification other than the
+// signature.
+func (n PaymentNotification) Hash() []byte {
+	n.Signature = Signature{}
+	b, err := json.Marshal(n)
+	if err != nil {
+		panic(err)
+	}
+	s := sha512.Sum512(b)
+	return s[0:sha512.Size]
+}
+
+func SignPaymentNotification(key PrivateKey, n PaymentNotification) PaymentNotification {
+	n.Signature = key.Sign(n.Hash())
+	return n
+}
+
+func (n PaymentNotification) Verify() error {
+	if !bytes.Equal(n.Signature.Signed(), n.Hash()) {
+		return errors.New("Signature does not match contents")
+	}
+	return n.Signature.Verify()
+}
+
+func (n PaymentNotification) Source() types.NodeAddress {
+	return n.Signature.Key().Hash()
+}
+
+func (n PaymentNotification) String() string {
+	return fmt.Sprintf("{%s %q %d period:%d debt:%d paid:%d ack:%v}", n.Transaction,
+		n.Address, n.Amount, n.Period, n.Debt, n.TotalPaid, n.Ack)
+}
+
+// A Discrepancy records a point where our books and a neighbor's disagree.
+type Discrepancy struct {
+	Peer        types.NodeAddress
+	Period      uint64
+	Transaction string
+	Reason      string
+	// Our value and the neighbor's value for whatever disagreed.
+	Ours   int64
+	Theirs int64
+}
+
+func (d Discrepancy) String() string {
+	return fmt.Sprintf("%x period %d: %s (ours %d, theirs %d)", d.Peer, d.Period,
+		d.Reason, d.Ours, d.Theirs)
+}
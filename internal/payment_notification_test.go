@@ -0,0 +1,116 @@
+package internal
+
+import (
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AutoRoute/node/types"
+)
+
+func TestPaymentNotificationSigning(t *testing.T) {
+	k, err := NewECDSAKey()
+	if err != nil {
+		t.Fatal(err)
+	}
+	n := SignPaymentNotification(k, PaymentNotification{
+		Transaction: "abc",
+		Address:     "addr",
+		Amount:      10,
+		Period:      1,
+		Debt:        15,
+		TotalPaid:   10,
+	})
+	if err := n.Verify(); err != nil {
+		t.Fatal(err)
+	}
+	if n.Source() != k.PublicKey().Hash() {
+		t.Fatalf("Expected source %x got %x", k.PublicKey().Hash(), n.Source())
+	}
+
+	n.Amount = 100
+	if n.Verify() == nil {
+		t.Fatal("Tampered notification should fail to verify")
+	}
+}
+
+func waitForAcks(t *testing.T, n *Node, peer types.NodeAddress) {
+	timeout := time.After(5 * time.Second)
+	tick := time.Tick(10 * time.Millisecond)
+	for {
+		select {
+		case <-timeout:
+			t.Fatalf("Payments to %x were never acknowledged", peer)
+		case <-tick:
+			n.router.Ledger.l.Lock()
+			paid := n.router.Ledger.periods[peer]
+			outstanding := len(n.router.Ledger.sent[peer])
+			n.router.Ledger.l.Unlock()
+			if paid > 0 && outstanding == 0 {
+				return
+			}
+		}
+	}
+}
+
+func reconciliationTest(t *testing.T) (*Node, *Node, chan time.Time) {
+	sim := NewMoneySimulator(10 * time.Millisecond)
+	sk1, _ := NewECDSAKey()
+	sk2, _ := NewECDSAKey()
+	lgr1 := testLogger{0, 0, 0, &sync.Mutex{}}
+	lgr2 := testLogger{0, 0, 0, &sync.Mutex{}}
+	payments := make(chan time.Time)
+	n1 := NewNode(sk1, sim.NewWallet(1000), time.Tick(10*time.Millisecond), payments, &lgr1)
+	n2 := NewNode(sk2, sim.NewWallet(0), time.Tick(10*time.Millisecond), time.Tick(time.Hour), &lgr2)
+	LinkNodes(n1, n2)
+
+	for i := 0; i < 3; i++ {
+		p := types.Packet{Dest: sk2.PublicKey().Hash(), Amt: 10, Data: []byte{byte(i)}}
+		err := n1.SendPacket(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		<-n2.Packets()
+	}
+	waitForDebts(t, n1, n2, 30)
+	return n1, n2, payments
+}
+
+func TestPaymentReconciliation(t *testing.T) {
+	n1, n2, payments := reconciliationTest(t)
+	defer n1.Close()
+	defer n2.Close()
+
+	payments <- time.Now()
+	waitForDebts(t, n1, n2, 0)
+	waitForAcks(t, n1, n2.GetNodeAddress())
+
+	if d := n1.PaymentDiscrepancies(); len(d) != 0 {
+		t.Fatalf("Unexpected discrepancies on payer %v", d)
+	}
+	if d := n2.PaymentDiscrepancies(); len(d) != 0 {
+		t.Fatalf("Unexpected discrepancies on payee %v", d)
+	}
+}
+
+func TestPaymentDiscrepancy(t *testing.T) {
+	n1, n2, payments := reconciliationTest(t)
+	defer n1.Close()
+	defer n2.Close()
+	a2 := n2.GetNodeAddress()
+
+	// The payer thinks it owes more than the payee ever billed.
+	n1.router.Ledger.l.Lock()
+	n1.router.Ledger.outgoing_debt[a2] += 20
+	n1.router.Ledger.l.Unlock()
+
+	payments <- time.Now()
+	waitForAcks(t, n1, a2)
+
+	if d := n1.PaymentDiscrepancies(); len(d) != 1 || d[0].Ours != 50 || d[0].Theirs != 30 {
+		t.Fatalf("Expected payer to flag the debt got %v", d)
+	}
+	if d := n2.PaymentDiscrepancies(); len(d) != 1 || d[0].Ours != 30 || d[0].Theirs != 50 {
+		t.Fatalf("Expected payee to flag the debt got %v", d)
+	}
+}
@@ -0,0 +1,262 @@
+package internal
+
+import (
+	"crypto/sha512"
+	"fmt"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/AutoRoute/node/types"
+)
+
+// By default a debt has to be worth ten times its share of the transaction fee
+// before we bother paying it.
+const default_min_fee_ratio = 10
+
+// How many of the most recent transactions are kept for the payment history.
+const max_batches = 1024
+
+// A debt we owe to a neighbor and the address it should be paid to.
+type debt struct {
+	id      types.NodeAddress
+	address string
+	amount  int64
+	// The transaction the debt was paid in, once it has been.
+	transaction string
+}
+
+// A PaymentBatch is a record of a single transaction and which debts it
+// settles.
+type PaymentBatch struct {
+	// Identifies the transaction to the neighbors it pays.
+	ID string
+	// Amount paid to each neighbor.
+	Debts map[types.NodeAddress]int64
+	// Address each neighbor was paid at.
+	Addresses map[types.NodeAddress]string
+	// Estimated fee of the transaction.
+	Fee  int64
+	Time time.Time
+}
+
+// The paymentScheduler decides which debts are worth paying and combines them
+// into as few transactions as the money system allows.
+type paymentScheduler struct {
+	m types.Money
+	// Debts smaller than min_fee_ratio times their share of the fee are held
+	// back until they grow.
+	min_fee_ratio float64
+	// The most recent transactions, used as a ring once it is full. made
+	// counts every transaction so far.
+	batches []PaymentBatch
+	made    int
+	// Amounts which have been sent but not yet confirmed, so they aren't
+	// paid a second time while we wait.
+	pending map[types.NodeAddress]int64
+	clock   Clock
+	l       *sync.Mutex
+}
+
+func newPaymentScheduler(m types.Money, min_fee_ratio float64, clock Clock) *paymentScheduler {
+	return &paymentScheduler{
+		m,
+		min_fee_ratio,
+		nil,
+		0,
+		make(map[types.NodeAddress]int64),
+		clock,
+		&sync.Mutex{},
+	}
+}
+
+// Works out the fee of a transaction with the given number of outputs, or
+// zero if the money system can't tell us.
+func (s *paymentScheduler) estimateFee(outputs int) int64 {
+	b, ok := s.m.(types.BatchMoney)
+	if !ok || outputs == 0 {
+		return 0
+	}
+	fee, err := b.EstimateFee(outputs)
+	if err != nil {
+		log.Printf("Unable to estimate fee: %v", err)
+		return 0
+	}
+	return fee
+}
+
+// Returns the largest debt a neighbor might hold back because it isn't worth
+// its share of a transaction fee yet, judging by what our own transactions
+// cost.
+func (s *paymentScheduler) holdback() int64 {
+	return int64(s.min_fee_ratio * float64(s.estimateFee(1)))
+}
+
+// Removes debts which aren't worth paying given the fee for a transaction
+// covering the remaining ones. Dropping a debt lowers the fee, so this repeats
+// until the set is stable.
+func (s *paymentScheduler) worthPaying(debts []debt, batched bool) ([]debt, int64) {
+	for {
+		outputs := 1
+		if batched {
+			outputs = len(debts)
+		}
+		fee := s.estimateFee(outputs)
+		share := float64(fee) / float64(outputs)
+		kept := make([]debt, 0, len(debts))
+		for _, d := range debts {
+			if d.amount > 0 && float64(d.amount) >= s.min_fee_ratio*share {
+				kept = append(kept, d)
+			}
+		}
+		if len(kept) == len(debts) || len(kept) == 0 {
+			if !batched {
+				fee *= int64(len(kept))
+			}
+			return kept, fee
+		}
+		debts = kept
+	}
+}
+
+// Pays the debts which are worth paying, less anything already on its way.
+// Returns the debts actually paid and a channel for each neighbor paid which
+// receives whether that payment was confirmed.
+func (s *paymentScheduler) Pay(debts []debt) ([]debt, map[types.NodeAddress]chan bool) {
+	b, batched := s.m.(types.BatchMoney)
+	s.l.Lock()
+	outstanding := make([]debt, 0, len(debts))
+	for _, d := range debts {
+		d.amount -= s.pending[d.id]
+		outstanding = append(outstanding, d)
+	}
+	s.l.Unlock()
+	debts, fee := s.worthPaying(outstanding, batched)
+	confirmations := make(map[types.NodeAddress]chan bool)
+	if len(debts) == 0 {
+		return debts, confirmations
+	}
+
+	if batched {
+		payments := make(map[string]int64)
+		for _, d := range debts {
+			payments[d.address] += d.amount
+		}
+		transaction, c, err := s.makePayments(b, payments)
+		if err != nil {
+			log.Printf("Failed to make a batched payment to %d neighbors: %v", len(debts), err)
+			return nil, confirmations
+		}
+		return s.record(transaction, c, debts, fee)
+	}
+
+	paid := make([]debt, 0, len(debts))
+	for _, d := range debts {
+		transaction, c, err := s.makePayment(d.amount, d.address)
+		if err != nil {
+			log.Printf("Failed to make a payment to %x (%x) : %v", d.id, d.address, err)
+			continue
+		}
+		recorded, confirmed := s.record(transaction, c, []debt{d}, fee/int64(len(debts)))
+		paid = append(paid, recorded...)
+		for id, c := range confirmed {
+			confirmations[id] = c
+		}
+	}
+	return paid, confirmations
+}
+
+// Pays a single destination, returning the id of the transaction if the money
+// system reports one.
+func (s *paymentScheduler) makePayment(amount int64, address string) (string, chan bool, error) {
+	if t, ok := s.m.(types.TransactionMoney); ok {
+		return t.MakeTransaction(map[string]int64{address: amount})
+	}
+	c, err := s.m.MakePayment(amount, address)
+	return "", c, err
+}
+
+// Pays several destinations in one transaction, returning its id if the money
+// system reports one.
+func (s *paymentScheduler) makePayments(b types.BatchMoney, payments map[string]int64) (string, chan bool, error) {
+	if t, ok := s.m.(types.TransactionMoney); ok {
+		return t.MakeTransaction(payments)
+	}
+	c, err := b.MakePayments(payments)
+	return "", c, err
+}
+
+// Records a transaction covering the given debts and marks them as pending
+// until Settled is called. Returns the debts tagged with the transaction and a
+// channel per debt which receives whether the transaction was confirmed.
+func (s *paymentScheduler) record(transaction string, c chan bool, debts []debt, fee int64) ([]debt, map[types.NodeAddress]chan bool) {
+	batch := PaymentBatch{
+		transaction,
+		make(map[types.NodeAddress]int64),
+		make(map[types.NodeAddress]string),
+		fee,
+		s.clock.Now(),
+	}
+	for _, d := range debts {
+		batch.Debts[d.id] += d.amount
+		batch.Addresses[d.id] = d.address
+	}
+	s.l.Lock()
+	if batch.ID == "" {
+		batch.ID = transactionID(s.made, batch)
+	}
+	tagged := make([]debt, 0, len(debts))
+	for _, d := range debts {
+		d.transaction = batch.ID
+		tagged = append(tagged, d)
+	}
+	if len(s.batches) < max_batches {
+		s.batches = append(s.batches, batch)
+	} else {
+		s.batches[s.made%max_batches] = batch
+	}
+	s.made++
+	for _, d := range debts {
+		s.pending[d.id] += d.amount
+	}
+	s.l.Unlock()
+
+	outs := make(map[types.NodeAddress]chan bool)
+	for _, d := range debts {
+		outs[d.id] = make(chan bool, 1)
+	}
+	go func() {
+		ok := <-c
+		for _, out := range outs {
+			out <- ok
+		}
+	}()
+	return tagged, outs
+}
+
+// Derives an identifier for the n'th transaction we have made, for money
+// systems which don't report their own transaction ids. It's unique enough to
+// match notifications with acknowledgements.
+func transactionID(n int, batch PaymentBatch) string {
+	h := sha512.Sum512([]byte(fmt.Sprintf("%d %d %v", n, batch.Time.UnixNano(), batch.Debts)))
+	return fmt.Sprintf("%x", h[0:8])
+}
+
+// Should be called once a payment's outcome has been recorded in the Ledger so
+// the debt stops being treated as in flight.
+func (s *paymentScheduler) Settled(d debt) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.pending[d.id] -= d.amount
+}
+
+// Returns the most recent transactions, oldest first.
+func (s *paymentScheduler) Batches() []PaymentBatch {
+	s.l.Lock()
+	defer s.l.Unlock()
+	if len(s.batches) < max_batches {
+		return append([]PaymentBatch(nil), s.batches...)
+	}
+	oldest := s.made % max_batches
+	return append(append([]PaymentBatch(nil), s.batches[oldest:]...), s.batches[:oldest]...)
+}
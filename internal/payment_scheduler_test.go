@@ -0,0 +1,152 @@
+package internal
+
+import (
+	"fmt"
+	"testing"
+
+	"github.com/AutoRoute/node/types"
+)
+
+// A BatchMoney with a fixed fee per output which records every transaction.
+type testBatchMoney struct {
+	fee_per_output int64
+	payments       []map[string]int64
+	confirm        chan bool
+}
+
+func (m *testBatchMoney) MakePayment(amount int64, destination string) (chan bool, error) {
+	return m.MakePayments(map[string]int64{destination: amount})
+}
+
+func (m *testBatchMoney) MakePayments(payments map[string]int64) (chan bool, error) {
+	m.payments = append(m.payments, payments)
+	return m.confirm, nil
+}
+
+func (m *testBatchMoney) GetNewAddress() (string, chan uint64, error) {
+	return "", make(chan uint64), nil
+}
+
+func (m *testBatchMoney) EstimateFee(outputs int) (int64, error) {
+	return m.fee_per_output * int64(outputs), nil
+}
+
+func TestPaymentSchedulerBatches(t *testing.T) {
+	m := &testBatchMoney{10, nil, make(chan bool, 1)}
+	s := newPaymentScheduler(m, 10, SystemClock())
+	a1, a2 := types.NodeAddress("1"), types.NodeAddress("2")
+
+	paid, confirmations := s.Pay([]debt{{a1, "addr1", 100, ""}, {a2, "addr2", 200, ""}})
+	if len(paid) != 2 || len(confirmations) != 2 {
+		t.Fatalf("Expected both debts to be paid got %v", paid)
+	}
+	if len(m.payments) != 1 {
+		t.Fatalf("Expected a single transaction got %d", len(m.payments))
+	}
+	if m.payments[0]["addr1"] != 100 || m.payments[0]["addr2"] != 200 {
+		t.Fatalf("Unexpected payment %v", m.payments[0])
+	}
+
+	batches := s.Batches()
+	if len(batches) != 1 {
+		t.Fatalf("Expected one batch got %d", len(batches))
+	}
+	if batches[0].Debts[a1] != 100 || batches[0].Debts[a2] != 200 || batches[0].Fee != 20 {
+		t.Fatalf("Unexpected batch %v", batches[0])
+	}
+
+	m.confirm <- true
+	for id, c := range confirmations {
+		if !<-c {
+			t.Fatalf("Payment to %s not confirmed", id)
+		}
+	}
+}
+
+func TestPaymentSchedulerThreshold(t *testing.T) {
+	m := &testBatchMoney{10, nil, make(chan bool, 1)}
+	s := newPaymentScheduler(m, 10, SystemClock())
+	a1, a2 := types.NodeAddress("1"), types.NodeAddress("2")
+
+	// The second debt is smaller than ten times its share of the fee.
+	paid, _ := s.Pay([]debt{{a1, "addr1", 100, ""}, {a2, "addr2", 99, ""}})
+	if len(paid) != 1 || paid[0].id != a1 {
+		t.Fatalf("Expected only the first debt to be paid got %v", paid)
+	}
+	if len(m.payments) != 1 || len(m.payments[0]) != 1 {
+		t.Fatalf("Unexpected payments %v", m.payments)
+	}
+
+	paid, _ = s.Pay([]debt{{a2, "addr2", 99, ""}})
+	if len(paid) != 0 || len(m.payments) != 1 {
+		t.Fatalf("Expected small debt to be held back got %v", paid)
+	}
+}
+
+func TestPaymentSchedulerPending(t *testing.T) {
+	m := &testBatchMoney{0, nil, make(chan bool, 2)}
+	s := newPaymentScheduler(m, 10, SystemClock())
+	a1 := types.NodeAddress("1")
+
+	paid, confirmations := s.Pay([]debt{{a1, "addr1", 100, ""}})
+	if len(paid) != 1 {
+		t.Fatalf("Expected debt to be paid got %v", paid)
+	}
+
+	// While the first payment is unconfirmed only new debt is paid.
+	paid, _ = s.Pay([]debt{{a1, "addr1", 150, ""}})
+	if len(paid) != 1 || paid[0].amount != 50 {
+		t.Fatalf("Expected only the new debt to be paid got %v", paid)
+	}
+
+	m.confirm <- true
+	m.confirm <- true
+	<-confirmations[a1]
+	s.Settled(debt{a1, "addr1", 100, ""})
+	s.Settled(debt{a1, "addr1", 50, ""})
+	paid, _ = s.Pay([]debt{{a1, "addr1", 10, ""}})
+	if len(paid) != 1 || paid[0].amount != 10 {
+		t.Fatalf("Expected settled debt to no longer be pending got %v", paid)
+	}
+}
+
+func TestPaymentSchedulerUnbatched(t *testing.T) {
+	s := newPaymentScheduler(FakeMoney{}, 10, SystemClock())
+	a1, a2 := types.NodeAddress("1"), types.NodeAddress("2")
+	paid, confirmations := s.Pay([]debt{{a1, "addr1", 1, ""}, {a2, "addr2", 2, ""}})
+	if len(paid) != 2 || len(s.Batches()) != 2 {
+		t.Fatalf("Expected two separate payments got %v", s.Batches())
+	}
+	for id, c := range confirmations {
+		if !<-c {
+			t.Fatalf("Payment to %s not confirmed", id)
+		}
+	}
+}
+
+func TestPaymentSchedulerTransactionID(t *testing.T) {
+	sim := NewMoneySimulator(0)
+	w := sim.NewWallet(1000)
+	addr, _, _ := sim.NewWallet(0).GetNewAddress()
+	s := newPaymentScheduler(w, 10, SystemClock())
+	a1 := types.NodeAddress("1")
+
+	paid, _ := s.Pay([]debt{{a1, addr, 100, ""}})
+	if len(paid) != 1 || paid[0].transaction != "simtx0" || s.Batches()[0].ID != "simtx0" {
+		t.Fatalf("Expected the wallet's transaction id got %v", paid)
+	}
+}
+
+func TestPaymentSchedulerHistoryBounded(t *testing.T) {
+	s := newPaymentScheduler(FakeMoney{}, 10, SystemClock())
+	for i := 0; i < max_batches+2; i++ {
+		s.Pay([]debt{{types.NodeAddress(fmt.Sprint(i)), "addr", 1, ""}})
+	}
+	batches := s.Batches()
+	if len(batches) != max_batches {
+		t.Fatalf("Kept %d transactions", len(batches))
+	}
+	if batches[0].Debts["2"] != 1 || batches[max_batches-1].Debts[types.NodeAddress(fmt.Sprint(max_batches+1))] != 1 {
+		t.Fatalf("Expected the most recent transactions oldest first got %v ... %v", batches[0], batches[max_batches-1])
+	}
+}
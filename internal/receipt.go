@@ -3,10 +3,15 @@ package internal
 import (
 	"log"
 	"sync"
+	"time"
 
 	"github.com/AutoRoute/node/types"
 )
 
+// If a packet we forward isn't receipted within this long we consider it
+// dropped by the neighbor we forwarded it to.
+const receipt_timeout = 10 * time.Minute
+
 // Takes care of handling packet receipts, namely relaying them to other
 // interested hosts and sending them to any objects which want to take action
 // on them via the ReceiptAction interface.
@@ -16,21 +21,36 @@ type receiptHandler struct {
 	l           *sync.Mutex
 	id          types.NodeAddress
 	outgoing    chan types.PacketHash
-	logger      Logger
-	quit        chan bool
+	// Channels closed when a packet we sent is receipted.
+	waiting map[types.PacketHash][]chan bool
+	// When each packet we forwarded but haven't seen a receipt for was sent.
+	unreceipted map[types.PacketHash]time.Time
+	reputation  *Reputation
+	// Time between forwarding a packet and seeing its receipt.
+	receipt_delay *Histogram
+	clock         Clock
+	logger        Logger
+	quit          chan bool
 }
 
-func newReceipt(id types.NodeAddress, c <-chan routingDecision, route_logger Logger) *receiptHandler {
+func newReceipt(id types.NodeAddress, c <-chan routingDecision, reputation *Reputation, metrics *Metrics, clock Clock, route_logger Logger) *receiptHandler {
 	r := &receiptHandler{
 		make(map[types.NodeAddress]ReceiptConnection),
 		make(map[types.PacketHash]routingDecision),
 		&sync.Mutex{},
 		id,
 		make(chan types.PacketHash),
+		make(map[types.PacketHash][]chan bool),
+		make(map[types.PacketHash]time.Time),
+		reputation,
+		metrics.NewHistogram("autoroute_receipt_delay_seconds",
+			"Time between forwarding a packet and receiving its receipt.", latency_buckets),
+		clock,
 		route_logger,
 		make(chan bool),
 	}
 	go r.sentPackets(c)
+	go r.findDropped(clock.Tick(receipt_timeout / 2))
 	return r
 }
 
@@ -61,6 +81,9 @@ func (r *receiptHandler) sentPackets(c <-chan routingDecision) {
 		case d := <-c:
 			r.l.Lock()
 			r.packets[d.hash] = d
+			if d.nexthop != r.id {
+				r.unreceipted[d.hash] = r.clock.Now()
+			}
 			r.l.Unlock()
 		case <-r.quit:
 			return
@@ -68,10 +91,60 @@ func (r *receiptHandler) sentPackets(c <-chan routingDecision) {
 	}
 }
 
+func (r *receiptHandler) findDropped(c <-chan time.Time) {
+	for {
+		select {
+		case now := <-c:
+			r.checkDropped(now)
+		case <-r.quit:
+			return
+		}
+	}
+}
+
+// Blames the next hop for every packet which should have been receipted by
+// now.
+func (r *receiptHandler) checkDropped(now time.Time) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	for hash, sent := range r.unreceipted {
+		if now.Sub(sent) < receipt_timeout {
+			continue
+		}
+		r.reputation.Report(r.packets[hash].nexthop, DroppedPacket)
+		delete(r.unreceipted, hash)
+	}
+}
+
 func (r *receiptHandler) PacketHashes() <-chan types.PacketHash {
 	return r.outgoing
 }
 
+// Returns a channel which is closed once a verified receipt for a packet we
+// sent arrives, and a function to stop waiting for it.
+func (r *receiptHandler) WaitForReceipt(hash types.PacketHash) (<-chan bool, func()) {
+	c := make(chan bool)
+	r.l.Lock()
+	r.waiting[hash] = append(r.waiting[hash], c)
+	r.l.Unlock()
+	cancel := func() {
+		r.l.Lock()
+		defer r.l.Unlock()
+		remaining := make([]chan bool, 0)
+		for _, w := range r.waiting[hash] {
+			if w != c {
+				remaining = append(remaining, w)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(r.waiting, hash)
+		} else {
+			r.waiting[hash] = remaining
+		}
+	}
+	return c, cancel
+}
+
 func (r *receiptHandler) SendReceipt(receipt PacketReceipt) {
 	r.sendReceipt(r.id, receipt)
 }
@@ -80,9 +153,14 @@ func (r *receiptHandler) sendReceipt(id types.NodeAddress, receipt PacketReceipt
 	if err := receipt.Verify(); err != nil {
 		log.Printf("Error verifying receipt from %x: %q", id, err)
 		log.Print(receipt)
+		if id != r.id {
+			r.reputation.Report(id, BadSignature)
+		}
 		return
 	}
-	dest := make(map[types.NodeAddress]bool)
+	// The packets each upstream neighbor forwarded to us.
+	dest := make(map[types.NodeAddress][]types.PacketHash)
+	valid := false
 	r.l.Lock()
 	defer r.l.Unlock()
 	for _, hash := range receipt.ListPackets() {
@@ -93,12 +171,26 @@ func (r *receiptHandler) sendReceipt(id types.NodeAddress, receipt PacketReceipt
 		}
 		if record.destination != receipt.Source() {
 			log.Printf("Invalid source %q != %q", record.source, receipt.Source())
+			r.reputation.Report(id, InvalidReceipt)
 			continue
 		}
 		if record.nexthop != id {
 			log.Printf("Received packet receipt from wrong host? %q != %q", id, record.nexthop)
+			r.reputation.Report(id, InvalidReceipt)
+			continue
+		}
+		if sent, ok := r.unreceipted[hash]; ok {
+			r.receipt_delay.Observe(r.clock.Since(sent).Seconds())
+			delete(r.unreceipted, hash)
+		}
+		valid = true
+		dest[record.source] = append(dest[record.source], hash)
+		if record.source == r.id {
+			for _, c := range r.waiting[hash] {
+				close(c)
+			}
+			delete(r.waiting, hash)
 		}
-		dest[record.source] = true
 		r.outgoing <- hash
 
 		err := r.logger.LogPacketReceipt(hash)
@@ -106,9 +198,13 @@ func (r *receiptHandler) sendReceipt(id types.NodeAddress, receipt PacketReceipt
 			log.Fatal("Couldn't log receipt?")
 		}
 	}
-	for addr, _ := range dest {
+	if valid && id != r.id {
+		r.reputation.Report(id, ValidReceipt)
+	}
+	// Each neighbor only gets proof of the packets it cares about.
+	for addr, hashes := range dest {
 		if addr != r.id {
-			r.connections[addr].SendReceipt(receipt)
+			r.connections[addr].SendReceipt(receipt.Prune(hashes))
 		}
 	}
 }
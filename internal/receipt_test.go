@@ -3,6 +3,7 @@ package internal
 import (
 	"sync"
 	"testing"
+	"time"
 
 	"github.com/AutoRoute/node/types"
 )
@@ -12,7 +13,7 @@ func TestReceiptHandler(t *testing.T) {
 	a1, a2 := types.NodeAddress("1"), pk2.PublicKey().Hash()
 	i1, i2 := make(chan routingDecision), make(chan routingDecision)
 	lgr1, lgr2 := testLogger{0, 0, 0, &sync.Mutex{}}, testLogger{0, 0, 0, &sync.Mutex{}}
-	ri1, ri2 := newReceipt(a1, i1, &lgr1), newReceipt(a2, i2, &lgr2)
+	ri1, ri2 := newReceipt(a1, i1, newMemoryReputation(), NewMetrics(), SystemClock(), &lgr1), newReceipt(a2, i2, newMemoryReputation(), NewMetrics(), SystemClock(), &lgr2)
 	defer ri1.Close()
 	defer ri2.Close()
 
@@ -34,3 +35,53 @@ func TestReceiptHandler(t *testing.T) {
 		t.Fatal("Not all receipts logged", lgr2.GetReceiptCount())
 	}
 }
+
+func TestReceiptHandlerPrunes(t *testing.T) {
+	pk2, _ := NewECDSAKey()
+	a1, a2, a3 := types.NodeAddress("1"), pk2.PublicKey().Hash(), types.NodeAddress("3")
+	i2 := make(chan routingDecision)
+	lgr2 := testLogger{0, 0, 0, &sync.Mutex{}}
+	ri2 := newReceipt(a2, i2, newMemoryReputation(), NewMetrics(), SystemClock(), &lgr2)
+	defer ri2.Close()
+
+	c1, c2 := makePairedReceiptConnections()
+	c3, c4 := makePairedReceiptConnections()
+	ri2.AddConnection(a1, c2)
+	ri2.AddConnection(a3, c4)
+
+	// One packet arrives from each neighbor.
+	p1 := types.Packet{Dest: a2, Amt: 3, Data: []byte("one")}
+	p3 := types.Packet{Dest: a2, Amt: 3, Data: []byte("three")}
+	i2 <- newRoutingDecision(p1, a1, a2, 1)
+	i2 <- newRoutingDecision(p3, a3, a2, 1)
+	for {
+		ri2.l.Lock()
+		recorded := len(ri2.packets)
+		ri2.l.Unlock()
+		if recorded == 2 {
+			break
+		}
+		time.Sleep(time.Millisecond)
+	}
+
+	go ri2.SendReceipt(CreateMerkleReceipt(pk2, []types.PacketHash{p1.Hash(), p3.Hash()}))
+	<-ri2.PacketHashes()
+	<-ri2.PacketHashes()
+
+	for i := 0; i < 2; i++ {
+		var r PacketReceipt
+		var expected types.PacketHash
+		select {
+		case r = <-c1.PacketReceipts():
+			expected = p1.Hash()
+		case r = <-c3.PacketReceipts():
+			expected = p3.Hash()
+		}
+		if err := r.Verify(); err != nil {
+			t.Fatal(err)
+		}
+		if l := r.ListPackets(); len(l) != 1 || l[0] != expected {
+			t.Fatalf("Expected receipt for only %x got %v", expected, l)
+		}
+	}
+}
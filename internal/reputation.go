@@ -0,0 +1,202 @@
+package internal
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"math"
+	"os"
+	"sync"
+	"time"
+
+	"github.com/AutoRoute/node/types"
+)
+
+// Something a neighbor can do which affects its reputation.
+type Behavior int
+
+const (
+	// The neighbor relayed a receipt which checked out.
+	ValidReceipt Behavior = iota
+	// The neighbor relayed a receipt for packets it didn't handle.
+	InvalidReceipt
+	// The neighbor let its debt to us sit unpaid.
+	UnpaidDebt
+	// The neighbor never returned a receipt for a packet we forwarded to it.
+	DroppedPacket
+	// The neighbor sent us something with a signature which didn't verify.
+	BadSignature
+)
+
+func (b Behavior) String() string {
+	switch b {
+	case ValidReceipt:
+		return "valid receipt"
+	case InvalidReceipt:
+		return "invalid receipt"
+	case UnpaidDebt:
+		return "unpaid debt"
+	case DroppedPacket:
+		return "dropped packet"
+	case BadSignature:
+		return "bad signature"
+	}
+	return fmt.Sprintf("behavior %d", int(b))
+}
+
+// How much each behavior changes a neighbor's score.
+var behavior_scores = map[Behavior]float64{
+	ValidReceipt:   1,
+	InvalidReceipt: -25,
+	UnpaidDebt:     -20,
+	DroppedPacket:  -1,
+	BadSignature:   -50,
+}
+
+const (
+	// Neighbors start at zero and can't bank more than this much good will.
+	max_reputation = 100
+	// Neighbors at or below this score are banned, so they are no longer
+	// routed through or accepted as connections.
+	min_reputation = -100
+)
+
+// Scores drift back towards zero, halving over this long, so old behavior is
+// eventually forgotten.
+const reputation_half_life = 24 * time.Hour
+
+// How long a neighbor stays banned after its score reaches min_reputation.
+const ban_duration = 24 * time.Hour
+
+// A neighbor's score as of when it was last updated.
+type reputationScore struct {
+	Score   float64
+	Updated time.Time
+	// The neighbor is banned until this time.
+	Banned_Until time.Time
+}
+
+// Reputation keeps score of how well each neighbor has behaved, optionally
+// persisting the scores to a file so they survive restarts. Scores are only
+// written out when Save is called.
+type Reputation struct {
+	scores map[types.NodeAddress]reputationScore
+	// Where to persist scores, or empty to keep them in memory.
+	path string
+	// Whether scores have changed since they were last saved.
+	dirty bool
+	clock Clock
+	l     *sync.Mutex
+}
+
+// Creates a Reputation which persists its scores to path, loading any which
+// are already there. An empty path keeps scores in memory only.
+func NewReputation(path string) (*Reputation, error) {
+	return NewReputationWithClock(path, SystemClock())
+}
+
+// Creates a Reputation whose scores decay and bans expire according to clock.
+func NewReputationWithClock(path string, clock Clock) (*Reputation, error) {
+	r := &Reputation{make(map[types.NodeAddress]reputationScore), path, false, clock, &sync.Mutex{}}
+	if len(path) == 0 {
+		return r, nil
+	}
+	b, err := ioutil.ReadFile(path)
+	if os.IsNotExist(err) {
+		return r, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(b, &r.scores)
+	if err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func newMemoryReputation() *Reputation {
+	r, _ := NewReputation("")
+	return r
+}
+
+// Returns a neighbor's score decayed up to now. Must be called with the lock
+// held.
+func (r *Reputation) score(id types.NodeAddress, now time.Time) float64 {
+	s := r.scores[id]
+	if s.Score == 0 || !now.After(s.Updated) {
+		return s.Score
+	}
+	return s.Score * math.Pow(0.5, float64(now.Sub(s.Updated))/float64(reputation_half_life))
+}
+
+// Records something a neighbor did.
+func (r *Reputation) Report(id types.NodeAddress, b Behavior) {
+	r.l.Lock()
+	defer r.l.Unlock()
+	now := r.clock.Now()
+	s := r.scores[id]
+	s.Score = r.score(id, now) + behavior_scores[b]
+	if s.Score > max_reputation {
+		s.Score = max_reputation
+	}
+	s.Updated = now
+	if s.Score <= min_reputation {
+		s.Banned_Until = now.Add(ban_duration)
+	}
+	r.scores[id] = s
+	r.dirty = true
+	if b != ValidReceipt {
+		log.Printf("%x: %v, reputation now %v", id, b, s.Score)
+	}
+}
+
+// Writes the scores to the file they are persisted in, if they have changed.
+func (r *Reputation) Save() error {
+	r.l.Lock()
+	defer r.l.Unlock()
+	if len(r.path) == 0 || !r.dirty {
+		return nil
+	}
+	b, err := json.Marshal(r.scores)
+	if err != nil {
+		return err
+	}
+	tmp := r.path + ".tmp"
+	err = ioutil.WriteFile(tmp, b, 0600)
+	if err != nil {
+		return err
+	}
+	err = os.Rename(tmp, r.path)
+	if err != nil {
+		return err
+	}
+	r.dirty = false
+	return nil
+}
+
+func (r *Reputation) Score(id types.NodeAddress) float64 {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return r.score(id, r.clock.Now())
+}
+
+// Returns whether a neighbor is still trusted enough to route through and
+// connect to, which it isn't while it's banned.
+func (r *Reputation) Trusted(id types.NodeAddress) bool {
+	r.l.Lock()
+	defer r.l.Unlock()
+	return !r.clock.Now().Before(r.scores[id].Banned_Until)
+}
+
+// Returns only the trusted addresses out of ids.
+func (r *Reputation) Filter(ids []types.NodeAddress) []types.NodeAddress {
+	trusted := make([]types.NodeAddress, 0, len(ids))
+	for _, id := range ids {
+		if r.Trusted(id) {
+			trusted = append(trusted, id)
+		}
+	}
+	return trusted
+}
@@ -0,0 +1,160 @@
+package internal
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AutoRoute/node/types"
+)
+
+func TestReputation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "reputation")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "reputation.json")
+
+	clock := NewFakeClock(time.Now())
+	r, err := NewReputationWithClock(path, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	a1, a2 := types.NodeAddress("1"), types.NodeAddress("2")
+	for i := 0; i < 200; i++ {
+		r.Report(a1, ValidReceipt)
+	}
+	if r.Score(a1) != max_reputation {
+		t.Fatalf("Expected score to be capped at %d got %v", max_reputation, r.Score(a1))
+	}
+	r.Report(a2, BadSignature)
+	r.Report(a2, BadSignature)
+	if r.Trusted(a2) {
+		t.Fatalf("Expected %x to be untrusted with score %v", a2, r.Score(a2))
+	}
+	if f := r.Filter([]types.NodeAddress{a1, a2}); len(f) != 1 || f[0] != a1 {
+		t.Fatalf("Expected only %x to be trusted got %v", a1, f)
+	}
+
+	// Scores are only written out when saved, and survive a restart.
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Fatalf("Scores written before being saved: %v", err)
+	}
+	err = r.Save()
+	if err != nil {
+		t.Fatal(err)
+	}
+	r2, err := NewReputationWithClock(path, clock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r2.Score(a1) != r.Score(a1) || r2.Score(a2) != r.Score(a2) || r2.Trusted(a2) {
+		t.Fatalf("Scores not persisted %v %v", r2.Score(a1), r2.Score(a2))
+	}
+
+	// Scores decay and bans expire.
+	clock.Advance(reputation_half_life)
+	if r2.Score(a1) != max_reputation/2 || r2.Score(a2) != 2*behavior_scores[BadSignature]/2 {
+		t.Fatalf("Scores didn't decay %v %v", r2.Score(a1), r2.Score(a2))
+	}
+	if ban_duration > reputation_half_life {
+		clock.Advance(ban_duration - reputation_half_life)
+	}
+	if !r2.Trusted(a2) {
+		t.Fatalf("Ban on %x didn't expire", a2)
+	}
+}
+
+func TestReceiptFromWrongHost(t *testing.T) {
+	pk2, _ := NewECDSAKey()
+	a1, a2, a3 := types.NodeAddress("1"), pk2.PublicKey().Hash(), types.NodeAddress("3")
+	i1 := make(chan routingDecision)
+	lgr1 := testLogger{0, 0, 0, &sync.Mutex{}}
+	rep := newMemoryReputation()
+	ri1 := newReceipt(a1, i1, rep, NewMetrics(), SystemClock(), &lgr1)
+	defer ri1.Close()
+
+	_, c2 := makePairedReceiptConnections()
+	c3, c4 := makePairedReceiptConnections()
+	ri1.AddConnection(a2, c2)
+	ri1.AddConnection(a3, c4)
+
+	// We forwarded the packet to a2, but a3 sends us the receipt.
+	p := testPacket(a2)
+	i1 <- newRoutingDecision(p, a1, a2, 1)
+	c3.SendReceipt(CreateMerkleReceipt(pk2, []types.PacketHash{p.Hash()}))
+
+	timeout := time.After(time.Second)
+	for rep.Score(a3) >= 0 {
+		select {
+		case <-ri1.PacketHashes():
+			t.Fatal("Receipt from the wrong host was credited")
+		case <-timeout:
+			t.Fatal("Receipt from the wrong host wasn't reported")
+		case <-time.After(time.Millisecond):
+		}
+	}
+
+	// a2 never sent a receipt so is eventually blamed for dropping it.
+	ri1.checkDropped(time.Now().Add(receipt_timeout))
+	if rep.Score(a2) >= 0 {
+		t.Fatalf("Expected %x to be blamed for the dropped packet", a2)
+	}
+}
+
+func TestLedgerUnpaidDebt(t *testing.T) {
+	delivered := make(chan types.PacketHash)
+	routed := make(chan routingDecision)
+	a1, a2 := types.NodeAddress("1"), types.NodeAddress("2")
+	rep := newMemoryReputation()
+	l := newLedger(a2, delivered, routed, rep)
+	defer l.Close()
+
+	p := testPacket(a2)
+	routed <- newRoutingDecision(p, a1, a2, 1)
+	delivered <- p.Hash()
+	WaitForIncomingDebt(t, l, a1, p.Amount())
+
+	// Debt which may be held back until it's worth a fee doesn't count.
+	now := time.Now()
+	grace := time.Hour
+	l.CheckUnpaid(now, grace, p.Amount())
+	l.CheckUnpaid(now.Add(2*grace), grace, p.Amount())
+	if rep.Score(a1) != 0 {
+		t.Fatalf("Expected %x not to be reported for held back debt got %v", a1, rep.Score(a1))
+	}
+
+	// Otherwise a neighbor has until the grace runs out.
+	l.CheckUnpaid(now, grace, 0)
+	l.CheckUnpaid(now.Add(grace-time.Second), grace, 0)
+	if rep.Score(a1) != 0 {
+		t.Fatalf("Expected %x not to be reported within the grace got %v", a1, rep.Score(a1))
+	}
+	l.CheckUnpaid(now.Add(grace), grace, 0)
+	if score := rep.Score(a1); score >= 0 || score < behavior_scores[UnpaidDebt] {
+		t.Fatalf("Expected %x to be reported for not paying got %v", a1, score)
+	}
+}
+
+func TestRouterRefusesUntrusted(t *testing.T) {
+	k1, _ := NewECDSAKey()
+	k2, _ := NewECDSAKey()
+	lgr1 := testLogger{0, 0, 0, &sync.Mutex{}}
+	lgr2 := testLogger{0, 0, 0, &sync.Mutex{}}
+	r1 := NewRouter(k1.PublicKey(), &lgr1)
+	r2 := NewRouter(k2.PublicKey(), &lgr2)
+	defer r1.Close()
+	defer r2.Close()
+
+	for r1.Reputation().Trusted(k2.PublicKey().Hash()) {
+		r1.Reputation().Report(k2.PublicKey().Hash(), BadSignature)
+	}
+	Link(r1, r2)
+	if len(r1.Connections()) != 0 {
+		t.Fatal("Connection from untrusted neighbor accepted")
+	}
+}
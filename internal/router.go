@@ -1,21 +1,13 @@
 package internal
 
 import (
-	"expvar"
 	"fmt"
+	"log"
 	"sync"
 
 	"github.com/AutoRoute/node/types"
 )
 
-var connections_export *expvar.Map
-var id_export *expvar.String
-
-func init() {
-	connections_export = expvar.NewMap("connections")
-	id_export = expvar.NewString("id")
-}
-
 // A Router handles all routing tasks that don't involve the local machine
 // including connection management, reachability handling, packet receipt
 // relaying, and (outstanding) payment tracking. AKA anything which doesn't
@@ -29,21 +21,52 @@ type Router struct {
 	*reachabilityHandler
 	*receiptHandler
 	*Ledger
+	reputation *Reputation
+	flows      *flowAccounting
+	metrics    *Metrics
+	stats      *RouterStats
+	clock      Clock
 
 	lock *sync.Mutex
 	quit chan bool
 }
 
 func NewRouter(pk PublicKey, route_logger Logger) *Router {
-	id_export.Set(fmt.Sprintf("%x", pk.Hash()))
+	return NewRouterWithReputation(pk, route_logger, newMemoryReputation())
+}
+
+func NewRouterWithReputation(pk PublicKey, route_logger Logger, reputation *Reputation) *Router {
+	return NewRouterWithOptions(pk, route_logger, RouterOptions{reputation, nil})
+}
+
+// Settings for a Router. Zero values fall back to an in memory reputation and
+// the system clock.
+type RouterOptions struct {
+	Reputation *Reputation
+	Clock      Clock
+}
+
+func NewRouterWithOptions(pk PublicKey, route_logger Logger, o RouterOptions) *Router {
+	reputation := o.Reputation
+	if reputation == nil {
+		reputation = newMemoryReputation()
+	}
+	clock := clockOrDefault(o.Clock)
 	reach := newReachability(pk.Hash(), route_logger)
 	// TODO(daniel): Eventually, add flags that allow a user to specify alternate
 	// routing algorithms.
-	algorithm := newBandwidthRouting(reach)
-	routing := newRoutingHandler(pk, algorithm, route_logger)
-	c1, c2, quit := splitChannel(routing.Routes())
-	receipt := newReceipt(pk.Hash(), c1, route_logger)
-	Ledger := newLedger(pk.Hash(), receipt.PacketHashes(), c2)
+	algorithm := newBandwidthRouting(reach, reputation)
+	metrics := NewMetrics()
+	stats := newRouterStats(pk.Hash())
+	routing := newRoutingHandler(pk, algorithm, stats, metrics, clock, route_logger)
+	receipt := newReceipt(pk.Hash(), routing.Routes(), reputation, metrics, clock, route_logger)
+	Ledger := newLedger(pk.Hash(), receipt.PacketHashes(), routing.Routes(), reputation)
+	flows := newFlowAccounting(routing.Routes(), clock)
+	metrics.NewGaugeFunc("autoroute_incoming_debt", "Satoshis each neighbor owes us.", "neighbor",
+		func() map[string]float64 { return debtGauge(Ledger.IncomingDebts()) })
+	metrics.NewGaugeFunc("autoroute_outgoing_debt", "Satoshis we owe each neighbor.", "neighbor",
+		func() map[string]float64 { return debtGauge(Ledger.OutgoingDebts()) })
+	metrics.Register(flows.WritePrometheus)
 	return &Router{
 		pk,
 		make(map[types.NodeAddress]Connection),
@@ -51,8 +74,13 @@ func NewRouter(pk PublicKey, route_logger Logger) *Router {
 		reach,
 		receipt,
 		Ledger,
+		reputation,
+		flows,
+		metrics,
+		stats,
+		clock,
 		&sync.Mutex{},
-		quit,
+		make(chan bool),
 	}
 }
 
@@ -79,13 +107,58 @@ func (r *Router) AddConnection(c Connection) {
 		c.Close()
 		return
 	}
+	if !r.reputation.Trusted(id) {
+		log.Printf("Refusing connection from untrusted neighbor %x", id)
+		c.Close()
+		return
+	}
 	r.connections[id] = c
 
 	// Curry the id since the various sub connections don't know about it
 	r.routingHandler.AddConnection(id, c)
 	r.reachabilityHandler.AddConnection(id, c)
 	r.receiptHandler.AddConnection(id, c)
-	connections_export.Add(fmt.Sprintf("%x", c.Key().Hash()), 1)
+	r.Ledger.AddConnection(id, c)
+	r.stats.addConnection(id)
+}
+
+// Returns the reputation of every neighbor we have dealt with.
+func (r *Router) Reputation() *Reputation {
+	return r.reputation
+}
+
+func debtGauge(debts map[types.NodeAddress]int64) map[string]float64 {
+	o := make(map[string]float64)
+	for n, d := range debts {
+		o[fmt.Sprintf("%x", n)] = float64(d)
+	}
+	return o
+}
+
+// Returns this router's connection and packet counters.
+func (r *Router) Stats() *RouterStats {
+	return r.stats
+}
+
+// Returns this router's metrics registry.
+func (r *Router) Metrics() *Metrics {
+	return r.metrics
+}
+
+// Returns traffic counters per source and destination.
+func (r *Router) Flows() *flowAccounting {
+	return r.flows
+}
+
+// Sends a payment notification or acknowledgement to a neighbor.
+func (r *Router) SendPaymentNotification(id types.NodeAddress, n PaymentNotification) error {
+	r.lock.Lock()
+	c, ok := r.connections[id]
+	r.lock.Unlock()
+	if !ok {
+		return fmt.Errorf("Not connected to %x", id)
+	}
+	return c.SendPaymentNotification(n)
 }
 
 func (r *Router) Close() error {
@@ -93,6 +166,7 @@ func (r *Router) Close() error {
 	r.routingHandler.Close()
 	r.receiptHandler.Close()
 	r.Ledger.Close()
+	r.flows.Close()
 	close(r.quit)
 	return nil
 }
@@ -1,23 +1,13 @@
 package internal
 
 import (
-	"expvar"
-	"fmt"
 	"log"
+	"sync"
+	"sync/atomic"
 
 	"github.com/AutoRoute/node/types"
 )
 
-var packets_sent *expvar.Map
-var packets_received *expvar.Map
-var packets_dropped *expvar.Int
-
-func init() {
-	packets_sent = expvar.NewMap("packets_sent")
-	packets_received = expvar.NewMap("packets_received")
-	packets_dropped = expvar.NewInt("packets_dropped")
-}
-
 func newRoutingDecision(p types.Packet, src types.NodeAddress,
 	nexthop types.NodeAddress, size int) routingDecision {
 	return routingDecision{p.Hash(), p.Amount(), src, p.Destination(), nexthop,
@@ -30,7 +20,9 @@ type routingHandler struct {
 	pk PublicKey
 	// A chan down which we send packets destined for ourselves.
 	incoming chan types.Packet
-	routes   chan routingDecision
+	// Every routing decision is sent down each of these.
+	routes   []chan routingDecision
+	routes_l *sync.Mutex
 	// A map of public key hashes to connections
 	connections map[types.NodeAddress]DataConnection
 	quit        chan bool
@@ -38,6 +30,17 @@ type routingHandler struct {
 	routing_algo routingAlgorithm
 	// The routing decision logger
 	route_logger Logger
+
+	stats *RouterStats
+	clock Clock
+
+	// The number of packets currently being routed.
+	in_flight          int64
+	forwarded          *Counter
+	delivered          *Counter
+	dropped            *Counter
+	forwarding_latency *Histogram
+	queue_depth        *Histogram
 }
 
 // Represents a permanent record of a routingHandler decision.
@@ -52,15 +55,26 @@ type routingDecision struct {
 }
 
 func newRoutingHandler(pk PublicKey,
-	algo routingAlgorithm, route_logger Logger) *routingHandler {
+	algo routingAlgorithm, stats *RouterStats, metrics *Metrics, clock Clock, route_logger Logger) *routingHandler {
 	handler := &routingHandler{
 		pk,
 		make(chan types.Packet),
-		make(chan routingDecision),
+		nil,
+		&sync.Mutex{},
 		make(map[types.NodeAddress]DataConnection),
 		make(chan bool),
 		algo,
 		route_logger,
+		stats,
+		clock,
+		0,
+		metrics.NewCounter("autoroute_packets_forwarded_total", "Packets sent on to a neighbor."),
+		metrics.NewCounter("autoroute_packets_delivered_total", "Packets which were for us."),
+		metrics.NewCounter("autoroute_packets_dropped_total", "Packets with nowhere to go."),
+		metrics.NewHistogram("autoroute_forwarding_latency_seconds",
+			"Time taken to pick a next hop and hand a packet to it.", latency_buckets),
+		metrics.NewHistogram("autoroute_queue_depth",
+			"Packets already being routed when another arrives.", depth_buckets),
 	}
 
 	handler.routing_algo.BindToRouting(handler)
@@ -104,9 +118,9 @@ func (r *routingHandler) SendPacket(p types.Packet) error {
 //  otherwise.
 func (r *routingHandler) checkIfWeAreDest(p types.Packet,
 	src types.NodeAddress) bool {
-	packets_received.Add(fmt.Sprintf("%x", src), 1)
+	r.stats.received(src)
 	if p.Destination() == r.pk.Hash() {
-		packets_sent.Add(fmt.Sprintf("%x", r.pk.Hash()), 1)
+		r.stats.sent(r.pk.Hash())
 		r.incoming <- p
 		go r.notifyDecision(p, src, r.pk.Hash())
 		return true
@@ -116,18 +130,24 @@ func (r *routingHandler) checkIfWeAreDest(p types.Packet,
 }
 
 func (r *routingHandler) sendPacket(p types.Packet, src types.NodeAddress) error {
+	start := r.clock.Now()
+	r.queue_depth.Observe(float64(atomic.AddInt64(&r.in_flight, 1) - 1))
+	defer atomic.AddInt64(&r.in_flight, -1)
+
 	if r.checkIfWeAreDest(p, src) {
 		// We're done here.
+		r.delivered.Inc()
 		return nil
 	}
 
 	next, err := r.routing_algo.FindNextHop(p.Destination(), src)
 	if err != nil {
-		packets_dropped.Add(1)
+		r.stats.dropped()
+		r.dropped.Inc()
 		return err
 	}
 
-	packets_sent.Add(fmt.Sprintf("%x", next), 1)
+	r.stats.sent(next)
 	go r.notifyDecision(p, src, next)
 
 	err = r.connections[next].SendPacket(p)
@@ -135,8 +155,10 @@ func (r *routingHandler) sendPacket(p types.Packet, src types.NodeAddress) error
 		log.Print("Error sending packet.\n")
 		return err
 	}
+	r.forwarded.Inc()
+	r.forwarding_latency.Observe(r.clock.Since(start).Seconds())
 
-	err = r.route_logger.LogRoutingDecision(p.Destination(), next, len(p.Data), p.Amount(), p.Hash())
+	err = r.route_logger.LogRoutingDecision(src, p.Destination(), next, len(p.Data), p.Amount(), p.Hash())
 	if err != nil {
 		return err
 	}
@@ -145,12 +167,28 @@ func (r *routingHandler) sendPacket(p types.Packet, src types.NodeAddress) error
 }
 
 func (r *routingHandler) notifyDecision(p types.Packet, src, next types.NodeAddress) {
-	r.routes <- routingDecision{p.Hash(), p.Amount(), src, p.Destination(), next,
+	d := routingDecision{p.Hash(), p.Amount(), src, p.Destination(), next,
 		len(p.Data)}
+	r.routes_l.Lock()
+	routes := r.routes
+	r.routes_l.Unlock()
+	for _, c := range routes {
+		select {
+		case c <- d:
+		case <-r.quit:
+			return
+		}
+	}
 }
 
+// Returns a new channel which receives every routing decision made from now
+// on. Each caller gets its own copy of the decisions.
 func (r *routingHandler) Routes() <-chan routingDecision {
-	return r.routes
+	r.routes_l.Lock()
+	defer r.routes_l.Unlock()
+	c := make(chan routingDecision)
+	r.routes = append(r.routes, c)
+	return c
 }
 
 func (r *routingHandler) Packets() <-chan types.Packet {
@@ -0,0 +1,58 @@
+package internal
+
+import (
+	"errors"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/AutoRoute/node/types"
+)
+
+// A routingAlgorithm which never finds a next hop.
+type noRouting struct{}
+
+func (noRouting) FindNextHop(id, src types.NodeAddress) (types.NodeAddress, error) {
+	return "", errors.New("no route")
+}
+func (noRouting) BindToRouting(routing *routingHandler) {}
+func (noRouting) Cleanup()                              {}
+
+func testRoutingHandler() *routingHandler {
+	sk, _ := NewECDSAKey()
+	pk := sk.PublicKey()
+	return newRoutingHandler(pk, noRouting{}, newRouterStats(pk.Hash()), NewMetrics(),
+		SystemClock(), &testLogger{0, 0, 0, &sync.Mutex{}})
+}
+
+func TestRoutingDecisionSubscribers(t *testing.T) {
+	r := testRoutingHandler()
+	defer r.Close()
+	c1, c2 := r.Routes(), r.Routes()
+
+	p := testPacket("destination")
+	go r.notifyDecision(p, "source", "next")
+	for _, c := range []<-chan routingDecision{c1, c2} {
+		d := <-c
+		if d.hash != p.Hash() || d.source != "source" || d.nexthop != "next" || d.amount != p.Amount() {
+			t.Fatalf("Unexpected routing decision %v", d)
+		}
+	}
+}
+
+func TestRoutingDecisionAfterClose(t *testing.T) {
+	r := testRoutingHandler()
+	r.Routes()
+	r.Close()
+
+	done := make(chan bool)
+	go func() {
+		r.notifyDecision(testPacket("destination"), "source", "next")
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(time.Second):
+		t.Fatal("Routing decision blocked on a closed routingHandler")
+	}
+}
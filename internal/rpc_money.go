@@ -1,6 +1,9 @@
 package internal
 
 import (
+	"encoding/json"
+	"errors"
+	"fmt"
 	"log"
 	"time"
 
@@ -10,30 +13,125 @@ import (
 	"github.com/btcsuite/btcutil"
 )
 
+// Rough sizes in bytes of the parts of a pay to pubkey hash transaction, used
+// to turn a fee rate into a fee.
+const (
+	tx_overhead_size = 10
+	tx_input_size    = 148
+	tx_output_size   = 34
+)
+
+// The number of blocks we are willing to wait for a payment to be mined.
+const fee_target_blocks = 6
+
+// The fee rate used when the daemon can't estimate one.
+const fallback_fee_per_kb = btcutil.Amount(10000)
+
+// RPCMoneyOptions contains everything needed to connect to a bitcoin daemon
+// and decide when payments made through it are final.
+type RPCMoneyOptions struct {
+	Host string
+	User string
+	Pass string
+	// The bitcoin network the daemon is running on. One of "mainnet",
+	// "testnet", "regtest" or "simnet".
+	Network string
+	// The number of confirmations a payment needs before it is considered
+	// successful.
+	Confirmations int64
+	// How often the daemon is polled for transaction and balance changes.
+	PollRate time.Duration
+	// Whether the RPC connection should use TLS.
+	TLS bool
+	// PEM encoded certificates used to verify the daemon when TLS is enabled.
+	// If empty the system roots are used.
+	Certificates []byte
+	// What polling is timed with, or nil for the system clock.
+	Clock Clock
+}
+
+// Returns the options NewRPCMoney has always used: an unencrypted connection
+// to a mainnet daemon, waiting for six confirmations and polling every 30
+// seconds.
+func DefaultRPCMoneyOptions(host, user, pass string) RPCMoneyOptions {
+	return RPCMoneyOptions{
+		Host:          host,
+		User:          user,
+		Pass:          pass,
+		Network:       "mainnet",
+		Confirmations: 6,
+		PollRate:      30 * time.Second,
+	}
+}
+
+// Maps a network name to the chain parameters used to decode addresses.
+func NetworkParams(network string) (*chaincfg.Params, error) {
+	switch network {
+	case "mainnet", "":
+		return &chaincfg.MainNetParams, nil
+	case "testnet":
+		return &chaincfg.TestNet3Params, nil
+	case "regtest":
+		return &chaincfg.RegressionNetParams, nil
+	case "simnet":
+		return &chaincfg.SimNetParams, nil
+	}
+	return nil, fmt.Errorf("Unknown bitcoin network %q", network)
+}
+
 func NewRPCMoney(host, user, pass string) (*RPCMoney, error) {
+	return NewRPCMoneyWithOptions(DefaultRPCMoneyOptions(host, user, pass))
+}
+
+func NewRPCMoneyWithOptions(o RPCMoneyOptions) (*RPCMoney, error) {
+	params, err := NetworkParams(o.Network)
+	if err != nil {
+		return nil, err
+	}
+	if o.PollRate <= 0 {
+		return nil, errors.New("Poll rate must be positive")
+	}
+	if o.Confirmations < 0 {
+		return nil, errors.New("Confirmations must not be negative")
+	}
 	config := &btcrpcclient.ConnConfig{
-		Host:         host,
-		User:         user,
-		Pass:         pass,
+		Host:         o.Host,
+		User:         o.User,
+		Pass:         o.Pass,
 		HTTPPostMode: true,
-		DisableTLS:   true,
+		DisableTLS:   !o.TLS,
+		Certificates: o.Certificates,
 	}
 	client, err := btcrpcclient.New(config, nil)
-	return &RPCMoney{client, 30 * time.Second, nil}, err
+	return &RPCMoney{client, params, o.Confirmations, o.PollRate, clockOrDefault(o.Clock), nil}, err
 }
 
 // RPCMoney represents a Money system which is backed by a bitcoin daemon over
 // an RPC connection.
 type RPCMoney struct {
-	rpc       *btcrpcclient.Client
-	poll_rate time.Duration
-	err       error
+	rpc           *btcrpcclient.Client
+	params        *chaincfg.Params
+	confirmations int64
+	poll_rate     time.Duration
+	clock         Clock
+	err           error
+}
+
+func (r *RPCMoney) decodeAddress(destination string) (btcutil.Address, error) {
+	address, err := btcutil.DecodeAddress(destination, r.params)
+	if err != nil {
+		return nil, err
+	}
+	if !address.IsForNet(r.params) {
+		return nil, fmt.Errorf("Address %s is not valid on %s", destination, r.params.Name)
+	}
+	return address, nil
 }
 
 // Returns a channel which will receive a nil once the payment is confirmed , or
 // an error if it isn't confirmed / errors.
 func (r *RPCMoney) MakePayment(amount int64, destination string) (chan bool, error) {
-	address, err := btcutil.DecodeAddress(destination, &chaincfg.MainNetParams)
+	address, err := r.decodeAddress(destination)
 	if err != nil {
 		return nil, err
 	}
@@ -46,9 +144,60 @@ func (r *RPCMoney) MakePayment(amount int64, destination string) (chan bool, err
 	return c, nil
 }
 
+// Pays all of the destinations in a single transaction. The returned channel
+// behaves the same as the one returned by MakePayment.
+func (r *RPCMoney) MakePayments(payments map[string]int64) (chan bool, error) {
+	_, c, err := r.MakeTransaction(payments)
+	return c, err
+}
+
+// Pays all of the destinations in a single transaction and returns its id.
+// The returned channel behaves the same as the one returned by MakePayment.
+func (r *RPCMoney) MakeTransaction(payments map[string]int64) (string, chan bool, error) {
+	amounts := make(map[btcutil.Address]btcutil.Amount)
+	for destination, amount := range payments {
+		address, err := r.decodeAddress(destination)
+		if err != nil {
+			return "", nil, err
+		}
+		amounts[address] = btcutil.Amount(amount)
+	}
+	hash, err := r.rpc.SendMany("", amounts)
+	if err != nil {
+		return "", nil, err
+	}
+	c := make(chan bool, 1)
+	go r.waitForPaymentSuccess(hash, c)
+	return hash.String(), c, nil
+}
+
+// Estimates the fee of a transaction paying the given number of outputs,
+// assuming a single input and a change output.
+func (r *RPCMoney) EstimateFee(outputs int) (int64, error) {
+	res, err := r.rpc.RawRequest("estimatefee", []json.RawMessage{json.RawMessage(fmt.Sprint(fee_target_blocks))})
+	if err != nil {
+		return 0, err
+	}
+	var per_kb float64
+	err = json.Unmarshal(res, &per_kb)
+	if err != nil {
+		return 0, err
+	}
+	rate := fallback_fee_per_kb
+	// The daemon returns a negative rate when it doesn't have enough data.
+	if per_kb > 0 {
+		rate, err = btcutil.NewAmount(per_kb)
+		if err != nil {
+			return 0, err
+		}
+	}
+	size := tx_overhead_size + tx_input_size + tx_output_size*int64(outputs+1)
+	return int64(rate) * size / 1000, nil
+}
+
 // Waits for a payment to suceed. If it errors it will close the channel and log the error + store it in the struct.
 func (r *RPCMoney) waitForPaymentSuccess(hash *wire.ShaHash, c chan bool) {
-	for _ = range time.Tick(r.poll_rate) {
+	for _ = range r.clock.Tick(r.poll_rate) {
 		info, err := r.rpc.GetTransaction(hash)
 		if err != nil {
 			log.Print(err)
@@ -56,7 +205,7 @@ func (r *RPCMoney) waitForPaymentSuccess(hash *wire.ShaHash, c chan bool) {
 			close(c)
 			return
 		}
-		if info.Confirmations > 6 {
+		if info.Confirmations >= r.confirmations {
 			c <- true
 			return
 		}
@@ -78,7 +227,7 @@ func (r *RPCMoney) GetNewAddress() (string, chan uint64, error) {
 // Listens to an address for balance changes and sends the change down a channel.
 func (r *RPCMoney) listenBalanceChanges(addr btcutil.Address, c chan uint64) {
 	old_amt := int64(0)
-	for _ = range time.Tick(r.poll_rate) {
+	for _ = range r.clock.Tick(r.poll_rate) {
 		log.Print("Checking received balance")
 		amt, err := r.rpc.GetReceivedByAddress(addr)
 		log.Printf("current balance %d", amt)
@@ -0,0 +1,279 @@
+package internal
+
+import (
+	"encoding/json"
+	"encoding/pem"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/btcsuite/btcd/chaincfg"
+	"github.com/btcsuite/btcutil"
+)
+
+// A minimal bitcoind which answers the wallet RPCs RPCMoney uses.
+type fakeBitcoind struct {
+	l             *sync.Mutex
+	params        *chaincfg.Params
+	confirmations map[string]int64
+	received      map[string]float64
+	sent          map[string]float64
+	addresses     int
+	fee_rate      float64
+}
+
+func newFakeBitcoind(params *chaincfg.Params) *fakeBitcoind {
+	return &fakeBitcoind{
+		&sync.Mutex{},
+		params,
+		make(map[string]int64),
+		make(map[string]float64),
+		make(map[string]float64),
+		0,
+		-1,
+	}
+}
+
+func (f *fakeBitcoind) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	var cmd struct {
+		Method string
+		Params []json.RawMessage
+		ID     interface{}
+	}
+	err := json.NewDecoder(req.Body).Decode(&cmd)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	f.l.Lock()
+	defer f.l.Unlock()
+	var result interface{}
+	switch cmd.Method {
+	case "getnewaddress":
+		f.addresses++
+		hash := make([]byte, 20)
+		hash[0] = byte(f.addresses)
+		addr, _ := btcutil.NewAddressPubKeyHash(hash, f.params)
+		result = addr.EncodeAddress()
+	case "sendtoaddress":
+		var addr string
+		var amt float64
+		json.Unmarshal(cmd.Params[0], &addr)
+		json.Unmarshal(cmd.Params[1], &amt)
+		txid := fmt.Sprintf("%064x", len(f.confirmations)+1)
+		f.confirmations[txid] = 0
+		f.sent[addr] += amt
+		result = txid
+	case "sendmany":
+		var amounts map[string]float64
+		json.Unmarshal(cmd.Params[1], &amounts)
+		txid := fmt.Sprintf("%064x", len(f.confirmations)+1)
+		f.confirmations[txid] = 0
+		for addr, amt := range amounts {
+			f.sent[addr] += amt
+		}
+		result = txid
+	case "estimatefee":
+		result = f.fee_rate
+	case "gettransaction":
+		var txid string
+		json.Unmarshal(cmd.Params[0], &txid)
+		result = map[string]interface{}{
+			"txid":          txid,
+			"confirmations": f.confirmations[txid],
+		}
+	case "getreceivedbyaddress":
+		var addr string
+		json.Unmarshal(cmd.Params[0], &addr)
+		result = f.received[addr]
+	default:
+		http.Error(w, "unknown method "+cmd.Method, http.StatusNotFound)
+		return
+	}
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"result": result,
+		"error":  nil,
+		"id":     cmd.ID,
+	})
+}
+
+// Adds a confirmation to every transaction the daemon has sent.
+func (f *fakeBitcoind) mine() {
+	f.l.Lock()
+	defer f.l.Unlock()
+	for txid := range f.confirmations {
+		f.confirmations[txid]++
+	}
+}
+
+func (f *fakeBitcoind) receive(addr string, btc float64) {
+	f.l.Lock()
+	defer f.l.Unlock()
+	f.received[addr] += btc
+}
+
+func testRPCMoney(t *testing.T, network string, confirmations int64) (*fakeBitcoind, *httptest.Server, *RPCMoney) {
+	params, err := NetworkParams(network)
+	if err != nil {
+		t.Fatal(err)
+	}
+	f := newFakeBitcoind(params)
+	s := httptest.NewServer(f)
+	o := DefaultRPCMoneyOptions(strings.TrimPrefix(s.URL, "http://"), "user", "pass")
+	o.Network = network
+	o.Confirmations = confirmations
+	o.PollRate = time.Millisecond
+	m, err := NewRPCMoneyWithOptions(o)
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	return f, s, m
+}
+
+func TestRPCMoneyNetworks(t *testing.T) {
+	for _, network := range []string{"mainnet", "testnet", "regtest", "simnet"} {
+		params, _ := NetworkParams(network)
+		_, s, m := testRPCMoney(t, network, 0)
+		addr, _ := btcutil.NewAddressPubKeyHash(make([]byte, 20), params)
+		c, err := m.MakePayment(1000, addr.EncodeAddress())
+		if err != nil {
+			t.Fatalf("%s: %v", network, err)
+		}
+		if !<-c {
+			t.Fatalf("%s: payment failed", network)
+		}
+		s.Close()
+	}
+	_, err := NetworkParams("fakenet")
+	if err == nil {
+		t.Fatal("Expected error for unknown network")
+	}
+}
+
+func TestRPCMoneyWrongNetwork(t *testing.T) {
+	_, s, m := testRPCMoney(t, "mainnet", 0)
+	defer s.Close()
+	addr, _ := btcutil.NewAddressPubKeyHash(make([]byte, 20), &chaincfg.TestNet3Params)
+	_, err := m.MakePayment(1000, addr.EncodeAddress())
+	if err == nil {
+		t.Fatal("Expected error paying a testnet address on mainnet")
+	}
+}
+
+func TestRPCMoneyConfirmations(t *testing.T) {
+	f, s, m := testRPCMoney(t, "regtest", 2)
+	defer s.Close()
+	addr, _ := btcutil.NewAddressPubKeyHash(make([]byte, 20), &chaincfg.RegressionNetParams)
+	c, err := m.MakePayment(1000, addr.EncodeAddress())
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mine()
+	select {
+	case <-c:
+		t.Fatal("Payment confirmed too early")
+	case <-time.After(20 * time.Millisecond):
+	}
+	f.mine()
+	select {
+	case ok := <-c:
+		if !ok {
+			t.Fatal("Payment failed")
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for confirmation")
+	}
+}
+
+func TestRPCMoneyBalance(t *testing.T) {
+	f, s, m := testRPCMoney(t, "regtest", 0)
+	defer s.Close()
+	addr, c, err := m.GetNewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.receive(addr, 0.0001)
+	select {
+	case amt := <-c:
+		if amt != 10000 {
+			t.Fatalf("Expected 10000 satoshis got %d", amt)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("Timed out waiting for balance change")
+	}
+}
+
+func TestRPCMoneyTLS(t *testing.T) {
+	s := httptest.NewTLSServer(newFakeBitcoind(&chaincfg.RegressionNetParams))
+	defer s.Close()
+	cert := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: s.Certificate().Raw})
+	o := DefaultRPCMoneyOptions(strings.TrimPrefix(s.URL, "https://"), "user", "pass")
+	o.Network = "regtest"
+	o.TLS = true
+	o.Certificates = cert
+	m, err := NewRPCMoneyWithOptions(o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, _, err = m.GetNewAddress()
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRPCMoneyBatchPayment(t *testing.T) {
+	f, s, m := testRPCMoney(t, "regtest", 1)
+	defer s.Close()
+	a1, _ := btcutil.NewAddressPubKeyHash(make([]byte, 20), &chaincfg.RegressionNetParams)
+	a2, _ := btcutil.NewAddressPubKeyHash(append([]byte{1}, make([]byte, 19)...), &chaincfg.RegressionNetParams)
+	c, err := m.MakePayments(map[string]int64{a1.EncodeAddress(): 1000, a2.EncodeAddress(): 2000})
+	if err != nil {
+		t.Fatal(err)
+	}
+	f.mine()
+	if !<-c {
+		t.Fatal("Payment failed")
+	}
+	f.l.Lock()
+	defer f.l.Unlock()
+	if len(f.confirmations) != 1 {
+		t.Fatalf("Expected a single transaction got %d", len(f.confirmations))
+	}
+	if f.sent[a1.EncodeAddress()] != 0.00001 || f.sent[a2.EncodeAddress()] != 0.00002 {
+		t.Fatalf("Wrong amounts sent %v", f.sent)
+	}
+}
+
+func TestRPCMoneyEstimateFee(t *testing.T) {
+	f, s, m := testRPCMoney(t, "regtest", 0)
+	defer s.Close()
+	fallback, err := m.EstimateFee(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fallback <= 0 {
+		t.Fatalf("Expected a fallback fee got %d", fallback)
+	}
+	f.l.Lock()
+	f.fee_rate = 0.001
+	f.l.Unlock()
+	one, err := m.EstimateFee(1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	two, err := m.EstimateFee(2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if one != 100000*(10+148+34*2)/1000 {
+		t.Fatalf("Unexpected fee %d", one)
+	}
+	if two-one != 100000*34/1000 {
+		t.Fatalf("Expected an extra output to cost %d got %d", 100000*34/1000, two-one)
+	}
+}
@@ -3,6 +3,7 @@ package internal
 import (
 	"bytes"
 	"encoding/json"
+	"errors"
 	"log"
 	"net"
 	"sync"
@@ -49,6 +50,14 @@ type SSHConnection struct {
 	packet_dec_l    *sync.Mutex
 	packet_chan     chan types.Packet
 
+	// payment
+	payment_ssh_chan *SSHChannel
+	payment_enc      *json.Encoder
+	payment_enc_l    *sync.Mutex
+	payment_dec      *json.Decoder
+	payment_dec_l    *sync.Mutex
+	payment_chan     chan PaymentNotification
+
 	other_metadata SSHMetaData
 	our_metadata   SSHMetaData
 	// Channel to allow blocking until ssh channels are established
@@ -72,6 +81,7 @@ func NewSSHConnection(conn ssh.Conn, chans <-chan ssh.NewChannel, reqs <-chan *s
 		nil, nil, &sync.Mutex{}, nil, &sync.Mutex{}, make(chan *BloomReachabilityMap),
 		nil, nil, &sync.Mutex{}, nil, &sync.Mutex{}, make(chan PacketReceipt),
 		nil, nil, &sync.Mutex{}, nil, &sync.Mutex{}, make(chan types.Packet),
+		nil, nil, &sync.Mutex{}, nil, &sync.Mutex{}, make(chan PaymentNotification),
 		SSHMetaData{},
 		metadata,
 		make(chan bool),
@@ -184,6 +194,28 @@ func (s *SSHConnection) listen() {
 				s.packet_dec = json.NewDecoder(c)
 				s.packet_dec_l.Unlock()
 				s.sync <- true
+			case "payment":
+				if s.payment_ssh_chan != nil {
+					nc.Reject(ssh.ConnectionFailed, "Connection already established")
+					s.lock.Unlock()
+					continue
+				}
+				c, r, err := nc.Accept()
+				if err != nil {
+					log.Printf("Error accepting channel request: %v", err)
+					s.lock.Unlock()
+					continue
+				}
+				s.payment_ssh_chan = &SSHChannel{c, r}
+				s.payment_enc_l.Lock()
+				s.payment_enc = json.NewEncoder(c)
+				s.payment_enc_l.Unlock()
+				s.payment_dec_l.Lock()
+				s.payment_dec = json.NewDecoder(c)
+				s.payment_dec_l.Unlock()
+				// Older peers don't open a payment channel, so listen
+				// doesn't wait for it.
+				go s.handlePaymentNotifications()
 			default:
 				nc.Reject(ssh.UnknownChannelType, "Unknown channel type")
 			}
@@ -206,7 +238,24 @@ func (s *SSHConnection) connect() error {
 	s.lock.Lock()
 	defer s.lock.Unlock()
 
-	c, r, err := s.conn.OpenChannel("reachability", nil)
+	// The payment channel is opened first so a peer which supports it has
+	// accepted it by the time listen returns. Older peers reject it, and
+	// payment notifications just aren't sent to them.
+	c, r, err := s.conn.OpenChannel("payment", nil)
+	if err == nil {
+		s.payment_ssh_chan = &SSHChannel{c, r}
+		s.payment_enc_l.Lock()
+		s.payment_enc = json.NewEncoder(c)
+		s.payment_enc_l.Unlock()
+		s.payment_dec_l.Lock()
+		s.payment_dec = json.NewDecoder(c)
+		s.payment_dec_l.Unlock()
+		go s.handlePaymentNotifications()
+	} else if e, ok := err.(*ssh.OpenChannelError); !ok || e.Reason != ssh.UnknownChannelType {
+		return err
+	}
+
+	c, r, err = s.conn.OpenChannel("reachability", nil)
 	if err != nil {
 		return err
 	}
@@ -324,6 +373,34 @@ func (s *SSHConnection) Packets() <-chan types.Packet {
 	return s.packet_chan
 }
 
+func (s *SSHConnection) SendPaymentNotification(n PaymentNotification) error {
+	s.payment_enc_l.Lock()
+	defer s.payment_enc_l.Unlock()
+	if s.payment_enc == nil {
+		return errors.New("Peer doesn't accept payment notifications")
+	}
+	return s.payment_enc.Encode(n)
+}
+
+func (s *SSHConnection) handlePaymentNotifications() {
+	for {
+		s.payment_dec_l.Lock()
+		var v PaymentNotification
+		err := s.payment_dec.Decode(&v)
+		if err != nil {
+			close(s.payment_chan)
+			return
+		} else {
+			s.payment_chan <- v
+		}
+		s.payment_dec_l.Unlock()
+	}
+}
+
+func (s *SSHConnection) PaymentNotifications() <-chan PaymentNotification {
+	return s.payment_chan
+}
+
 func (s *SSHConnection) Key() PublicKey {
 	return s.other_metadata.Sig.Key()
 }
@@ -5,8 +5,11 @@ import (
 	"fmt"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/AutoRoute/node/types"
+
+	"golang.org/x/crypto/ssh"
 )
 
 var port = 10000
@@ -110,7 +113,7 @@ func TestSSHPacketTransmission(t *testing.T) {
 	defer c1.Close()
 	defer c2.Close()
 
-	p := types.Packet{types.NodeAddress("foo"), 3, []byte("test")}
+	p := types.Packet{Dest: types.NodeAddress("foo"), Amt: 3, Data: []byte("test")}
 	err = c1.SendPacket(p)
 	if err != nil {
 		t.Fatal(err)
@@ -121,6 +124,73 @@ func TestSSHPacketTransmission(t *testing.T) {
 	}
 }
 
+func TestSSHPaymentNotificationTransmission(t *testing.T) {
+	sk1, _ := NewECDSAKey()
+	sk2, _ := NewECDSAKey()
+	c1, c2, err := ConnectSSH(sk1, sk2)
+	if err != nil {
+		t.Fatalf("Problems establish ssh connection: %v", err)
+		return
+	}
+	defer c1.Close()
+	defer c2.Close()
+
+	n := SignPaymentNotification(sk1, PaymentNotification{Transaction: "abc", Amount: 3})
+	err = c1.SendPaymentNotification(n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	n2 := <-c2.PaymentNotifications()
+	if n2.Transaction != n.Transaction || n2.Amount != n.Amount || n2.Verify() != nil {
+		t.Fatalf("Different notifications? %v != %v", n2, n)
+	}
+}
+
+func TestSSHWithoutPaymentChannel(t *testing.T) {
+	sk1, _ := NewECDSAKey()
+	sk2, _ := NewECDSAKey()
+	addr := fmt.Sprintf("127.0.0.1:%d", port)
+	port += 1
+	lt, err := net.Listen("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l := ListenSSH(lt, sk2, func() SSHMetaData { return SSHMetaData{} })
+
+	// Connect the way peers which predate payment notifications do.
+	ct, err := net.Dial("tcp", addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	signer, _ := ssh.NewSignerFromKey(sk1.K)
+	config := &ssh.ClientConfig{
+		User: string(sk1.PublicKey().Hash()),
+		Auth: []ssh.AuthMethod{ssh.PublicKeys(signer)},
+	}
+	client, chans, reqs, err := ssh.NewClientConn(ct, addr, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c1 := NewSSHConnection(client, chans, reqs, sk1, SSHMetaData{})
+	defer c1.Close()
+	for _, name := range []string{"reachability", "receipt", "packet"} {
+		_, _, err := client.OpenChannel(name, nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	select {
+	case c2 := <-l.Connections():
+		defer c2.Close()
+		if c2.SendPaymentNotification(PaymentNotification{}) == nil {
+			t.Fatal("Sent a payment notification without a payment channel")
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Connection without a payment channel never established")
+	}
+}
+
 func TestSSHSatisfiesConnection(t *testing.T) {
 	_ = Connection(&SSHConnection{})
 }
@@ -0,0 +1,121 @@
+package internal
+
+import (
+	"fmt"
+	"sync"
+
+	"github.com/AutoRoute/node/types"
+)
+
+// RouterStats counts the connections and packets handled by a single Router.
+// Every Router has its own so several can run in one process without mixing
+// their numbers.
+type RouterStats struct {
+	l                *sync.Mutex
+	id               types.NodeAddress
+	connections      map[types.NodeAddress]int64
+	packets_sent     map[types.NodeAddress]int64
+	packets_received map[types.NodeAddress]int64
+	packets_dropped  int64
+}
+
+func newRouterStats(id types.NodeAddress) *RouterStats {
+	return &RouterStats{
+		&sync.Mutex{},
+		id,
+		make(map[types.NodeAddress]int64),
+		make(map[types.NodeAddress]int64),
+		make(map[types.NodeAddress]int64),
+		0,
+	}
+}
+
+func (s *RouterStats) addConnection(id types.NodeAddress) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.connections[id]++
+}
+
+// Counts a packet sent to next, which is us if the packet was for us.
+func (s *RouterStats) sent(next types.NodeAddress) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.packets_sent[next]++
+}
+
+// Counts a packet received from src, which is us if we sent it.
+func (s *RouterStats) received(src types.NodeAddress) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.packets_received[src]++
+}
+
+func (s *RouterStats) dropped() {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.packets_dropped++
+}
+
+// A StatsSnapshot is a copy of one or more routers' counters, keyed by hex
+// encoded addresses. The field names match the expvar variables earlier
+// versions published.
+type StatsSnapshot struct {
+	Id               string
+	Connections      map[string]int64
+	Packets_sent     map[string]int64
+	Packets_received map[string]int64
+	Packets_dropped  int64
+}
+
+func newStatsSnapshot(id string) StatsSnapshot {
+	return StatsSnapshot{
+		id,
+		make(map[string]int64),
+		make(map[string]int64),
+		make(map[string]int64),
+		0,
+	}
+}
+
+func addCounts(to map[string]int64, from map[types.NodeAddress]int64) {
+	for id, n := range from {
+		to[fmt.Sprintf("%x", id)] += n
+	}
+}
+
+func (s *RouterStats) Snapshot() StatsSnapshot {
+	s.l.Lock()
+	defer s.l.Unlock()
+	o := newStatsSnapshot(fmt.Sprintf("%x", s.id))
+	addCounts(o.Connections, s.connections)
+	addCounts(o.Packets_sent, s.packets_sent)
+	addCounts(o.Packets_received, s.packets_received)
+	o.Packets_dropped = s.packets_dropped
+	return o
+}
+
+// Combines the counters of several routers into a single view, for example
+// to watch a whole simulated network in one process. The Id is left empty
+// unless there is only one router.
+func AggregateStats(stats ...*RouterStats) StatsSnapshot {
+	if len(stats) == 1 {
+		return stats[0].Snapshot()
+	}
+	o := newStatsSnapshot("")
+	for _, s := range stats {
+		snapshot := s.Snapshot()
+		for _, m := range []struct {
+			to, from map[string]int64
+		}{
+			{o.Connections, snapshot.Connections},
+			{o.Packets_sent, snapshot.Packets_sent},
+			{o.Packets_received, snapshot.Packets_received},
+		} {
+			for k, v := range m.from {
+				m.to[k] += v
+			}
+		}
+		o.Packets_dropped += snapshot.Packets_dropped
+	}
+	return o
+}
@@ -26,6 +26,26 @@ func makePairedReceiptConnections() (ReceiptConnection, ReceiptConnection) {
 	return testReceiptConnection{one, two}, testReceiptConnection{two, one}
 }
 
+type testPaymentConnection struct {
+	in  chan PaymentNotification
+	out chan PaymentNotification
+}
+
+func (c testPaymentConnection) SendPaymentNotification(n PaymentNotification) error {
+	c.out <- n
+	return nil
+}
+
+func (c testPaymentConnection) PaymentNotifications() <-chan PaymentNotification {
+	return c.in
+}
+
+func makePairedPaymentConnections() (PaymentConnection, PaymentConnection) {
+	one := make(chan PaymentNotification)
+	two := make(chan PaymentNotification)
+	return testPaymentConnection{one, two}, testPaymentConnection{two, one}
+}
+
 type testMapConnection struct {
 	in  chan *BloomReachabilityMap
 	out chan *BloomReachabilityMap
@@ -70,23 +90,33 @@ type testConnection struct {
 	DataConnection
 	MapConnection
 	ReceiptConnection
-	k PublicKey
+	PaymentConnection
+	k     PublicKey
+	meta  SSHMetaData
+	other SSHMetaData
 }
 
 func (t testConnection) Close() error               { return nil }
 func (t testConnection) Key() PublicKey             { return t.k }
-func (t testConnection) MetaData() SSHMetaData      { return SSHMetaData{} }
-func (t testConnection) OtherMetaData() SSHMetaData { return SSHMetaData{} }
+func (t testConnection) MetaData() SSHMetaData      { return t.meta }
+func (t testConnection) OtherMetaData() SSHMetaData { return t.other }
 
 func MakePairedConnections(k1, k2 PublicKey) (Connection, Connection) {
+	return MakePairedConnectionsWithMetaData(k1, k2, SSHMetaData{}, SSHMetaData{})
+}
+
+// Like MakePairedConnections, but m1 is the metadata sent by the owner of k1
+// and m2 the metadata sent by the owner of k2.
+func MakePairedConnectionsWithMetaData(k1, k2 PublicKey, m1, m2 SSHMetaData) (Connection, Connection) {
 	d1, d2 := makePairedDataConnections()
-	m1, m2 := makePairedMapConnections()
+	mc1, mc2 := makePairedMapConnections()
 	r1, r2 := makePairedReceiptConnections()
-	return testConnection{d1, m1, r1, k1}, testConnection{d2, m2, r2, k2}
+	p1, p2 := makePairedPaymentConnections()
+	return testConnection{d1, mc1, r1, p1, k1, m2, m1}, testConnection{d2, mc2, r2, p2, k2, m1, m2}
 }
 
 func testPacket(n types.NodeAddress) types.Packet {
-	return types.Packet{n, 3, []byte("test")}
+	return types.Packet{Dest: n, Amt: 3, Data: []byte("test")}
 }
 
 type Linkable interface {
@@ -100,6 +130,16 @@ func Link(a, b Linkable) {
 	b.AddConnection(c1)
 }
 
+// Links two nodes the way a real connection would, exchanging fresh payment
+// addresses from each node's money system.
+func LinkNodes(a, b *Node) {
+	ma := SSHMetaData{Payment_Address: a.GetNewAddress()}
+	mb := SSHMetaData{Payment_Address: b.GetNewAddress()}
+	c1, c2 := MakePairedConnectionsWithMetaData(a.GetAddress(), b.GetAddress(), ma, mb)
+	a.AddConnection(c2)
+	b.AddConnection(c1)
+}
+
 type testLogger struct {
 	BloomCount   int
 	RouteCount   int
@@ -114,7 +154,7 @@ func (t *testLogger) LogBloomFilter(brm *BloomReachabilityMap) error {
 	return nil
 }
 
-func (t *testLogger) LogRoutingDecision(dest types.NodeAddress, next types.NodeAddress, packet_size int, amt int64, packet_hash types.PacketHash) error {
+func (t *testLogger) LogRoutingDecision(src types.NodeAddress, dest types.NodeAddress, next types.NodeAddress, packet_size int, amt int64, packet_hash types.PacketHash) error {
 	t.l.Lock()
 	defer t.l.Unlock()
 	t.RouteCount++
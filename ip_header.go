@@ -0,0 +1,102 @@
+package node
+
+import (
+	"errors"
+	"fmt"
+	"net"
+)
+
+const (
+	ipv4_header_size = 20
+	ipv6_header_size = 40
+)
+
+var short_packet_error = errors.New("packet too short for its IP header")
+
+// The parts of an IPv4 or IPv6 header the tunnel cares about.
+type ipHeader struct {
+	// 4 or 6.
+	version  int
+	src, dst net.IP
+	// The transport protocol, taken from the IPv6 next header field. IPv6
+	// extension headers aren't followed.
+	protocol byte
+	// Where the transport header starts.
+	length int
+}
+
+// Parses the IP header at the start of a packet read from a tun device.
+func parseIPHeader(b []byte) (ipHeader, error) {
+	if len(b) == 0 {
+		return ipHeader{}, short_packet_error
+	}
+	switch b[0] >> 4 {
+	case 4:
+		if len(b) < ipv4_header_size {
+			return ipHeader{}, short_packet_error
+		}
+		length := int(b[0]&0xF) * 4
+		if length < ipv4_header_size || len(b) < length {
+			return ipHeader{}, short_packet_error
+		}
+		return ipHeader{4, net.IP(b[12:16]), net.IP(b[16:20]), b[9], length}, nil
+	case 6:
+		if len(b) < ipv6_header_size {
+			return ipHeader{}, short_packet_error
+		}
+		return ipHeader{6, net.IP(b[8:24]), net.IP(b[24:40]), b[6], ipv6_header_size}, nil
+	}
+	return ipHeader{}, fmt.Errorf("unknown IP version %d", b[0]>>4)
+}
+
+// Transport protocol numbers.
+const (
+	proto_icmp   = 1
+	proto_tcp    = 6
+	proto_udp    = 17
+	proto_icmpv6 = 58
+)
+
+// Returns the internet checksum of b.
+func checksum(b []byte) uint16 {
+	sum := uint32(0)
+	for i := 0; i+1 < len(b); i += 2 {
+		sum += uint32(b[i])<<8 | uint32(b[i+1])
+	}
+	if len(b)%2 == 1 {
+		sum += uint32(b[len(b)-1]) << 8
+	}
+	for sum>>16 != 0 {
+		sum = sum&0xFFFF + sum>>16
+	}
+	return ^uint16(sum)
+}
+
+// Returns the checksum of a TCP, UDP or ICMPv6 segment including the pseudo
+// header of its IP packet.
+func transportChecksum(src, dst net.IP, protocol byte, segment []byte) uint16 {
+	var pseudo []byte
+	if v4 := src.To4(); v4 != nil {
+		pseudo = append(append(pseudo, v4...), dst.To4()...)
+		pseudo = append(pseudo, 0, protocol, byte(len(segment)>>8), byte(len(segment)))
+	} else {
+		pseudo = append(append(pseudo, src.To16()...), dst.To16()...)
+		l := len(segment)
+		pseudo = append(pseudo, byte(l>>24), byte(l>>16), byte(l>>8), byte(l), 0, 0, 0, protocol)
+	}
+	return checksum(append(pseudo, segment...))
+}
+
+// Updates a checksum for a field changing from old to new, as in RFC 1624.
+// Both must be the same even length.
+func checksumAdjust(sum uint16, old, new []byte) uint16 {
+	acc := uint32(^sum)
+	for i := 0; i+1 < len(old); i += 2 {
+		acc += uint32(^(uint16(old[i])<<8 | uint16(old[i+1])))
+		acc += uint32(new[i])<<8 | uint32(new[i+1])
+	}
+	for acc>>16 != 0 {
+		acc = acc&0xFFFF + acc>>16
+	}
+	return ^uint16(acc)
+}
@@ -0,0 +1,40 @@
+package node
+
+import (
+	"net"
+	"testing"
+)
+
+func TestParseIPHeader(t *testing.T) {
+	for _, c := range []struct {
+		src, dst string
+		version  int
+		length   int
+	}{
+		{"10.0.0.1", "8.8.8.8", 4, ipv4_header_size},
+		{"2001::1", "2002::", 6, ipv6_header_size},
+	} {
+		p := ipTunPacket(c.src, c.dst)
+		h, err := parseIPHeader(p.Packet)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if h.version != c.version || !h.src.Equal(net.ParseIP(c.src)) ||
+			!h.dst.Equal(net.ParseIP(c.dst)) || h.protocol != 17 || h.length != c.length {
+			t.Fatalf("Unexpected header %+v for %+v", h, c)
+		}
+		if _, err := parseIPHeader(p.Packet[:c.length-1]); err == nil {
+			t.Fatalf("Expected a truncated IPv%d header to be rejected", c.version)
+		}
+	}
+
+	// Options make the IPv4 header longer.
+	p := ipTunPacket("10.0.0.1", "8.8.8.8").Packet
+	p[0] = 0x46
+	if h, err := parseIPHeader(p); err != nil || h.length != 24 {
+		t.Fatalf("Expected a 24 byte header got %+v %v", h, err)
+	}
+	if _, err := parseIPHeader([]byte{0x50}); err == nil {
+		t.Fatal("Expected an unknown version to be rejected")
+	}
+}
@@ -1,17 +1,42 @@
 package node
 
 import (
+	"bytes"
 	"encoding/json"
+	"fmt"
 	"io"
 	"sync"
+	"time"
 
+	"github.com/AutoRoute/bloom"
 	"github.com/AutoRoute/node/internal"
 	"github.com/AutoRoute/node/types"
 )
 
-// A routingDecision contains identifying information
-// for a particular packet and where it was sent
-type routingDecision struct {
+// The version of the route log format written by Logger. Logs written before
+// events were tagged are read as version 0.
+const RouteLogVersion = 1
+
+// What a RouteEvent records.
+type RouteEventType string
+
+const (
+	// Written once when a node starts, naming it.
+	StartEvent RouteEventType = "start"
+	// The node's conglomerate bloom filter changed.
+	BloomFilterEvent RouteEventType = "bloom_filter"
+	// A packet was forwarded to a neighbor.
+	RoutingDecisionEvent RouteEventType = "routing_decision"
+	// A receipt covering a packet we forwarded arrived.
+	PacketReceiptEvent RouteEventType = "packet_receipt"
+)
+
+// A RoutingDecision contains identifying information for a particular packet
+// and where it was sent.
+type RoutingDecision struct {
+	// The neighbor the packet came from, or the node itself if it originated
+	// there.
+	Source     types.NodeAddress
 	Dest       types.NodeAddress
 	Next       types.NodeAddress
 	PacketSize int
@@ -19,6 +44,19 @@ type routingDecision struct {
 	PacketHash types.PacketHash
 }
 
+// A RouteEvent is a single entry in a route log. Only the field matching its
+// Type is set.
+type RouteEvent struct {
+	Version int            `json:"version"`
+	Type    RouteEventType `json:"type"`
+	// Zero for version 0 events, which weren't timestamped.
+	Time        time.Time          `json:"time"`
+	Node        types.NodeAddress  `json:"node,omitempty"`
+	BloomFilter *bloom.BloomFilter `json:"bloom_filter,omitempty"`
+	Decision    *RoutingDecision   `json:"routing_decision,omitempty"`
+	Receipt     types.PacketHash   `json:"packet_receipt,omitempty"`
+}
+
 // Logger is used for logging information about what
 // the node knows about the network, where packets
 // are being sent, and confirmation that the packets
@@ -27,32 +65,110 @@ type routingDecision struct {
 type Logger struct {
 	log_enc *json.Encoder
 	lock    *sync.Mutex
+	clock   internal.Clock
 }
 
 func NewLogger(w io.Writer) Logger {
-	return Logger{json.NewEncoder(w), new(sync.Mutex)}
+	return Logger{json.NewEncoder(w), new(sync.Mutex), internal.SystemClock()}
+}
+
+func (lgr Logger) log(e RouteEvent) error {
+	e.Version = RouteLogVersion
+	e.Time = lgr.clock.Now()
+	lgr.lock.Lock()
+	defer lgr.lock.Unlock()
+	return lgr.log_enc.Encode(e)
+}
+
+// LogStart records which node is writing the log. NewServer calls it so
+// later events can be attributed.
+func (lgr Logger) LogStart(id types.NodeAddress) error {
+	return lgr.log(RouteEvent{Type: StartEvent, Node: id})
 }
 
 // LogBloomFilter logs the node's conglomerate bloom filter. Should be called
 // every time a new bloom filter is received.
 func (lgr Logger) LogBloomFilter(brm *internal.BloomReachabilityMap) error {
-	lgr.lock.Lock()
-	defer lgr.lock.Unlock()
-	return lgr.log_enc.Encode(brm.Conglomerate)
+	return lgr.log(RouteEvent{Type: BloomFilterEvent, BloomFilter: brm.Conglomerate})
 }
 
 // LogRoutingDecision logs information on a sent packet. Should be called
 // every time a packet is sent.
-func (lgr Logger) LogRoutingDecision(dest types.NodeAddress, next types.NodeAddress, packet_size int, amt int64, packet_hash types.PacketHash) error {
-	lgr.lock.Lock()
-	defer lgr.lock.Unlock()
-	return lgr.log_enc.Encode(routingDecision{dest, next, packet_size, amt, packet_hash})
+func (lgr Logger) LogRoutingDecision(src types.NodeAddress, dest types.NodeAddress, next types.NodeAddress, packet_size int, amt int64, packet_hash types.PacketHash) error {
+	return lgr.log(RouteEvent{Type: RoutingDecisionEvent,
+		Decision: &RoutingDecision{src, dest, next, packet_size, amt, packet_hash}})
 }
 
 // LogPacketReceipt logs a packet hash from a received receipt. Should be
 // called every time a receipt is received.
 func (lgr Logger) LogPacketReceipt(packet_hash types.PacketHash) error {
-	lgr.lock.Lock()
-	defer lgr.lock.Unlock()
-	return lgr.log_enc.Encode(packet_hash)
+	return lgr.log(RouteEvent{Type: PacketReceiptEvent, Receipt: packet_hash})
+}
+
+// A RouteLogReader reads back the events written by a Logger, including logs
+// from before events were tagged.
+type RouteLogReader struct {
+	dec *json.Decoder
+}
+
+func NewRouteLogReader(r io.Reader) *RouteLogReader {
+	return &RouteLogReader{json.NewDecoder(r)}
+}
+
+// Returns the next event in the log, or io.EOF once there are none left.
+func (r *RouteLogReader) Next() (RouteEvent, error) {
+	var raw json.RawMessage
+	err := r.dec.Decode(&raw)
+	if err != nil {
+		return RouteEvent{}, err
+	}
+	raw = bytes.TrimSpace(raw)
+	// Version 0 receipts were bare packet hashes.
+	if len(raw) > 0 && raw[0] == '"' {
+		e := RouteEvent{Type: PacketReceiptEvent}
+		return e, json.Unmarshal(raw, &e.Receipt)
+	}
+	var fields map[string]json.RawMessage
+	err = json.Unmarshal(raw, &fields)
+	if err != nil {
+		return RouteEvent{}, err
+	}
+	if _, ok := fields["version"]; !ok {
+		return legacyRouteEvent(raw, fields)
+	}
+	var e RouteEvent
+	err = json.Unmarshal(raw, &e)
+	if err != nil {
+		return e, err
+	}
+	if e.Version > RouteLogVersion {
+		return e, fmt.Errorf("Route log version %d is newer than %d", e.Version, RouteLogVersion)
+	}
+	return e, nil
+}
+
+// Decodes an untagged version 0 routing decision or bloom filter.
+func legacyRouteEvent(raw json.RawMessage, fields map[string]json.RawMessage) (RouteEvent, error) {
+	if _, ok := fields["Next"]; ok {
+		e := RouteEvent{Type: RoutingDecisionEvent, Decision: &RoutingDecision{}}
+		return e, json.Unmarshal(raw, e.Decision)
+	}
+	e := RouteEvent{Type: BloomFilterEvent, BloomFilter: &bloom.BloomFilter{}}
+	return e, json.Unmarshal(raw, e.BloomFilter)
+}
+
+// Reads every event in a route log.
+func ReadRouteLog(r io.Reader) ([]RouteEvent, error) {
+	reader := NewRouteLogReader(r)
+	events := make([]RouteEvent, 0)
+	for {
+		e, err := reader.Next()
+		if err == io.EOF {
+			return events, nil
+		}
+		if err != nil {
+			return events, err
+		}
+		events = append(events, e)
+	}
 }
@@ -3,12 +3,29 @@ package node
 import (
 	"bytes"
 	"encoding/json"
+	"strings"
 	"testing"
+	"time"
 
 	"github.com/AutoRoute/node/internal"
 	"github.com/AutoRoute/node/types"
 )
 
+func readOneEvent(t *testing.T, buf *bytes.Buffer, expected RouteEventType) RouteEvent {
+	events, err := ReadRouteLog(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(events) != 1 {
+		t.Fatalf("Expected one event got %v", events)
+	}
+	e := events[0]
+	if e.Type != expected {
+		t.Fatalf("Expected %s event got %s", expected, e.Type)
+	}
+	return e
+}
+
 func TestLogBloomFilter(t *testing.T) {
 	buf := bytes.Buffer{}
 	lgr := NewLogger(&buf)
@@ -23,39 +40,35 @@ func TestLogBloomFilter(t *testing.T) {
 	}
 
 	var bloomMap2 internal.BloomReachabilityMap
-	dec := json.NewDecoder(&buf)
-	err = dec.Decode(&bloomMap2.Conglomerate)
-	if err != nil {
-		t.Fatal(err)
-	}
-
+	bloomMap2.Conglomerate = readOneEvent(t, &buf, BloomFilterEvent).BloomFilter
 	if !(bloomMap2.IsReachable(a)) {
-		t.Fatal("Expected %s to be reachable in %v", a, bloomMap2)
+		t.Fatalf("Expected %s to be reachable in %v", a, bloomMap2)
 	}
 }
 
 func TestLogRoutingDecision(t *testing.T) {
 	buf := bytes.Buffer{}
+	now := time.Unix(1000, 0)
 	lgr := NewLogger(&buf)
+	lgr.clock = internal.NewFakeClock(now)
+	src := types.NodeAddress("source")
 	dest := types.NodeAddress("destination")
 	next := types.NodeAddress("next_hop")
 	packet_size := 10
 	packet_hash := types.PacketHash("packet_hash")
 	amt := int64(7)
 
-	err := lgr.LogRoutingDecision(dest, next, packet_size, amt, packet_hash)
+	err := lgr.LogRoutingDecision(src, dest, next, packet_size, amt, packet_hash)
 	if err != nil {
 		t.Fatal(err)
 	}
 
-	var rd routingDecision
-	dec := json.NewDecoder(&buf)
-	err = dec.Decode(&rd)
-	if err != nil {
-		t.Fatal(err)
+	e := readOneEvent(t, &buf, RoutingDecisionEvent)
+	if e.Version != RouteLogVersion || !e.Time.Equal(now) {
+		t.Fatalf("Unexpected version %d or time %v", e.Version, e.Time)
 	}
-
-	if rd.Dest != dest || rd.Next != next ||
+	rd := e.Decision
+	if rd.Source != src || rd.Dest != dest || rd.Next != next ||
 		rd.PacketSize != packet_size || rd.Amt != amt ||
 		rd.PacketHash != packet_hash {
 		t.Fatal("Unexpected log entry", rd.Dest, rd.Next, rd.PacketSize, rd.Amt)
@@ -72,14 +85,54 @@ func TestLogPacketReceipt(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	var packet_hash_out types.PacketHash
-	dec := json.NewDecoder(&buf)
-	err = dec.Decode(&packet_hash_out)
+	packet_hash_out := readOneEvent(t, &buf, PacketReceiptEvent).Receipt
+	if packet_hash_in != packet_hash_out {
+		t.Fatalf("Unexpected packet hash: %v != %v", packet_hash_in, packet_hash_out)
+	}
+}
+
+// Logs written before events were tagged can still be read.
+func TestReadLegacyRouteLog(t *testing.T) {
+	buf := bytes.Buffer{}
+	enc := json.NewEncoder(&buf)
+	bloomMap := internal.NewBloomReachabilityMap()
+	bloomMap.AddEntry(types.NodeAddress("1"))
+	enc.Encode(bloomMap.Conglomerate)
+	enc.Encode(struct {
+		Dest       types.NodeAddress
+		Next       types.NodeAddress
+		PacketSize int
+		Amt        int64
+		PacketHash types.PacketHash
+	}{"dest", "next", 10, 7, "hash"})
+	enc.Encode(types.PacketHash("hash"))
+
+	events, err := ReadRouteLog(&buf)
 	if err != nil {
 		t.Fatal(err)
 	}
+	if len(events) != 3 {
+		t.Fatalf("Expected 3 events got %v", events)
+	}
+	if events[0].Type != BloomFilterEvent || events[0].BloomFilter == nil {
+		t.Fatalf("Expected a bloom filter got %v", events[0])
+	}
+	if events[1].Type != RoutingDecisionEvent || events[1].Decision.Next != "next" || events[1].Decision.Amt != 7 {
+		t.Fatalf("Expected a routing decision got %v", events[1])
+	}
+	if events[2].Type != PacketReceiptEvent || events[2].Receipt != "hash" {
+		t.Fatalf("Expected a receipt got %v", events[2])
+	}
+	for _, e := range events {
+		if e.Version != 0 || !e.Time.IsZero() {
+			t.Fatalf("Expected an untimed version 0 event got %v", e)
+		}
+	}
+}
 
-	if packet_hash_in != packet_hash_out {
-		t.Fatalf("Unexpected packet hash: %v != %v", packet_hash_in, packet_hash_out)
+func TestReadNewerRouteLog(t *testing.T) {
+	_, err := ReadRouteLog(strings.NewReader(`{"version": 1000, "type": "start"}`))
+	if err == nil {
+		t.Fatal("Expected an error reading a newer log")
 	}
 }
@@ -0,0 +1,125 @@
+package node
+
+import (
+	"encoding/binary"
+	"net"
+)
+
+const (
+	// The smallest MTU a tunnel may have, which is the least IPv6 allows.
+	min_tunnel_mtu = 1280
+	// Leaves room for the tunnel and connection framing inside a 1500 byte
+	// link.
+	default_tunnel_mtu = 1400
+)
+
+// Returns the MTU of a tunnel whose client asked for asked bytes and whose
+// server allows at most most. An asked of 0 means the client didn't say.
+func negotiateMTU(asked int, most int) int {
+	mtu := most
+	if asked != 0 && asked < mtu {
+		mtu = asked
+	}
+	if mtu < min_tunnel_mtu {
+		mtu = min_tunnel_mtu
+	}
+	return mtu
+}
+
+// Splits an IPv4 packet into fragments of at most mtu bytes. Returns nil if
+// the packet isn't IPv4 or mustn't be fragmented, in which case the sender
+// should be told with packetTooBig.
+func fragment(p []byte, mtu int) [][]byte {
+	h, err := parseIPHeader(p)
+	if err != nil || h.version != 4 {
+		return nil
+	}
+	flags := binary.BigEndian.Uint16(p[6:])
+	if flags&0x4000 != 0 {
+		return nil
+	}
+	step := (mtu - h.length) &^ 7
+	if step <= 0 {
+		return nil
+	}
+	offset := int(flags & 0x1FFF)
+	payload := p[h.length:]
+	fragments := make([][]byte, 0, (len(payload)+step-1)/step)
+	for i := 0; i < len(payload); i += step {
+		end := i + step
+		more := flags & 0x2000
+		if end < len(payload) {
+			more = 0x2000
+		} else {
+			end = len(payload)
+		}
+		f := make([]byte, h.length+end-i)
+		copy(f, p[:h.length])
+		copy(f[h.length:], payload[i:end])
+		binary.BigEndian.PutUint16(f[2:], uint16(len(f)))
+		binary.BigEndian.PutUint16(f[6:], uint16(offset+i/8)|more)
+		f[10], f[11] = 0, 0
+		binary.BigEndian.PutUint16(f[10:], checksum(f[:h.length]))
+		fragments = append(fragments, f)
+	}
+	return fragments
+}
+
+// Returns an ICMP fragmentation needed or ICMPv6 packet too big message
+// telling the sender of p to send packets of at most mtu bytes. It comes from
+// p's destination so it passes any filtering of where packets on the tun
+// device come from. Returns nil if p shouldn't be answered, such as when it is
+// an ICMP error itself.
+func packetTooBig(p []byte, mtu int) []byte {
+	h, err := parseIPHeader(p)
+	if err != nil || len(p) <= h.length || h.src.IsUnspecified() || h.src.IsMulticast() {
+		return nil
+	}
+	icmp_type := p[h.length]
+	if h.version == 4 {
+		if h.protocol == proto_icmp && icmp_type != 0 && icmp_type != 8 {
+			return nil
+		}
+		quote := p
+		if len(quote) > h.length+8 {
+			quote = quote[:h.length+8]
+		}
+		b := make([]byte, ipv4_header_size+8+len(quote))
+		b[0] = 0x45
+		binary.BigEndian.PutUint16(b[2:], uint16(len(b)))
+		b[8] = 64
+		b[9] = proto_icmp
+		copy(b[12:16], h.dst)
+		copy(b[16:20], h.src)
+		binary.BigEndian.PutUint16(b[10:], checksum(b[:ipv4_header_size]))
+		icmp := b[ipv4_header_size:]
+		icmp[0] = 3
+		icmp[1] = 4
+		binary.BigEndian.PutUint16(icmp[6:], uint16(mtu))
+		copy(icmp[8:], quote)
+		binary.BigEndian.PutUint16(icmp[2:], checksum(icmp))
+		return b
+	}
+
+	if h.protocol == proto_icmpv6 && icmp_type < 128 {
+		return nil
+	}
+	// As much of the packet as fits in the smallest IPv6 MTU.
+	quote := p
+	if len(quote) > min_tunnel_mtu-ipv6_header_size-8 {
+		quote = quote[:min_tunnel_mtu-ipv6_header_size-8]
+	}
+	b := make([]byte, ipv6_header_size+8+len(quote))
+	b[0] = 0x60
+	binary.BigEndian.PutUint16(b[4:], uint16(8+len(quote)))
+	b[6] = proto_icmpv6
+	b[7] = 64
+	copy(b[8:24], h.dst)
+	copy(b[24:40], h.src)
+	icmp := b[ipv6_header_size:]
+	icmp[0] = 2
+	binary.BigEndian.PutUint32(icmp[4:], uint32(mtu))
+	copy(icmp[8:], quote)
+	binary.BigEndian.PutUint16(icmp[2:], transportChecksum(net.IP(b[8:24]), net.IP(b[24:40]), proto_icmpv6, icmp))
+	return b
+}
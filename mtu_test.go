@@ -0,0 +1,109 @@
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"testing"
+)
+
+// Builds a UDP packet of n bytes.
+func bigPacket(src, dst string, n int) []byte {
+	p := transportPacket(proto_udp, src, dst, 1000, 53)
+	p = append(p, make([]byte, n-len(p))...)
+	if p[0]>>4 == 4 {
+		binary.BigEndian.PutUint16(p[2:], uint16(n))
+		p[10], p[11] = 0, 0
+		binary.BigEndian.PutUint16(p[10:], checksum(p[:ipv4_header_size]))
+	} else {
+		binary.BigEndian.PutUint16(p[4:], uint16(n-ipv6_header_size))
+	}
+	return p
+}
+
+func TestNegotiateMTU(t *testing.T) {
+	for _, c := range []struct{ asked, most, mtu int }{
+		{0, 1400, 1400},
+		{1300, 1400, 1300},
+		{1500, 1400, 1400},
+		{576, 1400, min_tunnel_mtu},
+	} {
+		if mtu := negotiateMTU(c.asked, c.most); mtu != c.mtu {
+			t.Fatalf("Asking for %d of %d got %d not %d", c.asked, c.most, mtu, c.mtu)
+		}
+	}
+}
+
+func TestFragment(t *testing.T) {
+	p := bigPacket("10.64.0.1", "8.8.8.8", 3000)
+	fragments := fragment(p, 1300)
+	if len(fragments) != 3 {
+		t.Fatalf("Expected 3 fragments got %d", len(fragments))
+	}
+	var payload []byte
+	for i, f := range fragments {
+		if len(f) > 1300 || int(binary.BigEndian.Uint16(f[2:])) != len(f) {
+			t.Fatalf("Fragment %d is %d bytes", i, len(f))
+		}
+		if checksum(f[:ipv4_header_size]) != 0 {
+			t.Fatalf("Bad header checksum in fragment %d", i)
+		}
+		flags := binary.BigEndian.Uint16(f[6:])
+		if int(flags&0x1FFF)*8 != len(payload) || (flags&0x2000 != 0) != (i < 2) {
+			t.Fatalf("Fragment %d has flags and offset %x", i, flags)
+		}
+		payload = append(payload, f[ipv4_header_size:]...)
+	}
+	if !bytes.Equal(payload, p[ipv4_header_size:]) {
+		t.Fatal("Fragments don't add up to the packet")
+	}
+
+	// Packets which mustn't be fragmented, and IPv6 packets, aren't.
+	p[6] |= 0x40
+	if fragment(p, 1300) != nil {
+		t.Fatal("Fragmented a packet with don't fragment set")
+	}
+	if fragment(bigPacket("2001::1", "2002::", 3000), 1300) != nil {
+		t.Fatal("Fragmented an IPv6 packet")
+	}
+}
+
+func TestPacketTooBig(t *testing.T) {
+	for _, c := range []struct {
+		src, dst string
+		icmp     byte
+	}{
+		{"10.64.0.1", "8.8.8.8", 3},
+		{"2001::1", "2002::", 2},
+	} {
+		p := bigPacket(c.src, c.dst, 3000)
+		reply := packetTooBig(p, 1300)
+		if reply == nil {
+			t.Fatalf("No reply to %v", c.src)
+		}
+		checkChecksums(t, reply)
+		h, _ := parseIPHeader(reply)
+		if h.src.String() != c.dst || h.dst.String() != c.src || reply[h.length] != c.icmp {
+			t.Fatalf("Unexpected reply %v -> %v type %d", h.src, h.dst, reply[h.length])
+		}
+		if len(reply) > min_tunnel_mtu {
+			t.Fatalf("Reply is %d bytes", len(reply))
+		}
+		var mtu int
+		if h.version == 4 {
+			mtu = int(binary.BigEndian.Uint16(reply[h.length+6:]))
+		} else {
+			mtu = int(binary.BigEndian.Uint32(reply[h.length+4:]))
+		}
+		if mtu != 1300 {
+			t.Fatalf("Reply has MTU %d", mtu)
+		}
+		if !bytes.Equal(reply[h.length+8:], p[:len(reply)-h.length-8]) {
+			t.Fatal("Reply doesn't quote the packet")
+		}
+
+		// Errors aren't answered with errors.
+		if packetTooBig(reply, 1300) != nil {
+			t.Fatal("Answered an ICMP error")
+		}
+	}
+}
@@ -0,0 +1,403 @@
+package node
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AutoRoute/node/internal"
+)
+
+// How long an idle flow keeps its mapping.
+const (
+	nat_tcp_timeout = 2 * time.Hour
+	// Once either side sends a FIN or RST.
+	nat_tcp_closing_timeout = 10 * time.Second
+	nat_udp_timeout         = 5 * time.Minute
+	nat_icmp_timeout        = time.Minute
+)
+
+// The external ports or ICMP identifiers mappings are made from.
+const (
+	nat_first_port = 32768
+	nat_last_port  = 61000
+)
+
+var nat_exhausted_error = errors.New("no free NAT ports")
+
+// One side of a flow: the transport protocol, an address, and a port or ICMP
+// echo identifier.
+type natEndpoint struct {
+	protocol byte
+	ip       string
+	port     uint16
+}
+
+type natMapping struct {
+	internal natEndpoint
+	external uint16
+	expires  time.Time
+	closing  bool
+}
+
+// A NAT rewrites the source of packets leaving the tunnel to a single
+// address, and the destination of replies back, so an exit node can reach the
+// internet without any kernel NAT configuration. TCP, UDP and ICMP echo flows
+// are tracked, and ICMP errors about them are translated back to the client;
+// other packets are refused.
+//
+// Packets are rewritten in place with their checksums updated.
+type NAT struct {
+	address net.IP
+	next    map[byte]uint16
+	// Mappings by the client's side of the flow, and by protocol and external
+	// port.
+	outbound map[natEndpoint]*natMapping
+	inbound  map[natEndpoint]*natMapping
+	clock    internal.Clock
+	l        *sync.Mutex
+}
+
+// Creates a NAT which translates to address. Replies to address must be
+// routed to the exit node's tun device, so it shouldn't be assigned to any
+// local interface.
+func NewNAT(address net.IP, clock internal.Clock) *NAT {
+	if v4 := address.To4(); v4 != nil {
+		address = v4
+	}
+	return &NAT{
+		address,
+		make(map[byte]uint16),
+		make(map[natEndpoint]*natMapping),
+		make(map[natEndpoint]*natMapping),
+		clock,
+		&sync.Mutex{},
+	}
+}
+
+// Returns the address packets are translated to.
+func (n *NAT) Address() net.IP {
+	return n.address
+}
+
+// Where a packet's port or identifier is, and which checksums cover it.
+type natLayout struct {
+	h ipHeader
+	// Offsets of the source and destination ports, which are the same for
+	// ICMP echo identifiers.
+	src_port, dst_port int
+	// Offset of the transport checksum, or -1 if there is none to update.
+	sum int
+	// Whether the transport checksum covers the IP addresses.
+	pseudo bool
+}
+
+func natPacketLayout(p []byte, outbound bool) (natLayout, error) {
+	h, err := parseIPHeader(p)
+	if err != nil {
+		return natLayout{}, err
+	}
+	if h.version == 4 && binary.BigEndian.Uint16(p[6:8])&0x1FFF != 0 {
+		return natLayout{}, errors.New("can't translate IP fragments")
+	}
+	t := h.length
+	switch h.protocol {
+	case proto_tcp:
+		if len(p) < t+20 {
+			return natLayout{}, short_packet_error
+		}
+		return natLayout{h, t, t + 2, t + 16, true}, nil
+	case proto_udp:
+		if len(p) < t+8 {
+			return natLayout{}, short_packet_error
+		}
+		sum := t + 6
+		// A zero IPv4 UDP checksum means it wasn't computed.
+		if h.version == 4 && p[sum] == 0 && p[sum+1] == 0 {
+			sum = -1
+		}
+		return natLayout{h, t, t + 2, sum, true}, nil
+	case proto_icmp, proto_icmpv6:
+		if len(p) < t+8 {
+			return natLayout{}, short_packet_error
+		}
+		// Requests go out and replies come back.
+		echo := map[byte]byte{proto_icmp: 0, proto_icmpv6: 129}
+		if outbound {
+			echo = map[byte]byte{proto_icmp: 8, proto_icmpv6: 128}
+		}
+		if p[t] != echo[h.protocol] {
+			return natLayout{}, fmt.Errorf("can't translate ICMP type %d", p[t])
+		}
+		return natLayout{h, t + 4, t + 4, t + 2, h.protocol == proto_icmpv6}, nil
+	}
+	return natLayout{}, fmt.Errorf("can't translate protocol %d", h.protocol)
+}
+
+// Overwrites the bytes at off with value, fixing up the checksums covering
+// them.
+func natRewrite(p []byte, l natLayout, off int, value []byte, is_address bool) {
+	old := make([]byte, len(value))
+	copy(old, p[off:off+len(value)])
+	copy(p[off:], value)
+	if is_address && l.h.version == 4 {
+		sum := checksumAdjust(binary.BigEndian.Uint16(p[10:12]), old, value)
+		binary.BigEndian.PutUint16(p[10:12], sum)
+	}
+	if l.sum >= 0 && (!is_address || l.pseudo) {
+		sum := checksumAdjust(binary.BigEndian.Uint16(p[l.sum:l.sum+2]), old, value)
+		if sum == 0 && l.h.protocol == proto_udp {
+			sum = 0xFFFF
+		}
+		binary.BigEndian.PutUint16(p[l.sum:l.sum+2], sum)
+	}
+}
+
+func natTimeout(protocol byte) time.Duration {
+	switch protocol {
+	case proto_tcp:
+		return nat_tcp_timeout
+	case proto_udp:
+		return nat_udp_timeout
+	}
+	return nat_icmp_timeout
+}
+
+// Extends a mapping after it carries a packet.
+func (n *NAT) touch(m *natMapping, p []byte, l natLayout) {
+	if l.h.protocol == proto_tcp && p[l.h.length+13]&0x05 != 0 {
+		// FIN or RST
+		m.closing = true
+	}
+	timeout := natTimeout(m.internal.protocol)
+	if m.closing {
+		timeout = nat_tcp_closing_timeout
+	}
+	m.expires = n.clock.Now().Add(timeout)
+}
+
+// Finds or makes the mapping for a client's flow.
+func (n *NAT) mapping(e natEndpoint) (*natMapping, error) {
+	if m, ok := n.outbound[e]; ok {
+		return m, nil
+	}
+	n.expire(n.clock.Now())
+	for i := 0; i <= nat_last_port-nat_first_port; i++ {
+		port := n.next[e.protocol]
+		if port < nat_first_port || port > nat_last_port {
+			port = nat_first_port
+		}
+		n.next[e.protocol] = port + 1
+		key := natEndpoint{e.protocol, "", port}
+		if _, ok := n.inbound[key]; ok {
+			continue
+		}
+		m := &natMapping{e, port, time.Time{}, false}
+		n.outbound[e] = m
+		n.inbound[key] = m
+		return m, nil
+	}
+	return nil, nat_exhausted_error
+}
+
+// Rewrites a packet from a tunnel client so it appears to come from the NAT
+// address.
+func (n *NAT) Outbound(p []byte) error {
+	l, err := natPacketLayout(p, true)
+	if err != nil {
+		return err
+	}
+	if l.h.version == 4 && n.address.To4() == nil || l.h.version == 6 && n.address.To4() != nil {
+		return fmt.Errorf("can't translate IPv%d to %v", l.h.version, n.address)
+	}
+	e := natEndpoint{l.h.protocol, l.h.src.String(), binary.BigEndian.Uint16(p[l.src_port:])}
+
+	n.l.Lock()
+	defer n.l.Unlock()
+	m, err := n.mapping(e)
+	if err != nil {
+		return err
+	}
+	n.touch(m, p, l)
+
+	src := 12
+	if l.h.version == 6 {
+		src = 8
+	}
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, m.external)
+	natRewrite(p, l, src, n.address, true)
+	natRewrite(p, l, l.src_port, port, false)
+	return nil
+}
+
+// Rewrites a reply to the NAT address so it goes to the client which started
+// the flow. Returns false if the packet isn't part of a known flow.
+func (n *NAT) Inbound(p []byte) bool {
+	h, err := parseIPHeader(p)
+	if err != nil || !h.dst.Equal(n.address) {
+		return false
+	}
+	if len(p) >= h.length+8 && icmpError(h.protocol, p[h.length]) {
+		return n.inboundError(p, h)
+	}
+	l, err := natPacketLayout(p, false)
+	if err != nil {
+		return false
+	}
+	key := natEndpoint{l.h.protocol, "", binary.BigEndian.Uint16(p[l.dst_port:])}
+
+	n.l.Lock()
+	defer n.l.Unlock()
+	m, ok := n.inbound[key]
+	if !ok || n.clock.Now().After(m.expires) {
+		return false
+	}
+	n.touch(m, p, l)
+
+	dst := 16
+	if l.h.version == 6 {
+		dst = 24
+	}
+	ip := net.ParseIP(m.internal.ip)
+	if l.h.version == 4 {
+		ip = ip.To4()
+	}
+	port := make([]byte, 2)
+	binary.BigEndian.PutUint16(port, m.internal.port)
+	natRewrite(p, l, dst, ip, true)
+	natRewrite(p, l, l.dst_port, port, false)
+	return true
+}
+
+// Reports whether an ICMP message of type t is an error quoting the packet
+// which caused it, such as destination unreachable, packet too big or time
+// exceeded.
+func icmpError(protocol, t byte) bool {
+	switch protocol {
+	case proto_icmp:
+		return t == 3 || t == 11 || t == 12
+	case proto_icmpv6:
+		return t >= 1 && t <= 4
+	}
+	return false
+}
+
+// Translates an ICMP error about a packet a client sent. Both the error and
+// the packet it quotes are rewritten, so the error reaches the client about a
+// packet the client recognises.
+func (n *NAT) inboundError(p []byte, h ipHeader) bool {
+	if h.version == 4 && binary.BigEndian.Uint16(p[6:8])&0x1FFF != 0 {
+		return false
+	}
+	t := h.length
+	quoted := p[t+8:]
+	inner, err := parseIPHeader(quoted)
+	if err != nil || inner.version != h.version || !inner.src.Equal(n.address) {
+		return false
+	}
+	// Errors quote at least the first 8 bytes of the transport header, which
+	// hold the ports or echo identifier, but not necessarily its checksum.
+	it := inner.length
+	if len(quoted) < it+8 {
+		return false
+	}
+	port, sum := it, -1
+	switch inner.protocol {
+	case proto_tcp:
+		sum = it + 16
+	case proto_udp:
+		sum = it + 6
+		if quoted[sum] == 0 && quoted[sum+1] == 0 {
+			sum = -1
+		}
+	case proto_icmp, proto_icmpv6:
+		echo := map[byte]byte{proto_icmp: 8, proto_icmpv6: 128}
+		if quoted[it] != echo[inner.protocol] {
+			return false
+		}
+		port, sum = it+4, it+2
+	default:
+		return false
+	}
+	if sum+2 > len(quoted) {
+		sum = -1
+	}
+	key := natEndpoint{inner.protocol, "", binary.BigEndian.Uint16(quoted[port:])}
+
+	n.l.Lock()
+	m, ok := n.inbound[key]
+	if !ok || n.clock.Now().After(m.expires) {
+		n.l.Unlock()
+		return false
+	}
+	e := m.internal
+	n.l.Unlock()
+
+	ip := net.ParseIP(e.ip)
+	src, dst := 8, 24
+	if h.version == 4 {
+		ip = ip.To4()
+		src, dst = 12, 16
+	}
+	value := make([]byte, 2)
+	binary.BigEndian.PutUint16(value, e.port)
+	// The quoted transport checksum covers the addresses unless it's ICMPv4.
+	l := natLayout{inner, port, port, sum, inner.protocol != proto_icmp}
+	natRewrite(quoted, l, src, ip, true)
+	natRewrite(quoted, l, port, value, false)
+
+	copy(p[dst:], ip)
+	if h.version == 4 {
+		p[10], p[11] = 0, 0
+		binary.BigEndian.PutUint16(p[10:12], checksum(p[:t]))
+	}
+	// The quoted packet changed as well as the address, so the ICMP checksum
+	// is worked out again rather than adjusted.
+	p[t+2], p[t+3] = 0, 0
+	if h.protocol == proto_icmp {
+		binary.BigEndian.PutUint16(p[t+2:], checksum(p[t:]))
+	} else {
+		binary.BigEndian.PutUint16(p[t+2:], transportChecksum(h.src, ip, h.protocol, p[t:]))
+	}
+	return true
+}
+
+// Forgets every flow from ip, such as when the client it was leased to goes
+// away.
+func (n *NAT) Flush(ip net.IP) {
+	n.l.Lock()
+	defer n.l.Unlock()
+	for key, m := range n.inbound {
+		if m.internal.ip == ip.String() {
+			delete(n.inbound, key)
+			delete(n.outbound, m.internal)
+		}
+	}
+}
+
+func (n *NAT) expire(now time.Time) {
+	for key, m := range n.inbound {
+		if now.After(m.expires) {
+			delete(n.inbound, key)
+			delete(n.outbound, m.internal)
+		}
+	}
+}
+
+// Forgets flows which have been idle too long.
+func (n *NAT) Expire() {
+	n.l.Lock()
+	defer n.l.Unlock()
+	n.expire(n.clock.Now())
+}
+
+// Returns the number of flows being tracked.
+func (n *NAT) Flows() int {
+	n.l.Lock()
+	defer n.l.Unlock()
+	return len(n.outbound)
+}
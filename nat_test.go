@@ -0,0 +1,382 @@
+package node
+
+import (
+	"encoding/binary"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AutoRoute/tuntap"
+
+	"github.com/AutoRoute/node/internal"
+	"github.com/AutoRoute/node/types"
+)
+
+// Builds a packet with valid checksums. For ICMP the ports are the type and
+// the echo identifier.
+func transportPacket(protocol byte, src, dst string, sport, dport uint16) []byte {
+	src_ip, dst_ip := net.ParseIP(src), net.ParseIP(dst)
+	var segment []byte
+	switch protocol {
+	case proto_tcp:
+		segment = make([]byte, 24)
+		binary.BigEndian.PutUint16(segment[0:], sport)
+		binary.BigEndian.PutUint16(segment[2:], dport)
+		segment[12] = 5 << 4
+		segment[13] = 0x02 // SYN
+	case proto_udp:
+		segment = make([]byte, 12)
+		binary.BigEndian.PutUint16(segment[0:], sport)
+		binary.BigEndian.PutUint16(segment[2:], dport)
+		binary.BigEndian.PutUint16(segment[4:], uint16(len(segment)))
+	case proto_icmp, proto_icmpv6:
+		segment = make([]byte, 12)
+		segment[0] = byte(sport)
+		binary.BigEndian.PutUint16(segment[4:], dport)
+	}
+	copy(segment[len(segment)-4:], "data")
+
+	var p []byte
+	if v4 := src_ip.To4(); v4 != nil {
+		p = make([]byte, ipv4_header_size)
+		p[0] = 0x45
+		binary.BigEndian.PutUint16(p[2:], uint16(ipv4_header_size+len(segment)))
+		p[8] = 64
+		p[9] = protocol
+		copy(p[12:16], v4)
+		copy(p[16:20], dst_ip.To4())
+		binary.BigEndian.PutUint16(p[10:], checksum(p))
+	} else {
+		p = make([]byte, ipv6_header_size)
+		p[0] = 0x60
+		binary.BigEndian.PutUint16(p[4:], uint16(len(segment)))
+		p[6] = protocol
+		p[7] = 64
+		copy(p[8:24], src_ip)
+		copy(p[24:40], dst_ip)
+	}
+
+	sum := 16
+	switch protocol {
+	case proto_udp:
+		sum = 6
+	case proto_icmp, proto_icmpv6:
+		sum = 2
+	}
+	if protocol == proto_icmp {
+		binary.BigEndian.PutUint16(segment[sum:], checksum(segment))
+	} else {
+		binary.BigEndian.PutUint16(segment[sum:], transportChecksum(src_ip, dst_ip, protocol, segment))
+	}
+	return append(p, segment...)
+}
+
+// Checks every checksum in a packet is still correct.
+func checkChecksums(t *testing.T, p []byte) {
+	h, err := parseIPHeader(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.version == 4 && checksum(p[:h.length]) != 0 {
+		t.Fatalf("Bad IPv4 header checksum in %x", p)
+	}
+	segment := p[h.length:]
+	if h.protocol == proto_icmp {
+		if checksum(segment) != 0 {
+			t.Fatalf("Bad ICMP checksum in %x", p)
+		}
+	} else if transportChecksum(h.src, h.dst, h.protocol, segment) != 0 {
+		t.Fatalf("Bad transport checksum in %x", p)
+	}
+}
+
+// Returns a packet's source and destination address and port, or ICMP
+// identifier.
+func endpoints(t *testing.T, p []byte) (string, uint16, string, uint16) {
+	h, err := parseIPHeader(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	segment := p[h.length:]
+	if h.protocol == proto_icmp || h.protocol == proto_icmpv6 {
+		id := binary.BigEndian.Uint16(segment[4:])
+		return h.src.String(), id, h.dst.String(), id
+	}
+	return h.src.String(), binary.BigEndian.Uint16(segment[0:]),
+		h.dst.String(), binary.BigEndian.Uint16(segment[2:])
+}
+
+func TestChecksum(t *testing.T) {
+	// The example from RFC 1071.
+	b := []byte{0x00, 0x01, 0xf2, 0x03, 0xf4, 0xf5, 0xf6, 0xf7}
+	if sum := checksum(b); sum != ^uint16(0xddf2) {
+		t.Fatalf("Expected %x got %x", ^uint16(0xddf2), sum)
+	}
+	// Adjusting for a change matches recomputing.
+	sum := checksum(b)
+	changed := append([]byte{}, b...)
+	copy(changed[2:4], []byte{0x12, 0x34})
+	if adjusted := checksumAdjust(sum, b[2:4], changed[2:4]); adjusted != checksum(changed) {
+		t.Fatalf("Adjusted %x but recomputed %x", adjusted, checksum(changed))
+	}
+}
+
+func TestNATRoundTrip(t *testing.T) {
+	for _, c := range []struct {
+		protocol          byte
+		client, server    string
+		nat               string
+		request, response uint16
+	}{
+		{proto_tcp, "10.64.0.1", "8.8.8.8", "192.0.2.1", 0, 0},
+		{proto_udp, "10.64.0.1", "8.8.8.8", "192.0.2.1", 0, 0},
+		{proto_icmp, "10.64.0.1", "8.8.8.8", "192.0.2.1", 8, 0},
+		{proto_tcp, "2001::1", "2002::", "2001:db8::1", 0, 0},
+		{proto_udp, "2001::1", "2002::", "2001:db8::1", 0, 0},
+		{proto_icmpv6, "2001::1", "2002::", "2001:db8::1", 128, 129},
+	} {
+		nat := NewNAT(net.ParseIP(c.nat), internal.SystemClock())
+		sport, dport := uint16(1234), uint16(80)
+		if c.request != 0 {
+			sport, dport = c.request, 1234
+		}
+		p := transportPacket(c.protocol, c.client, c.server, sport, dport)
+		err := nat.Outbound(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		checkChecksums(t, p)
+		src, external, dst, _ := endpoints(t, p)
+		if src != c.nat || dst != c.server || external < nat_first_port || external > nat_last_port {
+			t.Fatalf("Protocol %d translated to %v:%d -> %v", c.protocol, src, external, dst)
+		}
+
+		// The reply goes back to the client.
+		if c.request != 0 {
+			sport, dport = c.response, external
+		} else {
+			sport, dport = 80, external
+		}
+		reply := transportPacket(c.protocol, c.server, c.nat, sport, dport)
+		if !nat.Inbound(reply) {
+			t.Fatalf("Protocol %d reply wasn't translated", c.protocol)
+		}
+		checkChecksums(t, reply)
+		src, _, dst, port := endpoints(t, reply)
+		if src != c.server || dst != c.client || port != 1234 {
+			t.Fatalf("Protocol %d reply translated to %v -> %v:%d", c.protocol, src, dst, port)
+		}
+		if nat.Flows() != 1 {
+			t.Fatalf("Expected 1 flow got %d", nat.Flows())
+		}
+	}
+}
+
+func TestNATMappings(t *testing.T) {
+	nat := NewNAT(net.ParseIP("192.0.2.1"), internal.SystemClock())
+	external := func(src string, port uint16) uint16 {
+		p := transportPacket(proto_udp, src, "8.8.8.8", port, 53)
+		err := nat.Outbound(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, e, _, _ := endpoints(t, p)
+		return e
+	}
+	a := external("10.64.0.1", 1000)
+	b := external("10.64.0.2", 1000)
+	if a == b {
+		t.Fatalf("Two clients share external port %d", a)
+	}
+	if again := external("10.64.0.1", 1000); again != a {
+		t.Fatalf("Flow moved from %d to %d", a, again)
+	}
+
+	// Unknown flows and unsupported packets are refused.
+	if nat.Inbound(transportPacket(proto_udp, "8.8.8.8", "192.0.2.1", 53, 1)) {
+		t.Fatal("Translated a reply to an unknown port")
+	}
+	if nat.Inbound(transportPacket(proto_tcp, "8.8.8.8", "192.0.2.1", 53, a)) {
+		t.Fatal("Translated a reply for another protocol")
+	}
+	if err := nat.Outbound(transportPacket(proto_icmp, "10.64.0.1", "8.8.8.8", 3, 1)); err == nil {
+		t.Fatal("Translated an ICMP error")
+	}
+	if err := nat.Outbound(transportPacket(proto_udp, "2001::1", "2002::", 1, 1)); err == nil {
+		t.Fatal("Translated IPv6 to an IPv4 address")
+	}
+	fragment := transportPacket(proto_udp, "10.64.0.1", "8.8.8.8", 1, 1)
+	fragment[7] = 1
+	if err := nat.Outbound(fragment); err == nil {
+		t.Fatal("Translated a fragment")
+	}
+}
+
+// Builds an ICMP error from src to dst quoting a packet.
+func icmpErrorPacket(src, dst string, quoted []byte) []byte {
+	protocol, t := byte(proto_icmp), byte(3)
+	if net.ParseIP(src).To4() == nil {
+		protocol, t = proto_icmpv6, 1
+	}
+	p := transportPacket(protocol, src, dst, uint16(t), 0)
+	h, _ := parseIPHeader(p)
+	p = append(p[:h.length+8], quoted...)
+	if h.version == 4 {
+		binary.BigEndian.PutUint16(p[2:], uint16(len(p)))
+		p[10], p[11] = 0, 0
+		binary.BigEndian.PutUint16(p[10:], checksum(p[:h.length]))
+	} else {
+		binary.BigEndian.PutUint16(p[4:], uint16(len(p)-h.length))
+	}
+	segment := p[h.length:]
+	segment[2], segment[3] = 0, 0
+	if protocol == proto_icmp {
+		binary.BigEndian.PutUint16(segment[2:], checksum(segment))
+	} else {
+		binary.BigEndian.PutUint16(segment[2:], transportChecksum(h.src, h.dst, protocol, segment))
+	}
+	return p
+}
+
+func TestNATICMPErrors(t *testing.T) {
+	for _, c := range []struct {
+		protocol       byte
+		client, server string
+		nat, router    string
+	}{
+		{proto_udp, "10.64.0.1", "8.8.8.8", "192.0.2.1", "198.51.100.1"},
+		{proto_tcp, "10.64.0.1", "8.8.8.8", "192.0.2.1", "198.51.100.1"},
+		{proto_icmp, "10.64.0.1", "8.8.8.8", "192.0.2.1", "198.51.100.1"},
+		{proto_udp, "2001::1", "2002::", "2001:db8::1", "2003::1"},
+		{proto_icmpv6, "2001::1", "2002::", "2001:db8::1", "2003::1"},
+	} {
+		nat := NewNAT(net.ParseIP(c.nat), internal.SystemClock())
+		sport, dport := uint16(1234), uint16(80)
+		if c.protocol == proto_icmp || c.protocol == proto_icmpv6 {
+			sport, dport = map[byte]uint16{proto_icmp: 8, proto_icmpv6: 128}[c.protocol], 1234
+		}
+		p := transportPacket(c.protocol, c.client, c.server, sport, dport)
+		err := nat.Outbound(p)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		e := icmpErrorPacket(c.router, c.nat, p)
+		if !nat.Inbound(e) {
+			t.Fatalf("Protocol %d error wasn't translated", c.protocol)
+		}
+		checkChecksums(t, e)
+		h, _ := parseIPHeader(e)
+		quoted := e[h.length+8:]
+		checkChecksums(t, quoted)
+		src, port, _, _ := endpoints(t, quoted)
+		if !h.dst.Equal(net.ParseIP(c.client)) || src != c.client || port != 1234 {
+			t.Fatalf("Protocol %d error translated to %v about %v:%d", c.protocol, h.dst, src, port)
+		}
+	}
+
+	// Errors which only quote the start of the transport header are still
+	// translated, but not errors about unknown flows.
+	nat := NewNAT(net.ParseIP("192.0.2.1"), internal.SystemClock())
+	p := transportPacket(proto_tcp, "10.64.0.1", "8.8.8.8", 1234, 80)
+	err := nat.Outbound(p)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := icmpErrorPacket("198.51.100.1", "192.0.2.1", p[:ipv4_header_size+8])
+	if !nat.Inbound(e) {
+		t.Fatal("Error quoting a truncated packet wasn't translated")
+	}
+	checkChecksums(t, e)
+	unknown := transportPacket(proto_udp, "192.0.2.1", "8.8.8.8", 1, 53)
+	if nat.Inbound(icmpErrorPacket("198.51.100.1", "192.0.2.1", unknown)) {
+		t.Fatal("Translated an error about an unknown flow")
+	}
+}
+
+func TestNATFlush(t *testing.T) {
+	nat := NewNAT(net.ParseIP("192.0.2.1"), internal.SystemClock())
+	for _, src := range []string{"10.64.0.1", "10.64.0.2"} {
+		err := nat.Outbound(transportPacket(proto_udp, src, "8.8.8.8", 1000, 53))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	nat.Flush(net.ParseIP("10.64.0.1").To4())
+	if nat.Flows() != 1 {
+		t.Fatalf("Expected 1 flow got %d", nat.Flows())
+	}
+}
+
+func TestNATExpiry(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	nat := NewNAT(net.ParseIP("192.0.2.1"), clock)
+	for _, protocol := range []byte{proto_tcp, proto_udp} {
+		err := nat.Outbound(transportPacket(protocol, "10.64.0.1", "8.8.8.8", 1000, 80))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	clock.Advance(nat_udp_timeout + time.Second)
+	nat.Expire()
+	if nat.Flows() != 1 {
+		t.Fatalf("Expected only the TCP flow to remain, got %d", nat.Flows())
+	}
+
+	// Closing a connection shortens how long it's kept.
+	fin := transportPacket(proto_tcp, "10.64.0.1", "8.8.8.8", 1000, 80)
+	fin[ipv4_header_size+13] = 0x01
+	err := nat.Outbound(fin)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock.Advance(nat_tcp_closing_timeout + time.Second)
+	nat.Expire()
+	if nat.Flows() != 0 {
+		t.Fatalf("Expected no flows got %d", nat.Flows())
+	}
+}
+
+func TestTunServerNAT(t *testing.T) {
+	o := DefaultTCPTunServerOptions()
+	o.NATIPv4 = "192.0.2.1"
+	tun := testTun{make(chan *tuntap.Packet, 1), make(chan *tuntap.Packet), nil, nil}
+	node := testNode{make(chan types.Packet), make(chan types.Packet), nil}
+	tunserver, err := NewTCPTunServerWithOptions(node, tun, 7, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunserver.Listen()
+	defer tunserver.Close()
+
+	resp := handshake(t, node, "source")
+	client := resp.IPv4.String()
+	p := tuntap.Packet{Protocol: 0x0800, Packet: transportPacket(proto_tcp, client, "8.8.8.8", 1234, 80)}
+	node.out <- dataPacket("destination", resp.Token, p)
+	out := <-tun.in
+	src, external, _, _ := endpoints(t, out.Packet)
+	if src != "192.0.2.1" {
+		t.Fatalf("Packet left from %v", src)
+	}
+
+	// IPv6 isn't translated.
+	p6 := ipTunPacket(resp.IP.String(), "2002::")
+	node.out <- dataPacket("destination", resp.Token, p6)
+	if out := <-tun.in; !net.IP(out.Packet[8:24]).Equal(resp.IP) {
+		t.Fatalf("IPv6 packet left from %v", net.IP(out.Packet[8:24]))
+	}
+
+	reply := tuntap.Packet{Protocol: 0x0800, Packet: transportPacket(proto_tcp, "8.8.8.8", "192.0.2.1", 80, external)}
+	tun.out <- &reply
+	ep := <-node.in
+	if ep.Dest != clientAddress("source") {
+		t.Fatalf("Reply sent to %q", ep.Dest)
+	}
+
+	// Whoever gets the address next doesn't inherit the flow.
+	tunserver.Release(clientAddress("source"))
+	if tunserver.nat4.Flows() != 0 {
+		t.Fatalf("%d flows left after release", tunserver.nat4.Flows())
+	}
+	expectNoTunServerError(t, tunserver)
+}
@@ -0,0 +1,436 @@
+package node
+
+import (
+	"crypto/sha512"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AutoRoute/tuntap"
+
+	"github.com/AutoRoute/node/internal"
+	"github.com/AutoRoute/node/types"
+)
+
+// The unique local prefix every node has an address in. Its global ID is the
+// first 40 bits of sha256("AutoRoute").
+var native_prefix = &net.IPNet{
+	IP:   net.ParseIP("fdae:f24:9a1c::"),
+	Mask: net.CIDRMask(48, 8*net.IPv6len),
+}
+
+// Returns the prefix node addresses are derived in, which should be routed to
+// a NativeTun's tun device.
+func NativePrefix() *net.IPNet {
+	return &net.IPNet{IP: append(net.IP(nil), native_prefix.IP...), Mask: native_prefix.Mask}
+}
+
+// Returns the IPv6 address a node has in NativePrefix, which is the prefix
+// followed by the start of a hash of the NodeAddress. Every node works out
+// the same address for a node without asking it.
+func NativeIP(addr types.NodeAddress) net.IP {
+	h := sha512.Sum512(append([]byte("NativeIP"), addr...))
+	ip := make(net.IP, net.IPv6len)
+	copy(ip, native_prefix.IP[:6])
+	copy(ip[6:], h[:])
+	return ip
+}
+
+// Settings for a NativeTun.
+type NativeTunOptions struct {
+	// Nodes which can be sent packets before they've sent us any. Anyone else
+	// is learned from the sessions they open.
+	Peers []types.NodeAddress
+	// The largest packet sent to another node, at least 1280.
+	MTU int
+	// How long a node learned from its packets is remembered after the last
+	// one.
+	PeerTimeout time.Duration
+	// Signs the hellos opening sessions with other nodes, which they should
+	// require. Hellos are unsigned if this is nil.
+	Key *Key
+	// Accept hellos which aren't signed, trusting whatever source they
+	// claim, and how far the time a hello was signed may be from ours.
+	AllowUnsigned   bool
+	SignatureWindow time.Duration
+	// How often a session is opened again, so a node which has forgotten it
+	// doesn't drop our packets for long.
+	HelloInterval time.Duration
+	// What learned nodes are timed with, or nil for the system clock.
+	Clock internal.Clock
+}
+
+// Returns the settings used by NewNativeTun.
+func DefaultNativeTunOptions() NativeTunOptions {
+	return NativeTunOptions{
+		MTU:             default_tunnel_mtu,
+		PeerTimeout:     30 * time.Minute,
+		SignatureWindow: 5 * time.Minute,
+		HelloInterval:   time.Minute,
+	}
+}
+
+// How long to wait for a hello to be answered before sending it again.
+const native_hello_retry = time.Second
+
+// A node which can be sent packets, and when it was last heard from unless
+// it's one of the configured peers.
+type nativePeer struct {
+	addr   types.NodeAddress
+	static bool
+	last   time.Time
+	// The token of the session the node opened with us, or 0 if it hasn't.
+	token uint64
+}
+
+// A session we opened with another node, which our packets to it carry the
+// token of.
+type nativeSession struct {
+	token    uint64
+	welcomed bool
+	hello    time.Time
+}
+
+// NativeTun sends IPv6 packets for addresses in NativePrefix from a tun device
+// straight to the node the address belongs to, and writes packets other nodes
+// send us to the tun device. No exit node is involved, but only nodes in
+// Peers or which have opened a session with us can be reached, since an
+// address can't be turned back into a NodeAddress.
+//
+// A node sending packets first opens a session with a hello signed like a
+// tunnel request, and its packets carry the session's token. Packets without
+// a known token, or from an address other than the one derived from the node
+// which opened the session, are dropped.
+type NativeTun struct {
+	node           NodeConnection
+	tun            TCPTun
+	amt            int64
+	ip             net.IP
+	mtu            int
+	peer_timeout   time.Duration
+	key            *Key
+	auth           *tunnelAuth
+	hello_interval time.Duration
+	peers          map[[net.IPv6len]byte]nativePeer
+	// The node each token of a session opened with us belongs to.
+	tokens map[uint64]types.NodeAddress
+	// The sessions we opened, by node.
+	sessions map[types.NodeAddress]*nativeSession
+	l        *sync.Mutex
+	clock    internal.Clock
+	quit     chan bool
+	err      chan error
+}
+
+// Constructs a NativeTun with the default settings. It doesn't start until
+// Listen is called.
+func NewNativeTun(n NodeConnection, tun TCPTun, amt int64) *NativeTun {
+	nt, err := NewNativeTunWithOptions(n, tun, amt, DefaultNativeTunOptions())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return nt
+}
+
+func NewNativeTunWithOptions(n NodeConnection, tun TCPTun, amt int64, o NativeTunOptions) (*NativeTun, error) {
+	clock := o.Clock
+	if clock == nil {
+		clock = internal.SystemClock()
+	}
+	if o.MTU < min_tunnel_mtu {
+		return nil, errors.New("native MTU must be at least 1280")
+	}
+	auth := newTunnelAuth(TCPTunServerOptions{
+		AllowUnsigned:   o.AllowUnsigned,
+		SignatureWindow: o.SignatureWindow,
+	})
+	nt := &NativeTun{n, tun, amt, NativeIP(n.GetNodeAddress()), o.MTU, o.PeerTimeout, o.Key, auth, o.HelloInterval,
+		make(map[[net.IPv6len]byte]nativePeer), make(map[uint64]types.NodeAddress), make(map[types.NodeAddress]*nativeSession),
+		&sync.Mutex{}, clock, make(chan bool), make(chan error, 1)}
+	for _, peer := range o.Peers {
+		nt.peers[nativeKey(NativeIP(peer))] = nativePeer{peer, true, time.Time{}, 0}
+	}
+	return nt, nil
+}
+
+// SplitNativePackets lets a NativeTun share a node with tunnels and proxies.
+// Native packets go to the second connection returned and everything else to
+// the first.
+func SplitNativePackets(n NodeConnection) (NodeConnection, NodeConnection) {
+	return splitPackets(n, types.IsNativePacket)
+}
+
+func nativeKey(ip net.IP) [net.IPv6len]byte {
+	var k [net.IPv6len]byte
+	copy(k[:], ip.To16())
+	return k
+}
+
+// Returns our address in NativePrefix, which should be put on the tun device.
+func (nt *NativeTun) IP() net.IP {
+	return nt.ip
+}
+
+// Listen starts listening on the tun device and AutoRoute connection.
+func (nt *NativeTun) Listen() {
+	go nt.listenNode()
+	go nt.listenTun()
+	go nt.expirePeers()
+}
+
+func (nt *NativeTun) Close() {
+	close(nt.quit)
+}
+
+func (nt *NativeTun) Error() chan error {
+	return nt.err
+}
+
+// Returns the node with the given address, if it's a peer or has opened a
+// session with us recently enough.
+func (nt *NativeTun) Lookup(ip net.IP) (types.NodeAddress, bool) {
+	nt.l.Lock()
+	defer nt.l.Unlock()
+	peer, ok := nt.peers[nativeKey(ip)]
+	return peer.addr, ok
+}
+
+// Remembers the session a node opened with us, replacing any it had before.
+// Tokens are visible to the nodes packets pass through, so a token another
+// node's session already has is refused rather than taken over, as is an
+// address which belongs to one of the configured peers.
+func (nt *NativeTun) learn(addr types.NodeAddress, token uint64) error {
+	nt.l.Lock()
+	defer nt.l.Unlock()
+	if owner, ok := nt.tokens[token]; ok && owner != addr {
+		return errors.New("token belongs to another session")
+	}
+	k := nativeKey(NativeIP(addr))
+	peer, ok := nt.peers[k]
+	if peer.static && peer.addr != addr {
+		return errors.New("address belongs to a peer")
+	}
+	if ok {
+		delete(nt.tokens, peer.token)
+	}
+	nt.peers[k] = nativePeer{addr, peer.static, nt.clock.Now(), token}
+	nt.tokens[token] = addr
+	return nil
+}
+
+// Returns the node which opened the session token names, marking it as
+// heard from.
+func (nt *NativeTun) sender(token uint64) (types.NodeAddress, bool) {
+	nt.l.Lock()
+	defer nt.l.Unlock()
+	addr, ok := nt.tokens[token]
+	if ok {
+		k := nativeKey(NativeIP(addr))
+		peer := nt.peers[k]
+		peer.last = nt.clock.Now()
+		nt.peers[k] = peer
+	}
+	return addr, ok
+}
+
+// Returns the token of our session with a node, opening one if there isn't
+// one yet, and whether a hello should be sent for it. Hellos are sent until
+// one is answered, and again every HelloInterval.
+func (nt *NativeTun) session(addr types.NodeAddress) (uint64, bool) {
+	nt.l.Lock()
+	defer nt.l.Unlock()
+	s, ok := nt.sessions[addr]
+	if !ok {
+		s = &nativeSession{newSessionToken(), false, time.Time{}}
+		nt.sessions[addr] = s
+	}
+	since := nt.clock.Since(s.hello)
+	if !ok || (!s.welcomed && since >= native_hello_retry) || since >= nt.hello_interval {
+		s.hello = nt.clock.Now()
+		return s.token, true
+	}
+	return s.token, false
+}
+
+// Asks a node to take packets carrying token from us.
+func (nt *NativeTun) sendHello(addr types.NodeAddress, token uint64) {
+	hello := types.NativePacket{Version: types.NativeVersion, Type: types.NativeHello, Source: nt.node.GetNodeAddress(), Token: token}
+	if nt.key != nil {
+		req, err := SignTCPTunnelRequest(*nt.key, types.TCPTunnelRequest{}, sessionTarget(addr, token, "native"), nt.clock.Now())
+		if err == nil {
+			hello.Data, err = req.MarshalBinary()
+		}
+		if err != nil {
+			log.Printf("Error signing native hello: %v", err)
+			return
+		}
+	}
+	nt.send(addr, hello)
+}
+
+// Checks who a hello is from and that they may open a session, and if so
+// remembers it and answers them.
+func (nt *NativeTun) hello(np types.NativePacket) {
+	req := types.TCPTunnelRequest{Source: np.Source}
+	var err error
+	if len(np.Data) > 0 {
+		err = req.UnmarshalBinary(np.Data)
+		if err == nil && req.Source != np.Source {
+			err = errors.New("hello signed by someone other than its source")
+		}
+	}
+	if err == nil && np.Token == 0 {
+		err = errors.New("hello has no token")
+	}
+	if err == nil {
+		target := sessionTarget(nt.node.GetNodeAddress(), np.Token, "native")
+		err = nt.auth.authorize(req, target, nt.clock.Now())
+	}
+	if err == nil {
+		err = nt.learn(np.Source, np.Token)
+	}
+	if err != nil {
+		log.Printf("Refusing native session from %x: %v", np.Source, err)
+		return
+	}
+	nt.send(np.Source, types.NativePacket{Version: types.NativeVersion, Type: types.NativeWelcome, Source: nt.node.GetNodeAddress(), Token: np.Token})
+}
+
+// Notes that a node has taken the session we opened with it.
+func (nt *NativeTun) welcome(np types.NativePacket) {
+	nt.l.Lock()
+	defer nt.l.Unlock()
+	if s, ok := nt.sessions[np.Source]; ok && s.token == np.Token {
+		s.welcomed = true
+	}
+}
+
+func (nt *NativeTun) send(addr types.NodeAddress, np types.NativePacket) {
+	np_b, err := np.MarshalBinary()
+	if err != nil {
+		log.Printf("Error encoding native packet: %v", err)
+		return
+	}
+	err = nt.node.SendPacket(types.Packet{Dest: addr, Amt: nt.amt, Data: np_b})
+	if err != nil {
+		log.Printf("Error sending native packet to %x: %v", addr, err)
+	}
+}
+
+// Forgets learned nodes which haven't sent anything for PeerTimeout.
+func (nt *NativeTun) expirePeers() {
+	tick := nt.clock.Tick(time.Minute)
+	for {
+		select {
+		case <-tick:
+		case <-nt.quit:
+			return
+		}
+		nt.l.Lock()
+		for k, peer := range nt.peers {
+			if !peer.static && nt.clock.Since(peer.last) >= nt.peer_timeout {
+				delete(nt.peers, k)
+				delete(nt.tokens, peer.token)
+				delete(nt.sessions, peer.addr)
+			}
+		}
+		nt.l.Unlock()
+	}
+}
+
+// Reads messages from other nodes, writing their packets to the tun device. A
+// packet must be to our address and from the address of the node which
+// opened the session it's part of.
+func (nt *NativeTun) listenNode() {
+	for {
+		var p types.Packet
+		select {
+		case p = <-nt.node.Packets():
+		case <-nt.quit:
+			return
+		}
+		var np types.NativePacket
+		err := np.UnmarshalBinary(p.Data)
+		if err != nil {
+			log.Printf("Dropping native packet: %v", err)
+			continue
+		}
+		switch np.Type {
+		case types.NativeHello:
+			nt.hello(np)
+			continue
+		case types.NativeWelcome:
+			nt.welcome(np)
+			continue
+		}
+		h, err := parseIPHeader(np.Data)
+		if err != nil || h.version != 6 {
+			log.Printf("Dropping native packet: not IPv6")
+			continue
+		}
+		sender, ok := nt.sender(np.Token)
+		if !ok {
+			log.Printf("Dropping native packet from %v with unknown session token", h.src)
+			continue
+		}
+		if !h.src.Equal(NativeIP(sender)) || !h.dst.Equal(nt.ip) {
+			log.Printf("Dropping native packet from %v to %v sent by %x", h.src, h.dst, sender)
+			continue
+		}
+		err = nt.tun.WritePacket(&tuntap.Packet{Protocol: 0x86DD, Packet: np.Data})
+		if err != nil {
+			reportError(nt.err, err)
+			return
+		}
+	}
+}
+
+// Reads packets from the tun device and sends those for other nodes'
+// addresses to them. Packets too big for the MTU are answered.
+func (nt *NativeTun) listenTun() {
+	for {
+		p, err := nt.tun.ReadPacket()
+		if err != nil {
+			reportError(nt.err, err)
+			return
+		}
+		select {
+		case <-nt.quit:
+			return
+		default:
+		}
+		// Anything else, such as neighbour discovery, isn't for other nodes.
+		h, err := parseIPHeader(p.Packet)
+		if err != nil || h.version != 6 || !h.src.Equal(nt.ip) || !native_prefix.Contains(h.dst) {
+			continue
+		}
+		dest, ok := nt.Lookup(h.dst)
+		if !ok {
+			log.Printf("Dropping native packet to unknown node %v", h.dst)
+			continue
+		}
+		if p.Truncated || len(p.Packet) > nt.mtu {
+			nt.tooBig(p)
+			continue
+		}
+		token, hello := nt.session(dest)
+		if hello {
+			nt.sendHello(dest, token)
+		}
+		nt.send(dest, types.NativePacket{Version: types.NativeVersion, Type: types.NativeData, Source: nt.node.GetNodeAddress(), Token: token, Data: p.Packet})
+	}
+}
+
+// Tells the sender of a packet from the tun device it's too big.
+func (nt *NativeTun) tooBig(p *tuntap.Packet) {
+	reply := packetTooBig(p.Packet, nt.mtu)
+	if reply == nil {
+		return
+	}
+	err := nt.tun.WritePacket(&tuntap.Packet{Protocol: p.Protocol, Packet: reply})
+	if err != nil {
+		log.Printf("Error answering oversized packet: %v", err)
+	}
+}
@@ -0,0 +1,162 @@
+package node
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/AutoRoute/tuntap"
+
+	"github.com/AutoRoute/node/types"
+)
+
+// A testNode with its own address.
+type namedTestNode struct {
+	testNode
+	addr types.NodeAddress
+}
+
+func (n namedTestNode) GetNodeAddress() types.NodeAddress {
+	return n.addr
+}
+
+func startTestNativeTun(t *testing.T, name string, peers ...string) (*NativeTun, namedTestNode, testTun) {
+	o := DefaultNativeTunOptions()
+	for _, peer := range peers {
+		o.Peers = append(o.Peers, clientAddress(peer))
+	}
+	key := testClientKey(name)
+	o.Key = &key
+	tun := testTun{make(chan *tuntap.Packet, 10), make(chan *tuntap.Packet), nil, nil}
+	node := namedTestNode{testNode{make(chan types.Packet, 10), make(chan types.Packet), nil}, clientAddress(name)}
+	nt, err := NewNativeTunWithOptions(node, tun, 7, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	nt.Listen()
+	return nt, node, tun
+}
+
+// Reads the next native message a node sent, checking its type and who it's
+// for.
+func expectNative(t *testing.T, node namedTestNode, msg_type byte, dest string) (types.Packet, types.NativePacket) {
+	p := <-node.in
+	var np types.NativePacket
+	err := np.UnmarshalBinary(p.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if np.Type != msg_type || p.Dest != clientAddress(dest) || np.Source != node.addr {
+		t.Fatalf("Expected type %d to %x got %+v to %x", msg_type, clientAddress(dest), np, p.Dest)
+	}
+	return p, np
+}
+
+func TestNativeIP(t *testing.T) {
+	a, b := NativeIP("a"), NativeIP("b")
+	if !NativePrefix().Contains(a) || NativePrefix().String() != "fdae:f24:9a1c::/48" {
+		t.Fatalf("%v isn't in %v", a, NativePrefix())
+	}
+	if !a.Equal(NativeIP("a")) || a.Equal(b) {
+		t.Fatalf("Derived %v and %v", a, b)
+	}
+}
+
+func TestNativeTun(t *testing.T) {
+	a, a_node, a_tun := startTestNativeTun(t, "a", "b")
+	defer a.Close()
+	b, b_node, b_tun := startTestNativeTun(t, "b")
+	defer b.Close()
+	a_ip, b_ip := NativeIP(clientAddress("a")).String(), NativeIP(clientAddress("b")).String()
+
+	// a knows b from its peers, and opens a session before its first
+	// packet. b learns a from the session.
+	p := ipTunPacket(a_ip, b_ip)
+	a_tun.out <- &p
+	hello, _ := expectNative(t, a_node, types.NativeHello, "b")
+	sent, data := expectNative(t, a_node, types.NativeData, "b")
+	b_node.out <- hello
+	welcome, _ := expectNative(t, b_node, types.NativeWelcome, "a")
+	b_node.out <- sent
+	if after := <-b_tun.in; !bytes.Equal(after.Packet, p.Packet) {
+		t.Fatalf("%x != %x", after.Packet, p.Packet)
+	}
+	a_node.out <- welcome
+	time.Sleep(10 * time.Millisecond)
+	reply := ipTunPacket(b_ip, a_ip)
+	b_tun.out <- &reply
+	expectNative(t, b_node, types.NativeHello, "a")
+	expectNative(t, b_node, types.NativeData, "a")
+
+	// Once the session is answered packets are sent without a hello.
+	a_tun.out <- &p
+	expectNative(t, a_node, types.NativeData, "b")
+
+	// Packets too big are answered.
+	big := tuntap.Packet{Protocol: 0x86DD, Packet: bigPacket(a_ip, b_ip, default_tunnel_mtu+1)}
+	a_tun.out <- &big
+	if answer := <-a_tun.in; answer.Packet[ipv6_header_size] != 2 {
+		t.Fatalf("Unexpected answer %x", answer.Packet)
+	}
+
+	// Packets to unknown nodes or from addresses which aren't ours go
+	// nowhere.
+	c_ip := NativeIP(clientAddress("c")).String()
+	for _, p := range []tuntap.Packet{
+		ipTunPacket(a_ip, c_ip),
+		ipTunPacket("2001::1", b_ip),
+		ipTunPacket(a_ip, "2001::1"),
+	} {
+		p := p
+		a_tun.out <- &p
+	}
+	// Nor do packets without a known token or from an address other than
+	// their session's, or hellos which are unsigned, signed by someone else,
+	// signed for another token or for a token another session has.
+	spoofed := []types.NativePacket{
+		{Type: types.NativeData, Source: clientAddress("a"), Token: data.Token + 1, Data: ipTunPacket(a_ip, b_ip).Packet},
+		{Type: types.NativeData, Source: clientAddress("c"), Token: data.Token, Data: ipTunPacket(c_ip, b_ip).Packet},
+		{Type: types.NativeHello, Source: clientAddress("c"), Token: 1},
+	}
+	for _, signer := range []string{"a", "c"} {
+		req, _ := SignTCPTunnelRequest(testClientKey(signer), types.TCPTunnelRequest{}, sessionTarget(clientAddress("b"), 1, "native"), time.Now())
+		req_b, _ := req.MarshalBinary()
+		spoofed = append(spoofed, types.NativePacket{Type: types.NativeHello, Source: clientAddress("c"), Token: 2, Data: req_b})
+	}
+	req, _ := SignTCPTunnelRequest(testClientKey("c"), types.TCPTunnelRequest{}, sessionTarget(clientAddress("b"), data.Token, "native"), time.Now())
+	req_b, _ := req.MarshalBinary()
+	spoofed = append(spoofed, types.NativePacket{Type: types.NativeHello, Source: clientAddress("c"), Token: data.Token, Data: req_b})
+	for _, np := range spoofed {
+		np.Version = types.NativeVersion
+		np_b, _ := np.MarshalBinary()
+		b_node.out <- types.Packet{Dest: clientAddress("b"), Amt: 7, Data: np_b}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if len(a_node.in) != 0 || len(b_node.in) != 0 || len(b_tun.in) != 0 {
+		t.Fatalf("%d and %d messages sent and %d written", len(a_node.in), len(b_node.in), len(b_tun.in))
+	}
+	if _, ok := b.Lookup(NativeIP(clientAddress("c"))); ok {
+		t.Fatal("Learned a node from a spoofed hello")
+	}
+	b_node.out <- sent
+	if after := <-b_tun.in; !bytes.Equal(after.Packet, p.Packet) {
+		t.Fatalf("%x != %x", after.Packet, p.Packet)
+	}
+}
+
+func TestSplitNativePackets(t *testing.T) {
+	node := testNode{make(chan types.Packet), make(chan types.Packet), nil}
+	rest, native := SplitNativePackets(node)
+	np := types.NativePacket{Type: types.NativeHello, Source: "source"}
+	b, _ := np.MarshalBinary()
+	go func() {
+		node.out <- types.Packet{Data: b}
+		node.out <- dataPacket("destination", 0, exampleTunPacket())
+	}()
+	if p := <-native.Packets(); !bytes.Equal(p.Data, b) {
+		t.Fatalf("NativeTun got %x", p.Data)
+	}
+	if p := <-rest.Packets(); p.Data[1] != 2 {
+		t.Fatalf("Tunnel got %x", p.Data)
+	}
+}
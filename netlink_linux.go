@@ -0,0 +1,422 @@
+package node
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// Interface configures a network interface through netlink. It remembers the
+// addresses and routes it adds so Cleanup can take them off again on
+// shutdown.
+type Interface struct {
+	name  string
+	index int
+	// What we added and haven't since removed, in the order they were
+	// added.
+	addresses []string
+	routes    []interfaceRoute
+	l         *sync.Mutex
+}
+
+type interfaceRoute struct {
+	prefix  string
+	gateway net.IP
+}
+
+// An interfaceError says what the kernel refused to do, keeping the error it
+// answered with so callers can check it with requestErrno.
+type interfaceError struct {
+	action string
+	err    error
+}
+
+func (e *interfaceError) Error() string {
+	return e.action + ": " + e.err.Error()
+}
+
+// Returns the errno the kernel refused a request with, or 0 if err isn't
+// one.
+func requestErrno(err error) syscall.Errno {
+	if e, ok := err.(*interfaceError); ok {
+		err = e.err
+	}
+	errno, _ := err.(syscall.Errno)
+	return errno
+}
+
+// Looks up the network interface called name.
+func NewInterface(name string) (*Interface, error) {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		return nil, err
+	}
+	return &Interface{name, ifi.Index, nil, nil, &sync.Mutex{}}, nil
+}
+
+func (i *Interface) Name() string {
+	return i.name
+}
+
+// Brings the interface up.
+func (i *Interface) Up() error {
+	b := linkMessage(i.index, syscall.IFF_UP, syscall.IFF_UP)
+	err := netlinkRequest(syscall.RTM_NEWLINK, 0, b)
+	if err != nil {
+		return &interfaceError{fmt.Sprintf("bringing up %s", i.name), err}
+	}
+	return nil
+}
+
+// Sets the largest packet the interface sends.
+func (i *Interface) SetMTU(mtu int) error {
+	b := linkMessage(i.index, 0, 0)
+	b = appendAttribute(b, syscall.IFLA_MTU, nativeUint32(uint32(mtu)))
+	err := netlinkRequest(syscall.RTM_NEWLINK, 0, b)
+	if err != nil {
+		return &interfaceError{fmt.Sprintf("setting %s MTU to %d", i.name, mtu), err}
+	}
+	return nil
+}
+
+// Adds an address such as "10.64.0.1/16" to the interface. An address
+// without a prefix length is given one covering only itself.
+func (i *Interface) AddAddr(addr string) error {
+	b, err := addrMessage(i.index, addr)
+	if err != nil {
+		return err
+	}
+	err = netlinkRequest(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, b)
+	if err != nil {
+		return &interfaceError{fmt.Sprintf("adding address %s to %s", addr, i.name), err}
+	}
+	i.l.Lock()
+	i.addresses = append(i.addresses, addr)
+	i.l.Unlock()
+	return nil
+}
+
+// Takes an address off the interface.
+func (i *Interface) DelAddr(addr string) error {
+	b, err := addrMessage(i.index, addr)
+	if err != nil {
+		return err
+	}
+	err = netlinkRequest(syscall.RTM_DELADDR, 0, b)
+	if err != nil {
+		return &interfaceError{fmt.Sprintf("removing address %s from %s", addr, i.name), err}
+	}
+	i.l.Lock()
+	for n, a := range i.addresses {
+		if a == addr {
+			i.addresses = append(i.addresses[:n], i.addresses[n+1:]...)
+			break
+		}
+	}
+	i.l.Unlock()
+	return nil
+}
+
+// Routes a prefix such as "10.64.0.0/16" out the interface, through gateway
+// if it isn't nil. A prefix without a length is a route to one address.
+func (i *Interface) AddRoute(prefix string, gateway net.IP) error {
+	b, err := routeMessage(i.index, prefix, gateway, false)
+	if err != nil {
+		return err
+	}
+	err = netlinkRequest(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, b)
+	if err != nil {
+		return &interfaceError{fmt.Sprintf("routing %s to %s", prefix, i.name), err}
+	}
+	i.l.Lock()
+	i.routes = append(i.routes, interfaceRoute{prefix, gateway})
+	i.l.Unlock()
+	return nil
+}
+
+// Removes a route added with AddRoute.
+func (i *Interface) DelRoute(prefix string, gateway net.IP) error {
+	b, err := routeMessage(i.index, prefix, gateway, true)
+	if err != nil {
+		return err
+	}
+	err = netlinkRequest(syscall.RTM_DELROUTE, 0, b)
+	if err != nil {
+		return &interfaceError{fmt.Sprintf("removing route %s from %s", prefix, i.name), err}
+	}
+	i.l.Lock()
+	for n, r := range i.routes {
+		if r.prefix == prefix && r.gateway.Equal(gateway) {
+			i.routes = append(i.routes[:n], i.routes[n+1:]...)
+			break
+		}
+	}
+	i.l.Unlock()
+	return nil
+}
+
+// Removes every route and then every address we added, newest first.
+// Anything already gone, such as when the interface was, is skipped. Returns
+// the first error but carries on past it.
+func (i *Interface) Cleanup() error {
+	i.l.Lock()
+	routes := append([]interfaceRoute(nil), i.routes...)
+	addresses := append([]string(nil), i.addresses...)
+	i.l.Unlock()
+
+	var first error
+	check := func(err error) {
+		if err != nil && !isGone(err) && first == nil {
+			first = err
+		}
+	}
+	for n := len(routes) - 1; n >= 0; n-- {
+		check(i.DelRoute(routes[n].prefix, routes[n].gateway))
+	}
+	for n := len(addresses) - 1; n >= 0; n-- {
+		check(i.DelAddr(addresses[n]))
+	}
+	return first
+}
+
+// Reports whether err is from removing something which isn't there.
+func isGone(err error) bool {
+	switch requestErrno(err) {
+	case syscall.ENOENT, syscall.ESRCH, syscall.ENODEV, syscall.EADDRNOTAVAIL:
+		return true
+	}
+	return false
+}
+
+// SetDevAddr takes a network interface name and an IP address in string form
+// and sets the device up and assigns it an IP address.
+func SetDevAddr(dev string, addr string) error {
+	i, err := NewInterface(dev)
+	if err != nil {
+		return err
+	}
+	err = i.Up()
+	if err != nil {
+		return err
+	}
+	return i.AddAddr(addr)
+}
+
+// SetDevMTU sets the largest packet a network interface sends.
+func SetDevMTU(dev string, mtu int) error {
+	i, err := NewInterface(dev)
+	if err != nil {
+		return err
+	}
+	return i.SetMTU(mtu)
+}
+
+// Takes an IP address off a network interface.
+func delDevAddr(dev string, addr string) error {
+	i, err := NewInterface(dev)
+	if err != nil {
+		return err
+	}
+	return i.DelAddr(addr)
+}
+
+// SetDevRoute brings a network interface up and routes a prefix such as
+// "10.64.0.0/16" to it.
+func SetDevRoute(dev string, prefix string) error {
+	i, err := NewInterface(dev)
+	if err != nil {
+		return err
+	}
+	err = i.Up()
+	if err != nil {
+		return err
+	}
+	return i.AddRoute(prefix, nil)
+}
+
+// Parses an address or prefix, giving ones without a length a prefix
+// covering only themselves. IPv4 addresses are returned in 4 bytes.
+func parsePrefix(s string) (net.IP, int, error) {
+	if strings.Contains(s, "/") {
+		ip, prefix, err := net.ParseCIDR(s)
+		if err != nil {
+			return nil, 0, err
+		}
+		ones, _ := prefix.Mask.Size()
+		if v4 := ip.To4(); v4 != nil {
+			return v4, ones, nil
+		}
+		return ip, ones, nil
+	}
+	ip := net.ParseIP(s)
+	if ip == nil {
+		return nil, 0, fmt.Errorf("invalid address %q", s)
+	}
+	if v4 := ip.To4(); v4 != nil {
+		return v4, 8 * net.IPv4len, nil
+	}
+	return ip, 8 * net.IPv6len, nil
+}
+
+func family(ip net.IP) byte {
+	if len(ip) == net.IPv4len {
+		return syscall.AF_INET
+	}
+	return syscall.AF_INET6
+}
+
+// Netlink messages are in the host's byte order.
+var native_endian = nativeEndian()
+
+// Returns the host's byte order.
+func nativeEndian() binary.ByteOrder {
+	x := uint16(1)
+	if *(*byte)(unsafe.Pointer(&x)) == 1 {
+		return binary.LittleEndian
+	}
+	return binary.BigEndian
+}
+
+func nativeUint32(v uint32) []byte {
+	b := make([]byte, 4)
+	native_endian.PutUint32(b, v)
+	return b
+}
+
+func appendAttribute(b []byte, attr_type uint16, data []byte) []byte {
+	l := syscall.SizeofRtAttr + len(data)
+	header := make([]byte, syscall.SizeofRtAttr)
+	native_endian.PutUint16(header[0:], uint16(l))
+	native_endian.PutUint16(header[2:], attr_type)
+	b = append(append(b, header...), data...)
+	// Attributes are padded to 4 bytes.
+	for len(b)%4 != 0 {
+		b = append(b, 0)
+	}
+	return b
+}
+
+// Returns an ifinfomsg changing the flags in change to those in flags.
+func linkMessage(index int, flags uint32, change uint32) []byte {
+	b := make([]byte, syscall.SizeofIfInfomsg)
+	b[0] = syscall.AF_UNSPEC
+	native_endian.PutUint32(b[4:], uint32(index))
+	native_endian.PutUint32(b[8:], flags)
+	native_endian.PutUint32(b[12:], change)
+	return b
+}
+
+// Returns an ifaddrmsg for an address on the interface with the given index.
+func addrMessage(index int, addr string) ([]byte, error) {
+	ip, ones, err := parsePrefix(addr)
+	if err != nil {
+		return nil, err
+	}
+	b := make([]byte, syscall.SizeofIfAddrmsg)
+	b[0] = family(ip)
+	b[1] = byte(ones)
+	b[3] = syscall.RT_SCOPE_UNIVERSE
+	native_endian.PutUint32(b[4:], uint32(index))
+	b = appendAttribute(b, syscall.IFA_LOCAL, ip)
+	b = appendAttribute(b, syscall.IFA_ADDRESS, ip)
+	return b, nil
+}
+
+// Returns an rtmsg for a route out the interface with the given index. Routes
+// are removed with the same message, less what the kernel shouldn't match on.
+func routeMessage(index int, prefix string, gateway net.IP, del bool) ([]byte, error) {
+	ip, ones, err := parsePrefix(prefix)
+	if err != nil {
+		return nil, err
+	}
+	ip = ip.Mask(net.CIDRMask(ones, 8*len(ip)))
+	b := make([]byte, syscall.SizeofRtMsg)
+	b[0] = family(ip)
+	b[1] = byte(ones)
+	b[4] = syscall.RT_TABLE_MAIN
+	b[5] = syscall.RTPROT_BOOT
+	b[6] = syscall.RT_SCOPE_LINK
+	b[7] = syscall.RTN_UNICAST
+	if gateway != nil {
+		b[6] = syscall.RT_SCOPE_UNIVERSE
+	}
+	if del {
+		b[5] = 0
+		b[6] = syscall.RT_SCOPE_NOWHERE
+	}
+	b = appendAttribute(b, syscall.RTA_DST, ip)
+	b = appendAttribute(b, syscall.RTA_OIF, nativeUint32(uint32(index)))
+	if gateway != nil {
+		gw := gateway.To4()
+		if len(ip) != net.IPv4len {
+			gw = gateway.To16()
+			if gateway.To4() != nil {
+				gw = nil
+			}
+		}
+		if gw == nil {
+			return nil, fmt.Errorf("gateway %v isn't the same family as %s", gateway, prefix)
+		}
+		b = appendAttribute(b, syscall.RTA_GATEWAY, gw)
+	}
+	return b, nil
+}
+
+var netlink_seq uint32
+
+// Sends a request to the kernel's routing netlink socket and waits for it to
+// be acknowledged, returning the error the kernel answered with if any.
+func netlinkRequest(message_type uint16, flags uint16, body []byte) error {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return err
+	}
+	defer syscall.Close(fd)
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return err
+	}
+
+	seq := atomic.AddUint32(&netlink_seq, 1)
+	b := make([]byte, syscall.NLMSG_HDRLEN, syscall.NLMSG_HDRLEN+len(body))
+	native_endian.PutUint32(b[0:], uint32(syscall.NLMSG_HDRLEN+len(body)))
+	native_endian.PutUint16(b[4:], message_type)
+	native_endian.PutUint16(b[6:], syscall.NLM_F_REQUEST|syscall.NLM_F_ACK|flags)
+	native_endian.PutUint32(b[8:], seq)
+	b = append(b, body...)
+	err = syscall.Sendto(fd, b, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return err
+	}
+
+	buf := make([]byte, syscall.Getpagesize())
+	for {
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq || m.Header.Type != syscall.NLMSG_ERROR {
+				continue
+			}
+			if len(m.Data) < 4 {
+				return errors.New("short netlink acknowledgement")
+			}
+			errno := int32(native_endian.Uint32(m.Data))
+			if errno == 0 {
+				return nil
+			}
+			return syscall.Errno(-errno)
+		}
+	}
+}
@@ -0,0 +1,144 @@
+package node
+
+import (
+	"net"
+	"syscall"
+	"testing"
+)
+
+// Returns the attributes after a netlink message header of the given size.
+func attributes(t *testing.T, b []byte, header int) map[uint16][]byte {
+	// ParseNetlinkRouteAttr wants the netlink header too.
+	m := &syscall.NetlinkMessage{Data: b}
+	m.Header.Type = syscall.RTM_NEWADDR
+	if header == syscall.SizeofRtMsg {
+		m.Header.Type = syscall.RTM_NEWROUTE
+	}
+	attrs, err := syscall.ParseNetlinkRouteAttr(m)
+	if err != nil {
+		t.Fatal(err)
+	}
+	found := make(map[uint16][]byte)
+	for _, a := range attrs {
+		found[a.Attr.Type] = a.Value
+	}
+	return found
+}
+
+func TestAddrMessage(t *testing.T) {
+	for _, c := range []struct {
+		addr   string
+		family byte
+		ones   byte
+		ip     string
+	}{
+		{"10.64.0.1/16", syscall.AF_INET, 16, "10.64.0.1"},
+		{"10.64.0.1", syscall.AF_INET, 32, "10.64.0.1"},
+		{"2001::1", syscall.AF_INET6, 128, "2001::1"},
+	} {
+		b, err := addrMessage(3, c.addr)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b[0] != c.family || b[1] != c.ones || native_endian.Uint32(b[4:]) != 3 {
+			t.Fatalf("Unexpected message for %s: %x", c.addr, b)
+		}
+		attrs := attributes(t, b, syscall.SizeofIfAddrmsg)
+		if !net.IP(attrs[syscall.IFA_LOCAL]).Equal(net.ParseIP(c.ip)) {
+			t.Fatalf("%s encoded as %v", c.addr, net.IP(attrs[syscall.IFA_LOCAL]))
+		}
+	}
+	if _, err := addrMessage(3, "nonsense"); err == nil {
+		t.Fatal("Accepted an invalid address")
+	}
+}
+
+func TestRouteMessage(t *testing.T) {
+	b, err := routeMessage(3, "128.0.0.0/1", net.ParseIP("10.64.0.1"), false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != syscall.AF_INET || b[1] != 1 || b[6] != syscall.RT_SCOPE_UNIVERSE {
+		t.Fatalf("Unexpected message %x", b)
+	}
+	attrs := attributes(t, b, syscall.SizeofRtMsg)
+	if !net.IP(attrs[syscall.RTA_DST]).Equal(net.ParseIP("128.0.0.0")) ||
+		!net.IP(attrs[syscall.RTA_GATEWAY]).Equal(net.ParseIP("10.64.0.1")) ||
+		native_endian.Uint32(attrs[syscall.RTA_OIF]) != 3 {
+		t.Fatalf("Unexpected attributes %v", attrs)
+	}
+
+	// Host bits are cleared and routes without a gateway are on the link.
+	b, err = routeMessage(3, "2001::1/64", nil, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	attrs = attributes(t, b, syscall.SizeofRtMsg)
+	if b[6] != syscall.RT_SCOPE_LINK || !net.IP(attrs[syscall.RTA_DST]).Equal(net.ParseIP("2001::")) {
+		t.Fatalf("Unexpected message %x", b)
+	}
+	if _, ok := attrs[syscall.RTA_GATEWAY]; ok {
+		t.Fatal("Route has a gateway")
+	}
+
+	if _, err := routeMessage(3, "2001::/64", net.ParseIP("10.64.0.1"), false); err == nil {
+		t.Fatal("Accepted an IPv4 gateway for an IPv6 route")
+	}
+}
+
+func hasAddr(t *testing.T, name string, ip string) bool {
+	ifi, err := net.InterfaceByName(name)
+	if err != nil {
+		t.Fatal(err)
+	}
+	addrs, err := ifi.Addrs()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, a := range addrs {
+		if a.(*net.IPNet).IP.Equal(net.ParseIP(ip)) {
+			return true
+		}
+	}
+	return false
+}
+
+func TestInterface(t *testing.T) {
+	if !isRoot() {
+		t.Skip()
+	}
+
+	i, err := NewInterface("lo")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = i.AddAddr("192.0.2.99/32")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = i.AddRoute("198.51.100.0/24", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !hasAddr(t, "lo", "192.0.2.99") {
+		t.Fatal("Address wasn't added")
+	}
+
+	// Adding the same route again is refused.
+	err = i.AddRoute("198.51.100.0/24", nil)
+	if requestErrno(err) != syscall.EEXIST {
+		t.Fatalf("Expected %v got %v", syscall.EEXIST, err)
+	}
+
+	err = i.Cleanup()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if hasAddr(t, "lo", "192.0.2.99") {
+		t.Fatal("Address wasn't removed")
+	}
+	err = i.DelRoute("198.51.100.0/24", nil)
+	if requestErrno(err) != syscall.ESRCH {
+		t.Fatalf("Expected the route to be gone got %v", err)
+	}
+}
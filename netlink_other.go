@@ -0,0 +1,69 @@
+//go:build !linux
+// +build !linux
+
+package node
+
+import (
+	"errors"
+	"net"
+)
+
+var no_netlink_error = errors.New("configuring network interfaces needs linux")
+
+// Interface configures a network interface, which is only supported on linux.
+// Elsewhere every method fails.
+type Interface struct {
+	name string
+}
+
+func NewInterface(name string) (*Interface, error) {
+	return nil, no_netlink_error
+}
+
+func (i *Interface) Name() string {
+	return i.name
+}
+
+func (i *Interface) Up() error {
+	return no_netlink_error
+}
+
+func (i *Interface) SetMTU(mtu int) error {
+	return no_netlink_error
+}
+
+func (i *Interface) AddAddr(addr string) error {
+	return no_netlink_error
+}
+
+func (i *Interface) DelAddr(addr string) error {
+	return no_netlink_error
+}
+
+func (i *Interface) AddRoute(prefix string, gateway net.IP) error {
+	return no_netlink_error
+}
+
+func (i *Interface) DelRoute(prefix string, gateway net.IP) error {
+	return no_netlink_error
+}
+
+func (i *Interface) Cleanup() error {
+	return nil
+}
+
+func SetDevAddr(dev string, addr string) error {
+	return no_netlink_error
+}
+
+func SetDevMTU(dev string, mtu int) error {
+	return no_netlink_error
+}
+
+func delDevAddr(dev string, addr string) error {
+	return no_netlink_error
+}
+
+func SetDevRoute(dev string, prefix string) error {
+	return no_netlink_error
+}
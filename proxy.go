@@ -0,0 +1,603 @@
+package node
+
+import (
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log"
+	"net"
+	"sync"
+	"time"
+
+	"github.com/AutoRoute/node/internal"
+	"github.com/AutoRoute/node/types"
+)
+
+const (
+	// The most of a stream carried in one message.
+	proxy_chunk_size = 1024
+	// How many messages of a stream may be waiting to be acknowledged.
+	proxy_window = 64
+)
+
+// Settings for the reliable streams a proxy and exit node share.
+type proxyTiming struct {
+	// How long to wait for an acknowledgement before sending again.
+	retransmit time.Duration
+	// How long to keep sending without any getting through before giving up.
+	timeout time.Duration
+	clock   internal.Clock
+}
+
+// Carries a TCP connection over proxy messages. Packets between nodes can be
+// lost, so pieces are numbered and sent again until the other end
+// acknowledges them, going back to the first unacknowledged piece each time.
+type proxyStream struct {
+	conn net.Conn
+	// Fills in the addressing and sends a message to the other end.
+	send     func(m types.ProxyMessage)
+	timing   proxyTiming
+	incoming chan types.ProxyMessage
+	// Closed when the stream is over.
+	done  chan bool
+	quit  chan bool
+	close *sync.Once
+}
+
+func newProxyStream(conn net.Conn, send func(m types.ProxyMessage), timing proxyTiming) *proxyStream {
+	return &proxyStream{conn, send, timing, make(chan types.ProxyMessage, 2*proxy_window), make(chan bool), make(chan bool), &sync.Once{}}
+}
+
+// Hands the stream a message from the other end, dropping it if the stream
+// is too far behind. It will be sent again.
+func (s *proxyStream) deliver(m types.ProxyMessage) {
+	select {
+	case s.incoming <- m:
+	default:
+	}
+}
+
+func (s *proxyStream) Close() {
+	s.close.Do(func() { close(s.quit) })
+}
+
+// Reports whether sequence number a comes before b, allowing for wrapping.
+func seqBefore(a, b uint32) bool {
+	return int32(a-b) < 0
+}
+
+func (s *proxyStream) reset(reason string) {
+	s.send(types.ProxyMessage{Type: types.ProxyReset, Data: []byte(reason)})
+}
+
+// Copies the connection to the other end and what the other end sends to the
+// connection until both are finished, one end gives up or Close is called.
+func (s *proxyStream) run() {
+	defer close(s.done)
+	defer s.conn.Close()
+	reads := make(chan []byte)
+	go s.readConn(reads)
+
+	var unacked []types.ProxyMessage
+	next_seq, expected := uint32(0), uint32(0)
+	sent_close, remote_closed := false, false
+	last_progress := s.timing.clock.Now()
+	tick := s.timing.clock.Tick(s.timing.retransmit)
+	for {
+		if sent_close && remote_closed && len(unacked) == 0 {
+			return
+		}
+		// Stop reading while the window is full.
+		r := reads
+		if sent_close || len(unacked) >= proxy_window {
+			r = nil
+		}
+		select {
+		case b := <-r:
+			if len(unacked) == 0 {
+				last_progress = s.timing.clock.Now()
+			}
+			m := types.ProxyMessage{Type: types.ProxyData, Seq: next_seq, Data: b}
+			if b == nil {
+				m.Type = types.ProxyClose
+				sent_close = true
+			}
+			next_seq++
+			unacked = append(unacked, m)
+			s.send(m)
+		case m := <-s.incoming:
+			switch m.Type {
+			case types.ProxyData, types.ProxyClose:
+				// Anything out of order is dropped and comes again.
+				if m.Seq == expected && !remote_closed {
+					expected++
+					if m.Type == types.ProxyClose {
+						remote_closed = true
+						if c, ok := s.conn.(interface {
+							CloseWrite() error
+						}); ok {
+							c.CloseWrite()
+						}
+					} else {
+						_, err := s.conn.Write(m.Data)
+						if err != nil {
+							s.reset(err.Error())
+							return
+						}
+					}
+				}
+				s.send(types.ProxyMessage{Type: types.ProxyAck, Seq: expected})
+			case types.ProxyAck:
+				for len(unacked) > 0 && seqBefore(unacked[0].Seq, m.Seq) {
+					unacked = unacked[1:]
+					last_progress = s.timing.clock.Now()
+				}
+			case types.ProxyReset:
+				log.Printf("Proxy stream reset: %s", m.Data)
+				return
+			}
+		case <-tick:
+			if len(unacked) == 0 || s.timing.clock.Since(last_progress) < s.timing.retransmit {
+				continue
+			}
+			if s.timing.clock.Since(last_progress) >= s.timing.timeout {
+				s.reset("timed out")
+				return
+			}
+			for _, m := range unacked {
+				s.send(m)
+			}
+		case <-s.quit:
+			s.reset("closed")
+			return
+		}
+	}
+}
+
+// Reads the connection in pieces until it ends, which is sent as nil.
+func (s *proxyStream) readConn(reads chan []byte) {
+	for {
+		b := make([]byte, proxy_chunk_size)
+		n, err := s.conn.Read(b)
+		if n > 0 {
+			select {
+			case reads <- b[:n]:
+			case <-s.done:
+				return
+			}
+		}
+		if err != nil {
+			select {
+			case reads <- nil:
+			case <-s.done:
+			}
+			return
+		}
+	}
+}
+
+// Returns a stream identifier other clients can't guess.
+func randomStream() uint64 {
+	b := make([]byte, 8)
+	_, err := rand.Read(b)
+	if err != nil {
+		log.Fatal(err)
+	}
+	return binary.BigEndian.Uint64(b)
+}
+
+// A NodeConnection which only sees some of another's packets.
+type splitConnection struct {
+	NodeConnection
+	packets chan types.Packet
+}
+
+func (c splitConnection) Packets() <-chan types.Packet {
+	return c.packets
+}
+
+// Sends packets which match to the second connection returned and everything
+// else to the first.
+func splitPackets(n NodeConnection, match func([]byte) bool) (NodeConnection, NodeConnection) {
+	rest := splitConnection{n, make(chan types.Packet)}
+	matched := splitConnection{n, make(chan types.Packet)}
+	go func() {
+		for p := range n.Packets() {
+			if match(p.Data) {
+				matched.packets <- p
+			} else {
+				rest.packets <- p
+			}
+		}
+	}()
+	return rest, matched
+}
+
+// SplitProxyPackets lets a tunnel and a proxy share a node. Proxy messages go
+// to the second connection returned and everything else to the first.
+func SplitProxyPackets(n NodeConnection) (NodeConnection, NodeConnection) {
+	return splitPackets(n, types.IsProxyMessage)
+}
+
+// Settings for an exit node's ProxyServer.
+type ProxyServerOptions struct {
+	// How long to wait for a connection to open.
+	DialTimeout time.Duration
+	// How long a UDP association is kept without any traffic.
+	UDPTimeout time.Duration
+	// How long to wait for a proxy to acknowledge data before sending it
+	// again, and how long to keep trying.
+	RetransmitInterval time.Duration
+	StreamTimeout      time.Duration
+	// Accept connects which aren't signed, trusting whatever source they
+	// claim.
+	AllowUnsigned bool
+	// How far the time a connect was signed may be from ours.
+	SignatureWindow time.Duration
+	// If Allow isn't empty only those proxies may connect. Proxies in Deny
+	// never may.
+	Allow []types.NodeAddress
+	Deny  []types.NodeAddress
+	// Let proxies reach loopback, link-local and private addresses, which
+	// are the exit node itself and the networks around it.
+	AllowPrivate bool
+	// What streams and associations are timed with, or nil for the system
+	// clock.
+	Clock internal.Clock
+}
+
+// Returns the settings used by NewProxyServer.
+func DefaultProxyServerOptions() ProxyServerOptions {
+	return ProxyServerOptions{
+		DialTimeout:        30 * time.Second,
+		UDPTimeout:         5 * time.Minute,
+		RetransmitInterval: time.Second,
+		StreamTimeout:      2 * time.Minute,
+		SignatureWindow:    5 * time.Minute,
+	}
+}
+
+// Streams and associations are named by the proxy they're for and the
+// identifier it picked.
+type proxyKey struct {
+	source types.NodeAddress
+	stream uint64
+}
+
+type proxyAssociation struct {
+	conn net.PacketConn
+	last time.Time
+}
+
+// Networks on or next to the exit node, on top of what net.IP can tell.
+var private_networks = []*net.IPNet{
+	parseNetwork("0.0.0.0/8"),
+	parseNetwork("10.0.0.0/8"),
+	parseNetwork("100.64.0.0/10"),
+	parseNetwork("172.16.0.0/12"),
+	parseNetwork("192.168.0.0/16"),
+	parseNetwork("fc00::/7"),
+}
+
+func parseNetwork(s string) *net.IPNet {
+	_, n, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return n
+}
+
+// Reports whether ip is the exit node itself or on a network around it.
+func privateIP(ip net.IP) bool {
+	if len(ip) == 0 || ip.IsUnspecified() || ip.IsLoopback() || ip.IsLinkLocalUnicast() ||
+		ip.IsLinkLocalMulticast() || ip.IsInterfaceLocalMulticast() {
+		return true
+	}
+	for _, n := range private_networks {
+		if n.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+var private_destination_error = errors.New("proxies may not reach private addresses")
+
+// A ProxyServer lets SOCKSProxy clients on other nodes open connections and
+// send UDP datagrams from an exit node. Clients are checked like tunnel
+// clients, and messages for streams no client opened are dropped rather than
+// answered, as who they claim to be from can't be trusted.
+type ProxyServer struct {
+	node   NodeConnection
+	amt    int64
+	o      ProxyServerOptions
+	auth   *tunnelAuth
+	timing proxyTiming
+	// Connections being opened, and the addresses of our end of the ones
+	// which are.
+	dialing      map[proxyKey]bool
+	streams      map[proxyKey]*proxyStream
+	local        map[proxyKey]string
+	associations map[proxyKey]*proxyAssociation
+	l            *sync.Mutex
+	quit         chan bool
+	err          chan error
+}
+
+// NewProxyServer constructs a ProxyServer. Like NewTCPTunServer it doesn't
+// start listening.
+func NewProxyServer(n NodeConnection, amt int64) *ProxyServer {
+	return NewProxyServerWithOptions(n, amt, DefaultProxyServerOptions())
+}
+
+func NewProxyServerWithOptions(n NodeConnection, amt int64, o ProxyServerOptions) *ProxyServer {
+	clock := o.Clock
+	if clock == nil {
+		clock = internal.SystemClock()
+	}
+	auth := newTunnelAuth(TCPTunServerOptions{
+		AllowUnsigned:   o.AllowUnsigned,
+		SignatureWindow: o.SignatureWindow,
+		Allow:           o.Allow,
+		Deny:            o.Deny,
+	})
+	return &ProxyServer{n, amt, o, auth, proxyTiming{o.RetransmitInterval, o.StreamTimeout, clock},
+		make(map[proxyKey]bool), make(map[proxyKey]*proxyStream), make(map[proxyKey]string),
+		make(map[proxyKey]*proxyAssociation), &sync.Mutex{}, make(chan bool), make(chan error, 1)}
+}
+
+func (ps *ProxyServer) Listen() {
+	go ps.listenNode()
+	go ps.expireAssociations()
+}
+
+// Stops the server, ending every stream and association.
+func (ps *ProxyServer) Close() {
+	close(ps.quit)
+	ps.l.Lock()
+	defer ps.l.Unlock()
+	for _, s := range ps.streams {
+		s.Close()
+	}
+	for key, a := range ps.associations {
+		a.conn.Close()
+		delete(ps.associations, key)
+	}
+}
+
+func (ps *ProxyServer) Error() chan error {
+	return ps.err
+}
+
+// Returns how many connections are open.
+func (ps *ProxyServer) Streams() int {
+	ps.l.Lock()
+	defer ps.l.Unlock()
+	return len(ps.streams)
+}
+
+func (ps *ProxyServer) send(key proxyKey, m types.ProxyMessage) {
+	m.Version = types.ProxyVersion
+	m.Source = ps.node.GetNodeAddress()
+	m.Stream = key.stream
+	b, err := m.MarshalBinary()
+	if err != nil {
+		log.Printf("Error encoding proxy message: %v", err)
+		return
+	}
+	err = ps.node.SendPacket(types.Packet{Dest: key.source, Amt: ps.amt, Data: b})
+	if err != nil {
+		log.Printf("Error sending proxy message to %x: %v", key.source, err)
+	}
+}
+
+func (ps *ProxyServer) listenNode() {
+	for {
+		var p types.Packet
+		select {
+		case p = <-ps.node.Packets():
+		case <-ps.quit:
+			return
+		}
+		var m types.ProxyMessage
+		err := m.UnmarshalBinary(p.Data)
+		if err != nil {
+			log.Printf("Error reading proxy message: %v", err)
+			continue
+		}
+		key := proxyKey{m.Source, m.Stream}
+		switch m.Type {
+		case types.ProxyConnect:
+			err := ps.authorize(m)
+			if err != nil {
+				log.Printf("Refusing proxy connect from %x: %v", m.Source, err)
+			} else if len(m.Address) == 0 {
+				ps.associate(key)
+			} else {
+				ps.connect(key, m.Address)
+			}
+		case types.ProxyDatagram:
+			ps.datagram(key, m)
+		case types.ProxyReset:
+			ps.l.Lock()
+			if a, ok := ps.associations[key]; ok {
+				a.conn.Close()
+				delete(ps.associations, key)
+			}
+			s := ps.streams[key]
+			ps.l.Unlock()
+			if s != nil {
+				s.deliver(m)
+			}
+		default:
+			ps.l.Lock()
+			s := ps.streams[key]
+			ps.l.Unlock()
+			if s != nil {
+				s.deliver(m)
+			}
+		}
+	}
+}
+
+// Returns an error if a connect isn't from who it claims or they may not use
+// the exit node.
+func (ps *ProxyServer) authorize(m types.ProxyMessage) error {
+	req := types.TCPTunnelRequest{Source: m.Source}
+	if len(m.Data) > 0 {
+		err := req.UnmarshalBinary(m.Data)
+		if err != nil {
+			return err
+		}
+		if req.Source != m.Source {
+			return errors.New("connect signed by someone other than its source")
+		}
+	}
+	target := sessionTarget(ps.node.GetNodeAddress(), m.Stream, m.Address)
+	return ps.auth.authorize(req, target, ps.timing.clock.Now())
+}
+
+// Connects to address unless it's somewhere proxies may not go.
+func (ps *ProxyServer) dial(address string) (net.Conn, error) {
+	addr, err := net.ResolveTCPAddr("tcp", address)
+	if err != nil {
+		return nil, err
+	}
+	if !ps.o.AllowPrivate && privateIP(addr.IP) {
+		return nil, private_destination_error
+	}
+	return net.DialTimeout("tcp", addr.String(), ps.o.DialTimeout)
+}
+
+// Opens a connection for a proxy and tells it how that went. Proxies ask
+// again until they hear back, so repeats are answered the same way.
+func (ps *ProxyServer) connect(key proxyKey, address string) {
+	ps.l.Lock()
+	if local, ok := ps.local[key]; ok {
+		ps.l.Unlock()
+		ps.send(key, types.ProxyMessage{Type: types.ProxyConnected, Address: local})
+		return
+	}
+	if ps.dialing[key] {
+		ps.l.Unlock()
+		return
+	}
+	ps.dialing[key] = true
+	ps.l.Unlock()
+
+	go func() {
+		conn, err := ps.dial(address)
+		ps.l.Lock()
+		delete(ps.dialing, key)
+		ps.l.Unlock()
+		if err != nil {
+			log.Printf("Error connecting to %s for %x: %v", address, key.source, err)
+			ps.send(key, types.ProxyMessage{Type: types.ProxyConnected, Data: []byte(err.Error())})
+			return
+		}
+		s := newProxyStream(conn, func(m types.ProxyMessage) { ps.send(key, m) }, ps.timing)
+		local := conn.LocalAddr().String()
+		ps.l.Lock()
+		ps.streams[key] = s
+		ps.local[key] = local
+		ps.l.Unlock()
+		ps.send(key, types.ProxyMessage{Type: types.ProxyConnected, Address: local})
+		go s.run()
+		<-s.done
+		ps.l.Lock()
+		delete(ps.streams, key)
+		delete(ps.local, key)
+		ps.l.Unlock()
+	}()
+}
+
+// Opens a UDP socket for a proxy's association and tells it where it is.
+// Repeats are answered the same way.
+func (ps *ProxyServer) associate(key proxyKey) {
+	ps.l.Lock()
+	a, ok := ps.associations[key]
+	if !ok {
+		conn, err := net.ListenPacket("udp", ":0")
+		if err != nil {
+			ps.l.Unlock()
+			log.Printf("Error opening UDP socket for %x: %v", key.source, err)
+			ps.send(key, types.ProxyMessage{Type: types.ProxyConnected, Data: []byte(err.Error())})
+			return
+		}
+		a = &proxyAssociation{conn, ps.timing.clock.Now()}
+		ps.associations[key] = a
+		go ps.readAssociation(key, conn)
+	}
+	a.last = ps.timing.clock.Now()
+	local := a.conn.LocalAddr().String()
+	ps.l.Unlock()
+	ps.send(key, types.ProxyMessage{Type: types.ProxyConnected, Address: local})
+}
+
+// Sends a datagram from a proxy through its association.
+func (ps *ProxyServer) datagram(key proxyKey, m types.ProxyMessage) {
+	ps.l.Lock()
+	a, ok := ps.associations[key]
+	if ok {
+		a.last = ps.timing.clock.Now()
+	}
+	ps.l.Unlock()
+	if !ok {
+		return
+	}
+
+	// Looking the address up may take a while.
+	data := append([]byte(nil), m.Data...)
+	go func() {
+		addr, err := net.ResolveUDPAddr("udp", m.Address)
+		if err != nil {
+			log.Printf("Dropping datagram to %s: %v", m.Address, err)
+			return
+		}
+		if !ps.o.AllowPrivate && privateIP(addr.IP) {
+			log.Printf("Dropping datagram to %s: %v", m.Address, private_destination_error)
+			return
+		}
+		_, err = a.conn.WriteTo(data, addr)
+		if err != nil {
+			log.Printf("Error sending datagram to %s: %v", m.Address, err)
+		}
+	}()
+}
+
+// Sends datagrams arriving at an association's socket back to its proxy until
+// the socket is closed.
+func (ps *ProxyServer) readAssociation(key proxyKey, conn net.PacketConn) {
+	b := make([]byte, 0xFFFF)
+	for {
+		n, from, err := conn.ReadFrom(b)
+		if err != nil {
+			return
+		}
+		ps.l.Lock()
+		if a, ok := ps.associations[key]; ok {
+			a.last = ps.timing.clock.Now()
+		}
+		ps.l.Unlock()
+		ps.send(key, types.ProxyMessage{Type: types.ProxyDatagram, Address: from.String(), Data: append([]byte(nil), b[:n]...)})
+	}
+}
+
+func (ps *ProxyServer) expireAssociations() {
+	tick := ps.timing.clock.Tick(time.Minute)
+	for {
+		select {
+		case <-tick:
+			ps.l.Lock()
+			for key, a := range ps.associations {
+				if ps.timing.clock.Since(a.last) >= ps.o.UDPTimeout {
+					a.conn.Close()
+					delete(ps.associations, key)
+				}
+			}
+			ps.l.Unlock()
+		case <-ps.quit:
+			return
+		}
+	}
+}
@@ -0,0 +1,367 @@
+package node
+
+import (
+	"bytes"
+	"io"
+	"math/rand"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/AutoRoute/node/types"
+)
+
+// Returns the two ends of a link between testNodes, the second dropping
+// every drop'th packet it is sent if drop isn't 0.
+func proxyLink(drop int) (testNode, testNode) {
+	to_proxy := make(chan types.Packet, 1000)
+	to_exit := make(chan types.Packet, 1000)
+	lossy := make(chan types.Packet, 1000)
+	go func() {
+		n := 0
+		for p := range lossy {
+			n++
+			if drop != 0 && n%drop == 0 {
+				continue
+			}
+			to_exit <- p
+		}
+	}()
+	return testNode{lossy, to_proxy, nil}, testNode{to_proxy, to_exit, nil}
+}
+
+// Starts a SOCKSProxy and ProxyServer talking over a link which loses every
+// drop'th packet on the way to the exit node. The exit node lets the proxy
+// reach private addresses if allow_private is set.
+func startProxy(t *testing.T, drop int, allow_private bool) (*SOCKSProxy, *ProxyServer) {
+	proxy_node, exit_node := proxyLink(drop)
+	so := DefaultSOCKSProxyOptions()
+	so.RetransmitInterval = 20 * time.Millisecond
+	so.ConnectTimeout = time.Second
+	key := testClientKey("proxy")
+	so.Key = &key
+	proxy, err := NewSOCKSProxyWithOptions(namedTestNode{proxy_node, clientAddress("proxy")}, "exit", 7, "127.0.0.1:0", so)
+	if err != nil {
+		t.Fatal(err)
+	}
+	o := DefaultProxyServerOptions()
+	o.RetransmitInterval = 20 * time.Millisecond
+	o.AllowPrivate = allow_private
+	exit := NewProxyServerWithOptions(namedTestNode{exit_node, "exit"}, 7, o)
+	exit.Listen()
+	return proxy, exit
+}
+
+// Starts a TCP server which echos everything it's sent.
+func echoServer(t *testing.T) net.Listener {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(c, c)
+				c.Close()
+			}()
+		}
+	}()
+	return l
+}
+
+// Sends a SOCKS5 request to the proxy and returns the connection and reply.
+func socksRequest(t *testing.T, proxy *SOCKSProxy, cmd byte, address string) (net.Conn, byte, string) {
+	c, err := net.Dial("tcp", proxy.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	host, port_s, _ := net.SplitHostPort(address)
+	port, _ := strconv.Atoi(port_s)
+	req := []byte{socks_version, 1, socks_no_auth, socks_version, cmd, 0}
+	if ip := net.ParseIP(host); ip != nil {
+		req = appendSOCKSAddress(req, ip, port)
+	} else {
+		req = append(append(req, socks_domain, byte(len(host))), host...)
+		req = append(req, byte(port>>8), byte(port))
+	}
+	_, err = c.Write(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	method := make([]byte, 2)
+	_, err = io.ReadFull(c, method)
+	if err != nil || method[1] != socks_no_auth {
+		t.Fatalf("Unexpected method %x: %v", method, err)
+	}
+	reply := make([]byte, 4+net.IPv4len+2)
+	_, err = io.ReadFull(c, reply)
+	if err != nil {
+		t.Fatal(err)
+	}
+	bound, _, err := parseSOCKSAddress(reply[3:])
+	if err != nil {
+		t.Fatal(err)
+	}
+	return c, reply[1], bound
+}
+
+func TestSOCKSAddress(t *testing.T) {
+	for _, c := range []struct {
+		b       []byte
+		address string
+	}{
+		{appendSOCKSAddress(nil, net.ParseIP("10.0.0.1"), 80), "10.0.0.1:80"},
+		{appendSOCKSAddress(nil, net.ParseIP("2001::1"), 443), "[2001::1]:443"},
+		{[]byte{socks_domain, 3, 'a', '.', 'b', 0, 53, 'x'}, "a.b:53"},
+	} {
+		address, l, err := parseSOCKSAddress(c.b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if address != c.address || (l != len(c.b) && c.b[0] != socks_domain) {
+			t.Fatalf("Parsed %x as %s, %d bytes", c.b, address, l)
+		}
+	}
+	if _, _, err := parseSOCKSAddress([]byte{socks_ipv4, 10, 0}); err == nil {
+		t.Fatal("Accepted a short address")
+	}
+}
+
+func TestSOCKSConnect(t *testing.T) {
+	proxy, exit := startProxy(t, 7, true)
+	defer proxy.Close()
+	defer exit.Close()
+	echo := echoServer(t)
+	defer echo.Close()
+
+	c, reply, _ := socksRequest(t, proxy, socks_connect, echo.Addr().String())
+	if reply != socks_succeeded {
+		t.Fatalf("Connect failed with %d", reply)
+	}
+
+	// Enough to need more than a window of pieces, over a link which loses
+	// some of them.
+	sent := make([]byte, 200*1024)
+	rand.Read(sent)
+	go c.Write(sent)
+	received := make([]byte, len(sent))
+	_, err := io.ReadFull(c, received)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(sent, received) {
+		t.Fatal("Data changed on the way")
+	}
+
+	// Closing our end closes the echo server's, which closes the stream.
+	c.(*net.TCPConn).CloseWrite()
+	_, err = c.Read(make([]byte, 1))
+	if err != io.EOF {
+		t.Fatalf("Expected EOF got %v", err)
+	}
+	c.Close()
+	for i := 0; exit.Streams() != 0; i++ {
+		if i == 100 {
+			t.Fatalf("%d streams still open", exit.Streams())
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestSOCKSConnectFails(t *testing.T) {
+	proxy, exit := startProxy(t, 0, true)
+	defer proxy.Close()
+	defer exit.Close()
+
+	// Nothing listens on a port we just closed.
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	l.Close()
+	c, reply, _ := socksRequest(t, proxy, socks_connect, l.Addr().String())
+	defer c.Close()
+	if reply != socks_refused {
+		t.Fatalf("Expected refused got %d", reply)
+	}
+
+	c, reply, _ = socksRequest(t, proxy, 2, l.Addr().String())
+	defer c.Close()
+	if reply != socks_not_supported {
+		t.Fatalf("BIND answered with %d", reply)
+	}
+
+	// Exit nodes which don't allow private addresses refuse them.
+	private, private_exit := startProxy(t, 0, false)
+	defer private.Close()
+	defer private_exit.Close()
+	echo := echoServer(t)
+	defer echo.Close()
+	c, reply, _ = socksRequest(t, private, socks_connect, echo.Addr().String())
+	defer c.Close()
+	if reply != socks_refused {
+		t.Fatalf("Connect to %s answered with %d", echo.Addr(), reply)
+	}
+}
+
+func TestSOCKSUDPAssociate(t *testing.T) {
+	proxy, exit := startProxy(t, 0, true)
+	defer proxy.Close()
+	defer exit.Close()
+	echo, err := net.ListenUDP("udp", &net.UDPAddr{IP: net.ParseIP("127.0.0.1")})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer echo.Close()
+	go func() {
+		b := make([]byte, 1000)
+		for {
+			n, from, err := echo.ReadFromUDP(b)
+			if err != nil {
+				return
+			}
+			echo.WriteToUDP(b[:n], from)
+		}
+	}()
+
+	c, reply, relay := socksRequest(t, proxy, socks_udp_associate, "0.0.0.0:0")
+	defer c.Close()
+	if reply != socks_succeeded {
+		t.Fatalf("Associate failed with %d", reply)
+	}
+	relay_addr, err := net.ResolveUDPAddr("udp", relay)
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := net.DialUDP("udp", nil, relay_addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer u.Close()
+	echo_addr := echo.LocalAddr().(*net.UDPAddr)
+	datagram := appendSOCKSAddress([]byte{0, 0, 0}, echo_addr.IP, echo_addr.Port)
+	_, err = u.Write(append(datagram, "hello"...))
+	if err != nil {
+		t.Fatal(err)
+	}
+	u.SetReadDeadline(time.Now().Add(5 * time.Second))
+	b := make([]byte, 1000)
+	n, err := u.Read(b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	from, l, err := parseSOCKSAddress(b[socks_udp_header_size:n])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if from != echo_addr.String() || string(b[socks_udp_header_size+l:n]) != "hello" {
+		t.Fatalf("Unexpected reply from %s: %q", from, b[socks_udp_header_size+l:n])
+	}
+}
+
+// Returns a connect from a named client for stream to address, signed unless
+// signer is empty.
+func connectPacket(name, signer string, stream uint64, address string) types.Packet {
+	m := types.ProxyMessage{Version: types.ProxyVersion, Type: types.ProxyConnect, Source: clientAddress(name), Stream: stream, Address: address}
+	if len(signer) > 0 {
+		req, err := SignTCPTunnelRequest(testClientKey(signer), types.TCPTunnelRequest{}, sessionTarget("source", stream, address), time.Now())
+		if err != nil {
+			panic(err)
+		}
+		m.Data, _ = req.MarshalBinary()
+	}
+	b, _ := m.MarshalBinary()
+	return types.Packet{Dest: "source", Amt: 7, Data: b}
+}
+
+func TestProxyServerRefuses(t *testing.T) {
+	node := testNode{make(chan types.Packet, 10), make(chan types.Packet), nil}
+	exit := NewProxyServer(node, 7)
+	exit.Listen()
+	defer exit.Close()
+
+	// Unsigned connects, connects signed by someone else, connects signed
+	// for another stream and messages for streams nobody opened get no
+	// answer.
+	data := types.ProxyMessage{Version: types.ProxyVersion, Type: types.ProxyData, Source: clientAddress("a"), Stream: 1}
+	data_b, _ := data.MarshalBinary()
+	for _, p := range []types.Packet{
+		connectPacket("a", "", 1, "192.0.2.1:80"),
+		connectPacket("a", "b", 1, "192.0.2.1:80"),
+		{Dest: "source", Amt: 7, Data: data_b},
+	} {
+		node.out <- p
+	}
+	signed := connectPacket("a", "a", 1, "192.0.2.1:80")
+	var m types.ProxyMessage
+	m.UnmarshalBinary(signed.Data)
+	m.Stream = 2
+	signed.Data, _ = m.MarshalBinary()
+	node.out <- signed
+	time.Sleep(10 * time.Millisecond)
+	if len(node.in) != 0 {
+		t.Fatalf("Answered %d refused messages", len(node.in))
+	}
+
+	// Signed connects to the exit node itself or its networks are refused.
+	for _, address := range []string{"127.0.0.1:80", "[::1]:80", "10.1.2.3:80", "169.254.0.1:80", "0.0.0.0:80", "[fe80::1]:80"} {
+		node.out <- connectPacket("a", "a", 3, address)
+		p := <-node.in
+		var m types.ProxyMessage
+		err := m.UnmarshalBinary(p.Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if p.Dest != clientAddress("a") || m.Type != types.ProxyConnected || string(m.Data) != private_destination_error.Error() {
+			t.Fatalf("Connect to %s answered with %v to %x", address, m, p.Dest)
+		}
+	}
+}
+
+func TestPrivateIP(t *testing.T) {
+	for _, ip := range []string{"127.0.0.2", "::1", "10.0.0.1", "172.31.0.1", "192.168.1.1", "100.64.0.1", "169.254.1.1", "fe80::1", "fd00::1", "::", "::ffff:127.0.0.1"} {
+		if !privateIP(net.ParseIP(ip)) {
+			t.Fatalf("%s isn't private", ip)
+		}
+	}
+	for _, ip := range []string{"192.0.2.1", "8.8.8.8", "2001:db8::1", "172.32.0.1"} {
+		if privateIP(net.ParseIP(ip)) {
+			t.Fatalf("%s is private", ip)
+		}
+	}
+	if !privateIP(nil) {
+		t.Fatal("No address isn't private")
+	}
+}
+
+func TestSplitProxyPackets(t *testing.T) {
+	node := testNode{make(chan types.Packet), make(chan types.Packet), nil}
+	tunnel, proxy := SplitProxyPackets(node)
+	m := types.ProxyMessage{Type: types.ProxyData}
+	b, _ := m.MarshalBinary()
+	go func() {
+		node.out <- types.Packet{Data: b}
+		node.out <- dataPacket("destination", 0, exampleTunPacket())
+	}()
+	if p := <-proxy.Packets(); !bytes.Equal(p.Data, b) {
+		t.Fatalf("Proxy got %x", p.Data)
+	}
+	if p := <-tunnel.Packets(); p.Data[1] != 2 {
+		t.Fatalf("Tunnel got %x", p.Data)
+	}
+}
+
+func TestSeqBefore(t *testing.T) {
+	if !seqBefore(1, 2) || seqBefore(2, 1) || seqBefore(1, 1) {
+		t.Fatal("Sequence numbers out of order")
+	}
+	max := ^uint32(0)
+	if !seqBefore(max, 0) {
+		t.Fatal("Sequence numbers don't wrap")
+	}
+}
@@ -0,0 +1,157 @@
+package node
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"time"
+
+	"github.com/AutoRoute/node/types"
+)
+
+// What a route log says about a single neighbor.
+type NeighborAnalysis struct {
+	// Packets forwarded to the neighbor, and how many of those were receipted.
+	Forwarded     int
+	Receipted     int
+	DeliveryRatio float64
+	// Mean time from forwarding a packet to seeing its receipt, over receipts
+	// whose events were both timestamped.
+	MeanReceiptLatency time.Duration
+	// Satoshis the neighbor owes us for receipted packets it sent through us.
+	Income int64
+	// Satoshis we owe the neighbor for receipted packets we sent through it.
+	Expenses int64
+
+	total_latency time.Duration
+	timed         int
+}
+
+// A RouteAnalysis is built by replaying one or more route logs.
+type RouteAnalysis struct {
+	// The node which wrote the log, if it said.
+	Node         types.NodeAddress
+	Events       int
+	BloomFilters int
+	// When the first and last timestamped events happened.
+	Start, End time.Time
+	// Receipts for packets the log never saw forwarded.
+	UnmatchedReceipts int
+	Neighbors         map[types.NodeAddress]*NeighborAnalysis
+	// Income minus expenses across all neighbors. Packets the node sent itself
+	// are expenses with no matching income.
+	Earnings int64
+
+	decisions map[types.PacketHash]RouteEvent
+	receipted map[types.PacketHash]bool
+}
+
+func NewRouteAnalysis() *RouteAnalysis {
+	return &RouteAnalysis{
+		Neighbors: make(map[types.NodeAddress]*NeighborAnalysis),
+		decisions: make(map[types.PacketHash]RouteEvent),
+		receipted: make(map[types.PacketHash]bool),
+	}
+}
+
+func (a *RouteAnalysis) neighbor(id types.NodeAddress) *NeighborAnalysis {
+	n, ok := a.Neighbors[id]
+	if !ok {
+		n = &NeighborAnalysis{}
+		a.Neighbors[id] = n
+	}
+	return n
+}
+
+// Replays a single event. Events should be added in the order they were
+// logged.
+func (a *RouteAnalysis) Add(e RouteEvent) {
+	a.Events++
+	if !e.Time.IsZero() {
+		if a.Start.IsZero() || e.Time.Before(a.Start) {
+			a.Start = e.Time
+		}
+		if e.Time.After(a.End) {
+			a.End = e.Time
+		}
+	}
+	switch e.Type {
+	case StartEvent:
+		a.Node = e.Node
+	case BloomFilterEvent:
+		a.BloomFilters++
+	case RoutingDecisionEvent:
+		a.decisions[e.Decision.PacketHash] = e
+		n := a.neighbor(e.Decision.Next)
+		n.Forwarded++
+		n.DeliveryRatio = float64(n.Receipted) / float64(n.Forwarded)
+	case PacketReceiptEvent:
+		a.addReceipt(e)
+	}
+}
+
+func (a *RouteAnalysis) addReceipt(e RouteEvent) {
+	sent, ok := a.decisions[e.Receipt]
+	if !ok {
+		a.UnmatchedReceipts++
+		return
+	}
+	if a.receipted[e.Receipt] {
+		return
+	}
+	a.receipted[e.Receipt] = true
+	d := sent.Decision
+
+	next := a.neighbor(d.Next)
+	next.Receipted++
+	next.DeliveryRatio = float64(next.Receipted) / float64(next.Forwarded)
+	if !sent.Time.IsZero() && !e.Time.IsZero() {
+		next.total_latency += e.Time.Sub(sent.Time)
+		next.timed++
+		next.MeanReceiptLatency = next.total_latency / time.Duration(next.timed)
+	}
+	next.Expenses += d.Amt
+	a.Earnings -= d.Amt
+
+	// Version 0 logs don't say where packets came from.
+	if len(d.Source) > 0 && d.Source != a.Node {
+		a.neighbor(d.Source).Income += d.Amt
+		a.Earnings += d.Amt
+	}
+}
+
+// Replays every event in a route log.
+func AnalyzeRouteLog(r io.Reader) (*RouteAnalysis, error) {
+	a := NewRouteAnalysis()
+	reader := NewRouteLogReader(r)
+	for {
+		e, err := reader.Next()
+		if err == io.EOF {
+			return a, nil
+		}
+		if err != nil {
+			return a, err
+		}
+		a.Add(e)
+	}
+}
+
+func (a *RouteAnalysis) String() string {
+	o := fmt.Sprintf("node %x: %d events, %d bloom filters, %d unmatched receipts\n",
+		a.Node, a.Events, a.BloomFilters, a.UnmatchedReceipts)
+	if !a.Start.IsZero() {
+		o += fmt.Sprintf("from %v to %v\n", a.Start.Format(time.RFC3339), a.End.Format(time.RFC3339))
+	}
+	ids := make([]string, 0, len(a.Neighbors))
+	for id := range a.Neighbors {
+		ids = append(ids, string(id))
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		n := a.Neighbors[types.NodeAddress(id)]
+		o += fmt.Sprintf("  %x: delivered %d/%d (%.1f%%), receipt latency %v, income %d, expenses %d\n",
+			id, n.Receipted, n.Forwarded, 100*n.DeliveryRatio, n.MeanReceiptLatency, n.Income, n.Expenses)
+	}
+	o += fmt.Sprintf("estimated earnings %d\n", a.Earnings)
+	return o
+}
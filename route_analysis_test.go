@@ -0,0 +1,59 @@
+package node
+
+import (
+	"bytes"
+	"testing"
+	"time"
+
+	"github.com/AutoRoute/node/internal"
+	"github.com/AutoRoute/node/types"
+)
+
+func TestAnalyzeRouteLog(t *testing.T) {
+	buf := bytes.Buffer{}
+	clock := internal.NewFakeClock(time.Unix(1000, 0))
+	lgr := NewLogger(&buf)
+	lgr.clock = clock
+	self, a, b := types.NodeAddress("self"), types.NodeAddress("a"), types.NodeAddress("b")
+
+	lgr.LogStart(self)
+	// a sends two packets through us to b, one of which is receipted after a
+	// second.
+	lgr.LogRoutingDecision(a, "dest", b, 10, 5, "1")
+	lgr.LogRoutingDecision(a, "dest", b, 10, 5, "2")
+	clock.Advance(time.Second)
+	lgr.LogPacketReceipt("1")
+	// We send a packet of our own through a, which is receipted after three.
+	lgr.LogRoutingDecision(self, "dest", a, 10, 2, "3")
+	clock.Advance(3 * time.Second)
+	lgr.LogPacketReceipt("3")
+	// Duplicate and unknown receipts.
+	lgr.LogPacketReceipt("3")
+	lgr.LogPacketReceipt("4")
+
+	r, err := AnalyzeRouteLog(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if r.Node != self || r.Events != 8 || r.UnmatchedReceipts != 1 {
+		t.Fatalf("Unexpected analysis %v", r)
+	}
+	if r.End.Sub(r.Start) != 4*time.Second {
+		t.Fatalf("Expected the log to span 4s got %v", r.End.Sub(r.Start))
+	}
+	if n := r.Neighbors[b]; n.Forwarded != 2 || n.Receipted != 1 || n.DeliveryRatio != 0.5 ||
+		n.MeanReceiptLatency != time.Second || n.Expenses != 5 || n.Income != 0 {
+		t.Fatalf("Unexpected analysis of b %+v", n)
+	}
+	if n := r.Neighbors[a]; n.Forwarded != 1 || n.DeliveryRatio != 1 ||
+		n.MeanReceiptLatency != 3*time.Second || n.Expenses != 2 || n.Income != 5 {
+		t.Fatalf("Unexpected analysis of a %+v", n)
+	}
+	if _, ok := r.Neighbors[self]; ok {
+		t.Fatal("Expected our own packets not to count as a neighbor")
+	}
+	// Relaying a's packet broke even, and ours cost 2.
+	if r.Earnings != -2 {
+		t.Fatalf("Expected earnings of -2 got %d", r.Earnings)
+	}
+}
@@ -2,9 +2,11 @@ package node
 
 import (
 	"errors"
+	"expvar"
 	"fmt"
 	"log"
 	"net"
+	"net/http"
 	"strconv"
 	"strings"
 	"sync"
@@ -35,13 +37,67 @@ func (e emptywriter) Write(p []byte) (n int, err error) {
 	return len(p), nil
 }
 
+// Settings controlling the tradeoff between latency and overhead of receipts
+// and payments.
+type ServerOptions struct {
+	// How often to send receipts for packets delivered to us.
+	ReceiptInterval time.Duration
+	// How often to pay our neighbors what we owe them.
+	PaymentInterval time.Duration
+	// Send a receipt as soon as this many packets are waiting for one, or zero
+	// to only send them every ReceiptInterval.
+	ReceiptBatchSize int
+	// Where to persist how well each neighbor has behaved, or empty to forget
+	// on restart.
+	ReputationPath string
+	// How long payments to us take to confirm. Neighbors have this long on
+	// top of two PaymentIntervals to pay down their debt before it counts
+	// against them, the second interval covering their payments and our
+	// checks not lining up.
+	ConfirmationTime time.Duration
+}
+
+// Returns the settings used by NewServer.
+func DefaultServerOptions() ServerOptions {
+	return ServerOptions{30 * time.Second, 30 * time.Second, 0, "", time.Hour}
+}
+
 func NewServer(key Key, m types.Money, logger *log.Logger, route_logger Logger) *Server {
-	n := internal.NewNode(key.k, m, time.Tick(30*time.Second), time.Tick(30*time.Second), route_logger)
+	s, err := NewServerWithOptions(key, m, logger, route_logger, DefaultServerOptions())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return s
+}
+
+func NewServerWithOptions(key Key, m types.Money, logger *log.Logger, route_logger Logger, o ServerOptions) (*Server, error) {
+	// time.Tick returns nil for these, which would silently stop receipts or
+	// payments.
+	if o.ReceiptInterval <= 0 {
+		return nil, errors.New("Receipt interval must be positive")
+	}
+	if o.PaymentInterval <= 0 {
+		return nil, errors.New("Payment interval must be positive")
+	}
+	if o.ConfirmationTime < 0 {
+		return nil, errors.New("Confirmation time must not be negative")
+	}
+	n := internal.NewNodeWithOptions(key.k, m, internal.NodeOptions{
+		ReceiptTicker:    time.Tick(o.ReceiptInterval),
+		PaymentTicker:    time.Tick(o.PaymentInterval),
+		ReceiptBatchSize: o.ReceiptBatchSize,
+		ReputationPath:   o.ReputationPath,
+		PaymentGrace:     2*o.PaymentInterval + o.ConfirmationTime,
+	}, route_logger)
 	if logger == nil {
 		logger = log.New(emptywriter{}, "", 0)
 	}
+	err := route_logger.LogStart(n.GetNodeAddress())
+	if err != nil {
+		logger.Printf("Error writing route log: %v", err)
+	}
 	return &Server{n, make(map[string]*internal.SSHListener),
-		make(map[types.NodeAddress]bool), sync.Mutex{}, "", logger}
+		make(map[types.NodeAddress]bool), sync.Mutex{}, "", logger}, nil
 }
 
 func (s *Server) Connect(addr string) error {
@@ -88,6 +144,64 @@ func (s *Server) Node() Node {
 	return Node{s.n}
 }
 
+// Serves per source and destination traffic counters in the Prometheus text
+// format.
+func (s *Server) FlowsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		err := s.n.WriteFlows(w)
+		if err != nil {
+			s.logger.Printf("Error writing flows: %v", err)
+		}
+	})
+}
+
+// Serves all of this node's metrics in the Prometheus text format.
+func (s *Server) MetricsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		err := s.n.WriteMetrics(w)
+		if err != nil {
+			s.logger.Printf("Error writing metrics: %v", err)
+		}
+	})
+}
+
+// Stats is a copy of the connection and packet counters of one or more
+// servers, keyed by hex encoded address.
+type Stats internal.StatsSnapshot
+
+// Returns this server's connection and packet counters.
+func (s *Server) Stats() Stats {
+	return Stats(s.n.Stats().Snapshot())
+}
+
+// Combines the counters of several servers running in the same process.
+func AggregateStats(servers ...*Server) Stats {
+	stats := make([]*internal.RouterStats, 0, len(servers))
+	for _, s := range servers {
+		stats = append(stats, s.n.Stats())
+	}
+	return Stats(internal.AggregateStats(stats...))
+}
+
+// Publishes this server's counters as the expvar variables connections,
+// packets_sent, packets_received, packets_dropped and id. Since expvar is
+// global this can only be called for one server per process.
+func (s *Server) PublishExpvar() {
+	vars := map[string]func(Stats) interface{}{
+		"connections":      func(st Stats) interface{} { return st.Connections },
+		"packets_sent":     func(st Stats) interface{} { return st.Packets_sent },
+		"packets_received": func(st Stats) interface{} { return st.Packets_received },
+		"packets_dropped":  func(st Stats) interface{} { return st.Packets_dropped },
+		"id":               func(st Stats) interface{} { return st.Id },
+	}
+	for name, f := range vars {
+		f := f
+		expvar.Publish(name, expvar.Func(func() interface{} { return f(s.Stats()) }))
+	}
+}
+
 func (s *Server) Close() error {
 	return s.n.Close()
 }
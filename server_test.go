@@ -75,7 +75,7 @@ func TestDataTransmission(t *testing.T) {
 	}
 
 	for i := 0; i < 10; i++ {
-		p2 := types.Packet{key2.k.PublicKey().Hash(), 3, []byte(fmt.Sprintf("test%d", i))}
+		p2 := types.Packet{Dest: key2.k.PublicKey().Hash(), Amt: 3, Data: []byte(fmt.Sprintf("test%d", i))}
 		err = n1.Node().SendPacket(p2)
 		if err != nil {
 			t.Fatalf("Error sending packet: %v", err)
@@ -94,6 +94,123 @@ func TestDataTransmission(t *testing.T) {
 	}
 }
 
+func TestServerIntervals(t *testing.T) {
+	key, _ := NewKey()
+	for _, o := range []ServerOptions{
+		{0, time.Hour, 0, "", 0},
+		{time.Hour, -time.Second, 0, "", 0},
+		{time.Hour, time.Hour, 0, "", -time.Second},
+	} {
+		_, err := NewServerWithOptions(key, internal.FakeMoney{}, nil, NewLogger(&bytes.Buffer{}), o)
+		if err == nil {
+			t.Fatalf("Accepted options %+v", o)
+		}
+	}
+}
+
+func TestReceiptBatchSize(t *testing.T) {
+	key1, _ := NewKey()
+	key2, _ := NewKey()
+	buf1 := bytes.Buffer{}
+	buf2 := bytes.Buffer{}
+
+	// Receipts are only ever sent because the batch fills up.
+	o := ServerOptions{time.Hour, time.Hour, 2, "", 0}
+	n1, err := NewServerWithOptions(key1, internal.FakeMoney{}, nil, NewLogger(&buf1), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n1.Close()
+	n2, err := NewServerWithOptions(key2, internal.FakeMoney{}, nil, NewLogger(&buf2), o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer n2.Close()
+	err = n1.Listen("[::1]:16545")
+	if err != nil {
+		t.Fatalf("Error listening %v", err)
+	}
+	err = n2.Connect("[::1]:16545")
+	if err != nil {
+		t.Fatalf("Error connecting %v", err)
+	}
+	err = WaitForReachable(n1.Node(), key2.k.PublicKey().Hash())
+	if err != nil {
+		t.Fatalf("Error waiting for information %v", err)
+	}
+
+	p1 := types.Packet{Dest: key2.k.PublicKey().Hash(), Amt: 3, Data: []byte("one")}
+	d, err := n1.Node().SendPacketWithReceipt(p1, 5*time.Second)
+	if err != nil {
+		t.Fatalf("Error sending packet: %v", err)
+	}
+	<-n2.Node().Packets()
+	select {
+	case err := <-d.Done():
+		t.Fatalf("Receipt sent before the batch filled: %v", err)
+	case <-time.After(100 * time.Millisecond):
+	}
+
+	p2 := types.Packet{Dest: key2.k.PublicKey().Hash(), Amt: 3, Data: []byte("two")}
+	err = n1.Node().SendPacket(p2)
+	if err != nil {
+		t.Fatalf("Error sending packet: %v", err)
+	}
+	<-n2.Node().Packets()
+	if err := d.Wait(); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestServerStats(t *testing.T) {
+	key1, _ := NewKey()
+	key2, _ := NewKey()
+	buf1 := bytes.Buffer{}
+	buf2 := bytes.Buffer{}
+
+	n1 := NewServer(key1, internal.FakeMoney{}, nil, NewLogger(&buf1))
+	defer n1.Close()
+	n2 := NewServer(key2, internal.FakeMoney{}, nil, NewLogger(&buf2))
+	defer n2.Close()
+	err := n1.Listen("[::1]:16546")
+	if err != nil {
+		t.Fatalf("Error listening %v", err)
+	}
+	err = n2.Connect("[::1]:16546")
+	if err != nil {
+		t.Fatalf("Error connecting %v", err)
+	}
+	err = WaitForReachable(n1.Node(), key2.k.PublicKey().Hash())
+	if err != nil {
+		t.Fatalf("Error waiting for information %v", err)
+	}
+
+	p := types.Packet{Dest: key2.k.PublicKey().Hash(), Amt: 3, Data: []byte("data")}
+	err = n1.Node().SendPacket(p)
+	if err != nil {
+		t.Fatalf("Error sending packet: %v", err)
+	}
+	<-n2.Node().Packets()
+
+	id1 := fmt.Sprintf("%x", key1.k.PublicKey().Hash())
+	id2 := fmt.Sprintf("%x", key2.k.PublicKey().Hash())
+	s1, s2 := n1.Stats(), n2.Stats()
+	if s1.Id != id1 || s2.Id != id2 {
+		t.Fatalf("Servers share ids %v %v", s1.Id, s2.Id)
+	}
+	if s1.Packets_sent[id2] != 1 || s1.Packets_received[id1] != 1 {
+		t.Fatalf("Unexpected stats for n1 %v", s1)
+	}
+	if s2.Packets_sent[id2] != 1 || s2.Packets_received[id1] != 1 || s2.Connections[id1] != 1 {
+		t.Fatalf("Unexpected stats for n2 %v", s2)
+	}
+
+	all := AggregateStats(n1, n2)
+	if all.Packets_sent[id2] != 2 || all.Connections[id1]+all.Connections[id2] != 2 {
+		t.Fatalf("Unexpected aggregate stats %v", all)
+	}
+}
+
 func benchmarkDataTransmission(size int, b *testing.B) {
 	key1, _ := NewKey()
 	key2, _ := NewKey()
@@ -119,7 +236,7 @@ func benchmarkDataTransmission(size int, b *testing.B) {
 		b.Fatalf("Error waiting for information %v", err)
 	}
 
-	p2 := types.Packet{key2.k.PublicKey().Hash(), 3, []byte(strings.Repeat("a", size))}
+	p2 := types.Packet{Dest: key2.k.PublicKey().Hash(), Amt: 3, Data: []byte(strings.Repeat("a", size))}
 	done := make(chan bool)
 
 	b.ResetTimer()
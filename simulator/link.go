@@ -0,0 +1,92 @@
+package simulator
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+
+	"github.com/AutoRoute/node/internal"
+	"github.com/AutoRoute/node/types"
+)
+
+// The number of packets which can be waiting to cross a link before senders
+// block.
+const link_queue_size = 1024
+
+type queuedPacket struct {
+	p    types.Packet
+	sent time.Time
+}
+
+// A link wraps one direction of a paired test connection so that packets sent
+// over it are delayed, rate limited and sometimes lost. Control traffic is
+// passed through untouched.
+type link struct {
+	internal.Connection
+	props Link
+	r     *rand.Rand
+	r_l   *sync.Mutex
+	queue chan queuedPacket
+	// Called for every packet which makes it across.
+	crossed func(types.PacketHash)
+	quit    chan bool
+}
+
+func newLink(c internal.Connection, props Link, r *rand.Rand, r_l *sync.Mutex, crossed func(types.PacketHash)) *link {
+	l := &link{c, props, r, r_l, make(chan queuedPacket, link_queue_size), crossed, make(chan bool)}
+	go l.deliver()
+	return l
+}
+
+func (l *link) lost() bool {
+	if l.props.Loss == 0 {
+		return false
+	}
+	l.r_l.Lock()
+	defer l.r_l.Unlock()
+	return l.r.Float64() < l.props.Loss
+}
+
+// Lost packets vanish silently, like on a real network.
+func (l *link) SendPacket(p types.Packet) error {
+	if l.lost() {
+		return nil
+	}
+	select {
+	case l.queue <- queuedPacket{p, time.Now()}:
+	case <-l.quit:
+	}
+	return nil
+}
+
+// Sends queued packets on in order once they would have crossed the link.
+func (l *link) deliver() {
+	// When the link will have finished transmitting everything so far.
+	busy_until := time.Time{}
+	for {
+		select {
+		case q := <-l.queue:
+			start := q.sent
+			if busy_until.After(start) {
+				start = busy_until
+			}
+			done := start
+			if l.props.Bandwidth > 0 {
+				done = start.Add(time.Duration(len(q.p.Data)) * time.Second / time.Duration(l.props.Bandwidth))
+			}
+			busy_until = done
+			time.Sleep(done.Add(time.Duration(l.props.Latency)).Sub(time.Now()))
+			err := l.Connection.SendPacket(q.p)
+			if err == nil {
+				l.crossed(q.p.Hash())
+			}
+		case <-l.quit:
+			return
+		}
+	}
+}
+
+func (l *link) Close() error {
+	close(l.quit)
+	return l.Connection.Close()
+}
@@ -0,0 +1,321 @@
+// Package simulator runs a whole AutoRoute network inside one process. Nodes
+// are wired together according to a Topology with the paired connections used
+// by the internal tests, pay each other through a simulated bitcoin network,
+// and report how well traffic got through.
+package simulator
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"sort"
+	"sync"
+	"time"
+
+	"github.com/AutoRoute/node/internal"
+	"github.com/AutoRoute/node/types"
+)
+
+// Settings for a Simulation.
+type Options struct {
+	ReceiptInterval time.Duration
+	PaymentInterval time.Duration
+	// How long payments take to confirm.
+	ConfirmationDelay time.Duration
+	// What every node's wallet starts with, in satoshis.
+	Balance int64
+	// Seeds the random choices of traffic and packet loss.
+	Seed int64
+}
+
+func DefaultOptions() Options {
+	return Options{100 * time.Millisecond, 500 * time.Millisecond, 100 * time.Millisecond, 1000000, 1}
+}
+
+// A Simulation is a running network of nodes.
+type Simulation struct {
+	names   []string
+	nodes   map[string]*internal.Node
+	wallets map[string]*internal.SimulatedWallet
+	links   []*link
+	r       *rand.Rand
+	r_l     *sync.Mutex
+
+	l sync.Mutex
+	// How many links each packet has crossed.
+	hops map[types.PacketHash]int
+	// Packets which have been sent, and which have arrived.
+	sent      map[types.PacketHash]bool
+	delivered map[types.PacketHash]bool
+	nonce     uint64
+	quit      chan bool
+}
+
+// Discards routing logs.
+type nullLogger struct{}
+
+func (nullLogger) LogBloomFilter(*internal.BloomReachabilityMap) error { return nil }
+func (nullLogger) LogRoutingDecision(types.NodeAddress, types.NodeAddress, types.NodeAddress, int, int64, types.PacketHash) error {
+	return nil
+}
+func (nullLogger) LogPacketReceipt(types.PacketHash) error { return nil }
+
+func NewSimulation(t Topology, o Options) (*Simulation, error) {
+	err := t.Validate()
+	if err != nil {
+		return nil, err
+	}
+	s := &Simulation{
+		t.Nodes(),
+		make(map[string]*internal.Node),
+		make(map[string]*internal.SimulatedWallet),
+		nil,
+		rand.New(rand.NewSource(o.Seed)),
+		&sync.Mutex{},
+		sync.Mutex{},
+		make(map[types.PacketHash]int),
+		make(map[types.PacketHash]bool),
+		make(map[types.PacketHash]bool),
+		0,
+		make(chan bool),
+	}
+	money := internal.NewMoneySimulator(o.ConfirmationDelay)
+	for _, name := range s.names {
+		key, err := internal.NewECDSAKey()
+		if err != nil {
+			s.Close()
+			return nil, err
+		}
+		w := money.NewWallet(o.Balance)
+		n := internal.NewNodeWithOptions(key, w, internal.NodeOptions{
+			ReceiptTicker: time.Tick(o.ReceiptInterval),
+			PaymentTicker: time.Tick(o.PaymentInterval),
+			PaymentGrace:  2*o.PaymentInterval + o.ConfirmationDelay,
+		}, nullLogger{})
+		s.nodes[name] = n
+		s.wallets[name] = w
+		go s.receive(n)
+	}
+	for _, l := range t.Connections {
+		s.connect(s.nodes[l.Source], s.nodes[l.Destination], l)
+	}
+	return s, nil
+}
+
+// Connects a and b the way internal.LinkNodes does, but through links with the
+// given properties.
+func (s *Simulation) connect(a, b *internal.Node, props Link) {
+	ma := internal.SSHMetaData{Payment_Address: a.GetNewAddress()}
+	mb := internal.SSHMetaData{Payment_Address: b.GetNewAddress()}
+	c1, c2 := internal.MakePairedConnectionsWithMetaData(a.GetAddress(), b.GetAddress(), ma, mb)
+	to_b := newLink(c2, props, s.r, s.r_l, s.crossed)
+	to_a := newLink(c1, props, s.r, s.r_l, s.crossed)
+	s.links = append(s.links, to_b, to_a)
+	a.AddConnection(to_b)
+	b.AddConnection(to_a)
+}
+
+func (s *Simulation) crossed(h types.PacketHash) {
+	s.l.Lock()
+	defer s.l.Unlock()
+	s.hops[h]++
+}
+
+// Consumes everything delivered to a node so routing never blocks.
+func (s *Simulation) receive(n *internal.Node) {
+	for {
+		select {
+		case p := <-n.Packets():
+			s.l.Lock()
+			s.delivered[p.Hash()] = true
+			s.l.Unlock()
+		case <-s.quit:
+			return
+		}
+	}
+}
+
+// Returns the node with the given name in the topology.
+func (s *Simulation) Node(name string) *internal.Node {
+	return s.nodes[name]
+}
+
+// Waits until every node can reach every other node.
+func (s *Simulation) WaitForReachability(timeout time.Duration) error {
+	deadline := time.After(timeout)
+	for {
+		unreachable := ""
+		for _, from := range s.names {
+			for _, to := range s.names {
+				if from != to && !s.nodes[from].IsReachable(s.nodes[to].GetNodeAddress()) {
+					unreachable = fmt.Sprintf("%s can't reach %s", from, to)
+				}
+			}
+		}
+		if len(unreachable) == 0 {
+			return nil
+		}
+		select {
+		case <-deadline:
+			return errors.New(unreachable)
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// Sends a packet carrying amount satoshis between two named nodes.
+func (s *Simulation) Send(from, to string, size int, amount int64) error {
+	src, ok := s.nodes[from]
+	if !ok {
+		return fmt.Errorf("Unknown node %q", from)
+	}
+	dst, ok := s.nodes[to]
+	if !ok {
+		return fmt.Errorf("Unknown node %q", to)
+	}
+	s.l.Lock()
+	s.nonce++
+	p := types.Packet{Dest: dst.GetNodeAddress(), Amt: amount, Data: make([]byte, size), Nonce: s.nonce}
+	s.sent[p.Hash()] = true
+	s.l.Unlock()
+	return src.SendPacket(p)
+}
+
+// Sends count packets between random pairs of nodes.
+func (s *Simulation) SendRandom(count, size int, amount int64) {
+	for i := 0; i < count; i++ {
+		s.r_l.Lock()
+		from := s.names[s.r.Intn(len(s.names))]
+		to := s.names[s.r.Intn(len(s.names)-1)]
+		s.r_l.Unlock()
+		if to == from {
+			to = s.names[len(s.names)-1]
+		}
+		// Packets which can't be routed simply count as undelivered.
+		s.Send(from, to, size, amount)
+	}
+}
+
+// Waits until every packet sent has been delivered, or the timeout passes.
+func (s *Simulation) WaitForDelivery(timeout time.Duration) {
+	deadline := time.After(timeout)
+	for {
+		s.l.Lock()
+		done := len(s.delivered) >= len(s.sent)
+		s.l.Unlock()
+		if done {
+			return
+		}
+		select {
+		case <-deadline:
+			return
+		case <-time.After(10 * time.Millisecond):
+		}
+	}
+}
+
+// The books of a single node at the end of a simulation.
+type Balance struct {
+	// What is left in the node's wallet.
+	Wallet int64
+	// What each neighbor owes this node, and what it owes each neighbor, by
+	// name.
+	Incoming map[string]int64
+	Outgoing map[string]int64
+}
+
+// A Report summarizes a simulation so far.
+type Report struct {
+	Sent      int
+	Delivered int
+	// The fraction of sent packets which arrived.
+	DeliveryRate float64
+	// How many delivered packets crossed each number of links.
+	PathLengths    map[int]int
+	MeanPathLength float64
+	Balances       map[string]Balance
+}
+
+func (r Report) String() string {
+	lengths := make([]int, 0, len(r.PathLengths))
+	for l := range r.PathLengths {
+		lengths = append(lengths, l)
+	}
+	sort.Ints(lengths)
+	o := fmt.Sprintf("delivered %d/%d (%.1f%%), mean path length %.2f\n",
+		r.Delivered, r.Sent, 100*r.DeliveryRate, r.MeanPathLength)
+	for _, l := range lengths {
+		o += fmt.Sprintf("  %d hops: %d packets\n", l, r.PathLengths[l])
+	}
+	names := make([]string, 0, len(r.Balances))
+	for name := range r.Balances {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b := r.Balances[name]
+		o += fmt.Sprintf("  %s: wallet %d, owed %v, owes %v\n", name, b.Wallet, b.Incoming, b.Outgoing)
+	}
+	return o
+}
+
+func (s *Simulation) Report() Report {
+	names := make(map[types.NodeAddress]string)
+	for name, n := range s.nodes {
+		names[n.GetNodeAddress()] = name
+	}
+	byName := func(debts map[types.NodeAddress]int64) map[string]int64 {
+		o := make(map[string]int64)
+		for id, d := range debts {
+			if name, ok := names[id]; ok {
+				o[name] = d
+			}
+		}
+		return o
+	}
+
+	s.l.Lock()
+	defer s.l.Unlock()
+	r := Report{
+		len(s.sent),
+		0,
+		0,
+		make(map[int]int),
+		0,
+		make(map[string]Balance),
+	}
+	total_hops := 0
+	for h := range s.sent {
+		if !s.delivered[h] {
+			continue
+		}
+		r.Delivered++
+		r.PathLengths[s.hops[h]]++
+		total_hops += s.hops[h]
+	}
+	if r.Sent > 0 {
+		r.DeliveryRate = float64(r.Delivered) / float64(r.Sent)
+	}
+	if r.Delivered > 0 {
+		r.MeanPathLength = float64(total_hops) / float64(r.Delivered)
+	}
+	for name, n := range s.nodes {
+		r.Balances[name] = Balance{
+			s.wallets[name].Balance(),
+			byName(n.IncomingDebts()),
+			byName(n.OutgoingDebts()),
+		}
+	}
+	return r
+}
+
+func (s *Simulation) Close() error {
+	close(s.quit)
+	for _, n := range s.nodes {
+		n.Close()
+	}
+	for _, l := range s.links {
+		l.Close()
+	}
+	return nil
+}
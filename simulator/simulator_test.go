@@ -0,0 +1,118 @@
+package simulator
+
+import (
+	"testing"
+	"time"
+)
+
+func testOptions() Options {
+	o := DefaultOptions()
+	o.ReceiptInterval = 10 * time.Millisecond
+	o.PaymentInterval = time.Hour
+	return o
+}
+
+func startSimulation(t *testing.T, topology Topology) *Simulation {
+	s, err := NewSimulation(topology, testOptions())
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = s.WaitForReachability(10 * time.Second)
+	if err != nil {
+		s.Close()
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestLoadTopology(t *testing.T) {
+	topology, err := LoadTopology("../testing/sample.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := topology.Nodes()
+	if len(names) != 3 || names[0] != "A" || names[1] != "B" || names[2] != "C" {
+		t.Fatalf("Unexpected nodes %v", names)
+	}
+
+	bad := Topology{[]Link{{Source: "A", Destination: "A"}}}
+	if bad.Validate() == nil {
+		t.Fatal("Expected a self link to be invalid")
+	}
+}
+
+func TestSimulation(t *testing.T) {
+	topology, err := LoadTopology("../testing/sample.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := startSimulation(t, topology)
+	defer s.Close()
+
+	err = s.Send("B", "C", 10, 5)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.SendRandom(20, 10, 0)
+	s.WaitForDelivery(10 * time.Second)
+
+	r := s.Report()
+	if r.Sent != 21 || r.DeliveryRate != 1 {
+		t.Fatalf("Expected every packet to arrive, got %v", r)
+	}
+	for hops := range r.PathLengths {
+		if hops < 1 || hops > 2 {
+			t.Fatalf("Unexpected path length %d in %v", hops, r)
+		}
+	}
+	if r.PathLengths[2] == 0 {
+		t.Fatalf("Expected the B to C packet to cross two links, got %v", r)
+	}
+
+	// B owes A for the packet it sent through it.
+	for i := 0; i < 500; i++ {
+		r = s.Report()
+		if r.Balances["B"].Outgoing["A"] >= 5 && r.Balances["A"].Incoming["B"] >= 5 {
+			return
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	t.Fatalf("Expected B to owe A, got %v", r)
+}
+
+func TestSimulationLoss(t *testing.T) {
+	s := startSimulation(t, Topology{[]Link{
+		{Source: "A", Destination: "B", Loss: 1},
+	}})
+	defer s.Close()
+
+	err := s.Send("A", "B", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.WaitForDelivery(100 * time.Millisecond)
+	r := s.Report()
+	if r.Sent != 1 || r.Delivered != 0 {
+		t.Fatalf("Expected the packet to be lost, got %v", r)
+	}
+}
+
+func TestSimulationLatency(t *testing.T) {
+	s := startSimulation(t, Topology{[]Link{
+		{Source: "A", Destination: "B", Latency: Duration(50 * time.Millisecond)},
+	}})
+	defer s.Close()
+
+	start := time.Now()
+	err := s.Send("A", "B", 10, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	s.WaitForDelivery(time.Second)
+	if r := s.Report(); r.Delivered != 1 {
+		t.Fatalf("Expected the packet to arrive, got %v", r)
+	}
+	if time.Since(start) < 50*time.Millisecond {
+		t.Fatal("Packet arrived faster than the link latency")
+	}
+}
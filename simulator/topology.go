@@ -0,0 +1,99 @@
+package simulator
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"time"
+)
+
+// A Topology describes a network of named nodes and the links between them,
+// in the format of testing/sample.json.
+type Topology struct {
+	Connections []Link `json:"connections"`
+}
+
+// A Link is a bidirectional connection between two nodes. Every property other
+// than the endpoints is optional and applies in both directions.
+type Link struct {
+	Source      string `json:"source"`
+	Destination string `json:"destination"`
+	// How long a packet takes to cross the link.
+	Latency Duration `json:"latency"`
+	// Bytes of packet data per second the link can carry, or zero for no
+	// limit.
+	Bandwidth int64 `json:"bandwidth"`
+	// The probability between 0 and 1 that a packet is lost.
+	Loss float64 `json:"loss"`
+}
+
+// A Duration is a time.Duration written in JSON as a string such as "10ms".
+type Duration time.Duration
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = Duration(v)
+	return nil
+}
+
+func LoadTopology(path string) (Topology, error) {
+	var t Topology
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return t, err
+	}
+	err = json.Unmarshal(b, &t)
+	if err != nil {
+		return t, err
+	}
+	return t, t.Validate()
+}
+
+func (t Topology) Validate() error {
+	if len(t.Connections) == 0 {
+		return errors.New("Topology has no connections")
+	}
+	for _, l := range t.Connections {
+		if len(l.Source) == 0 || len(l.Destination) == 0 {
+			return fmt.Errorf("Link %v is missing an endpoint", l)
+		}
+		if l.Source == l.Destination {
+			return fmt.Errorf("Link from %s to itself", l.Source)
+		}
+		if l.Loss < 0 || l.Loss > 1 {
+			return fmt.Errorf("Link %s-%s has invalid loss %v", l.Source, l.Destination, l.Loss)
+		}
+		if l.Latency < 0 || l.Bandwidth < 0 {
+			return fmt.Errorf("Link %s-%s has negative latency or bandwidth", l.Source, l.Destination)
+		}
+	}
+	return nil
+}
+
+// Returns the name of every node in the order they first appear.
+func (t Topology) Nodes() []string {
+	seen := make(map[string]bool)
+	names := make([]string, 0)
+	for _, l := range t.Connections {
+		for _, name := range []string{l.Source, l.Destination} {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	return names
+}
@@ -0,0 +1,539 @@
+package node
+
+import (
+	"encoding/binary"
+	"errors"
+	"io"
+	"io/ioutil"
+	"log"
+	"net"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/AutoRoute/node/internal"
+	"github.com/AutoRoute/node/types"
+)
+
+// SOCKS5 constants from RFC 1928.
+const (
+	socks_version = 5
+
+	socks_no_auth         = 0
+	socks_no_methods      = 0xFF
+	socks_connect         = 1
+	socks_udp_associate   = 3
+	socks_ipv4            = 1
+	socks_domain          = 3
+	socks_ipv6            = 4
+	socks_succeeded       = 0
+	socks_failure         = 1
+	socks_unreachable     = 4
+	socks_refused         = 5
+	socks_not_supported   = 7
+	socks_bad_address     = 8
+	socks_udp_header_size = 3
+)
+
+// Settings for a SOCKSProxy.
+type SOCKSProxyOptions struct {
+	// How long to wait for the exit node to open a connection.
+	ConnectTimeout time.Duration
+	// How long to wait for the exit node to acknowledge data before sending
+	// it again, and how long to keep trying.
+	RetransmitInterval time.Duration
+	StreamTimeout      time.Duration
+	// Signs connects so the exit node knows who they're from, which it
+	// should require. Connects are unsigned if this is nil.
+	Key *Key
+	// What streams are timed with, or nil for the system clock.
+	Clock internal.Clock
+}
+
+// Returns the settings used by NewSOCKSProxy.
+func DefaultSOCKSProxyOptions() SOCKSProxyOptions {
+	return SOCKSProxyOptions{
+		ConnectTimeout:     30 * time.Second,
+		RetransmitInterval: time.Second,
+		StreamTimeout:      2 * time.Minute,
+	}
+}
+
+// A connection or association waiting for the exit node to open its end.
+type socksPending struct {
+	// The connection, or nil for an association.
+	conn net.Conn
+	// Gets the exit node's answer, after which the stream is registered if
+	// it succeeded.
+	result chan types.ProxyMessage
+}
+
+// A UDP association, relaying datagrams between a local application and the
+// exit node.
+type socksAssociation struct {
+	udp *net.UDPConn
+	// Only datagrams from the host which asked for the association are
+	// relayed, and answers go to wherever it last sent from.
+	host   net.IP
+	client *net.UDPAddr
+	l      *sync.Mutex
+}
+
+// A SOCKSProxy is a SOCKS5 server which carries connections and UDP
+// datagrams over AutoRoute to a ProxyServer on an exit node, so applications
+// can use the network without root or a tun device. It supports CONNECT and
+// UDP ASSOCIATE without authentication.
+type SOCKSProxy struct {
+	node     NodeConnection
+	exit     types.NodeAddress
+	amt      int64
+	o        SOCKSProxyOptions
+	timing   proxyTiming
+	listener net.Listener
+	// Everything waiting on or talking to the exit node, by stream.
+	pending      map[uint64]*socksPending
+	streams      map[uint64]*proxyStream
+	associations map[uint64]*socksAssociation
+	l            *sync.Mutex
+	quit         chan bool
+	err          chan error
+}
+
+// NewSOCKSProxy listens for SOCKS5 clients on listen, such as
+// "127.0.0.1:1080", and carries what they send through exit.
+func NewSOCKSProxy(n NodeConnection, exit types.NodeAddress, amt int64, listen string) (*SOCKSProxy, error) {
+	return NewSOCKSProxyWithOptions(n, exit, amt, listen, DefaultSOCKSProxyOptions())
+}
+
+func NewSOCKSProxyWithOptions(n NodeConnection, exit types.NodeAddress, amt int64, listen string, o SOCKSProxyOptions) (*SOCKSProxy, error) {
+	clock := o.Clock
+	if clock == nil {
+		clock = internal.SystemClock()
+	}
+	listener, err := net.Listen("tcp", listen)
+	if err != nil {
+		return nil, err
+	}
+	p := &SOCKSProxy{n, exit, amt, o, proxyTiming{o.RetransmitInterval, o.StreamTimeout, clock}, listener,
+		make(map[uint64]*socksPending), make(map[uint64]*proxyStream), make(map[uint64]*socksAssociation),
+		&sync.Mutex{}, make(chan bool), make(chan error, 1)}
+	go p.accept()
+	go p.listenNode()
+	return p, nil
+}
+
+// Returns the address SOCKS clients connect to.
+func (p *SOCKSProxy) Addr() net.Addr {
+	return p.listener.Addr()
+}
+
+// Stops listening and ends every connection and association.
+func (p *SOCKSProxy) Close() {
+	close(p.quit)
+	p.listener.Close()
+	p.l.Lock()
+	defer p.l.Unlock()
+	for _, s := range p.streams {
+		s.Close()
+	}
+	for _, a := range p.associations {
+		a.udp.Close()
+	}
+}
+
+func (p *SOCKSProxy) Error() chan error {
+	return p.err
+}
+
+func (p *SOCKSProxy) send(stream uint64, m types.ProxyMessage) {
+	m.Version = types.ProxyVersion
+	m.Source = p.node.GetNodeAddress()
+	m.Stream = stream
+	b, err := m.MarshalBinary()
+	if err != nil {
+		log.Printf("Error encoding proxy message: %v", err)
+		return
+	}
+	err = p.node.SendPacket(types.Packet{Dest: p.exit, Amt: p.amt, Data: b})
+	if err != nil {
+		log.Printf("Error sending proxy message to %x: %v", p.exit, err)
+	}
+}
+
+func (p *SOCKSProxy) accept() {
+	for {
+		conn, err := p.listener.Accept()
+		if err != nil {
+			select {
+			case <-p.quit:
+			default:
+				reportError(p.err, err)
+			}
+			return
+		}
+		go p.handle(conn)
+	}
+}
+
+// Hands messages from the exit node to whatever they're for.
+func (p *SOCKSProxy) listenNode() {
+	for {
+		var packet types.Packet
+		select {
+		case packet = <-p.node.Packets():
+		case <-p.quit:
+			return
+		}
+		var m types.ProxyMessage
+		err := m.UnmarshalBinary(packet.Data)
+		if err != nil {
+			log.Printf("Error reading proxy message: %v", err)
+			continue
+		}
+		p.l.Lock()
+		pending := p.pending[m.Stream]
+		s := p.streams[m.Stream]
+		a := p.associations[m.Stream]
+		if pending != nil && (m.Type == types.ProxyConnected || m.Type == types.ProxyReset) {
+			// Registering the stream here means nothing the exit node
+			// sends after answering is missed.
+			delete(p.pending, m.Stream)
+			if m.Type == types.ProxyConnected && len(m.Data) == 0 && pending.conn != nil {
+				s = newProxyStream(pending.conn, func(sm types.ProxyMessage) { p.send(m.Stream, sm) }, p.timing)
+				p.streams[m.Stream] = s
+			}
+			pending.result <- m
+			p.l.Unlock()
+			continue
+		}
+		p.l.Unlock()
+
+		switch {
+		case a != nil && m.Type == types.ProxyDatagram:
+			a.deliver(m)
+		case s != nil:
+			// Repeated answers to our connect are ignored.
+			if m.Type != types.ProxyConnected {
+				s.deliver(m)
+			}
+		case pending == nil && (m.Type == types.ProxyData || m.Type == types.ProxyClose):
+			p.send(m.Stream, types.ProxyMessage{Type: types.ProxyReset, Data: []byte("no such stream")})
+		}
+	}
+}
+
+// Reads a SOCKS5 greeting and request from a client and carries it out.
+func (p *SOCKSProxy) handle(conn net.Conn) {
+	conn.SetDeadline(time.Now().Add(p.o.ConnectTimeout))
+	cmd, address, err := readSOCKSRequest(conn)
+	if err != nil {
+		if err != socks_no_methods_error {
+			log.Printf("Error reading SOCKS request: %v", err)
+		}
+		conn.Close()
+		return
+	}
+	switch cmd {
+	case socks_connect:
+		p.connect(conn, address)
+	case socks_udp_associate:
+		conn.SetDeadline(time.Time{})
+		p.associate(conn)
+	default:
+		writeSOCKSReply(conn, socks_not_supported, nil)
+		conn.Close()
+	}
+}
+
+// Asks the exit node to open stream to address, or an association if address
+// is empty, until it answers. Returns the SOCKS reply for how that went and
+// the exit node's answer.
+func (p *SOCKSProxy) open(stream uint64, address string, conn net.Conn) (byte, types.ProxyMessage) {
+	connect := types.ProxyMessage{Type: types.ProxyConnect, Address: address}
+	if p.o.Key != nil {
+		req, err := SignTCPTunnelRequest(*p.o.Key, types.TCPTunnelRequest{}, sessionTarget(p.exit, stream, address), p.timing.clock.Now())
+		if err == nil {
+			connect.Data, err = req.MarshalBinary()
+		}
+		if err != nil {
+			log.Printf("Error signing proxy connect: %v", err)
+			return socks_failure, connect
+		}
+	}
+	pending := &socksPending{conn, make(chan types.ProxyMessage, 1)}
+	p.l.Lock()
+	p.pending[stream] = pending
+	p.l.Unlock()
+
+	p.send(stream, connect)
+	timeout := p.timing.clock.After(p.o.ConnectTimeout)
+	tick := p.timing.clock.Tick(p.o.RetransmitInterval)
+	for {
+		select {
+		case m := <-pending.result:
+			if m.Type == types.ProxyReset || len(m.Data) > 0 {
+				log.Printf("Exit node couldn't open %q: %s", address, m.Data)
+				return socks_refused, m
+			}
+			return socks_succeeded, m
+		case <-tick:
+			p.send(stream, connect)
+		case <-timeout:
+			p.abandon(stream)
+			return socks_unreachable, connect
+		case <-p.quit:
+			p.abandon(stream)
+			return socks_failure, connect
+		}
+	}
+}
+
+// Asks the exit node to connect to address, then copies the connection to it.
+func (p *SOCKSProxy) connect(conn net.Conn, address string) {
+	stream := randomStream()
+	reply, m := p.open(stream, address, conn)
+	if reply != socks_succeeded {
+		writeSOCKSReply(conn, reply, nil)
+		conn.Close()
+		return
+	}
+	p.l.Lock()
+	s := p.streams[stream]
+	p.l.Unlock()
+	bound, _ := net.ResolveTCPAddr("tcp", m.Address)
+	err := writeSOCKSReply(conn, socks_succeeded, bound)
+	if err != nil {
+		s.Close()
+	}
+	conn.SetDeadline(time.Time{})
+	go s.run()
+	<-s.done
+	p.l.Lock()
+	delete(p.streams, stream)
+	p.l.Unlock()
+}
+
+// Gives up on opening a stream or association, telling the exit node in case
+// its answer arrived just too late.
+func (p *SOCKSProxy) abandon(stream uint64) {
+	p.l.Lock()
+	delete(p.pending, stream)
+	delete(p.streams, stream)
+	p.l.Unlock()
+	p.send(stream, types.ProxyMessage{Type: types.ProxyReset, Data: []byte("gave up connecting")})
+}
+
+// Opens a UDP socket for the client and an association on the exit node, and
+// relays datagrams between them until the client closes its connection.
+func (p *SOCKSProxy) associate(conn net.Conn) {
+	defer conn.Close()
+	stream := randomStream()
+	reply, _ := p.open(stream, "", nil)
+	if reply != socks_succeeded {
+		writeSOCKSReply(conn, reply, nil)
+		return
+	}
+	local := conn.LocalAddr().(*net.TCPAddr)
+	udp, err := net.ListenUDP("udp", &net.UDPAddr{IP: local.IP})
+	if err != nil {
+		log.Printf("Error opening UDP socket: %v", err)
+		writeSOCKSReply(conn, socks_failure, nil)
+		p.send(stream, types.ProxyMessage{Type: types.ProxyReset, Data: []byte("association closed")})
+		return
+	}
+	a := &socksAssociation{udp, conn.RemoteAddr().(*net.TCPAddr).IP, nil, &sync.Mutex{}}
+	p.l.Lock()
+	p.associations[stream] = a
+	p.l.Unlock()
+	err = writeSOCKSReply(conn, socks_succeeded, udp.LocalAddr())
+	if err == nil {
+		go a.relay(func(m types.ProxyMessage) { p.send(stream, m) })
+		// The association lasts as long as the connection asking for it.
+		io.Copy(ioutil.Discard, conn)
+	}
+	p.l.Lock()
+	delete(p.associations, stream)
+	p.l.Unlock()
+	udp.Close()
+	p.send(stream, types.ProxyMessage{Type: types.ProxyReset, Data: []byte("association closed")})
+}
+
+// Sends datagrams from the client to the exit node until the socket closes.
+func (a *socksAssociation) relay(send func(m types.ProxyMessage)) {
+	b := make([]byte, 0xFFFF)
+	for {
+		n, from, err := a.udp.ReadFromUDP(b)
+		if err != nil {
+			return
+		}
+		if !from.IP.Equal(a.host) {
+			continue
+		}
+		// Fragments aren't supported, and are dropped as RFC 1928 allows.
+		if n < socks_udp_header_size || b[2] != 0 {
+			continue
+		}
+		address, l, err := parseSOCKSAddress(b[socks_udp_header_size:n])
+		if err != nil {
+			continue
+		}
+		a.l.Lock()
+		a.client = from
+		a.l.Unlock()
+		data := append([]byte(nil), b[socks_udp_header_size+l:n]...)
+		send(types.ProxyMessage{Type: types.ProxyDatagram, Address: address, Data: data})
+	}
+}
+
+// Passes a datagram from the exit node to the client.
+func (a *socksAssociation) deliver(m types.ProxyMessage) {
+	a.l.Lock()
+	client := a.client
+	a.l.Unlock()
+	if client == nil {
+		return
+	}
+	from, err := net.ResolveUDPAddr("udp", m.Address)
+	if err != nil {
+		return
+	}
+	b := appendSOCKSAddress([]byte{0, 0, 0}, from.IP, from.Port)
+	_, err = a.udp.WriteToUDP(append(b, m.Data...), client)
+	if err != nil {
+		log.Printf("Error relaying datagram: %v", err)
+	}
+}
+
+var socks_no_methods_error = errors.New("SOCKS client offered no usable methods")
+
+// Reads the greeting and request from a SOCKS5 client, answering the
+// greeting. Returns the command and the address it is for.
+func readSOCKSRequest(conn net.Conn) (byte, string, error) {
+	b := make([]byte, 2)
+	_, err := io.ReadFull(conn, b)
+	if err != nil {
+		return 0, "", err
+	}
+	if b[0] != socks_version {
+		return 0, "", errors.New("unsupported SOCKS version " + strconv.Itoa(int(b[0])))
+	}
+	methods := make([]byte, b[1])
+	_, err = io.ReadFull(conn, methods)
+	if err != nil {
+		return 0, "", err
+	}
+	method := byte(socks_no_methods)
+	for _, m := range methods {
+		if m == socks_no_auth {
+			method = socks_no_auth
+		}
+	}
+	_, err = conn.Write([]byte{socks_version, method})
+	if err != nil {
+		return 0, "", err
+	}
+	if method == socks_no_methods {
+		return 0, "", socks_no_methods_error
+	}
+
+	header := make([]byte, 4)
+	_, err = io.ReadFull(conn, header)
+	if err != nil {
+		return 0, "", err
+	}
+	if header[0] != socks_version {
+		return 0, "", errors.New("unsupported SOCKS version " + strconv.Itoa(int(header[0])))
+	}
+	// The address is read into the buffer parseSOCKSAddress expects.
+	var rest []byte
+	switch header[3] {
+	case socks_ipv4:
+		rest = make([]byte, net.IPv4len+2)
+	case socks_ipv6:
+		rest = make([]byte, net.IPv6len+2)
+	case socks_domain:
+		l := make([]byte, 1)
+		_, err = io.ReadFull(conn, l)
+		if err != nil {
+			return 0, "", err
+		}
+		rest = make([]byte, int(l[0])+2)
+		header = append(header, l[0])
+	default:
+		writeSOCKSReply(conn, socks_bad_address, nil)
+		return 0, "", errors.New("unsupported SOCKS address type")
+	}
+	_, err = io.ReadFull(conn, rest)
+	if err != nil {
+		return 0, "", err
+	}
+	address, _, err := parseSOCKSAddress(append(header[3:], rest...))
+	return header[1], address, err
+}
+
+// Parses the address type, address and port at the start of b into
+// "host:port", also returning how many bytes they took.
+func parseSOCKSAddress(b []byte) (string, int, error) {
+	if len(b) < 1 {
+		return "", 0, errors.New("missing SOCKS address")
+	}
+	var host string
+	l := 1
+	switch b[0] {
+	case socks_ipv4:
+		l += net.IPv4len
+		if len(b) < l+2 {
+			return "", 0, errors.New("short SOCKS address")
+		}
+		host = net.IP(b[1:l]).String()
+	case socks_ipv6:
+		l += net.IPv6len
+		if len(b) < l+2 {
+			return "", 0, errors.New("short SOCKS address")
+		}
+		host = net.IP(b[1:l]).String()
+	case socks_domain:
+		if len(b) < 2 {
+			return "", 0, errors.New("short SOCKS address")
+		}
+		l += 1 + int(b[1])
+		if len(b) < l+2 {
+			return "", 0, errors.New("short SOCKS address")
+		}
+		host = string(b[2:l])
+	default:
+		return "", 0, errors.New("unsupported SOCKS address type")
+	}
+	port := binary.BigEndian.Uint16(b[l:])
+	return net.JoinHostPort(host, strconv.Itoa(int(port))), l + 2, nil
+}
+
+// Appends an address type, address and port to b.
+func appendSOCKSAddress(b []byte, ip net.IP, port int) []byte {
+	if v4 := ip.To4(); v4 != nil {
+		b = append(append(b, socks_ipv4), v4...)
+	} else if ip != nil {
+		b = append(append(b, socks_ipv6), ip.To16()...)
+	} else {
+		b = append(b, socks_ipv4, 0, 0, 0, 0)
+	}
+	return append(b, byte(port>>8), byte(port))
+}
+
+// Sends a SOCKS5 reply with the address the server bound, if any.
+func writeSOCKSReply(conn net.Conn, reply byte, bound net.Addr) error {
+	var ip net.IP
+	var port int
+	switch a := bound.(type) {
+	case *net.TCPAddr:
+		if a != nil {
+			ip, port = a.IP, a.Port
+		}
+	case *net.UDPAddr:
+		if a != nil {
+			ip, port = a.IP, a.Port
+		}
+	}
+	_, err := conn.Write(appendSOCKSAddress([]byte{socks_version, reply, 0}, ip, port))
+	return err
+}
@@ -0,0 +1,489 @@
+package node
+
+import (
+	"errors"
+	"log"
+	"sync"
+	"time"
+
+	"github.com/AutoRoute/tuntap"
+
+	"github.com/AutoRoute/node/internal"
+	"github.com/AutoRoute/node/types"
+)
+
+// An Ethernet header with a VLAN tag, which frames may carry on top of the
+// tunnel MTU.
+const tap_frame_overhead = 18
+
+const ethernet_header_size = 14
+
+// Settings for a TAPBridge.
+type TAPBridgeOptions struct {
+	// Who may join the bridge and what they may send, as for a TCPTunServer.
+	AllowUnsigned   bool
+	SignatureWindow time.Duration
+	Allow           []types.NodeAddress
+	Deny            []types.NodeAddress
+	DefaultPolicy   TunnelPolicy
+	Policies        map[types.NodeAddress]TunnelPolicy
+	// The largest frame payload sent to a client, at least 1280. Clients may
+	// ask for less.
+	MTU int
+	// How long a client keeps its session without sending anything.
+	SessionTimeout time.Duration
+	// How long a MAC address is remembered without a frame from it.
+	MACTimeout time.Duration
+	// What sessions and MAC addresses are timed with, or nil for the system
+	// clock.
+	Clock internal.Clock
+}
+
+// Returns the settings used by NewTAPBridge.
+func DefaultTAPBridgeOptions() TAPBridgeOptions {
+	return TAPBridgeOptions{
+		SignatureWindow: 5 * time.Minute,
+		MTU:             default_tunnel_mtu,
+		SessionTimeout:  10 * time.Minute,
+		MACTimeout:      5 * time.Minute,
+	}
+}
+
+type macAddress [6]byte
+
+// Where a MAC address was last seen. Addresses on the tap device's side have
+// an empty client.
+type learnedMAC struct {
+	client types.NodeAddress
+	last   time.Time
+}
+
+// A client's session with the bridge.
+type bridgeSession struct {
+	version byte
+	mtu     int
+	// Which frames, keepalives and closes belong to the session, or 0 for
+	// version 3 sessions.
+	token uint64
+	last  time.Time
+}
+
+// TAPBridge joins clients' tap devices to a tap device on this node at layer
+// 2. It learns which client each MAC address is behind, so frames for it are
+// only sent there, and floods the rest to everyone like a switch would.
+// Clients connect with a TCPTunClient with TAP set. Like a TCPTunServer, the
+// bridge tells which client sent a frame by its session token, and only
+// trusts the source version 3 messages claim for unsigned sessions.
+type TAPBridge struct {
+	node            NodeConnection
+	tap             TCPTun
+	amt             int64
+	auth            *tunnelAuth
+	mtu             int
+	session_timeout time.Duration
+	mac_timeout     time.Duration
+	sessions        map[types.NodeAddress]*bridgeSession
+	// The client each session token belongs to.
+	tokens map[uint64]types.NodeAddress
+	macs   map[macAddress]learnedMAC
+	l      *sync.Mutex
+	clock  internal.Clock
+	quit   chan bool
+	err    chan error
+}
+
+// Constructs a TAPBridge with the default settings. Like a TCPTunServer, it
+// doesn't start until Listen is called.
+func NewTAPBridge(n NodeConnection, tap TCPTun, amt int64) *TAPBridge {
+	b, err := NewTAPBridgeWithOptions(n, tap, amt, DefaultTAPBridgeOptions())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return b
+}
+
+func NewTAPBridgeWithOptions(n NodeConnection, tap TCPTun, amt int64, o TAPBridgeOptions) (*TAPBridge, error) {
+	clock := o.Clock
+	if clock == nil {
+		clock = internal.SystemClock()
+	}
+	if o.MTU < min_tunnel_mtu {
+		return nil, errors.New("tunnel MTU must be at least 1280")
+	}
+	auth := newTunnelAuth(TCPTunServerOptions{
+		AllowUnsigned:   o.AllowUnsigned,
+		SignatureWindow: o.SignatureWindow,
+		Allow:           o.Allow,
+		Deny:            o.Deny,
+		DefaultPolicy:   o.DefaultPolicy,
+		Policies:        o.Policies,
+	})
+	return &TAPBridge{n, tap, amt, auth, o.MTU, o.SessionTimeout, o.MACTimeout,
+		make(map[types.NodeAddress]*bridgeSession), make(map[uint64]types.NodeAddress), make(map[macAddress]learnedMAC),
+		&sync.Mutex{}, clock, make(chan bool), make(chan error, 1)}, nil
+}
+
+// Listen starts listening on the tap device and AutoRoute connection.
+func (b *TAPBridge) Listen() {
+	go b.listenNode()
+	go b.listenTap()
+	go b.expire()
+}
+
+func (b *TAPBridge) Close() {
+	close(b.quit)
+}
+
+func (b *TAPBridge) Error() chan error {
+	return b.err
+}
+
+// Returns the client a MAC address was last seen behind, or false if it's on
+// the tap device's side or hasn't been seen.
+func (b *TAPBridge) Lookup(mac [6]byte) (types.NodeAddress, bool) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	learned, ok := b.macs[mac]
+	if !ok || learned.client == "" {
+		return "", false
+	}
+	return learned.client, true
+}
+
+// Checks the client may join and starts its session. A client which already
+// has one is answered again.
+func (b *TAPBridge) connect(req types.TCPTunnelRequest) {
+	err := b.auth.authorize(req, b.node.GetNodeAddress(), b.clock.Now())
+	if err == nil && !req.TAP {
+		err = errors.New("this node only bridges ethernet frames")
+	}
+	if err == nil && req.Signature != nil && req.Version < 4 {
+		err = errors.New("signed tunnels need version 4")
+	}
+	if err != nil {
+		log.Printf("Refusing tunnel request from %x: %v", req.Source, err)
+		return
+	}
+	session := &bridgeSession{req.Version, negotiateMTU(int(req.MTU), b.mtu), 0, b.clock.Now()}
+	resp := types.TCPTunnelResponse{Version: req.Version, MTU: uint16(session.mtu), TAP: true}
+	b.l.Lock()
+	if req.Version >= 4 {
+		// A client retrying its request keeps its token, so frames it
+		// sent after an earlier answer aren't lost.
+		if old, ok := b.sessions[req.Source]; ok {
+			session.token = old.token
+		}
+		if session.token == 0 {
+			session.token = newSessionToken()
+		}
+		resp.Token = session.token
+	}
+	b.startSession(req.Source, session)
+	b.l.Unlock()
+	resp_b, err := resp.MarshalBinary()
+	if err != nil {
+		log.Printf("Error answering tunnel request from %x: %v", req.Source, err)
+		return
+	}
+	err = b.node.SendPacket(types.Packet{Dest: req.Source, Amt: b.amt, Data: resp_b})
+	if err != nil {
+		log.Printf("Error answering tunnel request from %x: %v", req.Source, err)
+	}
+}
+
+// Records a client's session, replacing any it had. Must be called with the
+// lock held.
+func (b *TAPBridge) startSession(client types.NodeAddress, session *bridgeSession) {
+	b.endSession(client)
+	b.sessions[client] = session
+	if session.token != 0 {
+		b.tokens[session.token] = client
+	}
+}
+
+// Forgets a client's session. Must be called with the lock held.
+func (b *TAPBridge) endSession(client types.NodeAddress) {
+	if session, ok := b.sessions[client]; ok {
+		delete(b.tokens, session.token)
+	}
+	delete(b.sessions, client)
+}
+
+// Returns which client sent a message, going by its token from version 4.
+// Older messages are only believed for sessions which are older too.
+func (b *TAPBridge) sender(version byte, source types.NodeAddress, token uint64) (types.NodeAddress, bool) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	if version >= 4 {
+		client, ok := b.tokens[token]
+		return client, ok
+	}
+	session, ok := b.sessions[source]
+	return source, ok && session.version < 4
+}
+
+// Renews the session of the client which sent k and answers it. Keepalives
+// without a known token are dropped.
+func (b *TAPBridge) keepalive(k types.TCPTunnelKeepalive) {
+	client, ok := b.sender(k.Version, k.Source, k.Token)
+	if !ok || !b.renew(client) {
+		return
+	}
+	reply := types.TCPTunnelKeepalive{Version: k.Version, Source: b.node.GetNodeAddress(), Token: k.Token}
+	reply_b, _ := reply.MarshalBinary()
+	err := b.node.SendPacket(types.Packet{Dest: client, Amt: b.amt, Data: reply_b})
+	if err != nil {
+		log.Printf("Error answering keepalive from %x: %v", client, err)
+	}
+}
+
+// Marks the client's session as heard from, returning false if it has none.
+func (b *TAPBridge) renew(client types.NodeAddress) bool {
+	b.l.Lock()
+	defer b.l.Unlock()
+	session, ok := b.sessions[client]
+	if ok {
+		session.last = b.clock.Now()
+	}
+	return ok
+}
+
+// Ends a client's session and forgets the MAC addresses behind it.
+func (b *TAPBridge) release(client types.NodeAddress) {
+	b.l.Lock()
+	defer b.l.Unlock()
+	b.endSession(client)
+	for mac, learned := range b.macs {
+		if learned.client == client {
+			delete(b.macs, mac)
+		}
+	}
+}
+
+// Tells a client its session is over.
+func (b *TAPBridge) sendClose(client types.NodeAddress, session bridgeSession, reason string) {
+	c := types.TCPTunnelClose{Version: session.version, Source: client, Token: session.token, Reason: reason}
+	c_b, err := c.MarshalBinary()
+	if err != nil {
+		log.Printf("Error closing tunnel to %x: %v", client, err)
+		return
+	}
+	err = b.node.SendPacket(types.Packet{Dest: client, Amt: b.amt, Data: c_b})
+	if err != nil {
+		log.Printf("Error closing tunnel to %x: %v", client, err)
+	}
+}
+
+// Ends sessions and forgets MAC addresses which have been quiet too long.
+func (b *TAPBridge) expire() {
+	tick := b.clock.Tick(time.Minute)
+	for {
+		select {
+		case <-tick:
+		case <-b.quit:
+			return
+		}
+		now := b.clock.Now()
+		expired := make(map[types.NodeAddress]bridgeSession)
+		b.l.Lock()
+		for client, session := range b.sessions {
+			if now.Sub(session.last) >= b.session_timeout {
+				expired[client] = *session
+			}
+		}
+		for mac, learned := range b.macs {
+			if now.Sub(learned.last) >= b.mac_timeout {
+				delete(b.macs, mac)
+			}
+		}
+		b.l.Unlock()
+		for client, session := range expired {
+			b.sendClose(client, session, "session expired")
+			b.release(client)
+		}
+		b.auth.expire(now)
+	}
+}
+
+// Records that the frame's source MAC address is behind client, and returns
+// where the frame should go: to a single client, to the tap device's side,
+// or flooded everywhere but where it came from. Frames from multicast
+// addresses are invalid and dropped.
+func (b *TAPBridge) learn(frame []byte, client types.NodeAddress) (dest types.NodeAddress, flood bool, ok bool) {
+	var dst, src macAddress
+	copy(dst[:], frame[0:6])
+	copy(src[:], frame[6:12])
+	if src[0]&1 != 0 {
+		return "", false, false
+	}
+	b.l.Lock()
+	defer b.l.Unlock()
+	now := b.clock.Now()
+	b.macs[src] = learnedMAC{client, now}
+	if dst[0]&1 != 0 {
+		return "", true, true
+	}
+	learned, known := b.macs[dst]
+	if !known || now.Sub(learned.last) >= b.mac_timeout {
+		return "", true, true
+	}
+	if learned.client == client {
+		// It's already on the side the frame came from.
+		return "", false, false
+	}
+	return learned.client, false, true
+}
+
+// Returns the clients with a session other than except.
+func (b *TAPBridge) clients(except types.NodeAddress) []types.NodeAddress {
+	b.l.Lock()
+	defer b.l.Unlock()
+	clients := make([]types.NodeAddress, 0, len(b.sessions))
+	for client := range b.sessions {
+		if client != except {
+			clients = append(clients, client)
+		}
+	}
+	return clients
+}
+
+// Sends a frame to a client, if it fits in the client's tunnel and policy.
+func (b *TAPBridge) sendTo(client types.NodeAddress, frame []byte, protocol int) error {
+	b.l.Lock()
+	session, ok := b.sessions[client]
+	var s bridgeSession
+	if ok {
+		s = *session
+	}
+	b.l.Unlock()
+	if !ok || len(frame) > s.mtu+tap_frame_overhead {
+		return nil
+	}
+	if !b.auth.allowTo(client, len(frame), b.clock.Now()) {
+		return nil
+	}
+	d := types.TCPTunnelData{Version: s.version, Protocol: uint16(protocol), Source: b.node.GetNodeAddress(), Token: s.token, Data: frame}
+	d_b, err := d.MarshalBinary()
+	if err != nil {
+		return err
+	}
+	return b.node.SendPacket(types.Packet{Dest: client, Amt: b.amt, Data: d_b})
+}
+
+// Sends a frame wherever learn says it should go. Frames from clients are
+// written to the tap device when it's where the frame goes.
+func (b *TAPBridge) forward(frame []byte, protocol int, from types.NodeAddress) error {
+	dest, flood, ok := b.learn(frame, from)
+	if !ok {
+		return nil
+	}
+	var to []types.NodeAddress
+	if flood {
+		to = b.clients(from)
+	} else if dest != "" {
+		to = []types.NodeAddress{dest}
+	}
+	if from != "" && (flood || dest == "") {
+		err := b.tap.WritePacket(&tuntap.Packet{Protocol: protocol, Packet: frame})
+		if err != nil {
+			return err
+		}
+	}
+	for _, client := range to {
+		err := b.sendTo(client, frame, protocol)
+		if err != nil {
+			log.Printf("Error bridging frame to %x: %v", client, err)
+		}
+	}
+	return nil
+}
+
+// Reads tunnel messages from clients, handling handshakes and bridging their
+// frames.
+func (b *TAPBridge) listenNode() {
+	for {
+		var p types.Packet
+		select {
+		case p = <-b.node.Packets():
+		case <-b.quit:
+			return
+		}
+		if len(p.Data) < 2 {
+			continue
+		}
+		switch p.Data[1] {
+		case 0, 3:
+			var req types.TCPTunnelRequest
+			err := req.UnmarshalBinary(p.Data)
+			if err != nil {
+				log.Printf("Error reading tunnel request: %v", err)
+				continue
+			}
+			b.connect(req)
+		case 2:
+			// Every TAP session is at least version 3, so messages name
+			// their sender one way or the other.
+			var d types.TCPTunnelData
+			err := d.UnmarshalBinary(p.Data)
+			if err != nil {
+				log.Printf("Dropping tunnel frame: %v", err)
+				continue
+			}
+			client, ok := b.sender(d.Version, d.Source, d.Token)
+			if !ok || len(d.Data) < ethernet_header_size || !b.renew(client) {
+				continue
+			}
+			if !b.auth.allowFrom(client, len(d.Data), p.Amt, b.clock.Now()) {
+				continue
+			}
+			err = b.forward(d.Data, int(d.Protocol), client)
+			if err != nil {
+				reportError(b.err, err)
+				return
+			}
+		case 4:
+			var k types.TCPTunnelKeepalive
+			err := k.UnmarshalBinary(p.Data)
+			if err != nil {
+				log.Printf("Error reading tunnel keepalive: %v", err)
+				continue
+			}
+			b.keepalive(k)
+		case 5:
+			var c types.TCPTunnelClose
+			err := c.UnmarshalBinary(p.Data)
+			if err != nil {
+				log.Printf("Error reading tunnel close: %v", err)
+				continue
+			}
+			if client, ok := b.sender(c.Version, c.Source, c.Token); ok {
+				b.release(client)
+			}
+		}
+	}
+}
+
+// Reads frames from the tap device and bridges them to clients.
+func (b *TAPBridge) listenTap() {
+	for {
+		p, err := b.tap.ReadPacket()
+		if err != nil {
+			reportError(b.err, err)
+			return
+		}
+		select {
+		case <-b.quit:
+			return
+		default:
+		}
+		if p.Truncated || len(p.Packet) < ethernet_header_size {
+			log.Printf("Dropping truncated frame from tap")
+			continue
+		}
+		err = b.forward(p.Packet, p.Protocol, "")
+		if err != nil {
+			reportError(b.err, err)
+			return
+		}
+	}
+}
@@ -0,0 +1,210 @@
+package node
+
+import (
+	"bytes"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/AutoRoute/tuntap"
+
+	"github.com/AutoRoute/node/internal"
+	"github.com/AutoRoute/node/types"
+)
+
+// Returns a signed request from a named client to join a bridge on a
+// testNode.
+func tapRequestPacket(name string) types.Packet {
+	req := types.TCPTunnelRequest{Version: types.TCPTunnelVersion, MTU: default_tunnel_mtu, TAP: true}
+	req, err := SignTCPTunnelRequest(testClientKey(name), req, "source", time.Now())
+	if err != nil {
+		panic(err)
+	}
+	req_b, _ := req.MarshalBinary()
+	return types.Packet{Dest: "destination", Amt: 7, Data: req_b}
+}
+
+// Returns an ARP frame between two MAC addresses.
+func ethernetFrame(dst, src string) []byte {
+	dst_mac, _ := net.ParseMAC(dst)
+	src_mac, _ := net.ParseMAC(src)
+	frame := append(append([]byte(nil), dst_mac...), src_mac...)
+	return append(frame, 0x08, 0x06, 'a', 'r', 'p')
+}
+
+// Returns a frame in a tunnel message from the session with token.
+func framePacket(token uint64, frame []byte) types.Packet {
+	d := types.TCPTunnelData{Version: types.TCPTunnelVersion, Protocol: 0x0806, Token: token, Data: frame}
+	d_b, _ := d.MarshalBinary()
+	return types.Packet{Dest: "destination", Amt: 7, Data: d_b}
+}
+
+// Reads a frame the bridge sent a named client.
+func expectFrame(t *testing.T, node testNode, name string, frame []byte) {
+	p := <-node.in
+	var d types.TCPTunnelData
+	err := d.UnmarshalBinary(p.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Dest != clientAddress(name) || !bytes.Equal(d.Data, frame) {
+		t.Fatalf("Expected %x for %x got %x for %x", frame, clientAddress(name), d.Data, p.Dest)
+	}
+}
+
+// Reads a frame the bridge wrote to the tap device.
+func expectTapFrame(t *testing.T, tap testTun, frame []byte) {
+	if p := <-tap.in; !bytes.Equal(p.Packet, frame) {
+		t.Fatalf("Expected %x on tap got %x", frame, p.Packet)
+	}
+}
+
+// Starts a bridge with clients a and b, returning their session tokens.
+func startTestTAPBridge(t *testing.T, clock internal.Clock) (*TAPBridge, testNode, testTun, map[string]uint64) {
+	o := DefaultTAPBridgeOptions()
+	o.Clock = clock
+	tap := testTun{make(chan *tuntap.Packet, 10), make(chan *tuntap.Packet), nil, nil}
+	node := testNode{make(chan types.Packet, 10), make(chan types.Packet), nil}
+	b, err := NewTAPBridgeWithOptions(node, tap, 7, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	b.Listen()
+	tokens := make(map[string]uint64)
+	for _, name := range []string{"a", "b"} {
+		node.out <- tapRequestPacket(name)
+		var resp types.TCPTunnelResponse
+		err := resp.UnmarshalBinary((<-node.in).Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !resp.TAP || resp.MTU != default_tunnel_mtu || len(resp.IP) != 0 || resp.Token == 0 {
+			t.Fatalf("Unexpected response %+v", resp)
+		}
+		tokens[name] = resp.Token
+	}
+	return b, node, tap, tokens
+}
+
+// Frames for learned addresses only go behind the client or tap device they
+// were seen on, and everything else is flooded.
+func TestTAPBridgeLearning(t *testing.T) {
+	b, node, tap, tokens := startTestTAPBridge(t, nil)
+	defer b.Close()
+	const a, c, local, unknown = "02:00:00:00:00:0a", "02:00:00:00:00:0c", "02:00:00:00:00:01", "02:00:00:00:00:ff"
+
+	// A broadcast from a goes to the tap device and b.
+	f := ethernetFrame("ff:ff:ff:ff:ff:ff", a)
+	node.out <- framePacket(tokens["a"], f)
+	expectTapFrame(t, tap, f)
+	expectFrame(t, node, "b", f)
+	if client, ok := b.Lookup([6]byte{2, 0, 0, 0, 0, 0xa}); !ok || client != clientAddress("a") {
+		t.Fatalf("Learned %x", client)
+	}
+
+	// Replies from the tap device only go to a.
+	f = ethernetFrame(a, local)
+	tap.out <- &tuntap.Packet{Protocol: 0x0806, Packet: f}
+	expectFrame(t, node, "a", f)
+
+	// Frames between clients skip the tap device.
+	f = ethernetFrame(a, c)
+	node.out <- framePacket(tokens["b"], f)
+	expectFrame(t, node, "a", f)
+
+	// Frames for the tap device's side stay there, and frames for where they
+	// came from go nowhere.
+	node.out <- framePacket(tokens["a"], ethernetFrame(a, a))
+	f = ethernetFrame(local, a)
+	node.out <- framePacket(tokens["a"], f)
+	expectTapFrame(t, tap, f)
+
+	// Unknown addresses are flooded.
+	f = ethernetFrame(unknown, c)
+	node.out <- framePacket(tokens["b"], f)
+	expectTapFrame(t, tap, f)
+	expectFrame(t, node, "a", f)
+
+	// Frames claiming a multicast source, without a known token or naming
+	// a client in version 3 are dropped, and so are closes without a known
+	// token.
+	node.out <- framePacket(tokens["a"], ethernetFrame(a, "01:00:5e:00:00:01"))
+	node.out <- framePacket(tokens["a"]+tokens["b"], ethernetFrame(a, unknown))
+	spoofed := types.TCPTunnelData{Version: 3, Protocol: 0x0806, Source: clientAddress("b"), Data: ethernetFrame(a, unknown)}
+	spoofed_b, _ := spoofed.MarshalBinary()
+	node.out <- types.Packet{Dest: "destination", Amt: 7, Data: spoofed_b}
+	for _, c := range []types.TCPTunnelClose{
+		{Version: types.TCPTunnelVersion, Token: tokens["a"] + tokens["b"]},
+		{Version: 3, Source: clientAddress("a")},
+	} {
+		c_b, _ := c.MarshalBinary()
+		node.out <- types.Packet{Dest: "destination", Amt: 7, Data: c_b}
+	}
+	time.Sleep(10 * time.Millisecond)
+	if len(node.in) != 0 || len(tap.in) != 0 {
+		t.Fatalf("%d unexpected messages and %d unexpected frames", len(node.in), len(tap.in))
+	}
+	if _, ok := b.Lookup([6]byte{2, 0, 0, 0, 0, 0xff}); ok {
+		t.Fatal("Learned an address from a client without a session")
+	}
+	f = ethernetFrame(a, local)
+	tap.out <- &tuntap.Packet{Protocol: 0x0806, Packet: f}
+	expectFrame(t, node, "a", f)
+}
+
+// Clients which go quiet lose their session and the addresses behind them.
+func TestTAPBridgeExpiry(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	b, node, _, tokens := startTestTAPBridge(t, clock)
+	defer b.Close()
+	f := ethernetFrame("ff:ff:ff:ff:ff:ff", "02:00:00:00:00:0a")
+	node.out <- framePacket(tokens["a"], f)
+	expectFrame(t, node, "b", f)
+
+	clock.BlockUntil(1)
+	clock.Advance(6 * time.Minute)
+	for i := 0; ; i++ {
+		if _, ok := b.Lookup([6]byte{2, 0, 0, 0, 0, 0xa}); !ok {
+			break
+		}
+		if i == 100 {
+			t.Fatal("Remembered a MAC address past its timeout")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	keepalive := types.TCPTunnelKeepalive{Version: types.TCPTunnelVersion, Token: tokens["b"]}
+	keepalive_b, _ := keepalive.MarshalBinary()
+	node.out <- types.Packet{Dest: "destination", Amt: 7, Data: keepalive_b}
+	<-node.in
+
+	clock.Advance(5 * time.Minute)
+	c := expectClose(t, node, "a")
+	if c.Reason != "session expired" {
+		t.Fatalf("Closed for %q", c.Reason)
+	}
+	node.out <- framePacket(tokens["a"], f)
+	node.out <- types.Packet{Dest: "destination", Amt: 7, Data: keepalive_b}
+	<-node.in
+	if len(node.in) != 0 {
+		t.Fatal("Bridged a frame from an expired client")
+	}
+}
+
+// Bridges and tunnel servers only take requests meant for them.
+func TestTAPBridgeModes(t *testing.T) {
+	b, node, _, _ := startTestTAPBridge(t, nil)
+	defer b.Close()
+	node.out <- requestPacket("c")
+
+	tun := testTun{make(chan *tuntap.Packet), make(chan *tuntap.Packet), nil, nil}
+	tun_node := testNode{make(chan types.Packet, 1), make(chan types.Packet), nil}
+	tunserver := NewTCPTunServer(tun_node, tun, 7)
+	tunserver.Listen()
+	defer tunserver.Close()
+	tun_node.out <- tapRequestPacket("c")
+
+	time.Sleep(10 * time.Millisecond)
+	if len(node.in) != 0 || len(tun_node.in) != 0 {
+		t.Fatal("Answered a request for the wrong kind of tunnel")
+	}
+}
@@ -1,15 +1,16 @@
 package node
 
 import (
+	"encoding"
 	"encoding/json"
 	"errors"
 	"log"
-	"os/exec"
-	//"strings"
+	"sync"
 	"time"
 
 	"github.com/AutoRoute/tuntap"
 
+	"github.com/AutoRoute/node/internal"
 	"github.com/AutoRoute/node/types"
 )
 
@@ -26,8 +27,77 @@ type TCPTunClient struct {
 	tun  TCPTun
 	dest types.NodeAddress
 	amt  int64
-	quit chan bool
-	err  chan error
+	o    TCPTunClientOptions
+	// The message version in use, which is whatever the server answered
+	// with.
+	version byte
+	// The token of our session, from version 4.
+	token uint64
+	// What the server knows us by, which older messages name. Signed
+	// requests are from our key and unsigned ones from our node.
+	source types.NodeAddress
+	// The largest packet we send, which the server may have lowered.
+	mtu int
+	// The addresses the server gave us.
+	addresses []string
+	// What addresses are put on and taken off the tun device with, and what
+	// its MTU is set with.
+	set_addr func(dev string, addr string) error
+	del_addr func(dev string, addr string) error
+	set_mtu  func(dev string, mtu int) error
+	clock    internal.Clock
+	l        *sync.Mutex
+	quit     chan bool
+	err      chan error
+}
+
+// Settings for a TCPTunClient.
+type TCPTunClientOptions struct {
+	// Signs tunnel requests so exit nodes can check who is asking, which most
+	// require. Requests are unsigned if this is nil, and so are requests for
+	// versions older than 4, which servers only take unsigned.
+	Key *Key
+	// The newest tunnel message version to ask for. Servers which only speak
+	// version 0 ignore requests for anything newer.
+	Version byte
+	// How many requests may go unanswered before asking for version 0
+	// unsigned instead, in case the server is too old to understand them.
+	// Zero never falls back. TAP tunnels can't.
+	FallbackRetries int
+	// The largest packet to ask to send and receive through the tunnel. The
+	// server may answer with less, which the tun device is set to.
+	MTU int
+	// Bridges Ethernet frames from a tap device rather than routing IP
+	// packets, which needs a TAPBridge at the other end and version 3.
+	TAP bool
+	// How long to wait for an answer to the first request, doubling with
+	// every retry up to MaxRetryInterval.
+	RetryInterval    time.Duration
+	MaxRetryInterval time.Duration
+	// How long to keep asking before giving up and reporting
+	// handshake_timeout_error.
+	HandshakeTimeout time.Duration
+	// How often to tell the server we're still here, and how long to go
+	// without hearing from it before reconnecting.
+	KeepaliveInterval time.Duration
+	KeepaliveTimeout  time.Duration
+	// What requests and keepalives are timed with, or nil for the system
+	// clock.
+	Clock internal.Clock
+}
+
+// Returns the settings used by NewTCPTunClient.
+func DefaultTCPTunClientOptions() TCPTunClientOptions {
+	return TCPTunClientOptions{
+		Version:           types.TCPTunnelVersion,
+		FallbackRetries:   3,
+		MTU:               default_tunnel_mtu,
+		RetryInterval:     time.Second,
+		MaxRetryInterval:  30 * time.Second,
+		HandshakeTimeout:  2 * time.Minute,
+		KeepaliveInterval: 30 * time.Second,
+		KeepaliveTimeout:  90 * time.Second,
+	}
 }
 
 type TCPTun interface {
@@ -35,29 +105,67 @@ type TCPTun interface {
 	WritePacket(p *tuntap.Packet) error
 }
 
-var truncated_error error = errors.New("truncated packet")
+var handshake_timeout_error = errors.New("tunnel handshake timed out")
+var tap_version_error = errors.New("TAP tunnels need version 3")
+var tap_mismatch_error = errors.New("tunnel server doesn't agree whether to bridge ethernet frames")
+
+// Wraps a packet from a tun device in a tunnel data message of the given
+// version from source, or in the session with token from version 4.
+func marshalTunnelData(p *tuntap.Packet, version byte, source types.NodeAddress, token uint64) ([]byte, error) {
+	d := types.TCPTunnelData{Version: version, Source: source, Token: token}
+	if version == 0 {
+		b, err := json.Marshal(p)
+		if err != nil {
+			return nil, err
+		}
+		d.Data = b
+	} else {
+		d.Protocol = uint16(p.Protocol)
+		d.Data = p.Packet
+	}
+	return d.MarshalBinary()
+}
 
-// SetDevAddr takes a network interface name and an IP address in string form
-// and sets the device up and assigns it an IP address.
-func SetDevAddr(dev string, addr string) error {
-	_, err := exec.Command("ip", "link", "set", "dev", dev, "up").CombinedOutput()
+// Unwraps the packet in a tunnel data message of any version, returning the
+// session token it carries too.
+func unmarshalTunnelData(b []byte) (*tuntap.Packet, uint64, error) {
+	var d types.TCPTunnelData
+	err := d.UnmarshalBinary(b)
 	if err != nil {
-		return err
+		return nil, 0, err
 	}
-	time.Sleep(100 * time.Millisecond)
-	_, err = exec.Command("ip", "addr", "add", addr, "dev", dev).CombinedOutput()
-	return err
+	if d.Version == 0 {
+		p := &tuntap.Packet{}
+		err = json.Unmarshal(d.Data, p)
+		return p, 0, err
+	}
+	return &tuntap.Packet{Protocol: int(d.Protocol), Packet: d.Data}, d.Token, nil
 }
 
 // NewTCPTunnel creates and starts a TCP tunneling client. After creating a TCP object, it starts
 // the handshake to the server (exit node) specified by dest and returns a pointer to the TCP
-// object. Then it starts listening on the tun and node connection.
+// object. Then it starts listening on the tun and node connection, keeping the
+// session alive and reconnecting if it is lost.
 func NewTCPTunClient(n NodeConnection, tun TCPTun, dest types.NodeAddress, amt int64, tun_name string) *TCPTunClient {
-	t := &TCPTunClient{n, tun, dest, amt, make(chan bool), make(chan error, 1)}
-	go t.handshake(tun_name)
+	return NewTCPTunClientWithOptions(n, tun, dest, amt, tun_name, DefaultTCPTunClientOptions())
+}
+
+func NewTCPTunClientWithOptions(n NodeConnection, tun TCPTun, dest types.NodeAddress, amt int64, tun_name string, o TCPTunClientOptions) *TCPTunClient {
+	t := newTCPTunClient(n, tun, dest, amt, o)
+	go t.run(tun_name)
 	return t
 }
 
+func newTCPTunClient(n NodeConnection, tun TCPTun, dest types.NodeAddress, amt int64, o TCPTunClientOptions) *TCPTunClient {
+	clock := o.Clock
+	if clock == nil {
+		clock = internal.SystemClock()
+	}
+	return &TCPTunClient{n, tun, dest, amt, o, o.Version, 0, n.GetNodeAddress(), o.MTU, nil, SetDevAddr, delDevAddr, SetDevMTU,
+		clock, &sync.Mutex{}, make(chan bool), make(chan error, 1)}
+}
+
+// Closes the session with the server and stops the client.
 func (t *TCPTunClient) Close() {
 	close(t.quit)
 }
@@ -66,34 +174,248 @@ func (t *TCPTunClient) Error() chan error {
 	return t.err
 }
 
-// Sends a request to tunnel with the server. Receives it's assigned IP address and
-// sets the tun device up with that address. That begins listening on the tun and
-// node connection.
-func (t *TCPTunClient) handshake(tun_name string) {
-	req := types.TCPTunnelRequest{t.node.GetNodeAddress()}
-	req_b, _ := req.MarshalBinary()
-	ep := types.Packet{t.dest, t.amt, req_b}
+// Returns the version, token and source messages in our session are sent
+// with.
+func (t *TCPTunClient) session() (byte, uint64, types.NodeAddress) {
+	t.l.Lock()
+	defer t.l.Unlock()
+	return t.version, t.token, t.source
+}
+
+// Returns whether a message with the given version and token is from our
+// session. Messages older than version 4 have no token to check.
+func (t *TCPTunClient) inSession(version byte, token uint64) bool {
+	t.l.Lock()
+	defer t.l.Unlock()
+	return version == t.version && token == t.token
+}
+
+func (t *TCPTunClient) currentMTU() int {
+	t.l.Lock()
+	defer t.l.Unlock()
+	return t.mtu
+}
+
+// Returns the request for a tunnel of the given version to send the server,
+// signed if we have a key and the version is new enough.
+func (t *TCPTunClient) request(version byte) (types.TCPTunnelRequest, error) {
+	if t.o.TAP && version < 3 {
+		return types.TCPTunnelRequest{}, tap_version_error
+	}
+	if t.o.Key == nil || version < 4 {
+		return types.TCPTunnelRequest{Version: version, MTU: uint16(t.o.MTU), TAP: t.o.TAP, Source: t.node.GetNodeAddress()}, nil
+	}
+	req := types.TCPTunnelRequest{Version: version, MTU: uint16(t.o.MTU), TAP: t.o.TAP}
+	return SignTCPTunnelRequest(*t.o.Key, req, t.dest, t.clock.Now())
+}
+
+// Sends a message to the server in the background, so a slow connection
+// doesn't hold up the session.
+func (t *TCPTunClient) send(m encoding.BinaryMarshaler) {
+	b, err := m.MarshalBinary()
+	if err != nil {
+		log.Printf("Error encoding tunnel message: %v", err)
+		return
+	}
 	go func() {
-		err := t.node.SendPacket(ep)
+		err := t.node.SendPacket(types.Packet{Dest: t.dest, Amt: t.amt, Data: b})
 		if err != nil {
-			t.err <- err
+			log.Printf("Error sending to tunnel server %x: %v", t.dest, err)
 		}
 	}()
+}
 
-	var resp types.TCPTunnelResponse
-	p := <-t.node.Packets()
-	err := resp.UnmarshalBinary(p.Data)
-	if err != nil {
-		log.Fatal(err)
+// Runs the session, reconnecting whenever the server ends it or stops
+// answering.
+func (t *TCPTunClient) run(tun_name string) {
+	if !t.handshake(tun_name) {
+		return
+	}
+	go t.readtun()
+
+	tick := t.clock.Tick(t.o.KeepaliveInterval)
+	last_heard := t.clock.Now()
+	for {
+		select {
+		case p := <-t.node.Packets():
+			last_heard = t.clock.Now()
+			if len(p.Data) < 2 {
+				continue
+			}
+			switch p.Data[1] {
+			case 2:
+				if !t.writetun(p) {
+					return
+				}
+			case 5:
+				var c types.TCPTunnelClose
+				err := c.UnmarshalBinary(p.Data)
+				if err != nil {
+					log.Printf("Error reading tunnel close: %v", err)
+					continue
+				}
+				if !t.inSession(c.Version, c.Token) {
+					continue
+				}
+				log.Printf("Tunnel server %x ended our session: %s", t.dest, c.Reason)
+				if !t.handshake(tun_name) {
+					return
+				}
+				last_heard = t.clock.Now()
+			}
+			// Keepalives only need to be heard, and stray responses to
+			// retried requests are ignored.
+		case <-tick:
+			if t.clock.Since(last_heard) >= t.o.KeepaliveTimeout {
+				log.Printf("Tunnel server %x stopped answering, reconnecting", t.dest)
+				if !t.handshake(tun_name) {
+					return
+				}
+				last_heard = t.clock.Now()
+				continue
+			}
+			version, token, source := t.session()
+			t.send(&types.TCPTunnelKeepalive{Version: version, Source: source, Token: token})
+		case <-t.quit:
+			version, token, source := t.session()
+			t.send(&types.TCPTunnelClose{Version: version, Source: source, Token: token, Reason: "client closed"})
+			for _, addr := range t.addresses {
+				err := t.del_addr(tun_name, addr)
+				if err != nil {
+					log.Printf("Error removing tunnel address %s: %v", addr, err)
+				}
+			}
+			return
+		}
 	}
+}
+
+// Asks the server for a tunnel until it answers, backing off between
+// requests, and sets the tun device up with the addresses it gives us.
+// Returns false if the client should stop, which after HandshakeTimeout is
+// reported through Error().
+func (t *TCPTunClient) handshake(tun_name string) bool {
+	deadline := t.clock.Now().Add(t.o.HandshakeTimeout)
+	wait := t.o.RetryInterval
+	version := t.o.Version
+	for tries := 0; ; tries++ {
+		remaining := deadline.Sub(t.clock.Now())
+		if remaining <= 0 {
+			reportError(t.err, handshake_timeout_error)
+			return false
+		}
+		if wait > remaining {
+			wait = remaining
+		}
+		if tries == t.o.FallbackRetries && tries > 0 && !t.o.TAP && version > 0 {
+			log.Printf("Tunnel server %x isn't answering, asking for version 0", t.dest)
+			version = 0
+		}
+		req, err := t.request(version)
+		if err != nil {
+			reportError(t.err, err)
+			return false
+		}
+		t.send(&req)
+		t.l.Lock()
+		t.source = req.Source
+		t.l.Unlock()
 
-	//tun_name = strings.Trim(tun_name, "\x00")
-	err = SetDevAddr(tun_name, resp.IP.String())
+		timeout := t.clock.After(wait)
+	waiting:
+		for {
+			select {
+			case p := <-t.node.Packets():
+				if len(p.Data) < 2 || p.Data[1] != 1 {
+					continue
+				}
+				var resp types.TCPTunnelResponse
+				err := resp.UnmarshalBinary(p.Data)
+				if err != nil {
+					log.Printf("Error reading tunnel response: %v", err)
+					continue
+				}
+				err = t.configure(tun_name, resp)
+				if err != nil {
+					reportError(t.err, err)
+					return false
+				}
+				return true
+			case <-timeout:
+				break waiting
+			case <-t.quit:
+				return false
+			}
+		}
+
+		wait *= 2
+		if wait > t.o.MaxRetryInterval {
+			wait = t.o.MaxRetryInterval
+		}
+	}
+}
+
+// Starts using the version, MTU and addresses the server answered with.
+// Addresses we already had are left alone so reconnecting doesn't disturb
+// them. Servers older than version 2 don't say, and get our MTU. Bridges
+// don't give out addresses.
+func (t *TCPTunClient) configure(tun_name string, resp types.TCPTunnelResponse) error {
+	if resp.TAP != t.o.TAP {
+		return tap_mismatch_error
+	}
+	mtu := t.o.MTU
+	if resp.MTU != 0 && int(resp.MTU) < mtu {
+		mtu = int(resp.MTU)
+	}
+	t.l.Lock()
+	t.version = resp.Version
+	if t.version > t.o.Version {
+		t.version = t.o.Version
+	}
+	t.token = resp.Token
+	t.mtu = mtu
+	t.l.Unlock()
+	// Packets too big for the tunnel are still caught in readtun if this
+	// fails.
+	err := t.set_mtu(tun_name, mtu)
 	if err != nil {
-		log.Fatal(err)
+		log.Printf("Error setting %s MTU to %d: %v", tun_name, mtu, err)
 	}
-	go t.readtun()
-	go t.writetun()
+	if t.o.TAP {
+		return nil
+	}
+
+	addresses := []string{resp.IP.String()}
+	if resp.IPv4 != nil {
+		addresses = append(addresses, resp.IPv4.String())
+	}
+	for _, old := range t.addresses {
+		if !containsString(addresses, old) {
+			err := t.del_addr(tun_name, old)
+			if err != nil {
+				log.Printf("Error removing old tunnel address %s: %v", old, err)
+			}
+		}
+	}
+	for _, addr := range addresses {
+		if !containsString(t.addresses, addr) {
+			err := t.set_addr(tun_name, addr)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	t.addresses = addresses
+	return nil
+}
+
+func containsString(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
 }
 
 // Reads from the tun device, wraps the node in a TCP tunneling packet and
@@ -107,56 +429,79 @@ func (t *TCPTunClient) readtun() {
 		}
 		p, err := t.tun.ReadPacket()
 		if err != nil {
-			t.err <- err
+			reportError(t.err, err)
 			return
 		}
-		if p.Truncated {
-			t.err <- truncated_error
-			return
-		}
-		b, err := json.Marshal(p)
-		if err != nil {
-			t.err <- err
-			return
-		}
-
-		tcp_data := types.TCPTunnelData{b}
-		tcp_data_b, _ := tcp_data.MarshalBinary()
-		ep := types.Packet{t.dest, t.amt, tcp_data_b}
-		err = t.node.SendPacket(ep)
-		if err != nil {
-			t.err <- err
-			return
+		mtu := t.currentMTU()
+		if t.o.TAP {
+			// Frames can't be fragmented or answered, only dropped.
+			if p.Truncated || len(p.Packet) > mtu+tap_frame_overhead {
+				log.Printf("Dropping oversized frame from tap")
+				continue
+			}
+		} else if p.Truncated {
+			log.Printf("Dropping truncated packet from tun")
+			t.tooBig(p, mtu)
+			continue
 		}
-	}
-}
-
-// Reads from the node connection, unwraps the node from the TCP tunneling packet
-// and sends it out the tun device.
-func (t *TCPTunClient) writetun() {
-	for {
-		select {
-		case p := <-t.node.Packets():
-			var tcp_data types.TCPTunnelData
-			err := tcp_data.UnmarshalBinary(p.Data)
-			if err != nil {
-				t.err <- err
-				return
+		packets := []*tuntap.Packet{p}
+		if !t.o.TAP && len(p.Packet) > mtu {
+			fragments := fragment(p.Packet, mtu)
+			if fragments == nil {
+				t.tooBig(p, mtu)
+				continue
 			}
-
-			ep := &tuntap.Packet{}
-			err = json.Unmarshal(tcp_data.Data, ep)
+			packets = packets[:0]
+			for _, f := range fragments {
+				packets = append(packets, &tuntap.Packet{Protocol: p.Protocol, Packet: f})
+			}
+		}
+		version, token, source := t.session()
+		for _, p := range packets {
+			tcp_data_b, err := marshalTunnelData(p, version, source, token)
 			if err != nil {
-				t.err <- err
-				return
+				log.Printf("Dropping packet from tun: %v", err)
+				continue
 			}
-			err = t.tun.WritePacket(ep)
+			ep := types.Packet{Dest: t.dest, Amt: t.amt, Data: tcp_data_b}
+			err = t.node.SendPacket(ep)
 			if err != nil {
-				t.err <- err
-				return
+				log.Printf("Error sending tunnel packet to %x: %v", t.dest, err)
 			}
-		case <-t.quit:
-			return
 		}
 	}
 }
+
+// Tells the sender of a packet from the tun device it's too big for the
+// tunnel.
+func (t *TCPTunClient) tooBig(p *tuntap.Packet, mtu int) {
+	reply := packetTooBig(p.Packet, mtu)
+	if reply == nil {
+		return
+	}
+	err := t.tun.WritePacket(&tuntap.Packet{Protocol: p.Protocol, Packet: reply})
+	if err != nil {
+		log.Printf("Error answering oversized packet: %v", err)
+	}
+}
+
+// Unwraps the packet from a TCP tunneling packet and sends it out the tun
+// device. Packets which can't be read or are from outside our session are
+// dropped. Returns false if the client should stop.
+func (t *TCPTunClient) writetun(p types.Packet) bool {
+	ep, token, err := unmarshalTunnelData(p.Data)
+	if err != nil {
+		log.Printf("Dropping tunnel packet: %v", err)
+		return true
+	}
+	if !t.inSession(p.Data[0], token) {
+		log.Printf("Dropping tunnel packet from outside our session")
+		return true
+	}
+	err = t.tun.WritePacket(ep)
+	if err != nil {
+		reportError(t.err, err)
+		return false
+	}
+	return true
+}
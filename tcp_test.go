@@ -2,6 +2,8 @@ package node
 
 import (
 	"bytes"
+	"encoding"
+	"encoding/binary"
 	"encoding/json"
 	"errors"
 	"net"
@@ -11,6 +13,7 @@ import (
 
 	"github.com/AutoRoute/tuntap"
 
+	"github.com/AutoRoute/node/internal"
 	"github.com/AutoRoute/node/types"
 )
 
@@ -57,13 +60,315 @@ func (n testNode) GetNodeAddress() types.NodeAddress {
 	return "source"
 }
 
+// Builds a minimal IPv4 or IPv6 packet between two addresses.
+func ipTunPacket(src, dst string) tuntap.Packet {
+	src_ip, dst_ip := net.ParseIP(src), net.ParseIP(dst)
+	var p []byte
+	if src_ip.To4() != nil {
+		p = make([]byte, ipv4_header_size+4)
+		p[0] = 0x45
+		p[9] = 17
+		copy(p[12:16], src_ip.To4())
+		copy(p[16:20], dst_ip.To4())
+	} else {
+		p = make([]byte, ipv6_header_size+4)
+		p[0] = 0x60
+		p[6] = 17
+		copy(p[8:24], src_ip)
+		copy(p[24:40], dst_ip)
+	}
+	return tuntap.Packet{Protocol: 0x8000, Truncated: false, Packet: p}
+}
+
 func exampleTunPacket() tuntap.Packet {
-	p := make([]byte, 192, 192)
-	p[0] = 0x6
-	addr := []byte(net.ParseIP("2002::"))
-	copy(p[64:192], addr)
-	tp := tuntap.Packet{Protocol: 0x8000, Truncated: false, Packet: p}
-	return tp
+	return ipTunPacket("2002::", "2001::1")
+}
+
+func TestTunnelDataVersions(t *testing.T) {
+	p := exampleTunPacket()
+	for _, version := range []byte{0, types.TCPTunnelVersion} {
+		b, err := marshalTunnelData(&p, version, "source", 9)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if b[0] != version {
+			t.Fatalf("Marshalled version %d as %d", version, b[0])
+		}
+		after, token, err := unmarshalTunnelData(b)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if after.Protocol != p.Protocol || !bytes.Equal(after.Packet, p.Packet) {
+			t.Fatalf("Version %d: %v != %v", version, p, after)
+		}
+		if version != 0 && token != 9 {
+			t.Fatalf("Version %d: token %x != 9", version, token)
+		}
+	}
+
+	// Version 1 carries the packet as is.
+	b, _ := marshalTunnelData(&p, 1, "source", 0)
+	if !bytes.Equal(b[4:], p.Packet) {
+		t.Fatalf("Expected raw packet got %x", b)
+	}
+}
+
+// Starts a client which records the addresses it would put on its tun device
+// instead of needing root.
+func startTestTunClient(node testNode, tun testTun, o TCPTunClientOptions) (*TCPTunClient, chan string) {
+	tcp := newTCPTunClient(node, tun, "destination", 7, o)
+	addresses := make(chan string, 10)
+	tcp.set_addr = func(dev string, addr string) error {
+		addresses <- addr
+		return nil
+	}
+	tcp.del_addr = func(dev string, addr string) error {
+		addresses <- "-" + addr
+		return nil
+	}
+	tcp.set_mtu = func(dev string, mtu int) error {
+		return nil
+	}
+	go tcp.run("tun0")
+	return tcp, addresses
+}
+
+// Reads the next message the client sends, failing unless it's of the given
+// type.
+func expectClientMessage(t *testing.T, node testNode, message_type byte) types.Packet {
+	p := <-node.in
+	if p.Dest != "destination" || len(p.Data) < 2 || p.Data[1] != message_type {
+		t.Fatalf("Expected message type %d to destination got %q to %q", message_type, p.Data, p.Dest)
+	}
+	return p
+}
+
+func sendClientMessage(node testNode, m encoding.BinaryMarshaler) {
+	b, _ := m.MarshalBinary()
+	node.out <- types.Packet{Dest: "source", Amt: 7, Data: b}
+}
+
+func TestTCPTunClientRetry(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	o := DefaultTCPTunClientOptions()
+	o.RetryInterval = time.Second
+	o.MaxRetryInterval = 4 * time.Second
+	o.HandshakeTimeout = 10 * time.Second
+	o.FallbackRetries = 2
+	o.Clock = clock
+	key := testClientKey("source")
+	o.Key = &key
+	tun := testTun{make(chan *tuntap.Packet), make(chan *tuntap.Packet), nil, nil}
+	node := testNode{make(chan types.Packet), make(chan types.Packet), nil}
+	tcp, _ := startTestTunClient(node, tun, o)
+	defer tcp.Close()
+
+	// Requests back off until the handshake runs out of time. Once two go
+	// unanswered the client asks for version 0 unsigned, as old servers
+	// expect.
+	for i, wait := range []time.Duration{1, 2, 4, 3} {
+		message_type, version := byte(3), byte(types.TCPTunnelVersion)
+		if i >= 2 {
+			message_type, version = 0, 0
+		}
+		var req types.TCPTunnelRequest
+		err := req.UnmarshalBinary(expectClientMessage(t, node, message_type).Data)
+		if err != nil || req.Version != version {
+			t.Fatalf("Unexpected request %+v: %v", req, err)
+		}
+		clock.BlockUntil(1)
+		clock.Advance(wait * time.Second)
+	}
+	if err := <-tcp.Error(); err != handshake_timeout_error {
+		t.Fatalf("Expected %v got %v", handshake_timeout_error, err)
+	}
+}
+
+func TestTCPTunClientSession(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	o := DefaultTCPTunClientOptions()
+	o.KeepaliveInterval = 10 * time.Second
+	o.KeepaliveTimeout = 25 * time.Second
+	o.Clock = clock
+	tun := testTun{make(chan *tuntap.Packet), make(chan *tuntap.Packet), nil, nil}
+	node := testNode{make(chan types.Packet), make(chan types.Packet), nil}
+	tcp, addresses := startTestTunClient(node, tun, o)
+	respond := func(ipv4 string) {
+		expectClientMessage(t, node, 0)
+		sendClientMessage(node, &types.TCPTunnelResponse{Version: 1, IP: net.ParseIP("2001::1"), IPv4: net.ParseIP(ipv4)})
+	}
+	// Once the client takes this the handshake is over.
+	keepalive := func() {
+		sendClientMessage(node, &types.TCPTunnelKeepalive{Version: 1, Source: "destination"})
+	}
+	expectAddresses := func(expected ...string) {
+		for _, e := range expected {
+			if a := <-addresses; a != e {
+				t.Fatalf("Expected %s got %s", e, a)
+			}
+		}
+		if len(addresses) != 0 {
+			t.Fatalf("Unexpected address change %s", <-addresses)
+		}
+	}
+
+	respond("10.64.0.1")
+	expectAddresses("2001::1", "10.64.0.1")
+
+	// Keepalives are sent every interval.
+	clock.BlockUntil(2)
+	clock.Advance(10 * time.Second)
+	var k types.TCPTunnelKeepalive
+	err := k.UnmarshalBinary(expectClientMessage(t, node, 4).Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if k.Source != "source" || k.Version != 1 {
+		t.Fatalf("Unexpected keepalive %+v", k)
+	}
+	keepalive()
+
+	// When the server ends the session the client reconnects, keeping its
+	// addresses if it's given the same ones.
+	sendClientMessage(node, &types.TCPTunnelClose{Version: 1, Source: "source", Reason: "test"})
+	respond("10.64.0.1")
+	keepalive()
+	clock.Advance(10 * time.Second)
+	expectClientMessage(t, node, 4)
+	expectAddresses()
+
+	// When the server stops answering it reconnects too.
+	clock.Advance(10 * time.Second)
+	expectClientMessage(t, node, 4)
+	clock.Advance(10 * time.Second)
+	respond("10.64.0.2")
+	keepalive()
+	expectAddresses("-10.64.0.1", "10.64.0.2")
+
+	// Closing the client ends the session and takes its addresses off the
+	// tun device.
+	tcp.Close()
+	var c types.TCPTunnelClose
+	err = c.UnmarshalBinary(expectClientMessage(t, node, 5).Data)
+	if err != nil || c.Source != "source" {
+		t.Fatalf("Unexpected close %+v %v", c, err)
+	}
+	expectAddresses("-2001::1", "-10.64.0.2")
+	select {
+	case err := <-tcp.Error():
+		t.Fatal(err)
+	default:
+	}
+}
+
+func TestTCPTunClientMTU(t *testing.T) {
+	tun := testTun{make(chan *tuntap.Packet), make(chan *tuntap.Packet), nil, nil}
+	node := testNode{make(chan types.Packet), make(chan types.Packet), nil}
+	tcp := newTCPTunClient(node, tun, "destination", 7, DefaultTCPTunClientOptions())
+	tcp.set_addr = func(dev string, addr string) error {
+		return nil
+	}
+	mtus := make(chan int, 1)
+	tcp.set_mtu = func(dev string, mtu int) error {
+		mtus <- mtu
+		return nil
+	}
+	go tcp.run("tun0")
+	defer tcp.Close()
+
+	var req types.TCPTunnelRequest
+	err := req.UnmarshalBinary(expectClientMessage(t, node, 0).Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if int(req.MTU) != default_tunnel_mtu {
+		t.Fatalf("Asked for MTU %d", req.MTU)
+	}
+	sendClientMessage(node, &types.TCPTunnelResponse{Version: types.TCPTunnelVersion, MTU: 1300, Token: 9, IP: net.ParseIP("2001::1")})
+	if mtu := <-mtus; mtu != 1300 {
+		t.Fatalf("Set tun MTU to %d", mtu)
+	}
+
+	// Packets bigger than the tunnel are answered, and smaller ones still
+	// go through.
+	big := tuntap.Packet{Protocol: 0x86DD, Packet: bigPacket("2001::1", "2002::", 1400)}
+	tun.out <- &big
+	reply := <-tun.in
+	h, err := parseIPHeader(reply.Packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if h.src.String() != "2002::" || reply.Packet[h.length] != 2 ||
+		binary.BigEndian.Uint32(reply.Packet[h.length+4:]) != 1300 {
+		t.Fatalf("Unexpected reply %x", reply.Packet)
+	}
+	small := tuntap.Packet{Protocol: 0x86DD, Packet: bigPacket("2001::1", "2002::", 1300)}
+	tun.out <- &small
+	ep, token, err := unmarshalTunnelData(expectClientMessage(t, node, 2).Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(ep.Packet, small.Packet) || token != 9 {
+		t.Fatalf("Packet changed in the tunnel, or sent with token %x", token)
+	}
+
+	// Messages which can't be read are dropped without ending the client,
+	// and only packets from our session reach the tun device.
+	node.out <- types.Packet{Dest: "source", Amt: 7, Data: []byte{types.TCPTunnelVersion, 2}}
+	for _, token := range []uint64{8, 9} {
+		p := exampleTunPacket()
+		p.Packet[39] = byte(token)
+		sendClientMessage(node, &types.TCPTunnelData{Version: types.TCPTunnelVersion, Protocol: uint16(p.Protocol), Token: token, Data: p.Packet})
+	}
+	if p := <-tun.in; p.Packet[39] != 9 {
+		t.Fatalf("Packet from another session written to tun: %x", p.Packet)
+	}
+}
+
+func TestTCPTunClientTAP(t *testing.T) {
+	o := DefaultTCPTunClientOptions()
+	o.TAP = true
+	tun := testTun{make(chan *tuntap.Packet), make(chan *tuntap.Packet), nil, nil}
+	node := testNode{make(chan types.Packet), make(chan types.Packet), nil}
+	tcp, addresses := startTestTunClient(node, tun, o)
+	defer tcp.Close()
+
+	var req types.TCPTunnelRequest
+	err := req.UnmarshalBinary(expectClientMessage(t, node, 0).Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !req.TAP {
+		t.Fatal("Didn't ask for a TAP tunnel")
+	}
+	sendClientMessage(node, &types.TCPTunnelResponse{Version: types.TCPTunnelVersion, MTU: 1300, TAP: true, Token: 5})
+
+	// Frames fit the MTU on top of their header, and can't be fragmented.
+	big := tuntap.Packet{Protocol: 0x0800, Packet: make([]byte, 1300+tap_frame_overhead+1)}
+	tun.out <- &big
+	frame := tuntap.Packet{Protocol: 0x0800, Packet: make([]byte, 1300+ethernet_header_size)}
+	tun.out <- &frame
+	var d types.TCPTunnelData
+	err = d.UnmarshalBinary(expectClientMessage(t, node, 2).Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if d.Token != 5 || len(d.Data) != len(frame.Packet) {
+		t.Fatalf("Unexpected %d byte frame in session %d", len(d.Data), d.Token)
+	}
+	if len(addresses) != 0 {
+		t.Fatalf("Set address %s on a tap device", <-addresses)
+	}
+
+	// Tunnel servers can't answer for a bridge.
+	tun_node := testNode{make(chan types.Packet), make(chan types.Packet), nil}
+	tun_tcp, _ := startTestTunClient(tun_node, tun, DefaultTCPTunClientOptions())
+	defer tun_tcp.Close()
+	expectClientMessage(t, tun_node, 0)
+	sendClientMessage(tun_node, &types.TCPTunnelResponse{Version: types.TCPTunnelVersion, MTU: 1300, TAP: true})
+	if err := <-tun_tcp.Error(); err != tap_mismatch_error {
+		t.Fatalf("Expected %v got %v", tap_mismatch_error, err)
+	}
 }
 
 func TestTCPTunRequest(t *testing.T) {
@@ -127,9 +432,9 @@ func TestTCPTunResponse(t *testing.T) {
 	}
 
 	// Have server send back response
-	resp := types.TCPTunnelResponse{net.ParseIP("2001::")}
+	resp := types.TCPTunnelResponse{IP: net.ParseIP("2001::")}
 	resp_b, _ := resp.MarshalBinary()
-	p = types.Packet{"source", amt, resp_b}
+	p = types.Packet{Dest: "source", Amt: amt, Data: resp_b}
 	node.out <- p
 
 	time.Sleep(300 * time.Millisecond)
@@ -185,9 +490,9 @@ func TestTCPTunToData(t *testing.T) {
 	}
 
 	// Have server send back response
-	resp := types.TCPTunnelResponse{net.ParseIP("2001::")}
+	resp := types.TCPTunnelResponse{IP: net.ParseIP("2001::")}
 	resp_b, _ := resp.MarshalBinary()
-	p = types.Packet{"source", amt, resp_b}
+	p = types.Packet{Dest: "source", Amt: amt, Data: resp_b}
 	node.out <- p
 
 	// Write to client's tun device
@@ -250,9 +555,9 @@ func TestTCPTunReadError(t *testing.T) {
 	}
 
 	// Have server send back response
-	resp := types.TCPTunnelResponse{net.ParseIP("2001::")}
+	resp := types.TCPTunnelResponse{IP: net.ParseIP("2001::")}
 	resp_b, _ := resp.MarshalBinary()
-	p = types.Packet{"source", amt, resp_b}
+	p = types.Packet{Dest: "source", Amt: amt, Data: resp_b}
 	node.out <- p
 
 	// Send in a test packet
@@ -293,9 +598,9 @@ func TestTCPTunReadTruncated(t *testing.T) {
 	}
 
 	// Have server send back response
-	resp := types.TCPTunnelResponse{net.ParseIP("2001::")}
+	resp := types.TCPTunnelResponse{IP: net.ParseIP("2001::")}
 	resp_b, _ := resp.MarshalBinary()
-	p = types.Packet{"source", amt, resp_b}
+	p = types.Packet{Dest: "source", Amt: amt, Data: resp_b}
 	node.out <- p
 
 	// Send in a test packet
@@ -303,10 +608,15 @@ func TestTCPTunReadTruncated(t *testing.T) {
 	tp.Truncated = true
 	tun.out <- &tp
 
-	// Make sure the error appears
-	err = <-tcp.Error()
-	if err != truncated_error {
-		t.Fatalf("%v != %v", truncated_error, err)
+	// Make sure the sender is told it was too big
+	reply := <-tun.in
+	if h, err := parseIPHeader(reply.Packet); err != nil || h.protocol != proto_icmpv6 || reply.Packet[h.length] != 2 {
+		t.Fatalf("Expected packet too big got %x", reply.Packet)
+	}
+	select {
+	case err := <-tcp.Error():
+		t.Fatal(err)
+	default:
 	}
 }
 
@@ -338,9 +648,9 @@ func TestTCPTunReadWriteFails(t *testing.T) {
 	}
 
 	// Have server send back response
-	resp := types.TCPTunnelResponse{net.ParseIP("2001::")}
+	resp := types.TCPTunnelResponse{IP: net.ParseIP("2001::")}
 	resp_b, _ := resp.MarshalBinary()
-	p = types.Packet{"source", amt, resp_b}
+	p = types.Packet{Dest: "source", Amt: amt, Data: resp_b}
 	node.out <- p
 
 	// Send in a test packet
@@ -381,9 +691,9 @@ func TestTCPTunWrite(t *testing.T) {
 	}
 
 	// Have server send back response
-	resp := types.TCPTunnelResponse{net.ParseIP("2001::")}
+	resp := types.TCPTunnelResponse{IP: net.ParseIP("2001::")}
 	resp_b, _ := resp.MarshalBinary()
-	p = types.Packet{"source", amt, resp_b}
+	p = types.Packet{Dest: "source", Amt: amt, Data: resp_b}
 	node.out <- p
 
 	// Send in a test packet
@@ -393,10 +703,10 @@ func TestTCPTunWrite(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	tcp_data := types.TCPTunnelData{b}
+	tcp_data := types.TCPTunnelData{Data: b}
 	tcp_data_b, _ := tcp_data.MarshalBinary()
 
-	p_in := types.Packet{dest, amt, tcp_data_b}
+	p_in := types.Packet{Dest: dest, Amt: amt, Data: tcp_data_b}
 	node.out <- p_in
 	tp_recv := <-tun.in
 
@@ -436,9 +746,9 @@ func TestTCPTunWriteSendError(t *testing.T) {
 	}
 
 	// Have server send back response
-	resp := types.TCPTunnelResponse{net.ParseIP("2001::")}
+	resp := types.TCPTunnelResponse{IP: net.ParseIP("2001::")}
 	resp_b, _ := resp.MarshalBinary()
-	p = types.Packet{"source", amt, resp_b}
+	p = types.Packet{Dest: "source", Amt: amt, Data: resp_b}
 	node.out <- p
 
 	// Send in a test packet
@@ -448,9 +758,9 @@ func TestTCPTunWriteSendError(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	tcp_data := types.TCPTunnelData{b}
+	tcp_data := types.TCPTunnelData{Data: b}
 	tcp_data_b, _ := tcp_data.MarshalBinary()
-	p_in := types.Packet{dest, amt, tcp_data_b}
+	p_in := types.Packet{Dest: dest, Amt: amt, Data: tcp_data_b}
 	node.out <- p_in
 
 	err = <-tcp.Error()
@@ -486,13 +796,13 @@ func TestTCPTunWriteUnmarshalError(t *testing.T) {
 	}
 
 	// Have server send back response
-	resp := types.TCPTunnelResponse{net.ParseIP("2001::")}
+	resp := types.TCPTunnelResponse{IP: net.ParseIP("2001::")}
 	resp_b, _ := resp.MarshalBinary()
-	p = types.Packet{"source", amt, resp_b}
+	p = types.Packet{Dest: "source", Amt: amt, Data: resp_b}
 	node.out <- p
 
 	// Send in a test packet
-	p_in := types.Packet{dest, amt, []byte("NOTJSON")}
+	p_in := types.Packet{Dest: dest, Amt: amt, Data: []byte("NOTJSON")}
 	node.out <- p_in
 
 	err = <-tcp.Error()
@@ -0,0 +1,225 @@
+package node
+
+import (
+	"bytes"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"sync"
+	"time"
+
+	"github.com/AutoRoute/node/internal"
+	"github.com/AutoRoute/node/types"
+)
+
+// Limits on what a tunnel client may do.
+type TunnelPolicy struct {
+	// Bytes per second the client may send and receive through the tunnel, or
+	// 0 for no limit.
+	MaxBandwidth int64
+	// The smallest Amt the client's data packets may carry.
+	MinAmt int64
+}
+
+var unsigned_request_error = errors.New("tunnel request isn't signed")
+
+// Signs req as a request to tunnel through server as of t, filling in its
+// Source and Time. Its version, MTU and flags are signed too, so they must be
+// set first.
+func SignTCPTunnelRequest(k Key, req types.TCPTunnelRequest, server types.NodeAddress, t time.Time) (types.TCPTunnelRequest, error) {
+	req.Source = k.k.PublicKey().Hash()
+	req.Time = t.UnixNano()
+	sig, err := json.Marshal(k.k.Sign(req.Hash(server)))
+	if err != nil {
+		return req, err
+	}
+	req.Signature = sig
+	return req, nil
+}
+
+// What a client signs in place of server to open session with it for
+// detail, such as the address a proxy connects to, so the signature can't be
+// replayed for another session.
+func sessionTarget(server types.NodeAddress, session uint64, detail string) types.NodeAddress {
+	b := make([]byte, 2, 2+len(server)+8+len(detail))
+	binary.BigEndian.PutUint16(b, uint16(len(server)))
+	b = append(b, server...)
+	b = append(b, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(b[len(b)-8:], session)
+	return types.NodeAddress(append(b, detail...))
+}
+
+// Checks req was signed by its source for server within window of now.
+func verifyTCPTunnelRequest(req types.TCPTunnelRequest, server types.NodeAddress, now time.Time, window time.Duration) error {
+	if req.Signature == nil {
+		return unsigned_request_error
+	}
+	var sig internal.Signature
+	err := json.Unmarshal(req.Signature, &sig)
+	if err != nil {
+		return err
+	}
+	if !bytes.Equal(sig.Signed(), req.Hash(server)) {
+		return errors.New("signature is for a different request")
+	}
+	err = sig.Verify()
+	if err != nil {
+		return err
+	}
+	if sig.Key().Hash() != req.Source {
+		return errors.New("tunnel request signed by someone other than its source")
+	}
+	signed := time.Unix(0, req.Time)
+	if signed.Before(now.Add(-window)) || signed.After(now.Add(window)) {
+		return errors.New("tunnel request signed at " + signed.String() + " is stale")
+	}
+	return nil
+}
+
+// Loads per client policies from a JSON object of hex NodeAddresses to
+// TunnelPolicy.
+func LoadTunnelPolicies(path string) (map[types.NodeAddress]TunnelPolicy, error) {
+	b, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var encoded map[string]TunnelPolicy
+	err = json.Unmarshal(b, &encoded)
+	if err != nil {
+		return nil, err
+	}
+	policies := make(map[types.NodeAddress]TunnelPolicy)
+	for id, policy := range encoded {
+		addr, err := hex.DecodeString(id)
+		if err != nil {
+			return nil, err
+		}
+		policies[types.NodeAddress(addr)] = policy
+	}
+	return policies, nil
+}
+
+// Limits a client to rate bytes a second, allowing bursts of up to a
+// second's worth or a maximum sized packet, whichever is more.
+type tokenBucket struct {
+	rate   int64
+	tokens float64
+	last   time.Time
+}
+
+func (b *tokenBucket) burst() float64 {
+	if b.rate < 0xFFFF {
+		return 0xFFFF
+	}
+	return float64(b.rate)
+}
+
+func (b *tokenBucket) take(n int, now time.Time) bool {
+	b.tokens += now.Sub(b.last).Seconds() * float64(b.rate)
+	if b.tokens > b.burst() {
+		b.tokens = b.burst()
+	}
+	b.last = now
+	if b.tokens < float64(n) {
+		return false
+	}
+	b.tokens -= float64(n)
+	return true
+}
+
+// Decides who may tunnel through an exit node and enforces their policies.
+type tunnelAuth struct {
+	allow_unsigned   bool
+	signature_window time.Duration
+	// If allow is empty everyone not denied is allowed.
+	allow          map[types.NodeAddress]bool
+	deny           map[types.NodeAddress]bool
+	default_policy TunnelPolicy
+	policies       map[types.NodeAddress]TunnelPolicy
+	buckets        map[types.NodeAddress]*tokenBucket
+	l              *sync.Mutex
+}
+
+func newTunnelAuth(o TCPTunServerOptions) *tunnelAuth {
+	a := &tunnelAuth{
+		o.AllowUnsigned,
+		o.SignatureWindow,
+		make(map[types.NodeAddress]bool),
+		make(map[types.NodeAddress]bool),
+		o.DefaultPolicy,
+		make(map[types.NodeAddress]TunnelPolicy),
+		make(map[types.NodeAddress]*tokenBucket),
+		&sync.Mutex{},
+	}
+	for _, id := range o.Allow {
+		a.allow[id] = true
+	}
+	for _, id := range o.Deny {
+		a.deny[id] = true
+	}
+	for id, policy := range o.Policies {
+		a.policies[id] = policy
+	}
+	return a
+}
+
+// Returns an error if req shouldn't be given a tunnel through server.
+func (a *tunnelAuth) authorize(req types.TCPTunnelRequest, server types.NodeAddress, now time.Time) error {
+	err := verifyTCPTunnelRequest(req, server, now, a.signature_window)
+	if err == unsigned_request_error && a.allow_unsigned {
+		err = nil
+	}
+	if err != nil {
+		return err
+	}
+	if a.deny[req.Source] || (len(a.allow) > 0 && !a.allow[req.Source]) {
+		return errors.New("client isn't allowed to tunnel")
+	}
+	return nil
+}
+
+func (a *tunnelAuth) policy(client types.NodeAddress) TunnelPolicy {
+	if policy, ok := a.policies[client]; ok {
+		return policy
+	}
+	return a.default_policy
+}
+
+// Reports whether a packet of n bytes paying amt may be sent from the client.
+// Packets to the client have no amt to check.
+func (a *tunnelAuth) allowFrom(client types.NodeAddress, n int, amt int64, now time.Time) bool {
+	if amt < a.policy(client).MinAmt {
+		return false
+	}
+	return a.allowTo(client, n, now)
+}
+
+// Reports whether a packet of n bytes may be sent to the client.
+func (a *tunnelAuth) allowTo(client types.NodeAddress, n int, now time.Time) bool {
+	rate := a.policy(client).MaxBandwidth
+	if rate <= 0 {
+		return true
+	}
+	a.l.Lock()
+	defer a.l.Unlock()
+	b, ok := a.buckets[client]
+	if !ok || b.rate != rate {
+		b = &tokenBucket{rate, 0, now}
+		b.tokens = b.burst()
+		a.buckets[client] = b
+	}
+	return b.take(n, now)
+}
+
+// Forgets buckets which have been idle long enough to refill.
+func (a *tunnelAuth) expire(now time.Time) {
+	a.l.Lock()
+	defer a.l.Unlock()
+	for client, b := range a.buckets {
+		if now.Sub(b.last).Seconds()*float64(b.rate) >= b.burst() {
+			delete(a.buckets, client)
+		}
+	}
+}
@@ -0,0 +1,196 @@
+package node
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/AutoRoute/tuntap"
+
+	"github.com/AutoRoute/node/internal"
+	"github.com/AutoRoute/node/types"
+)
+
+func TestSignTCPTunnelRequest(t *testing.T) {
+	now := time.Now()
+	req := types.TCPTunnelRequest{Version: types.TCPTunnelVersion, MTU: 1300}
+	req, err := SignTCPTunnelRequest(testClientKey("source"), req, "server", now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if req.Source != clientAddress("source") {
+		t.Fatalf("Request from %x", req.Source)
+	}
+	err = verifyTCPTunnelRequest(req, "server", now, time.Minute)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if verifyTCPTunnelRequest(req, "other server", now, time.Minute) == nil {
+		t.Fatal("Accepted a request for another server")
+	}
+	if verifyTCPTunnelRequest(req, "server", now.Add(2*time.Minute), time.Minute) == nil {
+		t.Fatal("Accepted a stale request")
+	}
+	forged := req
+	forged.Source = clientAddress("other")
+	if verifyTCPTunnelRequest(forged, "server", now, time.Minute) == nil {
+		t.Fatal("Accepted a request with a forged source")
+	}
+	downgraded := req
+	downgraded.Version = 2
+	if verifyTCPTunnelRequest(downgraded, "server", now, time.Minute) == nil {
+		t.Fatal("Accepted a request with a changed version")
+	}
+	shrunk := req
+	shrunk.MTU = 576
+	if verifyTCPTunnelRequest(shrunk, "server", now, time.Minute) == nil {
+		t.Fatal("Accepted a request with a changed MTU")
+	}
+	tapped := req
+	tapped.TAP = true
+	if verifyTCPTunnelRequest(tapped, "server", now, time.Minute) == nil {
+		t.Fatal("Accepted a request with changed flags")
+	}
+	if verifyTCPTunnelRequest(types.TCPTunnelRequest{Source: "source"}, "server", now, time.Minute) != unsigned_request_error {
+		t.Fatal("Accepted an unsigned request")
+	}
+}
+
+func TestTunnelAuthExpire(t *testing.T) {
+	o := DefaultTCPTunServerOptions()
+	o.DefaultPolicy = TunnelPolicy{MaxBandwidth: 0xFFFF}
+	a := newTunnelAuth(o)
+	now := time.Now()
+	a.allowTo("idle", 100, now)
+	a.allowTo("busy", 100, now)
+	a.allowTo("busy", 100, now.Add(time.Second))
+
+	// The idle client's bucket has refilled, the busy client's hasn't.
+	a.expire(now.Add(time.Second))
+	if _, ok := a.buckets["idle"]; ok {
+		t.Fatal("Kept a refilled bucket")
+	}
+	if _, ok := a.buckets["busy"]; !ok {
+		t.Fatal("Forgot a bucket which hasn't refilled")
+	}
+}
+
+func unsignedRequestPacket(source types.NodeAddress) types.Packet {
+	req := types.TCPTunnelRequest{Source: source}
+	req_b, _ := req.MarshalBinary()
+	return types.Packet{Dest: "destination", Amt: 7, Data: req_b}
+}
+
+func TestTunServerAuthorization(t *testing.T) {
+	o := DefaultTCPTunServerOptions()
+	o.Deny = []types.NodeAddress{clientAddress("denied")}
+	tun := testTun{make(chan *tuntap.Packet), make(chan *tuntap.Packet), nil, nil}
+	node := testNode{make(chan types.Packet), make(chan types.Packet), nil}
+	tunserver, err := NewTCPTunServerWithOptions(node, tun, 7, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunserver.Listen()
+	defer tunserver.Close()
+
+	// Refused requests get no response, so the next response is for the
+	// allowed client.
+	node.out <- unsignedRequestPacket(clientAddress("source"))
+	node.out <- requestPacket("denied")
+	handshake(t, node, "source")
+	if tunserver.ipv6.Leases() != 1 {
+		t.Fatalf("Expected 1 lease got %d", tunserver.ipv6.Leases())
+	}
+
+	o = DefaultTCPTunServerOptions()
+	o.AllowUnsigned = true
+	o.Allow = []types.NodeAddress{"unsigned", clientAddress("source")}
+	node = testNode{make(chan types.Packet), make(chan types.Packet), nil}
+	tunserver, err = NewTCPTunServerWithOptions(node, tun, 7, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunserver.Listen()
+	defer tunserver.Close()
+
+	node.out <- requestPacket("other")
+	node.out <- unsignedRequestPacket("unsigned")
+	if p := <-node.in; p.Dest != "unsigned" {
+		t.Fatalf("Response sent to %x", p.Dest)
+	}
+	handshake(t, node, "source")
+	expectNoTunServerError(t, tunserver)
+}
+
+func TestTunServerPolicy(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	o := DefaultTCPTunServerOptions()
+	o.Clock = clock
+	o.DefaultPolicy = TunnelPolicy{MinAmt: 5}
+	o.Policies = map[types.NodeAddress]TunnelPolicy{
+		clientAddress("limited"): {MaxBandwidth: 100},
+	}
+	tun := testTun{make(chan *tuntap.Packet, 10), make(chan *tuntap.Packet), nil, nil}
+	node := testNode{make(chan types.Packet), make(chan types.Packet), nil}
+	tunserver, err := NewTCPTunServerWithOptions(node, tun, 7, o)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tunserver.Listen()
+	defer tunserver.Close()
+
+	resp := handshake(t, node, "source")
+	// Only the packet to 2002::1 should make it through.
+	expectMarker := func() {
+		if p := <-tun.in; p.Packet[39] != 1 {
+			t.Fatalf("Expected only the marker packet got %x", p.Packet)
+		}
+	}
+	marker := dataPacket("destination", resp.Token, ipTunPacket(resp.IP.String(), "2002::1"))
+	cheap := dataPacket("destination", resp.Token, ipTunPacket(resp.IP.String(), "2002::"))
+	cheap.Amt = 4
+	node.out <- cheap
+	node.out <- marker
+	expectMarker()
+
+	// The limited client can burst a maximum sized packet's worth, and then
+	// must wait for more.
+	limited := handshake(t, node, "limited")
+	sent := 0
+	for sent+ipv6_header_size+4 <= 0xFFFF {
+		p := ipTunPacket(limited.IP.String(), "2002::")
+		node.out <- dataPacket("destination", limited.Token, p)
+		<-tun.in
+		sent += len(p.Packet)
+	}
+	node.out <- dataPacket("destination", limited.Token, ipTunPacket(limited.IP.String(), "2002::"))
+	node.out <- marker
+	expectMarker()
+	clock.Advance(time.Second)
+	node.out <- dataPacket("destination", limited.Token, ipTunPacket(limited.IP.String(), "2002::1"))
+	expectMarker()
+	expectNoTunServerError(t, tunserver)
+}
+
+func TestLoadTunnelPolicies(t *testing.T) {
+	f, err := ioutil.TempFile("", "policies")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	_, err = fmt.Fprintf(f, `{"%x": {"MaxBandwidth": 1000, "MinAmt": 3}}`, "client")
+	f.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	policies, err := LoadTunnelPolicies(f.Name())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(policies) != 1 || policies["client"] != (TunnelPolicy{1000, 3}) {
+		t.Fatalf("Unexpected policies %v", policies)
+	}
+}
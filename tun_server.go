@@ -1,30 +1,194 @@
 package node
 
 import (
-	"encoding/json"
-	"fmt"
+	"crypto/rand"
+	"encoding/binary"
+	"errors"
+	"log"
 	"net"
+	"sync"
+	"time"
 
 	"github.com/AutoRoute/tuntap"
 
+	"github.com/AutoRoute/node/internal"
 	"github.com/AutoRoute/node/types"
 )
 
+// Settings for an exit node's TCPTunServer.
+type TCPTunServerOptions struct {
+	// The prefixes client addresses are leased from. Either may be empty to
+	// not serve that family, but not both.
+	IPv4Prefix string
+	IPv6Prefix string
+	// How long a client keeps its addresses without sending any traffic.
+	LeaseTime time.Duration
+	// Addresses client traffic is translated to so it can reach the internet,
+	// or empty to forward client addresses unchanged. Replies to them must be
+	// routed to the tun device.
+	NATIPv4 string
+	NATIPv6 string
+	// Accept tunnel requests which aren't signed, trusting whatever source
+	// they claim.
+	AllowUnsigned bool
+	// How far the time a request was signed may be from ours.
+	SignatureWindow time.Duration
+	// If Allow isn't empty only those clients may tunnel. Clients in Deny
+	// never may.
+	Allow []types.NodeAddress
+	Deny  []types.NodeAddress
+	// Limits for clients without an entry in Policies.
+	DefaultPolicy TunnelPolicy
+	Policies      map[types.NodeAddress]TunnelPolicy
+	// The largest packet sent to a client, at least 1280. Clients may ask for
+	// less.
+	MTU int
+	// What leases are timed with, or nil for the system clock.
+	Clock internal.Clock
+}
+
+// Returns the settings used by NewTCPTunServer.
+func DefaultTCPTunServerOptions() TCPTunServerOptions {
+	return TCPTunServerOptions{
+		IPv4Prefix:      "10.64.0.0/16",
+		IPv6Prefix:      "2001::/64",
+		LeaseTime:       10 * time.Minute,
+		SignatureWindow: 5 * time.Minute,
+		MTU:             default_tunnel_mtu,
+	}
+}
+
+var no_prefix_error = errors.New("tunnel server needs an IPv4 or IPv6 prefix")
+
+// What a client's session was set up with.
+type tunnelSession struct {
+	version byte
+	mtu     int
+	// Which data, keepalive and close messages belong to the session, or 0
+	// for sessions older than version 4.
+	token uint64
+}
+
+// Returns a random token which can't be guessed. It isn't secret, as
+// responses carrying it can be read by every node they pass through.
+func newSessionToken() uint64 {
+	b := make([]byte, 8)
+	for {
+		_, err := rand.Read(b)
+		if err != nil {
+			log.Fatal(err)
+		}
+		if token := binary.BigEndian.Uint64(b); token != 0 {
+			return token
+		}
+	}
+}
+
+// Reports err through errs unless an error is already waiting, so a second
+// goroutine failing doesn't block forever.
+func reportError(errs chan error, err error) {
+	select {
+	case errs <- err:
+	default:
+	}
+}
+
 type TCPTunServer struct {
-	node        NodeConnection
-	tun         TCPTun
-	amt         int64
-	nodes       map[string]types.NodeAddress
-	connections map[types.NodeAddress]bool
-	currIP      int
-	quit        chan bool
-	err         chan error
+	node NodeConnection
+	tun  TCPTun
+	amt  int64
+	// Either pool may be nil if that family isn't served.
+	ipv4 *AddressPool
+	ipv6 *AddressPool
+	// Either may be nil if that family isn't translated.
+	nat4 *NAT
+	nat6 *NAT
+	auth *tunnelAuth
+	// The largest packet we send clients which don't say.
+	mtu      int
+	sessions map[types.NodeAddress]tunnelSession
+	// The client each session token belongs to.
+	tokens map[uint64]types.NodeAddress
+	l      *sync.Mutex
+	clock  internal.Clock
+	quit   chan bool
+	err    chan error
 }
 
 // NewTCPTunServer just constructs and returns a TCPTunServer with the given paramters.
 // Unlike NewTCPTunClient, it does not start listening.
 func NewTCPTunServer(n NodeConnection, tun TCPTun, amt int64) *TCPTunServer {
-	return &TCPTunServer{n, tun, amt, make(map[string]types.NodeAddress), make(map[types.NodeAddress]bool), 0, make(chan bool), make(chan error, 1)}
+	ts, err := NewTCPTunServerWithOptions(n, tun, amt, DefaultTCPTunServerOptions())
+	if err != nil {
+		log.Fatal(err)
+	}
+	return ts
+}
+
+func NewTCPTunServerWithOptions(n NodeConnection, tun TCPTun, amt int64, o TCPTunServerOptions) (*TCPTunServer, error) {
+	clock := o.Clock
+	if clock == nil {
+		clock = internal.SystemClock()
+	}
+	if o.MTU < min_tunnel_mtu {
+		return nil, errors.New("tunnel MTU must be at least 1280")
+	}
+	ts := &TCPTunServer{n, tun, amt, nil, nil, nil, nil, newTunnelAuth(o), o.MTU, make(map[types.NodeAddress]tunnelSession), make(map[uint64]types.NodeAddress), &sync.Mutex{}, clock, make(chan bool), make(chan error, 1)}
+	var err error
+	if len(o.IPv4Prefix) > 0 {
+		ts.ipv4, err = NewAddressPool(o.IPv4Prefix, o.LeaseTime, clock)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if len(o.IPv6Prefix) > 0 {
+		ts.ipv6, err = NewAddressPool(o.IPv6Prefix, o.LeaseTime, clock)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if ts.ipv4 == nil && ts.ipv6 == nil {
+		return nil, no_prefix_error
+	}
+	if len(o.NATIPv4) > 0 {
+		ip := net.ParseIP(o.NATIPv4).To4()
+		if ip == nil {
+			return nil, errors.New("invalid IPv4 NAT address " + o.NATIPv4)
+		}
+		ts.nat4 = NewNAT(ip, clock)
+	}
+	if len(o.NATIPv6) > 0 {
+		ip := net.ParseIP(o.NATIPv6)
+		if ip == nil || ip.To4() != nil {
+			return nil, errors.New("invalid IPv6 NAT address " + o.NATIPv6)
+		}
+		ts.nat6 = NewNAT(ip, clock)
+	}
+	return ts, nil
+}
+
+// Returns the prefixes clients are given addresses from, which should be
+// routed to the tun device.
+func (ts *TCPTunServer) Prefixes() []*net.IPNet {
+	prefixes := make([]*net.IPNet, 0, 2)
+	for _, pool := range []*AddressPool{ts.ipv4, ts.ipv6} {
+		if pool != nil {
+			prefixes = append(prefixes, pool.prefix)
+		}
+	}
+	return prefixes
+}
+
+// Returns the addresses client traffic is translated to, which should be
+// routed to the tun device.
+func (ts *TCPTunServer) NATAddresses() []net.IP {
+	addresses := make([]net.IP, 0, 2)
+	for _, nat := range []*NAT{ts.nat4, ts.nat6} {
+		if nat != nil {
+			addresses = append(addresses, nat.Address())
+		}
+	}
+	return addresses
 }
 
 func (ts *TCPTunServer) Close() {
@@ -35,111 +199,476 @@ func (ts *TCPTunServer) Error() chan error {
 	return ts.err
 }
 
-// connect takes the NodeAddress of the connecting Node (the Node that sent a request to tunnel),
-// adds it to the connection table, and assigns and sends it an IP address
-func (ts *TCPTunServer) connect(connectingNode types.NodeAddress) {
-	ip := fmt.Sprintf("2001::%d", ts.currIP)
-	ts.currIP++
-	nodeAddr := connectingNode
-	ts.nodes[ip] = nodeAddr
-	ts.connections[nodeAddr] = true
+// Returns the pool addresses of the given IP version are leased from.
+func (ts *TCPTunServer) pool(version int) *AddressPool {
+	if version == 4 {
+		return ts.ipv4
+	}
+	return ts.ipv6
+}
+
+// Returns the NAT for the given IP version, or nil if it isn't translated.
+func (ts *TCPTunServer) nat(version int) *NAT {
+	if version == 4 {
+		return ts.nat4
+	}
+	return ts.nat6
+}
+
+// connect takes a request to tunnel, checks the connecting Node (the Node that
+// sent it) may tunnel, leases it addresses, and sends them back. A node which
+// is already connected is sent the addresses it already has.
+func (ts *TCPTunServer) connect(req types.TCPTunnelRequest) {
+	connectingNode := req.Source
+	err := ts.auth.authorize(req, ts.node.GetNodeAddress(), ts.clock.Now())
+	if err == nil && req.TAP {
+		err = errors.New("this node doesn't bridge ethernet frames")
+	}
+	if err == nil && req.Signature != nil && req.Version < 4 {
+		// Older messages name their sender, which anyone can forge, so
+		// only sessions which trust whatever source is claimed use them.
+		err = errors.New("signed tunnels need version 4")
+	}
+	if err != nil {
+		log.Printf("Refusing tunnel request from %x: %v", connectingNode, err)
+		return
+	}
+
+	// UnmarshalBinary refuses versions newer than ours.
+	resp := types.TCPTunnelResponse{Version: req.Version}
+	session := tunnelSession{req.Version, ts.mtu, 0}
+	if req.Version >= 2 {
+		session.mtu = negotiateMTU(int(req.MTU), ts.mtu)
+		resp.MTU = uint16(session.mtu)
+	}
+	if ts.ipv6 != nil {
+		ip, err := ts.acquire(ts.ipv6, connectingNode)
+		if err != nil {
+			log.Printf("Refusing tunnel request from %x: %v", connectingNode, err)
+			return
+		}
+		resp.IP = ip
+	}
+	if ts.ipv4 != nil {
+		ip, err := ts.acquire(ts.ipv4, connectingNode)
+		if err != nil {
+			log.Printf("Refusing tunnel request from %x: %v", connectingNode, err)
+			return
+		}
+		if resp.IP == nil {
+			resp.IP = ip
+		} else {
+			resp.IPv4 = ip
+		}
+	}
 
-	resp := types.TCPTunnelResponse{net.ParseIP(ip)}
-	resp_b, _ := resp.MarshalBinary()
-	ep := types.Packet{nodeAddr, ts.amt, resp_b}
-	err := ts.node.SendPacket(ep)
+	ts.l.Lock()
+	if req.Version >= 4 {
+		// A client retrying its request keeps its token, so data it
+		// sent after an earlier answer isn't lost.
+		session.token = ts.sessions[connectingNode].token
+		if session.token == 0 {
+			session.token = newSessionToken()
+		}
+		resp.Token = session.token
+	}
+	ts.startSession(connectingNode, session)
+	ts.l.Unlock()
+	resp_b, err := resp.MarshalBinary()
 	if err != nil {
-		ts.err <- err
+		log.Printf("Error answering tunnel request from %x: %v", connectingNode, err)
 		return
 	}
+	ep := types.Packet{Dest: connectingNode, Amt: ts.amt, Data: resp_b}
+	err = ts.node.SendPacket(ep)
+	if err != nil {
+		log.Printf("Error answering tunnel request from %x: %v", connectingNode, err)
+	}
+}
+
+// Records a client's session, replacing any it had. Must be called with the
+// lock held.
+func (ts *TCPTunServer) startSession(client types.NodeAddress, session tunnelSession) {
+	ts.endSession(client)
+	ts.sessions[client] = session
+	if session.token != 0 {
+		ts.tokens[session.token] = client
+	}
+}
+
+// Forgets a client's session. Must be called with the lock held.
+func (ts *TCPTunServer) endSession(client types.NodeAddress) {
+	delete(ts.tokens, ts.sessions[client].token)
+	delete(ts.sessions, client)
+}
+
+// Returns the client a session token belongs to.
+func (ts *TCPTunServer) tokenClient(token uint64) (types.NodeAddress, bool) {
+	ts.l.Lock()
+	defer ts.l.Unlock()
+	client, ok := ts.tokens[token]
+	return client, ok
+}
+
+// Returns whether a client's session identifies it by the source messages
+// claim rather than a token.
+func (ts *TCPTunServer) legacy(client types.NodeAddress) bool {
+	ts.l.Lock()
+	defer ts.l.Unlock()
+	session, ok := ts.sessions[client]
+	return ok && session.version < 4
+}
+
+// Leases client an address from pool. An address it didn't already hold is
+// cleared of flows left behind by whoever held it before.
+func (ts *TCPTunServer) acquire(pool *AddressPool, client types.NodeAddress) (net.IP, error) {
+	held := pool.RenewNode(client)
+	ip, err := pool.Acquire(client)
+	if err == nil && !held {
+		ts.flushNAT(ip)
+	}
+	return ip, err
+}
+
+// Forgets the NAT flows of whoever holds ip.
+func (ts *TCPTunServer) flushNAT(ip net.IP) {
+	version := 6
+	if ip.To4() != nil {
+		version = 4
+	}
+	if nat := ts.nat(version); nat != nil {
+		nat.Flush(ip)
+	}
+}
+
+// Gives up a client's addresses so they can be handed to someone else.
+func (ts *TCPTunServer) Release(client types.NodeAddress) {
+	for _, pool := range []*AddressPool{ts.ipv4, ts.ipv6} {
+		if pool != nil {
+			if ip := pool.Release(client); ip != nil {
+				ts.flushNAT(ip)
+			}
+		}
+	}
+	ts.l.Lock()
+	ts.endSession(client)
+	ts.l.Unlock()
+}
+
+// Ends a client's session, telling it why, and gives up its addresses.
+func (ts *TCPTunServer) Disconnect(client types.NodeAddress, reason string) {
+	ts.sendClose(client, reason)
+	ts.Release(client)
+}
+
+// Tells a client its session is over.
+func (ts *TCPTunServer) sendClose(client types.NodeAddress, reason string) {
+	ts.l.Lock()
+	session := ts.sessions[client]
+	ts.l.Unlock()
+	c := types.TCPTunnelClose{Version: session.version, Source: client, Token: session.token, Reason: reason}
+	c_b, err := c.MarshalBinary()
+	if err != nil {
+		log.Printf("Error closing tunnel to %x: %v", client, err)
+		return
+	}
+	err = ts.node.SendPacket(types.Packet{Dest: client, Amt: ts.amt, Data: c_b})
+	if err != nil {
+		log.Printf("Error closing tunnel to %x: %v", client, err)
+	}
+}
+
+// Renews a client's leases and answers its keepalive, or tells it the session
+// is over if it has no leases left. Keepalives without a known token are
+// dropped.
+func (ts *TCPTunServer) keepalive(k types.TCPTunnelKeepalive) {
+	client, ok := ts.sender(k.Version, k.Source, k.Token)
+	if !ok {
+		return
+	}
+	renewed := false
+	for _, pool := range []*AddressPool{ts.ipv4, ts.ipv6} {
+		if pool != nil && pool.RenewNode(client) {
+			renewed = true
+		}
+	}
+	if !renewed {
+		ts.sendClose(client, "no session")
+		return
+	}
+	reply := types.TCPTunnelKeepalive{Version: k.Version, Source: ts.node.GetNodeAddress(), Token: k.Token}
+	reply_b, _ := reply.MarshalBinary()
+	err := ts.node.SendPacket(types.Packet{Dest: client, Amt: ts.amt, Data: reply_b})
+	if err != nil {
+		log.Printf("Error answering keepalive from %x: %v", client, err)
+	}
+}
+
+// Returns which client sent a keepalive or close, going by its token from
+// version 4. Older messages are only believed for sessions which are older
+// too.
+func (ts *TCPTunServer) sender(version byte, source types.NodeAddress, token uint64) (types.NodeAddress, bool) {
+	if version >= 4 {
+		return ts.tokenClient(token)
+	}
+	return source, ts.legacy(source)
+}
+
+// Returns the session data is sent to a client in.
+func (ts *TCPTunServer) session(client types.NodeAddress) tunnelSession {
+	ts.l.Lock()
+	defer ts.l.Unlock()
+	return ts.sessions[client]
+}
+
+// Returns the largest packet to send a client.
+func (ts *TCPTunServer) clientMTU(client types.NodeAddress) int {
+	ts.l.Lock()
+	defer ts.l.Unlock()
+	if session, ok := ts.sessions[client]; ok {
+		return session.mtu
+	}
+	return ts.mtu
+}
+
+// Tells the sender of a packet from the tun device it's too big for the
+// tunnel.
+func (ts *TCPTunServer) tooBig(p *tuntap.Packet, mtu int) {
+	reply := packetTooBig(p.Packet, mtu)
+	if reply == nil {
+		return
+	}
+	err := ts.tun.WritePacket(&tuntap.Packet{Protocol: p.Protocol, Packet: reply})
+	if err != nil {
+		log.Printf("Error answering oversized packet: %v", err)
+	}
 }
 
 // Listen() starts listening on the tun and AutoRoute connection
 func (ts *TCPTunServer) Listen() {
 	go ts.listenNode()
 	go ts.listenTun()
+	go ts.expireLeases()
+}
+
+// Ends the sessions of clients whose leases have run out, and forgets idle
+// NAT flows.
+func (ts *TCPTunServer) expireLeases() {
+	tick := ts.clock.Tick(time.Minute)
+	for {
+		select {
+		case <-tick:
+			expired := make(map[types.NodeAddress]bool)
+			for _, pool := range []*AddressPool{ts.ipv4, ts.ipv6} {
+				if pool != nil {
+					for _, client := range pool.Expire() {
+						expired[client] = true
+					}
+				}
+			}
+			for client := range expired {
+				ts.sendClose(client, "lease expired")
+				ts.l.Lock()
+				ts.endSession(client)
+				ts.l.Unlock()
+			}
+			for _, nat := range []*NAT{ts.nat4, ts.nat6} {
+				if nat != nil {
+					nat.Expire()
+				}
+			}
+			ts.auth.expire(ts.clock.Now())
+		case <-ts.quit:
+			return
+		}
+	}
 }
 
 // listenNode reads a packet from the node connection and determines whether
-// it's a TCP tunnel request or data packet. If it's a request to tunnel, connect
-// is called. Otherwise the packet is unwrapped and sent out the tun device.
+// it's a TCP tunnel request, data, keepalive or close packet. If it's a request
+// to tunnel, connect is called. Data packets are unwrapped and sent out the tun
+// device.
 func (ts *TCPTunServer) listenNode() {
-	for p := range ts.node.Packets() {
-		// src := types.NodeAddress(p.Dest)
-		// if _, ok := ts.connections[src]; !ok {
-		if p.Data[1] == 0 {
+	for {
+		var p types.Packet
+		select {
+		case p = <-ts.node.Packets():
+		case <-ts.quit:
+			return
+		}
+		if len(p.Data) < 2 {
+			continue
+		}
+		if p.Data[1] == 0 || p.Data[1] == 3 {
 			var req types.TCPTunnelRequest
 			err := req.UnmarshalBinary(p.Data)
 			if err != nil {
-				ts.err <- err
-			}
-
-			if _, ok := ts.connections[req.Source]; ok {
-				// If we are getting a request from someone that
-				// we're already tunneling with we should figure
-				// out how to handle that
+				log.Printf("Error reading tunnel request: %v", err)
 				continue
 			}
-
-			ts.connect(req.Source)
+			ts.connect(req)
 		} else if p.Data[1] == 2 {
-			/* do something with packet */
-			var tcp_data types.TCPTunnelData
-			err := tcp_data.UnmarshalBinary(p.Data)
+			ep, token, err := unmarshalTunnelData(p.Data)
 			if err != nil {
-				ts.err <- err
+				log.Printf("Dropping tunnel packet: %v", err)
+				continue
 			}
-
-			ep := &tuntap.Packet{}
-			err = json.Unmarshal(tcp_data.Data, ep)
-			if err != nil {
-				ts.err <- err
-				return
+			if !ts.fromClient(ep.Packet, p.Data[0], token, p.Amt) {
+				continue
 			}
 			err = ts.tun.WritePacket(ep)
 			if err != nil {
-				ts.err <- err
+				reportError(ts.err, err)
 				return
 			}
+		} else if p.Data[1] == 4 {
+			var k types.TCPTunnelKeepalive
+			err := k.UnmarshalBinary(p.Data)
+			if err != nil {
+				log.Printf("Error reading tunnel keepalive: %v", err)
+				continue
+			}
+			ts.keepalive(k)
+		} else if p.Data[1] == 5 {
+			var c types.TCPTunnelClose
+			err := c.UnmarshalBinary(p.Data)
+			if err != nil {
+				log.Printf("Error reading tunnel close: %v", err)
+				continue
+			}
+			if client, ok := ts.sender(c.Version, c.Source, c.Token); ok {
+				ts.Release(client)
+			}
 		}
 		// else don't do anyting with the packet
 		// We don't handle response packets
 	}
 }
 
+// Checks a packet from the tunnel came from an address leased to the session
+// its token belongs to, renewing the lease if so. Anything else is dropped so
+// clients can't spoof each other, as are packets breaking the client's
+// policy. Messages older than version 4 have no token and are only taken for
+// sessions which are older too, which trust whatever source is claimed.
+// Packets which are kept are translated in place if NAT is enabled.
+func (ts *TCPTunServer) fromClient(packet []byte, version byte, token uint64, amt int64) bool {
+	h, err := parseIPHeader(packet)
+	if err != nil {
+		log.Printf("Dropping tunnel packet: %v", err)
+		return false
+	}
+	pool := ts.pool(h.version)
+	if pool == nil {
+		log.Printf("Dropping IPv%d tunnel packet", h.version)
+		return false
+	}
+	var sender types.NodeAddress
+	if version >= 4 {
+		var ok bool
+		sender, ok = ts.tokenClient(token)
+		if !ok {
+			log.Printf("Dropping tunnel packet with unknown session token")
+			return false
+		}
+	}
+	client, ok := pool.Lookup(h.src)
+	if !ok {
+		log.Printf("Dropping tunnel packet from unleased address %v", h.src)
+		return false
+	}
+	if (version >= 4 && client != sender) || (version < 4 && !ts.legacy(client)) {
+		log.Printf("Dropping tunnel packet from %v sent outside its session", h.src)
+		return false
+	}
+	pool.Renew(h.src)
+	if !ts.auth.allowFrom(client, len(packet), amt, ts.clock.Now()) {
+		return false
+	}
+	if nat := ts.nat(h.version); nat != nil {
+		err = nat.Outbound(packet)
+		if err != nil {
+			log.Printf("Dropping tunnel packet from %v: %v", h.src, err)
+			return false
+		}
+	}
+	return true
+}
+
+// Returns the client a packet from the tun device is for, translating replies
+// to the NAT addresses back to the client's address.
+func (ts *TCPTunServer) destination(packet []byte) (types.NodeAddress, bool) {
+	h, err := parseIPHeader(packet)
+	if err != nil {
+		log.Printf("Dropping packet from tun: %v", err)
+		return "", false
+	}
+	pool := ts.pool(h.version)
+	if pool == nil {
+		return "", false
+	}
+	if nat := ts.nat(h.version); nat != nil && h.dst.Equal(nat.Address()) {
+		if !nat.Inbound(packet) {
+			return "", false
+		}
+		// The destination was rewritten in place.
+		h, _ = parseIPHeader(packet)
+	}
+	return pool.Lookup(h.dst)
+}
+
 // listenTun reads a packet from the tun device, wraps it in a TCP tunnel packet
 // and sends it out the node connection
 func (ts *TCPTunServer) listenTun() {
 	for {
 		p, err := ts.tun.ReadPacket()
 		if err != nil {
-			ts.err <- err
+			reportError(ts.err, err)
 			return
 		}
-		if p.Truncated {
-			ts.err <- truncated_error
+		select {
+		case <-ts.quit:
 			return
+		default:
 		}
-		b, err := json.Marshal(p)
-		if err != nil {
-			ts.err <- err
-			return
+		if p.Truncated {
+			log.Printf("Dropping truncated packet from tun")
+			ts.tooBig(p, ts.mtu)
+			continue
 		}
-		version := p.Packet[0]
-		if (version & 0xF) != 0x6 {
+		// Translating the destination changes the packet, and the sender
+		// needs to see what it sent if it's too big.
+		original := p
+		if len(p.Packet) > min_tunnel_mtu {
+			original = &tuntap.Packet{Protocol: p.Protocol, Packet: append([]byte(nil), p.Packet...)}
+		}
+		dest_node, ok := ts.destination(p.Packet)
+		if !ok || !ts.auth.allowTo(dest_node, len(p.Packet), ts.clock.Now()) {
 			continue
 		}
-
-		ip := net.IP(p.Packet[64:192])
-		dest_node := ts.nodes[string(ip)]
-
-		tcp_data := types.TCPTunnelData{b}
-		tcp_data_b, _ := tcp_data.MarshalBinary()
-		ep := types.Packet{dest_node, ts.amt, tcp_data_b}
-		err = ts.node.SendPacket(ep)
-		if err != nil {
-			ts.err <- err
-			return
+		packets := []*tuntap.Packet{p}
+		if mtu := ts.clientMTU(dest_node); len(p.Packet) > mtu {
+			fragments := fragment(p.Packet, mtu)
+			if fragments == nil {
+				ts.tooBig(original, mtu)
+				continue
+			}
+			packets = packets[:0]
+			for _, f := range fragments {
+				packets = append(packets, &tuntap.Packet{Protocol: p.Protocol, Packet: f})
+			}
+		}
+		for _, p := range packets {
+			session := ts.session(dest_node)
+			tcp_data_b, err := marshalTunnelData(p, session.version, ts.node.GetNodeAddress(), session.token)
+			if err != nil {
+				log.Printf("Error wrapping packet for %x: %v", dest_node, err)
+				continue
+			}
+			ep := types.Packet{Dest: dest_node, Amt: ts.amt, Data: tcp_data_b}
+			err = ts.node.SendPacket(ep)
+			if err != nil {
+				log.Printf("Error sending tunnel packet to %x: %v", dest_node, err)
+			}
 		}
 	}
 }
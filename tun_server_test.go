@@ -2,49 +2,89 @@ package node
 
 import (
 	"bytes"
-	"encoding/json"
+	"encoding"
+	"encoding/binary"
 	"errors"
 	"net"
 	"testing"
+	"time"
 
 	"github.com/AutoRoute/tuntap"
 
+	"github.com/AutoRoute/node/internal"
 	"github.com/AutoRoute/node/types"
 )
 
-func requestPacket(source types.NodeAddress) types.Packet {
-	req := types.TCPTunnelRequest{source}
+var test_client_keys = make(map[string]Key)
+
+// Returns the key of a named test client, making one the first time.
+func testClientKey(name string) Key {
+	k, ok := test_client_keys[name]
+	if !ok {
+		var err error
+		k, err = NewKey()
+		if err != nil {
+			panic(err)
+		}
+		test_client_keys[name] = k
+	}
+	return k
+}
+
+func clientAddress(name string) types.NodeAddress {
+	return testClientKey(name).k.PublicKey().Hash()
+}
+
+// Returns a signed tunnel request from a named client to a testNode.
+func requestPacket(name string) types.Packet {
+	req := types.TCPTunnelRequest{Version: types.TCPTunnelVersion}
+	req, err := SignTCPTunnelRequest(testClientKey(name), req, "source", time.Now())
+	if err != nil {
+		panic(err)
+	}
 	req_b, _ := req.MarshalBinary()
-	ep := types.Packet{"destination", 7, req_b}
+	ep := types.Packet{Dest: "destination", Amt: 7, Data: req_b}
 	return ep
 }
 
-func TestReceiveRequest(t *testing.T) {
-	amt := int64(7)
-	source := types.NodeAddress("source")
-	tun := testTun{make(chan *tuntap.Packet), make(chan *tuntap.Packet), nil, nil}
-	node := testNode{make(chan types.Packet), make(chan types.Packet), nil}
-	tunserver := NewTCPTunServer(node, tun, amt)
-	tunserver.Listen()
-	defer tunserver.Close()
-
-	// Send test request packet
-	node.out <- requestPacket(source)
+// Returns a data message in the session with the given token.
+func dataPacket(dest types.NodeAddress, token uint64, p tuntap.Packet) types.Packet {
+	tcp_data := types.TCPTunnelData{Version: types.TCPTunnelVersion, Protocol: uint16(p.Protocol), Token: token, Data: p.Packet}
+	tcp_data_b, _ := tcp_data.MarshalBinary()
+	return types.Packet{Dest: dest, Amt: 7, Data: tcp_data_b}
+}
 
-	// See if we get a response
+// Sends a tunnel request from a named client and returns the response.
+func handshake(t *testing.T, node testNode, name string) types.TCPTunnelResponse {
+	source := clientAddress(name)
+	node.out <- requestPacket(name)
 	var resp types.TCPTunnelResponse
 	p_resp := <-node.in
+	if p_resp.Dest != source {
+		t.Fatalf("Response sent to %q not %q", p_resp.Dest, source)
+	}
 	err := resp.UnmarshalBinary(p_resp.Data)
 	if err != nil {
 		t.Fatal(err)
 	}
+	return resp
+}
 
-	// Make sure the IP we are assigned is the first one the tun_server
-	// hands out
-	if !bytes.Equal(resp.IP, net.ParseIP("2001::")) {
-		t.Fatalf("%v != %v", resp.IP, "2001::")
+// Reads the message ending a named client's session.
+func expectClose(t *testing.T, node testNode, name string) types.TCPTunnelClose {
+	p := <-node.in
+	var c types.TCPTunnelClose
+	err := c.UnmarshalBinary(p.Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.Dest != clientAddress(name) || (c.Token == 0 && c.Source != clientAddress(name)) {
+		t.Fatalf("Close for %x with token %x sent to %x", c.Source, c.Token, p.Dest)
 	}
+	return c
+}
 
+func expectNoTunServerError(t *testing.T, tunserver *TCPTunServer) {
 	select {
 	case err := <-tunserver.Error():
 		t.Fatal(err)
@@ -52,117 +92,296 @@ func TestReceiveRequest(t *testing.T) {
 	}
 }
 
-func TestListenNodeData(t *testing.T) {
+func TestReceiveRequest(t *testing.T) {
 	amt := int64(7)
-	source := types.NodeAddress("source")
+	source := "source"
 	tun := testTun{make(chan *tuntap.Packet), make(chan *tuntap.Packet), nil, nil}
 	node := testNode{make(chan types.Packet), make(chan types.Packet), nil}
 	tunserver := NewTCPTunServer(node, tun, amt)
 	tunserver.Listen()
 	defer tunserver.Close()
 
-	// Send test request packet
-	node.out <- requestPacket(source)
-
-	// See if we get a response
-	var resp types.TCPTunnelResponse
-	p_resp := <-node.in
-	err := resp.UnmarshalBinary(p_resp.Data)
-	if err != nil {
-		t.Fatal(err)
+	// Make sure the addresses we are assigned are the first ones the
+	// tun_server hands out
+	resp := handshake(t, node, source)
+	if !resp.IP.Equal(net.ParseIP("2001::1")) || !resp.IPv4.Equal(net.ParseIP("10.64.0.1")) {
+		t.Fatalf("Unexpected addresses %v %v", resp.IP, resp.IPv4)
 	}
 
-	// Make sure the IP we are assigned is the first one the tun_server
-	// hands out
-	if !bytes.Equal(resp.IP, net.ParseIP("2001::")) {
-		t.Fatalf("%v != %v", resp.IP, "2001::")
+	// Asking again gets the same addresses.
+	again := handshake(t, node, source)
+	if !again.IP.Equal(resp.IP) || !again.IPv4.Equal(resp.IPv4) {
+		t.Fatalf("Addresses changed from %v %v to %v %v", resp.IP, resp.IPv4, again.IP, again.IPv4)
 	}
 
-	// Create test node packet
-	p := exampleTunPacket()
-	b, err := json.Marshal(p)
-	if err != nil {
-		t.Fatal(err)
+	// Another client gets the next ones.
+	other := handshake(t, node, "other")
+	if !other.IP.Equal(net.ParseIP("2001::2")) || !other.IPv4.Equal(net.ParseIP("10.64.0.2")) {
+		t.Fatalf("Unexpected addresses %v %v", other.IP, other.IPv4)
 	}
 
-	// Send test node packet
-	tcp_data := types.TCPTunnelData{b}
-	tcp_data_b, _ := tcp_data.MarshalBinary()
-	ep := types.Packet{"destination", 7, tcp_data_b}
-	node.out <- ep
+	expectNoTunServerError(t, tunserver)
+}
 
-	// Make sure we got it on the other end
-	p_after := <-tun.in
+func TestListenNodeData(t *testing.T) {
+	amt := int64(7)
+	source := "source"
+	tun := testTun{make(chan *tuntap.Packet), make(chan *tuntap.Packet), nil, nil}
+	node := testNode{make(chan types.Packet), make(chan types.Packet), nil}
+	tunserver := NewTCPTunServer(node, tun, amt)
+	tunserver.Listen()
+	defer tunserver.Close()
 
-	if p_after.Protocol != p.Protocol ||
-		p_after.Truncated != p.Truncated ||
-		!bytes.Equal(p_after.Packet, p.Packet) {
-		t.Fatalf("%q @= %q", p, p_after)
+	resp := handshake(t, node, source)
+
+	for _, p := range []tuntap.Packet{
+		ipTunPacket(resp.IP.String(), "2002::"),
+		ipTunPacket(resp.IPv4.String(), "8.8.8.8"),
+	} {
+		node.out <- dataPacket("destination", resp.Token, p)
+
+		// Make sure we got it on the other end
+		p_after := <-tun.in
+		if p_after.Protocol != p.Protocol ||
+			p_after.Truncated != p.Truncated ||
+			!bytes.Equal(p_after.Packet, p.Packet) {
+			t.Fatalf("%q @= %q", p, p_after)
+		}
 	}
 
-	select {
-	case err := <-tunserver.Error():
-		t.Fatal(err)
-	default:
+	expectNoTunServerError(t, tunserver)
+}
+
+// Packets from addresses which aren't leased are dropped.
+func TestListenNodeSpoofed(t *testing.T) {
+	tun := testTun{make(chan *tuntap.Packet, 1), make(chan *tuntap.Packet), nil, nil}
+	node := testNode{make(chan types.Packet), make(chan types.Packet), nil}
+	tunserver := NewTCPTunServer(node, tun, 7)
+	tunserver.Listen()
+	defer tunserver.Close()
+
+	resp := handshake(t, node, "source")
+	other := handshake(t, node, "other")
+	node.out <- dataPacket("destination", resp.Token, ipTunPacket("2001::99", "2002::"))
+	node.out <- dataPacket("destination", resp.Token, tuntap.Packet{Packet: []byte("test")})
+	// Neither another session's token, a made up one nor an old message
+	// naming the client gets a packet from its address through.
+	node.out <- dataPacket("destination", other.Token, ipTunPacket("2001::1", "2002::"))
+	node.out <- dataPacket("destination", resp.Token+other.Token, ipTunPacket("2001::1", "2002::"))
+	spoofed := ipTunPacket("2001::1", "2002::")
+	old := types.TCPTunnelData{Version: 3, Protocol: uint16(spoofed.Protocol), Source: clientAddress("source"), Data: spoofed.Packet}
+	old_b, _ := old.MarshalBinary()
+	node.out <- types.Packet{Dest: "destination", Amt: 7, Data: old_b}
+	// Once this arrives the earlier packets have been handled.
+	valid := ipTunPacket("2001::1", "2002::")
+	node.out <- dataPacket("destination", resp.Token, valid)
+	if p := <-tun.in; !bytes.Equal(p.Packet, valid.Packet) {
+		t.Fatalf("Expected only the valid packet, got %v", p.Packet)
 	}
+	expectNoTunServerError(t, tunserver)
 }
 
 func TestListenTun(t *testing.T) {
 	amt := int64(7)
-	source := types.NodeAddress("source")
 	tun := testTun{make(chan *tuntap.Packet), make(chan *tuntap.Packet), nil, nil}
 	node := testNode{make(chan types.Packet), make(chan types.Packet), nil}
 	tunserver := NewTCPTunServer(node, tun, amt)
 	tunserver.Listen()
 	defer tunserver.Close()
 
-	// Send test request packet
-	node.out <- requestPacket(source)
+	clients := []string{"source", "other"}
+	addresses := make(map[string]types.TCPTunnelResponse)
+	for _, c := range clients {
+		addresses[c] = handshake(t, node, c)
+	}
 
-	// See if we get a response
-	var resp types.TCPTunnelResponse
-	p_resp := <-node.in
-	err := resp.UnmarshalBinary(p_resp.Data)
+	// Packets of either family reach the client they're addressed to.
+	for _, c := range clients {
+		for _, p := range []tuntap.Packet{
+			ipTunPacket("2002::", addresses[c].IP.String()),
+			ipTunPacket("8.8.8.8", addresses[c].IPv4.String()),
+		} {
+			tun.out <- &p
+
+			// Receive the packet from the node connection
+			ep := <-node.in
+			if ep.Dest != clientAddress(c) {
+				t.Fatalf("Packet for %q sent to %q", c, ep.Dest)
+			}
+			var tcp_data types.TCPTunnelData
+			err := tcp_data.UnmarshalBinary(ep.Data)
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			// Make sure we got it from the node connection
+			if tcp_data.Token != addresses[c].Token ||
+				int(tcp_data.Protocol) != p.Protocol ||
+				!bytes.Equal(tcp_data.Data, p.Packet) {
+				t.Fatalf("%v @= %+v", p, tcp_data)
+			}
+		}
+	}
+
+	expectNoTunServerError(t, tunserver)
+}
+
+// Packets for released or expired addresses aren't sent anywhere.
+func TestTunServerLeases(t *testing.T) {
+	clock := internal.NewFakeClock(time.Now())
+	o := DefaultTCPTunServerOptions()
+	o.IPv4Prefix = ""
+	o.LeaseTime = time.Minute
+	o.Clock = clock
+	tun := testTun{make(chan *tuntap.Packet), make(chan *tuntap.Packet), nil, nil}
+	node := testNode{make(chan types.Packet), make(chan types.Packet), nil}
+	tunserver, err := NewTCPTunServerWithOptions(node, tun, 7, o)
 	if err != nil {
 		t.Fatal(err)
 	}
+	tunserver.Listen()
+	defer tunserver.Close()
 
-	// Make sure the IP we are assigned is the first one the tun_server
-	// hands out
-	if !bytes.Equal(resp.IP, net.ParseIP("2001::")) {
-		t.Fatalf("%v != %v", resp.IP, "2001::")
+	resp := handshake(t, node, "source")
+	if resp.IPv4 != nil || !resp.IP.Equal(net.ParseIP("2001::1")) {
+		t.Fatalf("Unexpected addresses %v %v", resp.IP, resp.IPv4)
 	}
-
-	// Send test tun packet
-	p := exampleTunPacket()
+	handshake(t, node, "other")
+	tunserver.Release(clientAddress("other"))
+	// Wait for the expiry ticker before moving the clock.
+	clock.BlockUntil(1)
+	clock.Advance(2 * time.Minute)
+	expectClose(t, node, "source")
+
+	for _, dst := range []string{"2001::1", "2001::2"} {
+		p := ipTunPacket("2002::", dst)
+		tun.out <- &p
+	}
+	resp = handshake(t, node, "third")
+	if !resp.IP.Equal(net.ParseIP("2001::3")) || tunserver.ipv6.Leases() != 1 {
+		t.Fatalf("Unexpected address %v with %d leases", resp.IP, tunserver.ipv6.Leases())
+	}
+	p := ipTunPacket("2002::", "2001::3")
 	tun.out <- &p
+	if ep := <-node.in; ep.Dest != clientAddress("third") {
+		t.Fatalf("Packet sent to %q", ep.Dest)
+	}
+	expectNoTunServerError(t, tunserver)
+}
 
-	// Receive the packet from the node connection
-	ep := <-node.in
-	var tcp_data types.TCPTunnelData
-	err = tcp_data.UnmarshalBinary(ep.Data)
+// Clients asking for the current version exchange raw packets, and version 0
+// clients keep getting JSON. Only unsigned requests may ask for a version
+// without session tokens.
+func TestTunServerVersions(t *testing.T) {
+	o := DefaultTCPTunServerOptions()
+	o.AllowUnsigned = true
+	tun := testTun{make(chan *tuntap.Packet), make(chan *tuntap.Packet), nil, nil}
+	node := testNode{make(chan types.Packet), make(chan types.Packet), nil}
+	tunserver, err := NewTCPTunServerWithOptions(node, tun, 7, o)
 	if err != nil {
 		t.Fatal(err)
 	}
+	tunserver.Listen()
+	defer tunserver.Close()
 
-	// Make sure we got it from the node connection
-	p_after := &tuntap.Packet{}
-	err = json.Unmarshal(tcp_data.Data, p_after)
+	signed, err := SignTCPTunnelRequest(testClientKey("signed"), types.TCPTunnelRequest{Version: 3}, "source", time.Now())
 	if err != nil {
 		t.Fatal(err)
 	}
+	signed_b, _ := signed.MarshalBinary()
+	node.out <- types.Packet{Dest: "destination", Amt: 7, Data: signed_b}
+
+	// The refused request gets no response, so the next one is for the new
+	// client.
+	resp := handshake(t, node, "new")
+	if resp.Version != types.TCPTunnelVersion || resp.Token == 0 {
+		t.Fatalf("Server answered with version %d token %x", resp.Version, resp.Token)
+	}
+	node.out <- unsignedRequestPacket(clientAddress("old"))
+	var old types.TCPTunnelResponse
+	err = old.UnmarshalBinary((<-node.in).Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.Version != 0 {
+		t.Fatalf("Server answered a version 0 request with version %d", old.Version)
+	}
 
-	if p_after.Protocol != p.Protocol ||
-		p_after.Truncated != p.Truncated ||
-		!bytes.Equal(p_after.Packet, p.Packet) {
-		t.Fatalf("%q @= %q", p, p_after)
+	// The old client is known by the address its packets come from.
+	p := ipTunPacket(old.IP.String(), "2002::")
+	data := types.TCPTunnelData{Version: 1, Protocol: uint16(p.Protocol), Data: p.Packet}
+	data_b, _ := data.MarshalBinary()
+	node.out <- types.Packet{Dest: "destination", Amt: 7, Data: data_b}
+	if after := <-tun.in; !bytes.Equal(after.Packet, p.Packet) || after.Protocol != p.Protocol {
+		t.Fatalf("%v != %v", p, after)
 	}
 
-	select {
-	case err := <-tunserver.Error():
-		t.Fatal(err)
-	default:
+	for _, c := range []struct {
+		ip      net.IP
+		version byte
+	}{{resp.IP, types.TCPTunnelVersion}, {old.IP, 0}} {
+		p := ipTunPacket("2002::", c.ip.String())
+		tun.out <- &p
+		var data types.TCPTunnelData
+		err = data.UnmarshalBinary((<-node.in).Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if data.Version != c.version {
+			t.Fatalf("Sent version %d to a version %d client", data.Version, c.version)
+		}
+		if c.version != 0 && !bytes.Equal(data.Data, p.Packet) {
+			t.Fatalf("Expected raw packet got %x", data.Data)
+		}
 	}
+	expectNoTunServerError(t, tunserver)
+}
+
+func TestTunServerSessions(t *testing.T) {
+	tun := testTun{make(chan *tuntap.Packet), make(chan *tuntap.Packet), nil, nil}
+	node := testNode{make(chan types.Packet), make(chan types.Packet), nil}
+	tunserver := NewTCPTunServer(node, tun, 7)
+	tunserver.Listen()
+	defer tunserver.Close()
+	send := func(m encoding.BinaryMarshaler) {
+		b, _ := m.MarshalBinary()
+		node.out <- types.Packet{Dest: "source", Amt: 7, Data: b}
+	}
+
+	// Keepalives from clients with a session are answered, even after a
+	// close with the wrong token or naming the client.
+	resp := handshake(t, node, "source")
+	send(&types.TCPTunnelClose{Version: types.TCPTunnelVersion, Token: resp.Token + 1})
+	send(&types.TCPTunnelClose{Version: 3, Source: clientAddress("source")})
+	send(&types.TCPTunnelKeepalive{Version: types.TCPTunnelVersion, Token: resp.Token})
+	p := <-node.in
+	var k types.TCPTunnelKeepalive
+	if err := k.UnmarshalBinary(p.Data); err != nil || p.Dest != clientAddress("source") || k.Token != resp.Token {
+		t.Fatalf("Unexpected keepalive answer %+v to %x: %v", k, p.Dest, err)
+	}
+
+	// A client which closes its session gets the same addresses back when it
+	// reconnects, and until then its keepalives are ignored. The answer to
+	// the request comes first, showing nothing was sent for the keepalive.
+	send(&types.TCPTunnelClose{Version: types.TCPTunnelVersion, Token: resp.Token})
+	send(&types.TCPTunnelKeepalive{Version: types.TCPTunnelVersion, Token: resp.Token})
+	again := handshake(t, node, "source")
+	if !again.IP.Equal(resp.IP) || !again.IPv4.Equal(resp.IPv4) {
+		t.Fatalf("Addresses changed from %v %v to %v %v", resp.IP, resp.IPv4, again.IP, again.IPv4)
+	}
+	if again.Token == resp.Token {
+		t.Fatal("Token reused after the session closed")
+	}
+	if retried := handshake(t, node, "source"); retried.Token != again.Token {
+		t.Fatal("Token changed when the request was retried")
+	}
+
+	// The server can end sessions itself.
+	go tunserver.Disconnect(clientAddress("source"), "testing")
+	if c := expectClose(t, node, "source"); c.Reason != "testing" {
+		t.Fatalf("Unexpected reason %q", c.Reason)
+	}
+	expectNoTunServerError(t, tunserver)
 }
 
 func TestTunServerReadError(t *testing.T) {
@@ -193,15 +412,73 @@ func TestTunServerReadTruncated(t *testing.T) {
 	tunserver.Listen()
 	defer tunserver.Close()
 
-	// Send in a test packet
-	p := tuntap.Packet{Protocol: 0x8000, Truncated: true, Packet: []byte("test")}
+	// Truncated packets are dropped and their sender told they were too big.
+	p := exampleTunPacket()
+	p.Truncated = true
 	tun.out <- &p
+	reply := <-tun.in
+	if h, err := parseIPHeader(reply.Packet); err != nil || h.protocol != proto_icmpv6 || reply.Packet[h.length] != 2 {
+		t.Fatalf("Expected packet too big got %x", reply.Packet)
+	}
 
-	// Make sure the error appears
-	err := <-tunserver.Error()
-	if err != truncated_error {
-		t.Fatalf("%v != %v", truncated_error, err)
+	// Ones too short to answer are just dropped. Sending another waits for
+	// the first to be handled.
+	p = tuntap.Packet{Protocol: 0x8000, Truncated: true, Packet: []byte("test")}
+	tun.out <- &p
+	tun.out <- &p
+	expectNoTunServerError(t, tunserver)
+}
+
+func TestTunServerMTU(t *testing.T) {
+	tun := testTun{make(chan *tuntap.Packet), make(chan *tuntap.Packet), nil, nil}
+	node := testNode{make(chan types.Packet), make(chan types.Packet), nil}
+	tunserver := NewTCPTunServer(node, tun, 7)
+	tunserver.Listen()
+	defer tunserver.Close()
+
+	req := types.TCPTunnelRequest{Version: types.TCPTunnelVersion, MTU: 1300}
+	req, err := SignTCPTunnelRequest(testClientKey("source"), req, "source", time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	req_b, _ := req.MarshalBinary()
+	node.out <- types.Packet{Dest: "destination", Amt: 7, Data: req_b}
+	var resp types.TCPTunnelResponse
+	err = resp.UnmarshalBinary((<-node.in).Data)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.MTU != 1300 {
+		t.Fatalf("Server answered with MTU %d", resp.MTU)
 	}
+
+	// IPv4 packets are fragmented to fit.
+	p := tuntap.Packet{Protocol: 0x0800, Packet: bigPacket("8.8.8.8", resp.IPv4.String(), 2000)}
+	tun.out <- &p
+	for i := 0; i < 2; i++ {
+		ep, _, err := unmarshalTunnelData((<-node.in).Data)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(ep.Packet) > 1300 {
+			t.Fatalf("Sent a %d byte packet", len(ep.Packet))
+		}
+	}
+
+	// IPv6 packets are answered with packet too big from where they were
+	// going.
+	p = tuntap.Packet{Protocol: 0x86DD, Packet: bigPacket("2002::", resp.IP.String(), 2000)}
+	tun.out <- &p
+	reply := <-tun.in
+	h, err := parseIPHeader(reply.Packet)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !h.src.Equal(resp.IP) || reply.Packet[h.length] != 2 ||
+		binary.BigEndian.Uint32(reply.Packet[h.length+4:]) != 1300 {
+		t.Fatalf("Unexpected reply %x", reply.Packet)
+	}
+	expectNoTunServerError(t, tunserver)
 }
 
 func TestTunServerReadWriteFails(t *testing.T) {
@@ -213,20 +490,23 @@ func TestTunServerReadWriteFails(t *testing.T) {
 	tunserver.Listen()
 	defer tunserver.Close()
 
-	// Send in a test packet
-	p := exampleTunPacket()
-	tun.out <- &p
-
-	// Make sure the error appears
-	err := <-tunserver.Error()
-	if err != write_error {
-		t.Fatalf("%v != %v", write_error, err)
+	// Lease the address directly, as the handshake would fail too.
+	ip, err := tunserver.ipv6.Acquire(clientAddress("source"))
+	if err != nil {
+		t.Fatal(err)
 	}
+
+	// A client which can't be reached doesn't stop the server, which goes
+	// on to read the next packet.
+	p := ipTunPacket("2002::", ip.String())
+	tun.out <- &p
+	tun.out <- &p
+	expectNoTunServerError(t, tunserver)
 }
 
 func TestTunServerWriteSendError(t *testing.T) {
 	amt := int64(7)
-	source := types.NodeAddress("source")
+	source := clientAddress("source")
 	write_error := errors.New("Write Error")
 	tun := testTun{make(chan *tuntap.Packet, 1), make(chan *tuntap.Packet), nil, write_error}
 	node := testNode{make(chan types.Packet), make(chan types.Packet), nil}
@@ -235,7 +515,7 @@ func TestTunServerWriteSendError(t *testing.T) {
 	defer tunserver.Close()
 
 	// Start handshake
-	node.out <- requestPacket(source)
+	node.out <- requestPacket("source")
 
 	// See if we get a response
 	var resp types.TCPTunnelResponse
@@ -245,21 +525,12 @@ func TestTunServerWriteSendError(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	if p_back.Dest != source || p_back.Amt != amt || !bytes.Equal(resp.IP, net.ParseIP("2001::")) {
+	if p_back.Dest != source || p_back.Amt != amt || !resp.IP.Equal(net.ParseIP("2001::1")) {
 		t.Fatalf("Incorrect handshake packet received")
 	}
 
 	// Send in a test packet
-	p := tuntap.Packet{Protocol: 0x8000, Truncated: false, Packet: []byte("test")}
-	b, err := json.Marshal(&p)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	tcp_data := types.TCPTunnelData{b}
-	tcp_data_b, _ := tcp_data.MarshalBinary()
-	p_in := types.Packet{source, amt, tcp_data_b}
-	node.out <- p_in
+	node.out <- dataPacket(source, resp.Token, ipTunPacket(resp.IP.String(), "2002::"))
 
 	err = <-tunserver.Error()
 	if err != write_error {
@@ -269,7 +540,7 @@ func TestTunServerWriteSendError(t *testing.T) {
 
 func TestTunServerWriteUnmarshalError(t *testing.T) {
 	amt := int64(7)
-	source := types.NodeAddress("source")
+	source := "source"
 	tun := testTun{make(chan *tuntap.Packet), make(chan *tuntap.Packet), nil, nil}
 	node := testNode{make(chan types.Packet), make(chan types.Packet), nil}
 	tunserver := NewTCPTunServer(node, tun, amt)
@@ -277,28 +548,21 @@ func TestTunServerWriteUnmarshalError(t *testing.T) {
 	defer tunserver.Close()
 
 	// Start handshake
-	node.out <- requestPacket(source)
-
-	// See if we get a response
-	var resp types.TCPTunnelResponse
-	p_back := <-node.in
-	err := resp.UnmarshalBinary(p_back.Data)
-	if err != nil {
-		t.Fatal(err)
-	}
-
-	if p_back.Dest != source || p_back.Amt != amt || !bytes.Equal(resp.IP, net.ParseIP("2001::0")) {
-		t.Fatalf("Incorrect handshake packet received")
-	}
+	resp := handshake(t, node, source)
 
-	// Send in a test packet
-	tcp_data := types.TCPTunnelData{[]byte("NOTJSON")}
+	// Messages which can't be read are dropped rather than stopping the
+	// server, so the valid packet after them is the first through.
+	tcp_data := types.TCPTunnelData{Data: []byte("NOTJSON")}
 	tcp_data_b, _ := tcp_data.MarshalBinary()
-	p_in := types.Packet{source, amt, tcp_data_b}
-	node.out <- p_in
-
-	err = <-tunserver.Error()
-	if err == nil {
-		t.Fatalf("%v != nil", err)
+	p_in := types.Packet{Dest: clientAddress(source), Amt: amt, Data: tcp_data_b}
+	for _, message_type := range []byte{0, 2, 3, 4, 5} {
+		node.out <- p_in
+		node.out <- types.Packet{Dest: clientAddress(source), Amt: amt, Data: []byte{types.TCPTunnelVersion + 1, message_type}}
+	}
+	valid := ipTunPacket(resp.IP.String(), "2002::")
+	node.out <- dataPacket(clientAddress(source), resp.Token, valid)
+	if p := <-tun.in; !bytes.Equal(p.Packet, valid.Packet) {
+		t.Fatalf("Expected only the valid packet, got %v", p.Packet)
 	}
+	expectNoTunServerError(t, tunserver)
 }
@@ -0,0 +1,98 @@
+package types
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// The newest native message version. Version 0 packets carry no token, so
+// nothing shows who really sent them.
+const NativeVersion = 1
+
+// Native message types. They follow the proxy message types so all of them
+// can share a connection.
+const (
+	// Carries an IPv6 packet in the session Token names.
+	NativeData = 13
+	// Opens a session with the receiver, which the sender's packets will
+	// carry Token for. Data holds the sender's TCPTunnelRequest, signed for
+	// the receiver and Token, or nothing if it doesn't sign.
+	NativeHello = 14
+	// Answers a NativeHello, carrying its Token.
+	NativeWelcome = 15
+)
+
+// A message between nodes sending IPv6 packets straight to the node their
+// destination address is derived from, without an exit node.
+type NativePacket struct {
+	Version byte
+	Type    byte
+	// The node which sent the message.
+	Source NodeAddress
+	// The session the message is part of. It can't be guessed, but nodes
+	// the message passes through see it. Version 1 and newer messages carry
+	// it.
+	Token uint64
+	// A raw IPv6 packet, or for a NativeHello the request opening the
+	// session.
+	Data []byte
+}
+
+// Returns the NativePacket as a byte slice.
+// Adds Version as the version number and Type as the message type.
+// Then come the length of Source as 2 bytes and Source. Version 1 and newer
+// messages then have the 8 byte Token. Last is the data.
+func (p *NativePacket) MarshalBinary() ([]byte, error) {
+	if len(p.Source) > 0xFFFF {
+		return nil, errors.New("Source too long")
+	}
+	b := make([]byte, 4, 4+len(p.Source)+8+len(p.Data))
+	b[0] = p.Version
+	b[1] = p.Type
+	binary.BigEndian.PutUint16(b[2:], uint16(len(p.Source)))
+	b = append(b, p.Source...)
+	if p.Version >= 1 {
+		b = append(b, make([]byte, 8)...)
+		binary.BigEndian.PutUint64(b[len(b)-8:], p.Token)
+	}
+	return append(b, p.Data...), nil
+}
+
+// Takes byte slice from the wire and unmarshals it.
+// Checks version is known and message type is one of the native messages
+func (p *NativePacket) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return errors.New("Packet too short")
+	}
+	if data[0] > NativeVersion {
+		return errors.New("Wrong packet version")
+	}
+	if !IsNativePacket(data) {
+		return errors.New("Wrong packet type")
+	}
+	l := int(binary.BigEndian.Uint16(data[2:]))
+	if len(data) < 4+l {
+		return errors.New("Packet too short")
+	}
+	p.Version = data[0]
+	p.Type = data[1]
+	p.Source = NodeAddress(data[4 : 4+l])
+	data = data[4+l:]
+	p.Token = 0
+	if p.Version >= 1 {
+		if len(data) < 8 {
+			return errors.New("Packet too short")
+		}
+		p.Token = binary.BigEndian.Uint64(data)
+		data = data[8:]
+	}
+	p.Data = data
+
+	return nil
+}
+
+// Reports whether b looks like a native packet rather than a tunnel or proxy
+// message.
+func IsNativePacket(b []byte) bool {
+	return len(b) >= 2 && b[1] >= NativeData && b[1] <= NativeWelcome
+}
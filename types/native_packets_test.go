@@ -0,0 +1,45 @@
+package types
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestNativePacket(t *testing.T) {
+	out_p := NativePacket{Version: NativeVersion, Type: NativeData, Source: "source", Token: 5, Data: []byte{0x60, 0, 0, 0}}
+	var in_p NativePacket
+
+	in_p_wire, err := out_p.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsNativePacket(in_p_wire) || IsProxyMessage(in_p_wire) {
+		t.Fatal("Didn't recognise a native packet")
+	}
+	err = in_p.UnmarshalBinary(in_p_wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in_p.Type != out_p.Type || in_p.Source != out_p.Source || in_p.Token != out_p.Token || !bytes.Equal(in_p.Data, out_p.Data) {
+		t.Fatalf("%+v != %+v", in_p, out_p)
+	}
+
+	err = in_p.UnmarshalBinary(in_p_wire[:6])
+	if err == nil {
+		t.Fatalf("Didn't catch truncated source")
+	}
+	err = in_p.UnmarshalBinary(in_p_wire[:14])
+	if err == nil {
+		t.Fatalf("Didn't catch truncated token")
+	}
+	in_p_wire[1] = NativeWelcome + 1
+	if IsNativePacket(in_p_wire) || in_p.UnmarshalBinary(in_p_wire) == nil {
+		t.Fatalf("Didn't catch bad type")
+	}
+	in_p_wire[1] = NativeWelcome
+	in_p_wire[0] = NativeVersion + 1
+	err = in_p.UnmarshalBinary(in_p_wire)
+	if err == nil {
+		t.Fatalf("Didn't catch bad version")
+	}
+}
@@ -2,6 +2,7 @@ package types
 
 import (
 	"crypto/sha512"
+	"encoding/binary"
 	"fmt"
 )
 
@@ -14,6 +15,10 @@ type Packet struct {
 	Amt int64
 	// The data is the physical data which will be sent.
 	Data []byte
+	// The Nonce distinguishes packets which would otherwise be identical, such
+	// as retransmits, so they don't share a hash. Zero means no nonce, which is
+	// what packets from older nodes decode to.
+	Nonce uint64 `json:",omitempty"`
 }
 
 func (p Packet) Destination() NodeAddress {
@@ -23,6 +28,15 @@ func (p Packet) Destination() NodeAddress {
 // The PacketHash is a useful canonical representation of the packet.
 func (p Packet) Hash() PacketHash {
 	o := sha512.Sum512([]byte(string(p.Dest) + string(p.Data)))
+	if p.Nonce == 0 {
+		return PacketHash(string(o[0:sha512.Size]))
+	}
+	// Hash the nonce together with the hash of the rest so that no packet
+	// with a nonce can ever share a hash with one without.
+	b := make([]byte, sha512.Size+8)
+	copy(b, o[0:sha512.Size])
+	binary.BigEndian.PutUint64(b[sha512.Size:], p.Nonce)
+	o = sha512.Sum512(b)
 	return PacketHash(string(o[0:sha512.Size]))
 }
 
@@ -31,5 +45,5 @@ func (p Packet) Amount() int64 {
 }
 
 func (p Packet) String() string {
-	return fmt.Sprintf("{%x %v %q}", p.Dest, p.Amt, p.Data)
+	return fmt.Sprintf("{%x %v %q %d}", p.Dest, p.Amt, p.Data, p.Nonce)
 }
@@ -15,7 +15,7 @@ func TestPacketMarshalling(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	m := Packet{NodeAddress(string(b)), 3, []byte("test")}
+	m := Packet{Dest: NodeAddress(string(b)), Amt: 3, Data: []byte("test")}
 	b, err = json.Marshal(m)
 	if err != nil {
 		t.Fatal(err)
@@ -38,3 +38,38 @@ func TestPacketMarshalling(t *testing.T) {
 	}
 	_ = m.String()
 }
+
+func TestPacketNonce(t *testing.T) {
+	p1 := Packet{Dest: "dest", Amt: 3, Data: []byte("data")}
+	p2 := p1
+	if p1.Hash() != p2.Hash() {
+		t.Fatal("Identical packets should have the same hash")
+	}
+	p1.Nonce, p2.Nonce = 1, 2
+	if p1.Hash() == p2.Hash() {
+		t.Fatal("Packets with different nonces should have different hashes")
+	}
+
+	// Packets from nodes which don't know about nonces decode without one.
+	var old Packet
+	err := json.Unmarshal([]byte(`{"Dest":"64657374","Amt":3,"Data":"ZGF0YQ=="}`), &old)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if old.Nonce != 0 || old.Hash() != (Packet{Dest: "dest", Amt: 3, Data: []byte("data")}).Hash() {
+		t.Fatalf("Unexpected decoding of packet without nonce %v", old)
+	}
+
+	b, err := json.Marshal(p1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var p3 Packet
+	err = json.Unmarshal(b, &p3)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p3.Hash() != p1.Hash() {
+		t.Fatalf("Nonce lost in encoding %v != %v", p3, p1)
+	}
+}
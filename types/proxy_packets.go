@@ -0,0 +1,105 @@
+package types
+
+import (
+	"encoding/binary"
+	"errors"
+)
+
+// The newest proxy message version. Since version 1 connects are signed and
+// UDP associations are opened with a connect.
+const ProxyVersion = 1
+
+// Proxy message types. They follow the tunnel message types so both can share
+// a connection.
+const (
+	// Asks the exit node to open a TCP connection to Address, or a UDP
+	// association if Address is empty. Data holds the proxy's signed
+	// TCPTunnelRequest, or nothing if it doesn't sign.
+	ProxyConnect = 6
+	// Answers a ProxyConnect. Data holds the error if it failed, otherwise
+	// Address is the exit node's end of the connection or association.
+	ProxyConnected = 7
+	// Carries the next Seq'th piece of a stream.
+	ProxyData = 8
+	// Says every piece of a stream before Seq has arrived.
+	ProxyAck = 9
+	// Says the sender has nothing more to send after Seq.
+	ProxyClose = 10
+	// Abandons a stream or association. Data holds why.
+	ProxyReset = 11
+	// Carries a UDP datagram to Address, or from it when sent by the exit node.
+	ProxyDatagram = 12
+)
+
+// A message between a proxy and an exit node. Stream names the connection or
+// UDP association the message belongs to, and is picked at random by the
+// proxy so other clients can't guess it.
+type ProxyMessage struct {
+	Version byte
+	Type    byte
+	// The proxy the stream belongs to. Replies from the exit node carry the
+	// exit node's address.
+	Source  NodeAddress
+	Stream  uint64
+	Seq     uint32
+	Address string
+	Data    []byte
+}
+
+// Returns the ProxyMessage as a byte slice.
+// Adds Version as the version number and Type as the message type.
+// Then come the length of Source as 2 bytes, Source, the 8 byte Stream, the 4
+// byte Seq, the length of Address as 2 bytes, Address and the data.
+func (m *ProxyMessage) MarshalBinary() ([]byte, error) {
+	if len(m.Source) > 0xFFFF || len(m.Address) > 0xFFFF {
+		return nil, errors.New("Source or address too long")
+	}
+	b := make([]byte, 4, 4+len(m.Source)+12+2+len(m.Address)+len(m.Data))
+	b[0] = m.Version
+	b[1] = m.Type
+	binary.BigEndian.PutUint16(b[2:], uint16(len(m.Source)))
+	b = append(b, m.Source...)
+	b = append(b, make([]byte, 12)...)
+	binary.BigEndian.PutUint64(b[len(b)-12:], m.Stream)
+	binary.BigEndian.PutUint32(b[len(b)-4:], m.Seq)
+	b = append(b, byte(len(m.Address)>>8), byte(len(m.Address)))
+	b = append(b, m.Address...)
+	return append(b, m.Data...), nil
+}
+
+// Takes byte slice from the wire and unmarshals it.
+// Checks version is known and message type is one of the proxy messages
+func (m *ProxyMessage) UnmarshalBinary(data []byte) error {
+	if len(data) < 4 {
+		return errors.New("Packet too short")
+	}
+	if data[0] > ProxyVersion {
+		return errors.New("Wrong packet version")
+	}
+	if data[1] < ProxyConnect || data[1] > ProxyDatagram {
+		return errors.New("Wrong packet type")
+	}
+	l := int(binary.BigEndian.Uint16(data[2:]))
+	if len(data) < 4+l+12+2 {
+		return errors.New("Packet too short")
+	}
+	m.Version = data[0]
+	m.Type = data[1]
+	m.Source = NodeAddress(data[4 : 4+l])
+	data = data[4+l:]
+	m.Stream = binary.BigEndian.Uint64(data)
+	m.Seq = binary.BigEndian.Uint32(data[8:])
+	a := int(binary.BigEndian.Uint16(data[12:]))
+	if len(data) < 14+a {
+		return errors.New("Packet too short")
+	}
+	m.Address = string(data[14 : 14+a])
+	m.Data = data[14+a:]
+
+	return nil
+}
+
+// Reports whether b looks like a proxy message rather than a tunnel one.
+func IsProxyMessage(b []byte) bool {
+	return len(b) >= 2 && b[1] >= ProxyConnect && b[1] <= ProxyDatagram
+}
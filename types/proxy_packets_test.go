@@ -0,0 +1,43 @@
+package types
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestProxyMessage(t *testing.T) {
+	out_m := ProxyMessage{Type: ProxyData, Source: "source", Stream: 1 << 40, Seq: 7, Address: "example.com:80", Data: []byte("data")}
+	var in_m ProxyMessage
+
+	in_m_wire, err := out_m.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !IsProxyMessage(in_m_wire) {
+		t.Fatal("Didn't recognise a proxy message")
+	}
+	err = in_m.UnmarshalBinary(in_m_wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in_m.Type != out_m.Type || in_m.Source != out_m.Source || in_m.Stream != out_m.Stream ||
+		in_m.Seq != out_m.Seq || in_m.Address != out_m.Address || !bytes.Equal(in_m.Data, out_m.Data) {
+		t.Fatalf("%+v != %+v", in_m, out_m)
+	}
+
+	err = in_m.UnmarshalBinary(in_m_wire[:20])
+	if err == nil {
+		t.Fatalf("Didn't catch truncated message")
+	}
+	in_m_wire[1] = 2
+	err = in_m.UnmarshalBinary(in_m_wire)
+	if err == nil || IsProxyMessage(in_m_wire) {
+		t.Fatalf("Didn't catch a tunnel message")
+	}
+	in_m_wire[0] = ProxyVersion + 1
+	in_m_wire[1] = ProxyData
+	err = in_m.UnmarshalBinary(in_m_wire)
+	if err == nil {
+		t.Fatalf("Didn't catch bad version")
+	}
+}
@@ -1,98 +1,485 @@
 package types
 
 import (
+	"crypto/sha512"
+	"encoding/binary"
 	"errors"
 	"net"
 )
 
+// The newest tunnel message version. Version 1 data messages carry raw IP
+// packets where version 0 carried JSON encoded tuntap packets; the other
+// messages are the same in both. A client asks for a tunnel with the newest
+// version it speaks and the server answers with the same, which then decides
+// the version of data messages in both directions. Version 2 requests and
+// responses also carry the largest packet the tunnel takes, and version 3 ones
+// say whether it carries Ethernet frames from a tap device instead. Version 3
+// data messages also name their sender. From version 4 the response carries a
+// random session token which data, keepalive and close messages carry in both
+// directions instead of naming their sender, so only the two ends of a
+// session can send them.
+const TCPTunnelVersion = 4
+
+// The length of a session token on the wire.
+const tunnel_token_size = 8
+
+// Set in the flags byte of version 3 requests and responses for tunnels
+// carrying Ethernet frames.
+const tunnel_flag_tap = 1
+
+// Checks the version and type at the start of a tunnel message.
+func checkTunnelHeader(data []byte, message_type byte) error {
+	if len(data) < 2 {
+		return errors.New("Packet too short")
+	}
+
+	if data[0] > TCPTunnelVersion {
+		return errors.New("Wrong packet version")
+	}
+
+	if data[1] != message_type {
+		return errors.New("Wrong packet type")
+	}
+	return nil
+}
+
 // TCP tunneling request packet
 // Client sends empty struct to request tunneling
 type TCPTunnelRequest struct {
+	// The newest message version the client speaks.
+	Version byte
+	// The largest packet the client wants to send or receive. Only version 2
+	// and newer requests carry it.
+	MTU uint16
+	// Asks to bridge Ethernet frames rather than route IP packets. Only
+	// version 3 and newer requests carry it.
+	TAP    bool
 	Source NodeAddress
+	// When the request was signed, in nanoseconds since the epoch.
+	Time int64
+	// Proves the request came from Source. Requests with a signature are sent
+	// as message type 3 so servers which don't check them can still be asked.
+	Signature []byte
 }
 
 // Returns the TCPTunnelRequest as a byte slice.
 // Adds version number and message type
-//   Version number is always 0 for now
-//   Message type is 0 for TCPTunnelRequest
+//   Version number is Version
+//   Message type is 0 for TCPTunnelRequest, or 3 if it is signed
+// From version 2 the 2 byte MTU comes next, and from version 3 a flags byte.
+// A signed request then has the length of Source as 2 bytes, Source, the 8
+// byte Time and the signature.
 func (req *TCPTunnelRequest) MarshalBinary() ([]byte, error) {
-	return append([]byte{0, 0}, []byte(req.Source)...), nil
+	b := []byte{req.Version, 0}
+	if req.Signature != nil {
+		b[1] = 3
+	}
+	if req.Version >= 2 {
+		b = append(b, byte(req.MTU>>8), byte(req.MTU))
+	}
+	if req.Version >= 3 {
+		b = append(b, tunnelFlags(req.TAP))
+	} else if req.TAP {
+		return nil, errors.New("TAP tunnels need version 3")
+	}
+	if req.Signature == nil {
+		return append(b, []byte(req.Source)...), nil
+	}
+	if len(req.Source) > 0xFFFF {
+		return nil, errors.New("Source too long")
+	}
+	b = append(b, byte(len(req.Source)>>8), byte(len(req.Source)))
+	b = append(b, req.Source...)
+	b = append(b, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(b[len(b)-8:], uint64(req.Time))
+	return append(b, req.Signature...), nil
 }
 
 // Takes byte slice from the wire and unmarshals it.
-// Checks version is 0 and message type is TCPTunnelRequest (0)
+// Checks version is known and message type is TCPTunnelRequest (0 or 3)
 func (req *TCPTunnelRequest) UnmarshalBinary(data []byte) error {
-	if data[0] != 0 {
+	if len(data) < 2 {
+		return errors.New("Packet too short")
+	}
+
+	if data[0] > TCPTunnelVersion {
 		return errors.New("Wrong packet version")
 	}
+	req.Version = data[0]
 
-	if data[1] != 0 {
+	if data[1] != 0 && data[1] != 3 {
 		return errors.New("Wrong packet type")
 	}
+	signed := data[1] == 3
+	req.MTU = 0
+	req.TAP = false
+	data = data[2:]
+	if req.Version >= 2 {
+		if len(data) < 2 {
+			return errors.New("Packet too short")
+		}
+		req.MTU = binary.BigEndian.Uint16(data)
+		data = data[2:]
+	}
+	if req.Version >= 3 {
+		if len(data) < 1 {
+			return errors.New("Packet too short")
+		}
+		req.TAP = data[0]&tunnel_flag_tap != 0
+		data = data[1:]
+	}
 
-	req.Source = NodeAddress(data[2:])
+	if !signed {
+		req.Source = NodeAddress(data)
+		req.Time = 0
+		req.Signature = nil
+		return nil
+	}
+
+	if len(data) < 2 {
+		return errors.New("Packet too short")
+	}
+	l := int(binary.BigEndian.Uint16(data))
+	if len(data) < 2+l+8 {
+		return errors.New("Packet too short")
+	}
+	req.Source = NodeAddress(data[2 : 2+l])
+	req.Time = int64(binary.BigEndian.Uint64(data[2+l:]))
+	req.Signature = data[2+l+8:]
 
 	return nil
 }
 
+// Appends a session token to b.
+func appendToken(b []byte, token uint64) []byte {
+	b = append(b, make([]byte, tunnel_token_size)...)
+	binary.BigEndian.PutUint64(b[len(b)-tunnel_token_size:], token)
+	return b
+}
+
+// Returns the flags byte of a version 3 request or response.
+func tunnelFlags(tap bool) byte {
+	if tap {
+		return tunnel_flag_tap
+	}
+	return 0
+}
+
+// Returns what a client signs to ask server for a tunnel. Including the
+// server stops a request being replayed to other exit nodes, and including
+// the version, MTU and flags stops it being replayed asking for something
+// else. The MTU and flags are only included by the versions which carry them.
+func (req *TCPTunnelRequest) Hash(server NodeAddress) []byte {
+	b := make([]byte, 2, 2+len(server)+2+len(req.Source)+8+4)
+	binary.BigEndian.PutUint16(b, uint16(len(server)))
+	b = append(b, server...)
+	b = append(b, byte(len(req.Source)>>8), byte(len(req.Source)))
+	b = append(b, req.Source...)
+	b = append(b, make([]byte, 8)...)
+	binary.BigEndian.PutUint64(b[len(b)-8:], uint64(req.Time))
+	b = append(b, req.Version)
+	if req.Version >= 2 {
+		b = append(b, byte(req.MTU>>8), byte(req.MTU))
+	}
+	if req.Version >= 3 {
+		b = append(b, tunnelFlags(req.TAP))
+	}
+	s := sha512.Sum512(append([]byte("TCPTunnelRequest"), b...))
+	return s[:]
+}
+
 // TCP tunneling response packet
 // Server sends ip addres for client after receiving a request to tunnel
 type TCPTunnelResponse struct {
-	IP net.IP
+	// The message version the client and server will use, which is never
+	// newer than the version in the request.
+	Version byte
+	// The largest packet either end will send through the tunnel. Only
+	// version 2 and newer responses carry it.
+	MTU uint16
+	// Whether the tunnel bridges Ethernet frames, in which case no addresses
+	// are leased. Only version 3 and newer responses carry it.
+	TAP bool
+	// Identifies the session in later messages. Only version 4 and newer
+	// responses carry it.
+	Token uint64
+	IP    net.IP
+	// An IPv4 address leased alongside the IPv6 one in IP, if the server has
+	// an IPv4 prefix.
+	IPv4 net.IP
 }
 
 // Returns the TCPTunnelResponse as a byte slice.
 // Adds version number and message type
-//   Version number is always 0 for now
+//   Version number is Version
 //   Message type is 1 for TCPTunnelResponse
+// From version 2 the 2 byte MTU comes next, from version 3 a flags byte and
+// from version 4 the 8 byte Token. If there is an IPv4 address it follows a 16
+// byte IP.
 func (resp *TCPTunnelResponse) MarshalBinary() ([]byte, error) {
-	return append([]byte{0, 1}, resp.IP...), nil
+	b := []byte{resp.Version, 1}
+	if resp.Version >= 2 {
+		b = append(b, byte(resp.MTU>>8), byte(resp.MTU))
+	}
+	if resp.Version >= 3 {
+		b = append(b, tunnelFlags(resp.TAP))
+	} else if resp.TAP {
+		return nil, errors.New("TAP tunnels need version 3")
+	}
+	if resp.Version >= 4 {
+		b = appendToken(b, resp.Token)
+	}
+	if resp.IPv4 == nil {
+		return append(b, resp.IP...), nil
+	}
+	ip, ipv4 := resp.IP.To16(), resp.IPv4.To4()
+	if ip == nil || ipv4 == nil {
+		return nil, errors.New("Invalid addresses")
+	}
+	return append(append(b, ip...), ipv4...), nil
 }
 
 // Takes byte slice from the wire and unmarshals it.
-// Checks version is 0 and message type is TCPTunnelResponse (1)
-// Rest of the data in the packet is the IP address
+// Checks version is known and message type is TCPTunnelResponse (1)
+// Rest of the data in the packet is the MTU and IP address
 func (resp *TCPTunnelResponse) UnmarshalBinary(data []byte) error {
-	if data[0] != 0 {
-		return errors.New("Wrong packet version")
+	err := checkTunnelHeader(data, 1)
+	if err != nil {
+		return err
 	}
-
-	if data[1] != 1 {
-		return errors.New("Wrong packet type")
+	resp.Version = data[0]
+	resp.MTU = 0
+	resp.TAP = false
+	data = data[2:]
+	if resp.Version >= 2 {
+		if len(data) < 2 {
+			return errors.New("Packet too short")
+		}
+		resp.MTU = binary.BigEndian.Uint16(data)
+		data = data[2:]
+	}
+	if resp.Version >= 3 {
+		if len(data) < 1 {
+			return errors.New("Packet too short")
+		}
+		resp.TAP = data[0]&tunnel_flag_tap != 0
+		data = data[1:]
+	}
+	resp.Token = 0
+	if resp.Version >= 4 {
+		if len(data) < tunnel_token_size {
+			return errors.New("Packet too short")
+		}
+		resp.Token = binary.BigEndian.Uint64(data)
+		data = data[tunnel_token_size:]
 	}
 
-	resp.IP = data[2:]
+	if len(data) == net.IPv6len+net.IPv4len {
+		resp.IP = data[:net.IPv6len]
+		resp.IPv4 = data[net.IPv6len:]
+		return nil
+	}
+	resp.IP = data
+	resp.IPv4 = nil
 
 	return nil
 }
 
-// TCP tunneling response packet
+// TCP tunneling data packet
 // Data packet sent during normal transmission, after handshake
 type TCPTunnelData struct {
+	Version byte
+	// The ethertype of the packet, such as 0x86DD for IPv6. Version 1 and newer
+	// messages carry it.
+	Protocol uint16
+	// The client or server which sent the message, which bridges need to know
+	// who a frame came from. Only version 3 messages carry it.
+	Source NodeAddress
+	// The token of the session the message is part of. Version 4 and newer
+	// messages carry it instead of Source.
+	Token uint64
+	// A raw IP packet or Ethernet frame, or a JSON encoded tuntap.Packet in
+	// version 0.
 	Data []byte
 }
 
 // Returns the TCPTunnelData as a byte slice.
 // Adds version number and message type
-//   Version number is always 0 for now
+//   Version number is Version
 //   Message type is 2 for TCPTunnelData
+// Version 1 and newer messages have the 2 byte Protocol before the data.
+// Version 3 ones then have the length of Source as 2 bytes and Source, and
+// newer ones the 8 byte Token.
 func (d *TCPTunnelData) MarshalBinary() ([]byte, error) {
-	return append([]byte{0, 2}, d.Data...), nil
+	if d.Version == 0 {
+		return append([]byte{0, 2}, d.Data...), nil
+	}
+	if len(d.Source) > 0xFFFF {
+		return nil, errors.New("Source too long")
+	}
+	b := make([]byte, 4, 4+2+len(d.Source)+len(d.Data))
+	b[0] = d.Version
+	b[1] = 2
+	binary.BigEndian.PutUint16(b[2:], d.Protocol)
+	if d.Version == 3 {
+		b = append(b, byte(len(d.Source)>>8), byte(len(d.Source)))
+		b = append(b, d.Source...)
+	} else if d.Version >= 4 {
+		b = appendToken(b, d.Token)
+	}
+	return append(b, d.Data...), nil
 }
 
 // Takes byte slice from the wire and unmarshals it.
-// Checks version is 0 and message type is TCPTunnelData (2)
+// Checks version is known and message type is TCPTunnelData (2)
 // Rest of the data in the packet is the message data
 func (d *TCPTunnelData) UnmarshalBinary(data []byte) error {
-	if data[0] != 0 {
-		return errors.New("Wrong packet version")
+	err := checkTunnelHeader(data, 2)
+	if err != nil {
+		return err
 	}
+	d.Version = data[0]
 
-	if data[1] != 2 {
-		return errors.New("Wrong packet type")
+	d.Source = ""
+	d.Token = 0
+	if d.Version == 0 {
+		d.Protocol = 0
+		d.Data = data[2:]
+		return nil
+	}
+	if len(data) < 4 {
+		return errors.New("Packet too short")
 	}
+	d.Protocol = binary.BigEndian.Uint16(data[2:])
+	data = data[4:]
+	if d.Version == 3 {
+		if len(data) < 2 {
+			return errors.New("Packet too short")
+		}
+		l := int(binary.BigEndian.Uint16(data))
+		if len(data) < 2+l {
+			return errors.New("Packet too short")
+		}
+		d.Source = NodeAddress(data[2 : 2+l])
+		data = data[2+l:]
+	} else if d.Version >= 4 {
+		if len(data) < tunnel_token_size {
+			return errors.New("Packet too short")
+		}
+		d.Token = binary.BigEndian.Uint64(data)
+		data = data[tunnel_token_size:]
+	}
+	d.Data = data
+
+	return nil
+}
+
+// TCP tunneling keepalive packet
+// Client sends one periodically to keep its session, and the server answers
+// with its own so the client knows the server is still there
+type TCPTunnelKeepalive struct {
+	Version byte
+	// Who sent the keepalive, in messages older than version 4.
+	Source NodeAddress
+	// The session's token, in version 4 and newer messages.
+	Token uint64
+}
+
+// Returns the TCPTunnelKeepalive as a byte slice.
+// Adds version number and message type
+//   Version number is Version
+//   Message type is 4 for TCPTunnelKeepalive
+// Then comes the 8 byte Token from version 4, or Source before that.
+func (k *TCPTunnelKeepalive) MarshalBinary() ([]byte, error) {
+	if k.Version >= 4 {
+		return appendToken([]byte{k.Version, 4}, k.Token), nil
+	}
+	return append([]byte{k.Version, 4}, []byte(k.Source)...), nil
+}
 
-	d.Data = data[2:]
+// Takes byte slice from the wire and unmarshals it.
+// Checks version is known and message type is TCPTunnelKeepalive (4)
+// Rest of the data in the packet is the token or source
+func (k *TCPTunnelKeepalive) UnmarshalBinary(data []byte) error {
+	err := checkTunnelHeader(data, 4)
+	if err != nil {
+		return err
+	}
+	k.Version = data[0]
+	k.Source = ""
+	k.Token = 0
+	if k.Version < 4 {
+		k.Source = NodeAddress(data[2:])
+		return nil
+	}
+	if len(data) < 2+tunnel_token_size {
+		return errors.New("Packet too short")
+	}
+	k.Token = binary.BigEndian.Uint64(data[2:])
+
+	return nil
+}
+
+// TCP tunneling close packet
+// Either side sends one to end a session
+type TCPTunnelClose struct {
+	Version byte
+	// The client whose session is over, in messages older than version 4.
+	Source NodeAddress
+	// The session's token, in version 4 and newer messages.
+	Token  uint64
+	Reason string
+}
+
+// Returns the TCPTunnelClose as a byte slice.
+// Adds version number and message type
+//   Version number is Version
+//   Message type is 5 for TCPTunnelClose
+// The 8 byte Token from version 4, or before that the length of Source as 2
+// bytes and Source, come before the reason.
+func (c *TCPTunnelClose) MarshalBinary() ([]byte, error) {
+	if c.Version >= 4 {
+		return append(appendToken([]byte{c.Version, 5}, c.Token), c.Reason...), nil
+	}
+	if len(c.Source) > 0xFFFF {
+		return nil, errors.New("Source too long")
+	}
+	b := make([]byte, 4, 4+len(c.Source)+len(c.Reason))
+	b[0] = c.Version
+	b[1] = 5
+	binary.BigEndian.PutUint16(b[2:], uint16(len(c.Source)))
+	b = append(b, c.Source...)
+	return append(b, c.Reason...), nil
+}
+
+// Takes byte slice from the wire and unmarshals it.
+// Checks version is known and message type is TCPTunnelClose (5)
+func (c *TCPTunnelClose) UnmarshalBinary(data []byte) error {
+	err := checkTunnelHeader(data, 5)
+	if err != nil {
+		return err
+	}
+	c.Source = ""
+	c.Token = 0
+	if data[0] >= 4 {
+		if len(data) < 2+tunnel_token_size {
+			return errors.New("Packet too short")
+		}
+		c.Version = data[0]
+		c.Token = binary.BigEndian.Uint64(data[2:])
+		c.Reason = string(data[2+tunnel_token_size:])
+		return nil
+	}
+	if len(data) < 4 {
+		return errors.New("Packet too short")
+	}
+	l := int(binary.BigEndian.Uint16(data[2:]))
+	if len(data) < 4+l {
+		return errors.New("Packet too short")
+	}
+	c.Version = data[0]
+	c.Source = NodeAddress(data[4 : 4+l])
+	c.Reason = string(data[4+l:])
 
 	return nil
 }
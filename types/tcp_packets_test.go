@@ -8,7 +8,7 @@ import (
 
 func TestValidRequestPacket(t *testing.T) {
 	source := NodeAddress("source")
-	out_req := TCPTunnelRequest{source}
+	out_req := TCPTunnelRequest{Source: source}
 	var in_req TCPTunnelRequest
 
 	in_req_wire, err := out_req.MarshalBinary()
@@ -26,6 +26,38 @@ func TestValidRequestPacket(t *testing.T) {
 	}
 }
 
+func TestSignedRequestPacket(t *testing.T) {
+	out_req := TCPTunnelRequest{Source: "source", Time: 1234, Signature: []byte("signature")}
+	var in_req TCPTunnelRequest
+
+	in_req_wire, err := out_req.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in_req_wire[1] != 3 {
+		t.Fatalf("Signed request sent as type %d", in_req_wire[1])
+	}
+
+	err = in_req.UnmarshalBinary(in_req_wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in_req.Source != out_req.Source || in_req.Time != out_req.Time ||
+		!bytes.Equal(in_req.Signature, out_req.Signature) {
+		t.Fatalf("%+v != %+v", in_req, out_req)
+	}
+
+	err = in_req.UnmarshalBinary(in_req_wire[:8])
+	if err == nil {
+		t.Fatalf("Didn't catch truncated request")
+	}
+
+	// The hash depends on the server being asked.
+	if bytes.Equal(out_req.Hash("a"), out_req.Hash("b")) {
+		t.Fatalf("Hash doesn't cover the server")
+	}
+}
+
 func TestInvalidRequestPacketVersion(t *testing.T) {
 	out_req := TCPTunnelRequest{}
 	var in_req TCPTunnelRequest
@@ -35,7 +67,7 @@ func TestInvalidRequestPacketVersion(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	in_req_wire[0] = 1
+	in_req_wire[0] = TCPTunnelVersion + 1
 	err = in_req.UnmarshalBinary(in_req_wire)
 	if err == nil {
 		t.Fatalf("Didn't catch bad version")
@@ -60,7 +92,7 @@ func TestInvalidRequestPacketType(t *testing.T) {
 
 func TestValidResponsePacket(t *testing.T) {
 	ip := net.IP([]byte{127, 0, 0, 1})
-	out_resp := TCPTunnelResponse{ip}
+	out_resp := TCPTunnelResponse{IP: ip}
 	var in_resp TCPTunnelResponse
 
 	in_resp_wire, err := out_resp.MarshalBinary()
@@ -78,9 +110,28 @@ func TestValidResponsePacket(t *testing.T) {
 	}
 }
 
+func TestDualStackResponsePacket(t *testing.T) {
+	out_resp := TCPTunnelResponse{IP: net.ParseIP("2001::1"), IPv4: net.ParseIP("10.0.0.1")}
+	var in_resp TCPTunnelResponse
+
+	in_resp_wire, err := out_resp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = in_resp.UnmarshalBinary(in_resp_wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if !in_resp.IP.Equal(out_resp.IP) || !in_resp.IPv4.Equal(out_resp.IPv4) {
+		t.Fatalf("Addresses are not the same: %v %v", in_resp.IP, in_resp.IPv4)
+	}
+}
+
 func TestInvalidResponsePacketVersion(t *testing.T) {
 	ip := net.IP([]byte{127, 0, 0, 1})
-	out_resp := TCPTunnelResponse{ip}
+	out_resp := TCPTunnelResponse{IP: ip}
 	var in_resp TCPTunnelResponse
 
 	in_resp_wire, err := out_resp.MarshalBinary()
@@ -88,7 +139,7 @@ func TestInvalidResponsePacketVersion(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	in_resp_wire[0] = 1
+	in_resp_wire[0] = TCPTunnelVersion + 1
 	err = in_resp.UnmarshalBinary(in_resp_wire)
 	if err == nil {
 		t.Fatalf("Didn't catch bad version")
@@ -97,7 +148,7 @@ func TestInvalidResponsePacketVersion(t *testing.T) {
 
 func TestInvalidResponsePacketType(t *testing.T) {
 	ip := net.IP([]byte{127, 0, 0, 1})
-	out_resp := TCPTunnelResponse{ip}
+	out_resp := TCPTunnelResponse{IP: ip}
 	var in_resp TCPTunnelResponse
 
 	in_resp_wire, err := out_resp.MarshalBinary()
@@ -114,7 +165,7 @@ func TestInvalidResponsePacketType(t *testing.T) {
 
 func TestValidDataPacket(t *testing.T) {
 	data := []byte{'t', 'e', 's', 't'}
-	out_data := TCPTunnelData{data}
+	out_data := TCPTunnelData{Data: data}
 	var in_data TCPTunnelData
 
 	in_data_wire, err := out_data.MarshalBinary()
@@ -132,9 +183,172 @@ func TestValidDataPacket(t *testing.T) {
 	}
 }
 
+func TestRawDataPacket(t *testing.T) {
+	out_data := TCPTunnelData{Version: 1, Protocol: 0x86DD, Data: []byte{0x60, 0, 0, 0}}
+	var in_data TCPTunnelData
+
+	in_data_wire, err := out_data.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(in_data_wire, []byte{1, 2, 0x86, 0xDD, 0x60, 0, 0, 0}) {
+		t.Fatalf("Unexpected encoding %x", in_data_wire)
+	}
+
+	err = in_data.UnmarshalBinary(in_data_wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in_data.Version != 1 || in_data.Protocol != out_data.Protocol ||
+		!bytes.Equal(in_data.Data, out_data.Data) {
+		t.Fatalf("%+v != %+v", in_data, out_data)
+	}
+
+	err = in_data.UnmarshalBinary(in_data_wire[:3])
+	if err == nil {
+		t.Fatalf("Didn't catch truncated header")
+	}
+}
+
+func TestRequestVersion(t *testing.T) {
+	for _, out_req := range []TCPTunnelRequest{
+		{Version: 1, Source: "source"},
+		{Version: 1, Source: "source", Time: 5, Signature: []byte("signature")},
+	} {
+		var in_req TCPTunnelRequest
+		in_req_wire, err := out_req.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = in_req.UnmarshalBinary(in_req_wire)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if in_req.Version != 1 || in_req.Source != out_req.Source {
+			t.Fatalf("%+v != %+v", in_req, out_req)
+		}
+	}
+}
+
+func TestMTUPackets(t *testing.T) {
+	for _, out_req := range []TCPTunnelRequest{
+		{Version: 2, MTU: 1300, Source: "source"},
+		{Version: 2, MTU: 1300, Source: "source", Time: 5, Signature: []byte("signature")},
+	} {
+		var in_req TCPTunnelRequest
+		in_req_wire, err := out_req.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = in_req.UnmarshalBinary(in_req_wire)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if in_req.MTU != 1300 || in_req.Source != out_req.Source || in_req.Time != out_req.Time {
+			t.Fatalf("%+v != %+v", in_req, out_req)
+		}
+	}
+
+	out_resp := TCPTunnelResponse{Version: 2, MTU: 1300, IP: net.ParseIP("2001::1"), IPv4: net.ParseIP("10.0.0.1")}
+	var in_resp TCPTunnelResponse
+	in_resp_wire, err := out_resp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = in_resp.UnmarshalBinary(in_resp_wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in_resp.MTU != 1300 || !in_resp.IP.Equal(out_resp.IP) || !in_resp.IPv4.Equal(out_resp.IPv4) {
+		t.Fatalf("%+v != %+v", in_resp, out_resp)
+	}
+
+	// Older versions don't carry the MTU.
+	out_resp.Version = 1
+	in_resp_wire, _ = out_resp.MarshalBinary()
+	if len(in_resp_wire) != 2+net.IPv6len+net.IPv4len {
+		t.Fatalf("Version 1 response is %d bytes", len(in_resp_wire))
+	}
+	err = in_resp.UnmarshalBinary(in_resp_wire)
+	if err != nil || in_resp.MTU != 0 {
+		t.Fatalf("Unexpected version 1 response %+v: %v", in_resp, err)
+	}
+
+	err = in_resp.UnmarshalBinary([]byte{2, 1, 5})
+	if err == nil {
+		t.Fatalf("Didn't catch truncated MTU")
+	}
+}
+
+func TestTAPPackets(t *testing.T) {
+	for _, out_req := range []TCPTunnelRequest{
+		{Version: 3, MTU: 1300, TAP: true, Source: "source"},
+		{Version: 3, MTU: 1300, TAP: true, Source: "source", Time: 5, Signature: []byte("signature")},
+		{Version: 3, MTU: 1300, Source: "source"},
+	} {
+		var in_req TCPTunnelRequest
+		in_req_wire, err := out_req.MarshalBinary()
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = in_req.UnmarshalBinary(in_req_wire)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if in_req.TAP != out_req.TAP || in_req.MTU != 1300 || in_req.Source != out_req.Source {
+			t.Fatalf("%+v != %+v", in_req, out_req)
+		}
+	}
+
+	out_resp := TCPTunnelResponse{Version: 3, MTU: 1300, TAP: true}
+	var in_resp TCPTunnelResponse
+	in_resp_wire, err := out_resp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = in_resp.UnmarshalBinary(in_resp_wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !in_resp.TAP || in_resp.MTU != 1300 || len(in_resp.IP) != 0 {
+		t.Fatalf("%+v != %+v", in_resp, out_resp)
+	}
+
+	// Older versions can't say.
+	out_resp.Version = 2
+	_, err = out_resp.MarshalBinary()
+	if err == nil {
+		t.Fatal("Version 2 response claimed to be TAP")
+	}
+	err = in_resp.UnmarshalBinary([]byte{3, 1, 5, 0})
+	if err == nil {
+		t.Fatalf("Didn't catch missing flags")
+	}
+}
+
+func TestSourcedDataPacket(t *testing.T) {
+	out_data := TCPTunnelData{Version: 3, Protocol: 0x0806, Source: "source", Data: []byte("frame")}
+	var in_data TCPTunnelData
+	in_data_wire, err := out_data.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = in_data.UnmarshalBinary(in_data_wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in_data.Source != "source" || in_data.Protocol != 0x0806 || string(in_data.Data) != "frame" {
+		t.Fatalf("%+v != %+v", in_data, out_data)
+	}
+	err = in_data.UnmarshalBinary(in_data_wire[:8])
+	if err == nil {
+		t.Fatal("Didn't catch truncated source")
+	}
+}
+
 func TestInvalidDataPacketVersion(t *testing.T) {
 	data := []byte{'t', 'e', 's', 't'}
-	out_data := TCPTunnelData{data}
+	out_data := TCPTunnelData{Data: data}
 	var in_data TCPTunnelData
 
 	in_data_wire, err := out_data.MarshalBinary()
@@ -142,7 +356,7 @@ func TestInvalidDataPacketVersion(t *testing.T) {
 		t.Fatal(err)
 	}
 
-	in_data_wire[0] = 1
+	in_data_wire[0] = TCPTunnelVersion + 1
 	err = in_data.UnmarshalBinary(in_data_wire)
 	if err == nil {
 		t.Fatalf("Didn't catch bad version")
@@ -151,7 +365,7 @@ func TestInvalidDataPacketVersion(t *testing.T) {
 
 func TestInvalidDataPacketType(t *testing.T) {
 	data := []byte{'t', 'e', 's', 't'}
-	out_data := TCPTunnelData{data}
+	out_data := TCPTunnelData{Data: data}
 	var in_data TCPTunnelData
 
 	in_data_wire, err := out_data.MarshalBinary()
@@ -165,3 +379,108 @@ func TestInvalidDataPacketType(t *testing.T) {
 		t.Fatalf("Didin't catch bad packet type")
 	}
 }
+
+func TestKeepalivePacket(t *testing.T) {
+	out_k := TCPTunnelKeepalive{Version: 1, Source: "source"}
+	var in_k TCPTunnelKeepalive
+
+	in_k_wire, err := out_k.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = in_k.UnmarshalBinary(in_k_wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in_k != out_k {
+		t.Fatalf("%+v != %+v", in_k, out_k)
+	}
+
+	in_k_wire[1] = 5
+	err = in_k.UnmarshalBinary(in_k_wire)
+	if err == nil {
+		t.Fatalf("Didn't catch bad packet type")
+	}
+}
+
+func TestClosePacket(t *testing.T) {
+	out_c := TCPTunnelClose{Version: 1, Source: "source", Reason: "lease expired"}
+	var in_c TCPTunnelClose
+
+	in_c_wire, err := out_c.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = in_c.UnmarshalBinary(in_c_wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in_c != out_c {
+		t.Fatalf("%+v != %+v", in_c, out_c)
+	}
+
+	err = in_c.UnmarshalBinary(in_c_wire[:6])
+	if err == nil {
+		t.Fatalf("Didn't catch truncated source")
+	}
+}
+
+func TestTokenPackets(t *testing.T) {
+	out_resp := TCPTunnelResponse{Version: 4, MTU: 1300, Token: 0x0102030405060708, IP: net.ParseIP("2001::1"), IPv4: net.ParseIP("10.0.0.1")}
+	var in_resp TCPTunnelResponse
+	in_resp_wire, err := out_resp.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = in_resp.UnmarshalBinary(in_resp_wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in_resp.Token != out_resp.Token || in_resp.MTU != 1300 || !in_resp.IP.Equal(out_resp.IP) || !in_resp.IPv4.Equal(out_resp.IPv4) {
+		t.Fatalf("%+v != %+v", in_resp, out_resp)
+	}
+	err = in_resp.UnmarshalBinary(in_resp_wire[:8])
+	if err == nil {
+		t.Fatal("Didn't catch truncated token")
+	}
+
+	out_data := TCPTunnelData{Version: 4, Protocol: 0x86DD, Token: 7, Data: []byte("packet")}
+	var in_data TCPTunnelData
+	in_data_wire, err := out_data.MarshalBinary()
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = in_data.UnmarshalBinary(in_data_wire)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if in_data.Token != 7 || in_data.Source != "" || in_data.Protocol != 0x86DD || string(in_data.Data) != "packet" {
+		t.Fatalf("%+v != %+v", in_data, out_data)
+	}
+	err = in_data.UnmarshalBinary(in_data_wire[:6])
+	if err == nil {
+		t.Fatal("Didn't catch truncated token")
+	}
+
+	out_k := TCPTunnelKeepalive{Version: 4, Token: 7}
+	var in_k TCPTunnelKeepalive
+	in_k_wire, _ := out_k.MarshalBinary()
+	err = in_k.UnmarshalBinary(in_k_wire)
+	if err != nil || in_k != out_k {
+		t.Fatalf("%+v != %+v: %v", in_k, out_k, err)
+	}
+	if in_k.UnmarshalBinary(in_k_wire[:4]) == nil {
+		t.Fatal("Didn't catch truncated token")
+	}
+
+	out_c := TCPTunnelClose{Version: 4, Token: 7, Reason: "client closed"}
+	var in_c TCPTunnelClose
+	in_c_wire, _ := out_c.MarshalBinary()
+	err = in_c.UnmarshalBinary(in_c_wire)
+	if err != nil || in_c != out_c {
+		t.Fatalf("%+v != %+v: %v", in_c, out_c, err)
+	}
+	if in_c.UnmarshalBinary(in_c_wire[:4]) == nil {
+		t.Fatal("Didn't catch truncated token")
+	}
+}
@@ -37,3 +37,24 @@ type Money interface {
 	MakePayment(amount int64, destination string) (chan bool, error)
 	GetNewAddress() (string, chan uint64, error)
 }
+
+// A payment engine which knows what its transactions cost and can pay several
+// destinations with a single transaction.
+type BatchMoney interface {
+	Money
+	// Estimates the fee in satoshis for a transaction with the given number of
+	// outputs.
+	EstimateFee(outputs int) (int64, error)
+	// Pays every destination in the map the corresponding amount in a single
+	// transaction.
+	MakePayments(payments map[string]int64) (chan bool, error)
+}
+
+// A payment engine which reports the id of the transaction each payment is
+// made in, so the payee can find it.
+type TransactionMoney interface {
+	Money
+	// Pays every destination in the map the corresponding amount in a single
+	// transaction, returning its id.
+	MakeTransaction(payments map[string]int64) (string, chan bool, error)
+}
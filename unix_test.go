@@ -23,7 +23,7 @@ func TestUnixSocket(t *testing.T) {
 	}
 	defer c.Close()
 
-	p := types.Packet{"dest", 10, []byte("data")}
+	p := types.Packet{Dest: "dest", Amt: 10, Data: []byte("data")}
 	c2, err := net.Dial("unix", "/tmp/test")
 	if err != nil {
 		t.Fatal(err)